@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/besean163/gophermart/internal/accrualmock"
+)
+
+func main() {
+	config := accrualmock.DefaultConfig()
+	var address, steps string
+	flag.StringVar(&address, "a", "", "server run address")
+	flag.StringVar(&steps, "steps", strings.Join(config.Steps, ","), "comma separated default order script, 204, 429 and 500 are failure steps")
+	flag.Float64Var(&config.Accrual, "accrual", config.Accrual, "fixed accrual amount")
+	flag.Float64Var(&config.AccrualMin, "accrual-min", 0, "min random accrual amount")
+	flag.Float64Var(&config.AccrualMax, "accrual-max", 0, "max random accrual amount, random amounts are disabled if not greater than min")
+	flag.BoolVar(&config.AutoRegister, "auto-register", config.AutoRegister, "register unknown orders with default script, otherwise respond 204")
+	flag.Float64Var(&config.NotFoundRate, "rate-204", 0, "share of random 204 responses")
+	flag.Float64Var(&config.RateLimitRate, "rate-429", 0, "share of random 429 responses")
+	flag.Float64Var(&config.ServerErrorRate, "rate-500", 0, "share of random 500 responses")
+	flag.DurationVar(&config.RetryAfter, "retry-after", config.RetryAfter, "Retry-After value of 429 responses")
+	flag.DurationVar(&config.Latency, "latency", 0, "response latency")
+	flag.Int64Var(&config.Seed, "seed", config.Seed, "random seed")
+	flag.Parse()
+
+	if runAddressEnv := os.Getenv("RUN_ADDRESS"); runAddressEnv != "" && address == "" {
+		address = runAddressEnv
+	}
+	if address == "" {
+		address = ":8081"
+	}
+	config.Steps = strings.Split(steps, ",")
+
+	server := http.Server{
+		Addr:              address,
+		Handler:           accrualmock.New(config),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	log.Printf("run accrual mock on %s", address)
+	if err := server.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
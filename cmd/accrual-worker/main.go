@@ -0,0 +1,14 @@
+package main
+
+import (
+	"log"
+
+	"github.com/besean163/gophermart/internal/app"
+)
+
+func main() {
+	worker := app.NewWorker()
+	if err := worker.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
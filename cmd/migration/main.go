@@ -8,7 +8,7 @@ import (
 )
 
 func main() {
-	logger.NewLogger()
+	logger.NewLogger(logger.DefaultConfig())
 	config := migration.NewConfig()
 	if err := migration.Run(config.DatabaseDSN); err != nil {
 		log.Fatal(err)
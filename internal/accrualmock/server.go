@@ -0,0 +1,240 @@
+// Package accrualmock - симулятор внешней системы расчета начислений.
+// Используется как отдельный бинарник (cmd/accrual-mock) и как httptest-сервер в тестах:
+//
+//	mock := accrualmock.New(accrualmock.DefaultConfig())
+//	server := httptest.NewServer(mock)
+package accrualmock
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/go-chi/chi/v5"
+)
+
+// Специальные шаги сценария, вместо статуса отдают соответствующий код ответа.
+const (
+	StepNotFound    = "204"
+	StepRateLimited = "429"
+	StepServerError = "500"
+)
+
+type Config struct {
+	// Steps - сценарий по умолчанию, каждый запрос заказа продвигает его на шаг, последний шаг повторяется.
+	// Пустой список заменяется сценарием из DefaultConfig.
+	Steps []string
+	// Accrual начисляется на шаге PROCESSED, если AccrualMax > AccrualMin, сумма случайная из диапазона.
+	Accrual    float64
+	AccrualMin float64
+	AccrualMax float64
+	// AutoRegister регистрирует неизвестные заказы по сценарию Steps, иначе на них отвечаем 204.
+	AutoRegister bool
+	// Доли случайных ответов 204, 429 и 500, от 0 до 1.
+	NotFoundRate    float64
+	RateLimitRate   float64
+	ServerErrorRate float64
+	// RetryAfter отдается в целых секундах, доли округляются вверх, но не меньше 1.
+	RetryAfter time.Duration
+	Latency    time.Duration
+	Seed       int64
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Steps: []string{
+			entities.AccrealStatusRegistered,
+			entities.AccrealStatusProcessing,
+			entities.AccrealStatusProcessed,
+		},
+		Accrual:      500,
+		AutoRegister: true,
+		RetryAfter:   60 * time.Second,
+		Seed:         time.Now().UnixNano(),
+	}
+}
+
+// Script - сценарий одного заказа. Accrual == nil - сумма по настройкам сервера.
+type Script struct {
+	Steps   []string `json:"steps"`
+	Accrual *float64 `json:"accrual,omitempty"`
+}
+
+type Response struct {
+	Order   string   `json:"order"`
+	Status  string   `json:"status"`
+	Accrual *float64 `json:"accrual,omitempty"`
+}
+
+type orderState struct {
+	script   Script
+	step     int
+	accrual  float64
+	requests int
+}
+
+type Server struct {
+	mu     sync.Mutex
+	config Config
+	random *rand.Rand
+	orders map[string]*orderState
+	router chi.Router
+}
+
+func New(config Config) *Server {
+	if len(config.Steps) == 0 {
+		config.Steps = DefaultConfig().Steps
+	}
+	server := &Server{
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+		orders: make(map[string]*orderState),
+		router: chi.NewRouter(),
+	}
+	server.router.Get("/api/orders/{number}", server.getOrder)
+	server.router.Put("/api/mock/orders/{number}", server.putScript)
+	return server
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.router.ServeHTTP(w, r)
+}
+
+// SetScript задает сценарий заказа и сбрасывает его текущее состояние.
+// Сценарий без шагов заменяется сценарием сервера по умолчанию.
+func (server *Server) SetScript(number string, script Script) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if len(script.Steps) == 0 {
+		script.Steps = server.config.Steps
+	}
+	server.orders[number] = server.newState(script)
+}
+
+// Requests возвращает число запросов заказа, полезно для проверок в тестах.
+func (server *Server) Requests(number string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if state, ok := server.orders[number]; ok {
+		return state.requests
+	}
+	return 0
+}
+
+func (server *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	if server.config.Latency > 0 {
+		select {
+		case <-time.After(server.config.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	number := chi.URLParam(r, "number")
+	step, accrual := server.next(number)
+	switch step {
+	case StepNotFound:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case StepRateLimited:
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(server.config.RetryAfter)))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("No more than N requests per minute allowed"))
+		return
+	case StepServerError:
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{
+		Order:  number,
+		Status: step,
+	}
+	if step == entities.AccrealStatusProcessed {
+		response.Accrual = &accrual
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (server *Server) putScript(w http.ResponseWriter, r *http.Request) {
+	var script Script
+	if err := json.NewDecoder(r.Body).Decode(&script); err != nil || len(script.Steps) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	server.SetScript(chi.URLParam(r, "number"), script)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// next возвращает текущий шаг заказа и продвигает сценарий.
+// Случайные сбои не двигают сценарий, как и у настоящей системы, где запрос не дошел до обработки.
+func (server *Server) next(number string) (string, float64) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if step := server.randomFailure(); step != "" {
+		if state, ok := server.orders[number]; ok {
+			state.requests++
+		}
+		return step, 0
+	}
+
+	state, ok := server.orders[number]
+	if !ok {
+		if !server.config.AutoRegister {
+			return StepNotFound, 0
+		}
+		state = server.newState(Script{Steps: server.config.Steps})
+		server.orders[number] = state
+	}
+	state.requests++
+
+	step := state.script.Steps[state.step]
+	if state.step < len(state.script.Steps)-1 {
+		state.step++
+	}
+	return step, state.accrual
+}
+
+func (server *Server) randomFailure() string {
+	value := server.random.Float64()
+	switch {
+	case value < server.config.NotFoundRate:
+		return StepNotFound
+	case value < server.config.NotFoundRate+server.config.RateLimitRate:
+		return StepRateLimited
+	case value < server.config.NotFoundRate+server.config.RateLimitRate+server.config.ServerErrorRate:
+		return StepServerError
+	}
+	return ""
+}
+
+func (server *Server) newState(script Script) *orderState {
+	state := &orderState{script: script}
+	if len(state.script.Steps) == 0 {
+		state.script.Steps = server.config.Steps
+	}
+	switch {
+	case script.Accrual != nil:
+		state.accrual = *script.Accrual
+	case server.config.AccrualMax > server.config.AccrualMin:
+		amount := server.config.AccrualMin + server.random.Float64()*(server.config.AccrualMax-server.config.AccrualMin)
+		state.accrual = math.Round(amount*100) / 100
+	default:
+		state.accrual = server.config.Accrual
+	}
+	return state
+}
+
+// retryAfterSeconds округляет паузу вверх: Retry-After: 0 клиент понял бы как "повторяй сразу".
+func retryAfterSeconds(retryAfter time.Duration) int {
+	return max(1, int(math.Ceil(retryAfter.Seconds())))
+}
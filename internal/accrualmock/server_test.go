@@ -0,0 +1,132 @@
+package accrualmock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	config := DefaultConfig()
+	config.Accrual = 729.98
+	mock := New(config)
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	get := func(t *testing.T, number string) (*http.Response, Response) {
+		response, err := http.Get(server.URL + "/api/orders/" + number)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		var body Response
+		if response.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(response.Body).Decode(&body))
+		}
+		return response, body
+	}
+
+	t.Run("default script", func(t *testing.T) {
+		var statuses []string
+		for i := 0; i < 4; i++ {
+			_, body := get(t, "12345678903")
+			statuses = append(statuses, body.Status)
+		}
+		assert.Equal(t, []string{
+			entities.AccrealStatusRegistered,
+			entities.AccrealStatusProcessing,
+			entities.AccrealStatusProcessed,
+			entities.AccrealStatusProcessed,
+		}, statuses)
+
+		_, body := get(t, "12345678903")
+		require.NotNil(t, body.Accrual)
+		assert.Equal(t, 729.98, *body.Accrual)
+		assert.Equal(t, 5, mock.Requests("12345678903"))
+	})
+
+	t.Run("scripted failures", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodPut, server.URL+"/api/mock/orders/2377225624",
+			strings.NewReader(`{"steps":["429","500","204","INVALID"]}`))
+		require.NoError(t, err)
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		require.Equal(t, http.StatusNoContent, response.StatusCode)
+
+		response, _ = get(t, "2377225624")
+		assert.Equal(t, http.StatusTooManyRequests, response.StatusCode)
+		assert.Equal(t, "60", response.Header.Get("Retry-After"))
+
+		response, _ = get(t, "2377225624")
+		assert.Equal(t, http.StatusInternalServerError, response.StatusCode)
+
+		response, _ = get(t, "2377225624")
+		assert.Equal(t, http.StatusNoContent, response.StatusCode)
+
+		_, body := get(t, "2377225624")
+		assert.Equal(t, entities.AccrealStatusInvalid, body.Status)
+		assert.Nil(t, body.Accrual)
+	})
+
+	t.Run("unknown order without auto register", func(t *testing.T) {
+		config := DefaultConfig()
+		config.AutoRegister = false
+		server := httptest.NewServer(New(config))
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/api/orders/12345678903")
+		require.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	})
+
+	t.Run("empty steps use default script", func(t *testing.T) {
+		config := DefaultConfig()
+		config.Steps = nil
+		mock := New(config)
+		mock.SetScript("2377225624", Script{})
+
+		for _, number := range []string{"12345678903", "2377225624"} {
+			recorder := httptest.NewRecorder()
+			mock.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil))
+			var body Response
+			require.NoError(t, json.NewDecoder(recorder.Body).Decode(&body))
+			assert.Equal(t, entities.AccrealStatusRegistered, body.Status)
+		}
+	})
+
+	t.Run("sub-second retry after", func(t *testing.T) {
+		config := DefaultConfig()
+		config.RetryAfter = 300 * time.Millisecond
+		config.Steps = []string{StepRateLimited}
+		mock := New(config)
+
+		recorder := httptest.NewRecorder()
+		mock.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/orders/1", nil))
+		assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+		assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	})
+
+	t.Run("random accrual in range", func(t *testing.T) {
+		config := DefaultConfig()
+		config.AccrualMin = 10
+		config.AccrualMax = 20
+		config.Steps = []string{entities.AccrealStatusProcessed}
+		mock := New(config)
+
+		recorder := httptest.NewRecorder()
+		mock.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/orders/1", nil))
+		var body Response
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(&body))
+		require.NotNil(t, body.Accrual)
+		assert.GreaterOrEqual(t, *body.Accrual, 10.0)
+		assert.LessOrEqual(t, *body.Accrual, 20.0)
+	})
+}
@@ -7,18 +7,40 @@ import (
 	"os/signal"
 	"time"
 
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
 	"github.com/besean163/gophermart/internal/database"
+	"github.com/besean163/gophermart/internal/entities"
 	"github.com/besean163/gophermart/internal/handlers"
 	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/metrics"
 	"github.com/besean163/gophermart/internal/migration"
+	databaseidempotency "github.com/besean163/gophermart/internal/repositories/database/idempotency_repository"
+	databaseorderqueue "github.com/besean163/gophermart/internal/repositories/database/order_queue"
 	databaseorders "github.com/besean163/gophermart/internal/repositories/database/order_repository"
+	databaseoutbox "github.com/besean163/gophermart/internal/repositories/database/outbox_repository"
 	databaseusers "github.com/besean163/gophermart/internal/repositories/database/user_repository"
+	databasewebhooks "github.com/besean163/gophermart/internal/repositories/database/webhook_repository"
+	inmemidempotency "github.com/besean163/gophermart/internal/repositories/inmem/idempotency_repository"
+	inmemorderqueue "github.com/besean163/gophermart/internal/repositories/inmem/order_queue"
 	inmemorders "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	inmemoutbox "github.com/besean163/gophermart/internal/repositories/inmem/outbox_repository"
 	inmemusers "github.com/besean163/gophermart/internal/repositories/inmem/user_repository"
+	inmemwebhooks "github.com/besean163/gophermart/internal/repositories/inmem/webhook_repository"
 	authservice "github.com/besean163/gophermart/internal/services/auth_service"
+	idempotencyservice "github.com/besean163/gophermart/internal/services/idempotency_service"
 	loyalityservice "github.com/besean163/gophermart/internal/services/loyality_service"
+	outboxservice "github.com/besean163/gophermart/internal/services/outbox_service"
+	streamservice "github.com/besean163/gophermart/internal/services/stream_service"
+	webhookservice "github.com/besean163/gophermart/internal/services/webhook_service"
+	"github.com/besean163/gophermart/internal/tracing"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"gorm.io/gorm"
+)
+
+const (
+	orderStreamHistorySize = 1000
+	orderQueueSize         = 1000
 )
 
 type Server interface {
@@ -42,11 +64,27 @@ func NewApp() App {
 }
 
 func (app App) Run() error {
-	err := logger.NewLogger()
+	err := logger.NewLogger(app.config.Logger)
+	if err != nil {
+		return err
+	}
+	shutdownTracing, err := tracing.Init(app.ctx, app.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Get().Warn("tracing shutdown error", zap.String("error", err.Error()))
+		}
+	}()
+	db, err := openDB(app.config.DatabaseDSN)
 	if err != nil {
 		return err
 	}
-	err = migration.Run(app.config.DatabaseDSN)
+	if db != nil {
+		defer database.Close(db)
+	}
+	err = migration.Migrate(db)
 	if err != nil {
 		return err
 	}
@@ -55,7 +93,7 @@ func (app App) Run() error {
 	defer cancel()
 	runGracefulStopRoutine(cancel)
 
-	handler, err := NewHandler(ctx, app.config)
+	handler, err := NewHandler(ctx, app.config, db)
 	if err != nil {
 		return err
 	}
@@ -79,6 +117,14 @@ func (app App) Run() error {
 	return nil
 }
 
+// openDB открывает одно подключение на процесс, в inmem-режиме возвращает nil.
+func openDB(dsn string) (*gorm.DB, error) {
+	if dsn == "" {
+		return nil, nil
+	}
+	return database.NewDB(dsn)
+}
+
 func runGracefulStopRoutine(cancel context.CancelFunc) {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
@@ -89,21 +135,109 @@ func runGracefulStopRoutine(cancel context.CancelFunc) {
 	}()
 }
 
-func NewHandler(ctx context.Context, config AppConfig) (handlers.Handler, error) {
+// NewHandler собирает сервисы API. db - общее подключение для всех репозиториев, nil в inmem-режиме.
+func NewHandler(ctx context.Context, config AppConfig, db *gorm.DB) (handlers.Handler, error) {
 	var handler handlers.Handler
-	authService, err := NewAuthService(config)
+	// в inmem-режиме репозитории заказов и пользователей пишут события в общий outbox,
+	// в режиме БД outbox - таблица, которую они пишут в своих транзакциях
+	var outbox *inmemoutbox.Repository
+	if config.DatabaseDSN == "" {
+		outbox = inmemoutbox.New()
+	}
+
+	authService, err := NewAuthService(config, db, outbox)
 	if err != nil {
 		return handler, err
 	}
-	loyalityService, err := NewLoyaltyService(ctx, config)
+	webhookService, err := NewWebhookService(config, db)
 	if err != nil {
 		return handler, err
 	}
+	webhookService.Run(ctx)
 
-	handler = handlers.NewHandlers(authService, loyalityService, config.HashSecret)
+	idempotencyService, err := NewIdempotencyService(config, db)
+	if err != nil {
+		return handler, err
+	}
+	idempotencyService.Run(ctx)
+
+	relay, err := NewOutboxRelay(config, db, outbox, outboxservice.MultiSink{outboxservice.LogSink{}, webhookService})
+	if err != nil {
+		return handler, err
+	}
+	relay.Run(ctx)
+
+	accrualClient := accrualclient.New(config.RunAccrualAddress, config.Accrual)
+	registerAccrualMetrics(metrics.Default(), accrualClient.Breaker())
+
+	orderStream := streamservice.New(ctx, orderStreamHistorySize)
+	var loyaltyOptions []loyalityservice.Option
+	if config.DatabaseDSN == "" {
+		loyaltyOptions = append(loyaltyOptions, loyalityservice.WithOrderNotifier(orderStream))
+	} else {
+		// заказы меняют и другие экземпляры, и accrual-worker: события приходят через NOTIFY
+		runOrderStreamListener(ctx, config.DatabaseDSN, orderStream)
+	}
+	loyalityService, err := NewLoyaltyService(config, db, outbox, accrualClient, loyaltyOptions...)
+	if err != nil {
+		return handler, err
+	}
+	if !config.DisablePolling {
+		loyalityService.RunPoller(ctx)
+	}
+	loyalityService.RunHoldExpiry(ctx)
+
+	handler = handlers.NewHandlers(
+		authService,
+		loyalityService,
+		config.HashSecret,
+		handlers.WithAdminToken(config.AdminToken),
+		handlers.WithRefreshInterval(config.RefreshInterval),
+		handlers.WithOrderStream(orderStream),
+		handlers.WithWebhookService(webhookService),
+		handlers.WithIdempotencyService(idempotencyService),
+		handlers.WithHealthCheck("accrual", accrualHealthCheck(accrualClient.Breaker())),
+		handlers.WithMetrics(metrics.Default()),
+	)
+	handler.RunCleanup(ctx)
 	return handler, nil
 }
 
+func runOrderStreamListener(ctx context.Context, dsn string, orderStream *streamservice.Service) {
+	database.Listen(ctx, dsn, entities.OrderEventsChannel, func(payload string) {
+		event, err := entities.ParseOrderNotification(payload)
+		if err != nil {
+			logger.Get().Warn("order notification error", zap.String("error", err.Error()))
+			return
+		}
+		orderStream.NotifyOrderEvent(event)
+	})
+}
+
+func accrualHealthCheck(breaker *accrualclient.Breaker) handlers.HealthCheck {
+	return func(ctx context.Context) (bool, any) {
+		status := breaker.Status()
+		return status.State == accrualclient.BreakerClosed, status
+	}
+}
+
+func registerAccrualMetrics(registry *metrics.Registry, breaker *accrualclient.Breaker) {
+	states := map[accrualclient.BreakerState]float64{
+		accrualclient.BreakerClosed:   0,
+		accrualclient.BreakerHalfOpen: 1,
+		accrualclient.BreakerOpen:     2,
+	}
+	registry.Gauge("gophermart_accrual_breaker_state", "Accrual circuit breaker state: 0 closed, 1 half-open, 2 open.", nil, func() float64 {
+		return states[breaker.State()]
+	})
+	registry.Gauge("gophermart_accrual_breaker_failures", "Consecutive accrual system failures.", nil, func() float64 {
+		return float64(breaker.Status().Failures)
+	})
+	registry.Counter("gophermart_accrual_breaker_trips_total", "Times the accrual circuit breaker opened.", nil, func() float64 {
+		return float64(breaker.Status().Trips)
+	})
+}
+
 type CustomServer struct {
 	handler handlers.Handler
 	config  AppConfig
@@ -130,34 +264,79 @@ func (server *CustomServer) Shutdown(ctx context.Context) error {
 	return server.server.Shutdown(ctx)
 }
 
-func NewLoyaltyService(ctx context.Context, config AppConfig) (handlers.LoyaltyService, error) {
+func NewLoyaltyService(config AppConfig, db *gorm.DB, outbox *inmemoutbox.Repository, accrualClient accrualclient.Client, options ...loyalityservice.Option) (loyalityservice.Service, error) {
 
 	var repository loyalityservice.OrderRepository
+	var queue loyalityservice.OrderQueue
 	if config.DatabaseDSN == "" {
-		repository = inmemorders.New()
+		repository = inmemorders.New(outbox)
+		queue = inmemorderqueue.New(orderQueueSize)
 	} else {
-		db, err := database.NewDB(config.DatabaseDSN)
+		var err error
+		repository, err = databaseorders.NewRepository(db)
 		if err != nil {
-			return nil, err
+			return loyalityservice.Service{}, err
 		}
-		repository, err = databaseorders.NewRepository(db)
+		queue, err = databaseorderqueue.New(db, config.DatabaseDSN)
 		if err != nil {
-			return nil, err
+			return loyalityservice.Service{}, err
 		}
 	}
 
-	return loyalityservice.New(ctx, repository, config.RunAccrualAddress), nil
+	options = append([]loyalityservice.Option{
+		loyalityservice.WithAccrualClient(accrualClient),
+		loyalityservice.WithReconciliation(config.Reconcile),
+		loyalityservice.WithClaimLease(config.ClaimLease),
+		loyalityservice.WithOrderQueue(queue),
+		loyalityservice.WithWithdrawnOrderOwnerCheck(config.CheckWithdrawnOrderOwner),
+		loyalityservice.WithHoldTTL(config.HoldTTL),
+		loyalityservice.WithPointsExpiry(config.Expiry),
+		loyalityservice.WithTierMultiplier(config.TierMultiplier),
+		loyalityservice.WithReferralProgram(config.Referral),
+	}, options...)
+	return loyalityservice.New(repository, config.RunAccrualAddress, options...), nil
 }
 
-func NewAuthService(config AppConfig) (handlers.AuthService, error) {
-	var repository authservice.UserRepository
+func NewWebhookService(config AppConfig, db *gorm.DB) (webhookservice.Service, error) {
+	var repository webhookservice.Repository
 	if config.DatabaseDSN == "" {
-		repository = inmemusers.New()
+		repository = inmemwebhooks.New()
 	} else {
-		db, err := database.NewDB(config.DatabaseDSN)
+		var err error
+		repository, err = databasewebhooks.New(db)
 		if err != nil {
-			return nil, err
+			return webhookservice.Service{}, err
+		}
+	}
+
+	webhookConfig := webhookservice.DefaultConfig()
+	webhookConfig.AllowPrivateNetworks = config.WebhookAllowPrivate
+	return webhookservice.New(repository, webhookConfig), nil
+}
+
+func NewIdempotencyService(config AppConfig, db *gorm.DB) (idempotencyservice.Service, error) {
+	var repository idempotencyservice.Repository
+	if config.DatabaseDSN == "" {
+		repository = inmemidempotency.New()
+	} else {
+		var err error
+		repository, err = databaseidempotency.New(db)
+		if err != nil {
+			return idempotencyservice.Service{}, err
 		}
+	}
+
+	serviceConfig := idempotencyservice.DefaultConfig()
+	serviceConfig.TTL = config.IdempotencyTTL
+	return idempotencyservice.New(repository, serviceConfig), nil
+}
+
+func NewAuthService(config AppConfig, db *gorm.DB, outbox *inmemoutbox.Repository) (handlers.AuthService, error) {
+	var repository authservice.UserRepository
+	if config.DatabaseDSN == "" {
+		repository = inmemusers.New(outbox)
+	} else {
+		var err error
 		repository, err = databaseusers.New(db)
 		if err != nil {
 			return nil, err
@@ -166,3 +345,18 @@ func NewAuthService(config AppConfig) (handlers.AuthService, error) {
 
 	return authservice.New(repository, config.HashSecret, time.Hour*3), nil
 }
+
+func NewOutboxRelay(config AppConfig, db *gorm.DB, outbox *inmemoutbox.Repository, sink outboxservice.Sink) (outboxservice.Relay, error) {
+	var repository outboxservice.Repository
+	if config.DatabaseDSN == "" {
+		repository = outbox
+	} else {
+		var err error
+		repository, err = databaseoutbox.New(db)
+		if err != nil {
+			return outboxservice.Relay{}, err
+		}
+	}
+
+	return outboxservice.New(repository, sink, outboxservice.DefaultConfig()), nil
+}
@@ -3,21 +3,78 @@ package app
 import (
 	"flag"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
+	"github.com/besean163/gophermart/internal/logger"
+	loyalityservice "github.com/besean163/gophermart/internal/services/loyality_service"
+	"github.com/besean163/gophermart/internal/tracing"
 )
 
 type AppConfig struct {
-	RunAddress        string
-	RunAccrualAddress string
-	DatabaseDSN       string
-	HashSecret        string
+	RunAddress               string
+	RunAccrualAddress        string
+	DatabaseDSN              string
+	HashSecret               string
+	AdminToken               string
+	RefreshInterval          time.Duration
+	Logger                   logger.Config
+	Tracing                  tracing.Config
+	Accrual                  accrualclient.Config
+	Reconcile                loyalityservice.ReconcileConfig
+	ClaimLease               time.Duration
+	DisablePolling           bool
+	IdempotencyTTL           time.Duration
+	CheckWithdrawnOrderOwner bool
+	HoldTTL                  time.Duration
+	Expiry                   loyalityservice.ExpiryConfig
+	TierMultiplier           bool
+	Referral                 loyalityservice.ReferralConfig
+	WebhookAllowPrivate      bool
 }
 
 func NewConfig() AppConfig {
 	config := AppConfig{}
+	var logOutput string
 	flag.StringVar(&config.RunAddress, "a", "", "server run port")
 	flag.StringVar(&config.RunAccrualAddress, "r", "", "accrual run port")
 	flag.StringVar(&config.DatabaseDSN, "d", "", "data base dsn")
 	flag.StringVar(&config.HashSecret, "k", "secret", "hash secret")
+	flag.StringVar(&config.AdminToken, "admin-token", "", "admin api token, admin api is disabled if empty")
+	flag.DurationVar(&config.RefreshInterval, "refresh-interval", 0, "min interval between order refresh requests of one user")
+	flag.StringVar(&config.Logger.Level, "log-level", "", "log level: debug, info, warn, error")
+	flag.StringVar(&config.Logger.Encoding, "log-encoding", "", "log encoding: json or console")
+	flag.StringVar(&logOutput, "log-output", "", "comma separated log output paths")
+	flag.IntVar(&config.Logger.SamplingInitial, "log-sampling-initial", -1, "log sampling initial count per second, 0 disables sampling")
+	flag.IntVar(&config.Logger.SamplingThereafter, "log-sampling-thereafter", -1, "log sampling thereafter rate, 0 disables sampling")
+	flag.StringVar(&config.Tracing.Exporter, "trace-exporter", "", "trace exporter: none, otlp, stdout or file")
+	flag.StringVar(&config.Tracing.OTLPEndpoint, "trace-endpoint", "", "otlp http endpoint url, e.g. http://localhost:4318")
+	flag.StringVar(&config.Tracing.FilePath, "trace-file", "", "trace file path for file exporter")
+	flag.Float64Var(&config.Tracing.SampleRatio, "trace-sample-ratio", -1, "share of traces to sample, from 0 to 1")
+	flag.DurationVar(&config.Accrual.Timeout, "accrual-timeout", 0, "accrual system request timeout")
+	flag.IntVar(&config.Accrual.Breaker.FailureThreshold, "accrual-breaker-threshold", -1, "consecutive accrual failures to open circuit breaker")
+	flag.DurationVar(&config.Accrual.Breaker.Cooldown, "accrual-breaker-cooldown", 0, "time circuit breaker stays open before probe request")
+	flag.DurationVar(&config.IdempotencyTTL, "idempotency-ttl", 0, "how long responses to requests with Idempotency-Key are kept")
+	flag.DurationVar(&config.HoldTTL, "hold-ttl", 0, "how long points stay reserved by a hold that is neither captured nor released")
+	flag.IntVar(&config.Expiry.Months, "points-expiry-months", -1, "accrued points expire after this many months, 0 disables expiry")
+	flag.DurationVar(&config.Expiry.Interval, "points-expiry-interval", 0, "how often expired points are written off")
+	flag.DurationVar(&config.Expiry.NoticePeriod, "points-expiry-notice", 0, "report points expiring within this period in balance")
+	flag.BoolVar(&config.TierMultiplier, "tier-multiplier", false, "add tier multiplier bonus on top of accrual system value")
+	flag.Float64Var(&config.Referral.ReferrerBonus, "referral-referrer-bonus", -1, "points for the inviting user when referred user's first order is processed")
+	flag.Float64Var(&config.Referral.RefereeBonus, "referral-referee-bonus", -1, "points for the referred user for the first processed order")
+	flag.IntVar(&config.Referral.MaxRewards, "referral-max-rewards", -1, "max rewarded referrals per user, 0 means no limit")
+	flag.Float64Var(&config.Referral.MinAccrual, "referral-min-accrual", -1, "min accrual of referred user's first order to pay referral bonuses")
+	flag.IntVar(&config.Referral.MaxPerDay, "referral-max-per-day", -1, "max referrals per user per day, 0 means no limit")
+	flag.BoolVar(&config.WebhookAllowPrivate, "webhook-allow-private", false, "allow webhooks to loopback and private network addresses")
+	flag.BoolVar(&config.CheckWithdrawnOrderOwner, "withdraw-check-order-owner", false, "reject withdrawals against order numbers uploaded by another user")
+	flag.BoolVar(&config.DisablePolling, "disable-polling", false, "do not poll accrual system in api process, run cmd/accrual-worker instead")
+	flag.DurationVar(&config.ClaimLease, "accrual-claim-lease", 0, "how long a poller replica owns claimed orders")
+	flag.DurationVar(&config.Reconcile.Interval, "reconcile-interval", 0, "accrual reconciliation interval, reconciliation is disabled if not set")
+	flag.DurationVar(&config.Reconcile.Options.Window, "reconcile-window", 0, "reconcile orders processed within this window")
+	flag.Float64Var(&config.Reconcile.Options.SampleRate, "reconcile-sample-rate", -1, "share of processed orders to reconcile, from 0 to 1")
+	flag.BoolVar(&config.Reconcile.Options.Correct, "reconcile-correct", false, "post correcting ledger adjustments for mismatches")
 	flag.Parse()
 
 	if runAddressEnv := os.Getenv("RUN_ADDRESS"); runAddressEnv != "" && config.RunAddress == "" {
@@ -36,5 +93,174 @@ func NewConfig() AppConfig {
 		config.HashSecret = HashSecretEnv
 	}
 
+	if adminTokenEnv := os.Getenv("ADMIN_TOKEN"); adminTokenEnv != "" && config.AdminToken == "" {
+		config.AdminToken = adminTokenEnv
+	}
+
+	if refreshIntervalEnv, err := time.ParseDuration(os.Getenv("ORDER_REFRESH_INTERVAL")); err == nil && config.RefreshInterval == 0 {
+		config.RefreshInterval = refreshIntervalEnv
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = 5 * time.Second
+	}
+
+	config.Logger = newLoggerConfig(config.Logger, logOutput)
+	config.Tracing = newTracingConfig(config.Tracing)
+	config.Accrual = newAccrualConfig(config.Accrual)
+	config.Reconcile = newReconcileConfig(config.Reconcile)
+	config.Expiry = newExpiryConfig(config.Expiry)
+	config.Referral = newReferralConfig(config.Referral)
+	if disablePollingEnv, err := strconv.ParseBool(os.Getenv("DISABLE_ACCRUAL_POLLING")); err == nil && !config.DisablePolling {
+		config.DisablePolling = disablePollingEnv
+	}
+	if tierMultiplierEnv, err := strconv.ParseBool(os.Getenv("TIER_MULTIPLIER")); err == nil && !config.TierMultiplier {
+		config.TierMultiplier = tierMultiplierEnv
+	}
+	if webhookAllowPrivateEnv, err := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_PRIVATE")); err == nil && !config.WebhookAllowPrivate {
+		config.WebhookAllowPrivate = webhookAllowPrivateEnv
+	}
+	if checkOwnerEnv, err := strconv.ParseBool(os.Getenv("WITHDRAW_CHECK_ORDER_OWNER")); err == nil && !config.CheckWithdrawnOrderOwner {
+		config.CheckWithdrawnOrderOwner = checkOwnerEnv
+	}
+	config.ClaimLease = durationEnvOrDefault("ACCRUAL_CLAIM_LEASE", config.ClaimLease, 30*time.Second)
+	config.HoldTTL = durationEnvOrDefault("HOLD_TTL", config.HoldTTL, 15*time.Minute)
+	config.IdempotencyTTL = durationEnvOrDefault("IDEMPOTENCY_TTL", config.IdempotencyTTL, 24*time.Hour)
+
+	return config
+}
+
+func newLoggerConfig(config logger.Config, output string) logger.Config {
+	defaults := logger.DefaultConfig()
+
+	if levelEnv := os.Getenv("LOG_LEVEL"); levelEnv != "" && config.Level == "" {
+		config.Level = levelEnv
+	}
+	if config.Level == "" {
+		config.Level = defaults.Level
+	}
+
+	if encodingEnv := os.Getenv("LOG_ENCODING"); encodingEnv != "" && config.Encoding == "" {
+		config.Encoding = encodingEnv
+	}
+	if config.Encoding == "" {
+		config.Encoding = defaults.Encoding
+	}
+
+	if outputEnv := os.Getenv("LOG_OUTPUT"); outputEnv != "" && output == "" {
+		output = outputEnv
+	}
+	config.OutputPaths = defaults.OutputPaths
+	if output != "" {
+		config.OutputPaths = strings.Split(output, ",")
+	}
+
+	config.SamplingInitial = intEnvOrDefault("LOG_SAMPLING_INITIAL", config.SamplingInitial, defaults.SamplingInitial)
+	config.SamplingThereafter = intEnvOrDefault("LOG_SAMPLING_THEREAFTER", config.SamplingThereafter, defaults.SamplingThereafter)
+
+	return config
+}
+
+// intEnvOrDefault используется для числовых флагов, где -1 означает "не задан".
+func intEnvOrDefault(env string, value int, def int) int {
+	if value >= 0 {
+		return value
+	}
+	if envValue, err := strconv.Atoi(os.Getenv(env)); err == nil && envValue >= 0 {
+		return envValue
+	}
+	return def
+}
+
+func floatEnvOrDefault(env string, value float64, def float64) float64 {
+	if value >= 0 {
+		return value
+	}
+	if envValue, err := strconv.ParseFloat(os.Getenv(env), 64); err == nil && envValue >= 0 {
+		return envValue
+	}
+	return def
+}
+
+func newTracingConfig(config tracing.Config) tracing.Config {
+	config.ServiceName = "gophermart"
+
+	if exporterEnv := os.Getenv("OTEL_TRACES_EXPORTER"); exporterEnv != "" && config.Exporter == "" {
+		config.Exporter = exporterEnv
+	}
+	if config.Exporter == "" {
+		config.Exporter = tracing.ExporterNone
+	}
+
+	if endpointEnv := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpointEnv != "" && config.OTLPEndpoint == "" {
+		config.OTLPEndpoint = endpointEnv
+	}
+
+	if fileEnv := os.Getenv("TRACE_FILE"); fileEnv != "" && config.FilePath == "" {
+		config.FilePath = fileEnv
+	}
+	if config.FilePath == "" {
+		config.FilePath = "traces.json"
+	}
+
+	if config.SampleRatio < 0 {
+		config.SampleRatio = 1
+		if ratio, err := strconv.ParseFloat(os.Getenv("TRACE_SAMPLE_RATIO"), 64); err == nil && ratio >= 0 {
+			config.SampleRatio = ratio
+		}
+	}
+
+	return config
+}
+
+func newAccrualConfig(config accrualclient.Config) accrualclient.Config {
+	defaults := accrualclient.DefaultConfig()
+	defaults.Timeout = durationEnvOrDefault("ACCRUAL_TIMEOUT", config.Timeout, defaults.Timeout)
+	defaults.Breaker.FailureThreshold = intEnvOrDefault("ACCRUAL_BREAKER_THRESHOLD", config.Breaker.FailureThreshold, defaults.Breaker.FailureThreshold)
+	defaults.Breaker.Cooldown = durationEnvOrDefault("ACCRUAL_BREAKER_COOLDOWN", config.Breaker.Cooldown, defaults.Breaker.Cooldown)
+	return defaults
+}
+
+// durationEnvOrDefault используется для флагов длительности, где 0 означает "не задан".
+func durationEnvOrDefault(env string, value time.Duration, def time.Duration) time.Duration {
+	if value > 0 {
+		return value
+	}
+	if envValue, err := time.ParseDuration(os.Getenv(env)); err == nil && envValue > 0 {
+		return envValue
+	}
+	return def
+}
+
+func newReconcileConfig(config loyalityservice.ReconcileConfig) loyalityservice.ReconcileConfig {
+	config.Interval = durationEnvOrDefault("RECONCILE_INTERVAL", config.Interval, 0)
+	config.Options.Window = durationEnvOrDefault("RECONCILE_WINDOW", config.Options.Window, 30*24*time.Hour)
+
+	if config.Options.SampleRate < 0 {
+		config.Options.SampleRate = 1
+		if rate, err := strconv.ParseFloat(os.Getenv("RECONCILE_SAMPLE_RATE"), 64); err == nil && rate >= 0 {
+			config.Options.SampleRate = rate
+		}
+	}
+
+	if correctEnv, err := strconv.ParseBool(os.Getenv("RECONCILE_CORRECT")); err == nil && !config.Options.Correct {
+		config.Options.Correct = correctEnv
+	}
+	config.Options.Reason = "scheduled reconciliation"
+	return config
+}
+
+func newReferralConfig(config loyalityservice.ReferralConfig) loyalityservice.ReferralConfig {
+	config.ReferrerBonus = floatEnvOrDefault("REFERRAL_REFERRER_BONUS", config.ReferrerBonus, 0)
+	config.RefereeBonus = floatEnvOrDefault("REFERRAL_REFEREE_BONUS", config.RefereeBonus, 0)
+	config.MaxRewards = intEnvOrDefault("REFERRAL_MAX_REWARDS", config.MaxRewards, 20)
+	config.MinAccrual = floatEnvOrDefault("REFERRAL_MIN_ACCRUAL", config.MinAccrual, 0)
+	config.MaxPerDay = intEnvOrDefault("REFERRAL_MAX_PER_DAY", config.MaxPerDay, 10)
+	return config
+}
+
+func newExpiryConfig(config loyalityservice.ExpiryConfig) loyalityservice.ExpiryConfig {
+	config.Months = intEnvOrDefault("POINTS_EXPIRY_MONTHS", config.Months, 0)
+	config.Interval = durationEnvOrDefault("POINTS_EXPIRY_INTERVAL", config.Interval, time.Hour)
+	config.NoticePeriod = durationEnvOrDefault("POINTS_EXPIRY_NOTICE", config.NoticePeriod, 30*24*time.Hour)
 	return config
 }
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/besean163/gophermart/internal/database"
+	"github.com/besean163/gophermart/internal/handlers"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/metrics"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
+)
+
+var (
+	ErrWorkerNeedsDatabase = errors.New("accrual worker needs database dsn")
+)
+
+// Worker - отдельный процесс опроса системы начислений, API при этом запускается с -disable-polling.
+// Реплики делят заказы через аренду в Postgres, поэтому inmem-режим не поддерживается.
+type Worker struct {
+	ctx    context.Context
+	config AppConfig
+}
+
+func NewWorker() Worker {
+	return Worker{
+		ctx:    context.Background(),
+		config: NewConfig(),
+	}
+}
+
+func (worker Worker) Run() error {
+	if worker.config.DatabaseDSN == "" {
+		return ErrWorkerNeedsDatabase
+	}
+
+	err := logger.NewLogger(worker.config.Logger)
+	if err != nil {
+		return err
+	}
+	worker.config.Tracing.ServiceName = "gophermart-accrual-worker"
+	shutdownTracing, err := tracing.Init(worker.ctx, worker.config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Get().Warn("tracing shutdown error", zap.String("error", err.Error()))
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(worker.ctx)
+	defer cancel()
+	runGracefulStopRoutine(cancel)
+
+	accrualClient := accrualclient.New(worker.config.RunAccrualAddress, worker.config.Accrual)
+	registerAccrualMetrics(metrics.Default(), accrualClient.Breaker())
+
+	db, err := openDB(worker.config.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer database.Close(db)
+
+	loyalityService, err := NewLoyaltyService(worker.config, db, nil, accrualClient)
+	if err != nil {
+		return err
+	}
+	loyalityService.RunPoller(ctx)
+	logger.Get().Info("run accrual worker", zap.String("accrual address", worker.config.RunAccrualAddress))
+
+	if worker.config.RunAddress == "" {
+		<-ctx.Done()
+		return nil
+	}
+
+	// адрес задан - отдаем health и метрики для оркестратора
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Default())
+	mux.Handle("GET /api/health", handlers.NewHandlers(nil, nil, "",
+		handlers.WithHealthCheck("accrual", accrualHealthCheck(accrualClient.Breaker())),
+	))
+	server := &http.Server{
+		Addr:    worker.config.RunAddress,
+		Handler: mux,
+	}
+
+	errGroup, _ := errgroup.WithContext(ctx)
+	errGroup.Go(func() error {
+		err := server.ListenAndServe()
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	})
+	errGroup.Go(func() error {
+		<-ctx.Done()
+		return server.Shutdown(context.Background())
+	})
+	return errGroup.Wait()
+}
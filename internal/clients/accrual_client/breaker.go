@@ -0,0 +1,162 @@
+package accrualclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("accrual circuit breaker is open")
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+type BreakerConfig struct {
+	// FailureThreshold - число подряд идущих сбоев, после которого цепь размыкается.
+	FailureThreshold int
+	// Cooldown - сколько цепь остается разомкнутой до пробного запроса.
+	Cooldown time.Duration
+}
+
+// BreakerStatus - снимок состояния для health и метрик.
+type BreakerStatus struct {
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`
+	Trips    int          `json:"trips"`
+	OpenedAt *time.Time   `json:"opened_at,omitempty"`
+}
+
+// Breaker - circuit breaker системы начислений. В полуоткрытом состоянии
+// пропускает один пробный запрос: успех замыкает цепь, сбой снова размыкает.
+// Каждая смена состояния начинает новое поколение, результаты запросов,
+// разрешенных в прошлом поколении, не учитываются.
+type Breaker struct {
+	mu         sync.Mutex
+	config     BreakerConfig
+	state      BreakerState
+	generation uint64
+	failures   int
+	trips      int
+	openedAt   time.Time
+	probing    bool
+	now        func() time.Time
+}
+
+// NewBreaker подставляет значения по умолчанию вместо неположительных: с нулевым
+// порогом цепь размыкалась бы после первого же сбоя.
+func NewBreaker(config BreakerConfig) *Breaker {
+	defaults := DefaultConfig().Breaker
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaults.FailureThreshold
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = defaults.Cooldown
+	}
+	return &Breaker{
+		config: config,
+		state:  BreakerClosed,
+		now:    time.Now,
+	}
+}
+
+// Allow сообщает, можно ли выполнить запрос, и возвращает поколение, в котором он разрешен.
+// Разрешенный запрос обязательно завершается вызовом Success, Failure или Release с этим поколением.
+func (breaker *Breaker) Allow() (uint64, bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	switch breaker.currentState() {
+	case BreakerClosed:
+		return breaker.generation, true
+	case BreakerHalfOpen:
+		if breaker.probing {
+			return 0, false
+		}
+		breaker.setState(BreakerHalfOpen)
+		breaker.probing = true
+		return breaker.generation, true
+	}
+	return 0, false
+}
+
+func (breaker *Breaker) Success(generation uint64) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if generation != breaker.generation {
+		return
+	}
+	breaker.failures = 0
+	if breaker.state == BreakerHalfOpen {
+		breaker.setState(BreakerClosed)
+	}
+}
+
+func (breaker *Breaker) Failure(generation uint64) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	// запросы, разрешенные до размыкания, не продлевают cooldown
+	if generation != breaker.generation {
+		return
+	}
+	breaker.failures++
+	if breaker.state == BreakerHalfOpen || breaker.failures >= breaker.config.FailureThreshold {
+		breaker.trips++
+		breaker.openedAt = breaker.now()
+		breaker.setState(BreakerOpen)
+	}
+}
+
+// Release завершает разрешенный запрос, не меняя состояние цепи.
+func (breaker *Breaker) Release(generation uint64) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if generation == breaker.generation {
+		breaker.probing = false
+	}
+}
+
+func (breaker *Breaker) setState(state BreakerState) {
+	breaker.state = state
+	breaker.generation++
+	breaker.probing = false
+}
+
+// State учитывает истекший cooldown: разомкнутая цепь отдается как полуоткрытая.
+func (breaker *Breaker) State() BreakerState {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.currentState()
+}
+
+func (breaker *Breaker) Status() BreakerStatus {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	status := BreakerStatus{
+		State:    breaker.currentState(),
+		Failures: breaker.failures,
+		Trips:    breaker.trips,
+	}
+	if status.State != BreakerClosed {
+		openedAt := breaker.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+func (breaker *Breaker) currentState() BreakerState {
+	if breaker.state == BreakerOpen && breaker.now().Sub(breaker.openedAt) >= breaker.config.Cooldown {
+		return BreakerHalfOpen
+	}
+	return breaker.state
+}
@@ -0,0 +1,116 @@
+package accrualclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/accrualmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := NewBreaker(BreakerConfig{FailureThreshold: 2, Cooldown: time.Minute})
+	breaker.now = func() time.Time { return now }
+
+	generation, ok := breaker.Allow()
+	require.True(t, ok)
+	breaker.Failure(generation)
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	late, ok := breaker.Allow()
+	require.True(t, ok)
+	generation, ok = breaker.Allow()
+	require.True(t, ok)
+	breaker.Failure(generation)
+	assert.Equal(t, BreakerOpen, breaker.State())
+	_, ok = breaker.Allow()
+	assert.False(t, ok)
+
+	t.Run("non-positive config falls back to defaults", func(t *testing.T) {
+		breaker := NewBreaker(BreakerConfig{})
+		assert.Equal(t, DefaultConfig().Breaker, breaker.config)
+
+		generation, ok := breaker.Allow()
+		require.True(t, ok)
+		breaker.Failure(generation)
+		assert.Equal(t, BreakerClosed, breaker.State())
+	})
+
+	t.Run("late results of closed state are ignored", func(t *testing.T) {
+		openedAt := breaker.Status().OpenedAt
+		now = now.Add(30 * time.Second)
+		breaker.Failure(late)
+		breaker.Success(late)
+		assert.Equal(t, BreakerOpen, breaker.State())
+		assert.Equal(t, openedAt, breaker.Status().OpenedAt, "failure while open must not extend cooldown")
+		now = now.Add(-30 * time.Second)
+	})
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	generation, ok = breaker.Allow()
+	require.True(t, ok)
+	_, ok = breaker.Allow()
+	assert.False(t, ok, "only one probe in half-open state")
+
+	breaker.Failure(generation)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	now = now.Add(time.Minute)
+	generation, ok = breaker.Allow()
+	require.True(t, ok)
+	breaker.Success(generation)
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	status := breaker.Status()
+	assert.Equal(t, 2, status.Trips)
+	assert.Equal(t, 0, status.Failures)
+	assert.Nil(t, status.OpenedAt)
+}
+
+func TestClientBreaker(t *testing.T) {
+	ctx := context.Background()
+
+	mock := accrualmock.New(accrualmock.DefaultConfig())
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	mock.SetScript("12345678903", accrualmock.Script{Steps: []string{
+		accrualmock.StepServerError,
+		accrualmock.StepServerError,
+		"PROCESSING",
+	}})
+
+	config := DefaultConfig()
+	config.Breaker = BreakerConfig{FailureThreshold: 2, Cooldown: time.Hour}
+	client := New(server.URL, config)
+
+	for i := 0; i < 2; i++ {
+		result, err := client.GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, ResultServerError, result.Kind)
+	}
+	assert.False(t, client.Available())
+
+	_, err := client.GetOrder(ctx, "12345678903")
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, mock.Requests("12345678903"), "open breaker must not reach accrual system")
+
+	t.Run("unexpected status is a failure", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+		client := New(server.URL, config)
+
+		for i := 0; i < 2; i++ {
+			_, err := client.GetOrder(ctx, "12345678903")
+			assert.ErrorIs(t, err, ErrUnexpectedStatusCode)
+		}
+		assert.False(t, client.Available())
+	})
+}
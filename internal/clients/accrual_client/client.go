@@ -0,0 +1,210 @@
+package accrualclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/tracing"
+	"github.com/go-resty/resty/v2"
+)
+
+var (
+	ErrUnexpectedStatusCode = errors.New("unexpected accrual response status code")
+)
+
+// ResultKind - типизированный итог запроса заказа в системе начислений.
+type ResultKind string
+
+const (
+	ResultRegistered  ResultKind = "REGISTERED"
+	ResultProcessing  ResultKind = "PROCESSING"
+	ResultInvalid     ResultKind = "INVALID"
+	ResultProcessed   ResultKind = "PROCESSED"
+	ResultNotFound    ResultKind = "NOT_FOUND"
+	ResultRateLimited ResultKind = "RATE_LIMITED"
+	ResultServerError ResultKind = "SERVER_ERROR"
+	// ResultUnknown - ответ 200 с неизвестным статусом, ResultMalformed - ответ 200, который не разобрать.
+	// Клиент их не интерпретирует, решение принимает вызывающий.
+	ResultUnknown   ResultKind = "UNKNOWN"
+	ResultMalformed ResultKind = "MALFORMED"
+)
+
+// Result - ответ системы начислений. RetryAfter заполняется для ResultRateLimited.
+// Для ответов 200 Status и Accrual передаются как есть, HasAccrual - было ли поле accrual
+// в ответе, Body - исходное тело для разбора проблемных ответов.
+type Result struct {
+	Kind       ResultKind
+	Order      string
+	Status     string
+	Accrual    float64
+	HasAccrual bool
+	RetryAfter time.Duration
+	StatusCode int
+	Body       string
+}
+
+type Config struct {
+	Timeout             time.Duration
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// DefaultRetryAfter используется, если 429 пришел без корректного Retry-After.
+	DefaultRetryAfter time.Duration
+	Breaker           BreakerConfig
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Timeout:             5 * time.Second,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		DefaultRetryAfter:   60 * time.Second,
+		Breaker: BreakerConfig{
+			FailureThreshold: 5,
+			Cooldown:         30 * time.Second,
+		},
+	}
+}
+
+type response struct {
+	Order   string   `json:"order"`
+	Status  string   `json:"status"`
+	Accrual *float64 `json:"accrual"`
+}
+
+// Client - HTTP-клиент системы начислений. Один клиент и пул соединений
+// переиспользуются всеми воркерами.
+type Client struct {
+	client  *resty.Client
+	config  Config
+	breaker *Breaker
+}
+
+func New(baseURL string, config Config) Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          config.MaxIdleConnsPerHost,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		ResponseHeaderTimeout: config.Timeout,
+	}
+
+	return Client{
+		client: resty.New().
+			SetTransport(tracing.NewTransport(transport)).
+			SetTimeout(config.Timeout).
+			SetBaseURL(baseURL),
+		config:  config,
+		breaker: NewBreaker(config.Breaker),
+	}
+}
+
+func (client Client) Breaker() *Breaker {
+	return client.breaker
+}
+
+// Available сообщает, стоит ли сейчас опрашивать систему начислений.
+func (client Client) Available() bool {
+	return client.breaker.State() != BreakerOpen
+}
+
+// GetOrder запрашивает заказ. Ошибка возвращается для сетевых сбоев, неожиданных кодов ответа
+// и разомкнутого breaker, коды 204, 429 и 5xx отдаются как Result.
+// Сетевые сбои, 5xx и неожиданные коды считаются отказами системы начислений для breaker.
+func (client Client) GetOrder(ctx context.Context, number string) (Result, error) {
+	generation, ok := client.breaker.Allow()
+	if !ok {
+		return Result{}, ErrCircuitOpen
+	}
+
+	result, err := client.getOrder(ctx, number)
+	switch {
+	case err != nil && result.StatusCode == 0 && ctx.Err() != nil:
+		// запрос отменен вызывающим, о доступности системы он ничего не говорит
+		client.breaker.Release(generation)
+	case err != nil, result.Kind == ResultServerError:
+		client.breaker.Failure(generation)
+	default:
+		client.breaker.Success(generation)
+	}
+	return result, err
+}
+
+func (client Client) getOrder(ctx context.Context, number string) (Result, error) {
+	resp, err := client.client.R().
+		SetContext(ctx).
+		SetPathParam("number", number).
+		Get("/api/orders/{number}")
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{
+		Order:      number,
+		StatusCode: resp.StatusCode(),
+	}
+	switch code := resp.StatusCode(); {
+	case code == http.StatusOK:
+	case code == http.StatusNoContent:
+		result.Kind = ResultNotFound
+		return result, nil
+	case code == http.StatusTooManyRequests:
+		result.Kind = ResultRateLimited
+		result.RetryAfter = client.retryAfter(resp.Header().Get("Retry-After"))
+		return result, nil
+	case code >= http.StatusInternalServerError:
+		result.Kind = ResultServerError
+		return result, nil
+	default:
+		return result, ErrUnexpectedStatusCode
+	}
+
+	result.Body = string(resp.Body())
+	var body response
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		result.Kind = ResultMalformed
+		return result, nil
+	}
+
+	result.Order = body.Order
+	result.Status = body.Status
+	if body.Accrual != nil {
+		result.Accrual = *body.Accrual
+		result.HasAccrual = true
+	}
+	switch body.Status {
+	case entities.AccrealStatusRegistered:
+		result.Kind = ResultRegistered
+	case entities.AccrealStatusProcessing:
+		result.Kind = ResultProcessing
+	case entities.AccrealStatusInvalid:
+		result.Kind = ResultInvalid
+	case entities.AccrealStatusProcessed:
+		result.Kind = ResultProcessed
+	default:
+		result.Kind = ResultUnknown
+	}
+	return result, nil
+}
+
+func (client Client) retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return client.config.DefaultRetryAfter
+}
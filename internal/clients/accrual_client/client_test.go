@@ -0,0 +1,82 @@
+package accrualclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/accrualmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOrder(t *testing.T) {
+	ctx := context.Background()
+
+	config := accrualmock.DefaultConfig()
+	config.Accrual = 729.98
+	config.RetryAfter = 30 * time.Second
+	mock := accrualmock.New(config)
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	mock.SetScript("12345678903", accrualmock.Script{Steps: []string{
+		"REGISTERED",
+		"PROCESSING",
+		accrualmock.StepRateLimited,
+		accrualmock.StepServerError,
+		accrualmock.StepNotFound,
+		"INVALID",
+		"PROCESSED",
+	}})
+
+	client := New(server.URL, DefaultConfig())
+	expected := []Result{
+		{Kind: ResultRegistered, Order: "12345678903", StatusCode: http.StatusOK},
+		{Kind: ResultProcessing, Order: "12345678903", StatusCode: http.StatusOK},
+		{Kind: ResultRateLimited, Order: "12345678903", StatusCode: http.StatusTooManyRequests, RetryAfter: 30 * time.Second},
+		{Kind: ResultServerError, Order: "12345678903", StatusCode: http.StatusInternalServerError},
+		{Kind: ResultNotFound, Order: "12345678903", StatusCode: http.StatusNoContent},
+		{Kind: ResultInvalid, Order: "12345678903", StatusCode: http.StatusOK},
+		{Kind: ResultProcessed, Order: "12345678903", StatusCode: http.StatusOK, Accrual: 729.98},
+	}
+	for _, want := range expected {
+		result, err := client.GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, want.Kind, result.Kind)
+		assert.Equal(t, want.Order, result.Order)
+		assert.Equal(t, want.Accrual, result.Accrual)
+		assert.Equal(t, want.Kind == ResultProcessed, result.HasAccrual)
+		assert.Equal(t, want.RetryAfter, result.RetryAfter)
+		assert.Equal(t, want.StatusCode, result.StatusCode)
+	}
+
+	t.Run("unknown status", func(t *testing.T) {
+		mock.SetScript("2377225624", accrualmock.Script{Steps: []string{"DONE"}})
+		result, err := client.GetOrder(ctx, "2377225624")
+		require.NoError(t, err)
+		assert.Equal(t, ResultUnknown, result.Kind)
+		assert.Equal(t, "DONE", result.Status)
+		assert.Contains(t, result.Body, `"status":"DONE"`)
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"order":`))
+		}))
+		defer server.Close()
+
+		result, err := New(server.URL, DefaultConfig()).GetOrder(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, ResultMalformed, result.Kind)
+		assert.Equal(t, `{"order":`, result.Body)
+	})
+
+	t.Run("network error", func(t *testing.T) {
+		client := New("http://127.0.0.1:1", DefaultConfig())
+		_, err := client.GetOrder(ctx, "12345678903")
+		assert.Error(t, err)
+	})
+}
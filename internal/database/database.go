@@ -1,25 +1,35 @@
 package database
 
 import (
+	"github.com/besean163/gophermart/internal/tracing"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-var db *gorm.DB
-
+// NewDB открывает пул подключений. Процесс открывает его один раз и передает
+// всем репозиториям, закрывает - Close при остановке.
 func NewDB(dsn string) (*gorm.DB, error) {
-	if db == nil {
-		conn, err := gorm.Open(postgres.Open(dsn))
-		if err != nil {
-			return nil, err
-		}
-		parentDB, err := conn.DB()
-		if err != nil {
-			return nil, err
-		}
-		parentDB.SetMaxIdleConns(10)
-		db = conn
+	conn, err := gorm.Open(postgres.Open(dsn))
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Use(tracing.GormPlugin{})
+	if err != nil {
+		return nil, err
+	}
+	parentDB, err := conn.DB()
+	if err != nil {
+		return nil, err
 	}
+	parentDB.SetMaxIdleConns(10)
+	return conn, nil
+}
 
-	return db, nil
+// Close закрывает пул, открытый NewDB.
+func Close(db *gorm.DB) error {
+	parentDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return parentDB.Close()
 }
@@ -0,0 +1,51 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+)
+
+const listenRetryDelay = 5 * time.Second
+
+// Listen подписывается на канал NOTIFY и передает сообщения в handle, пока не отменен ctx.
+// Оборванное соединение восстанавливается, уведомления за время обрыва теряются.
+func Listen(ctx context.Context, dsn string, channel string, handle func(payload string)) {
+	go func() {
+		for {
+			err := listen(ctx, dsn, channel, handle)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Get().Warn("listen error", zap.String("channel", channel), zap.String("error", err.Error()))
+
+			select {
+			case <-time.After(listenRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func listen(ctx context.Context, dsn string, channel string, handle func(payload string)) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		handle(notification.Payload)
+	}
+}
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+)
+
+// txKey - ключ контекста, в котором репозитории передают друг другу открытую транзакцию.
+type txKey struct{}
+
+// WithTx возвращает ctx, запросы репозиториев с которым идут в транзакции tx.
+func WithTx(ctx context.Context, tx *gorm.DB) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+// Conn возвращает транзакцию из ctx, если она есть, иначе общее подключение db.
+func Conn(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if tx, ok := ctx.Value(txKey{}).(*gorm.DB); ok {
+		return tx.WithContext(ctx)
+	}
+	return db.WithContext(ctx)
+}
@@ -1,6 +1,20 @@
 package entities
 
+import "time"
+
+// Balance - Current доступен для списания, Held зарезервирован активными резервами и в Current не входит.
+// ExpiringSoon и Expirations заполняются, если включено сгорание баллов.
 type Balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current      float64            `json:"current"`
+	Held         float64            `json:"held"`
+	Withdrawn    float64            `json:"withdrawn"`
+	ExpiringSoon float64            `json:"expiring_soon,omitempty"`
+	Expirations  []PointsExpiration `json:"expirations,omitempty"`
+}
+
+// PointsExpiration - остаток начисления по заказу, который сгорит в ExpiresAt.
+type PointsExpiration struct {
+	OrderNumber string    `json:"order"`
+	Amount      float64   `json:"amount"`
+	ExpiresAt   time.Time `json:"expires_at"`
 }
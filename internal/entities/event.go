@@ -0,0 +1,82 @@
+package entities
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	EventOrderAccrued     = "OrderAccrued"
+	EventOrderInvalidated = "OrderInvalidated"
+	EventPointsWithdrawn  = "PointsWithdrawn"
+	EventPointsRefunded   = "PointsRefunded"
+	EventUserRegistered   = "UserRegistered"
+)
+
+// OutboxEvent - доменное событие, записанное в outbox в одной транзакции с изменением состояния.
+// Relay публикует такие события хотя бы один раз, получатели дедуплицируют по EventID.
+type OutboxEvent struct {
+	ID          int        `json:"-" gorm:"primarykey"`
+	EventID     string     `json:"id" gorm:"uniqueIndex"`
+	Type        string     `json:"type"`
+	AggregateID string     `json:"aggregate_id"`
+	UserID      int        `json:"user_id" gorm:"index"`
+	Payload     string     `json:"payload"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PublishedAt *time.Time `json:"published_at,omitempty" gorm:"index"`
+	Attempts    int        `json:"-"`
+	LastError   string     `json:"-"`
+	// ClaimedUntil - до какого момента событие не выбирается relay: оно отправляется
+	// другим экземпляром или ждет повтора после ошибки.
+	ClaimedUntil *time.Time `json:"-" gorm:"index"`
+	// FailedAt - событие исчерпало попытки и отложено в dead-letter.
+	FailedAt *time.Time `json:"-" gorm:"index"`
+}
+
+type userRegisteredPayload struct {
+	ID    int    `json:"id"`
+	Login string `json:"login"`
+}
+
+// NewOrderStatusEvent возвращает событие для перехода заказа в конечный статус
+// или nil, если для этого статуса событий нет.
+func NewOrderStatusEvent(order Order) *OutboxEvent {
+	switch order.Status {
+	case OrderStatusProcessed:
+		return newOutboxEvent(EventOrderAccrued, order.Number, order.UserID, order)
+	case OrderStatusInvalid:
+		return newOutboxEvent(EventOrderInvalidated, order.Number, order.UserID, order)
+	}
+	return nil
+}
+
+func NewPointsWithdrawnEvent(withdrawn Withdrawn) *OutboxEvent {
+	return newOutboxEvent(EventPointsWithdrawn, withdrawn.OrderNumber, withdrawn.UserID, withdrawn)
+}
+
+func NewPointsRefundedEvent(entry LedgerEntry) *OutboxEvent {
+	return newOutboxEvent(EventPointsRefunded, entry.OrderNumber, entry.UserID, entry)
+}
+
+func NewUserRegisteredEvent(user User) *OutboxEvent {
+	return newOutboxEvent(EventUserRegistered, strconv.Itoa(user.ID), user.ID, userRegisteredPayload{
+		ID:    user.ID,
+		Login: user.Login,
+	})
+}
+
+func newOutboxEvent(eventType string, aggregateID string, userID int, data any) *OutboxEvent {
+	// все полезные нагрузки - простые структуры, ошибки маршалинга здесь быть не может
+	payload, _ := json.Marshal(data)
+	return &OutboxEvent{
+		EventID:     uuid.NewString(),
+		Type:        eventType,
+		AggregateID: aggregateID,
+		UserID:      userID,
+		Payload:     string(payload),
+		CreatedAt:   time.Now(),
+	}
+}
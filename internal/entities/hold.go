@@ -0,0 +1,50 @@
+package entities
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	HoldStatusActive   = "ACTIVE"
+	HoldStatusCaptured = "CAPTURED"
+	HoldStatusReleased = "RELEASED"
+	HoldStatusExpired  = "EXPIRED"
+)
+
+var (
+	ErrHoldNotActive       = errors.New("hold is not active")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+)
+
+// Hold - баллы, зарезервированные под оплату заказа. Пока резерв активен, он уменьшает
+// доступный баланс. Capture превращает резерв в списание, Release и истечение срока его снимают.
+type Hold struct {
+	ID          int        `json:"id" gorm:"primarykey"`
+	UserID      int        `json:"-" gorm:"index"`
+	OrderNumber string     `json:"order"`
+	Sum         float64    `json:"sum"`
+	Captured    float64    `json:"captured,omitempty"`
+	Status      string     `json:"status" gorm:"index"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at" gorm:"index"`
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+}
+
+func NewHold(userID int, orderNumber string, sum float64, ttl time.Duration) *Hold {
+	now := time.Now()
+	return &Hold{
+		UserID:      userID,
+		OrderNumber: orderNumber,
+		Sum:         sum,
+		Status:      HoldStatusActive,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+}
+
+// IsActive - резерв еще держит баллы. Просроченный резерв не учитывается,
+// даже если фоновая задача еще не перевела его в EXPIRED.
+func (hold Hold) IsActive(now time.Time) bool {
+	return hold.Status == HoldStatusActive && hold.ExpiresAt.After(now)
+}
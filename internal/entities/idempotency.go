@@ -0,0 +1,35 @@
+package entities
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrIdempotencyKeyReused     = errors.New("idempotency key reused with different request")
+	ErrIdempotencyKeyInProgress = errors.New("request with idempotency key is in progress")
+	// ErrIdempotencyLeaseLost - ключ забрал повтор запроса, ответ владельца прежней аренды не сохраняется.
+	ErrIdempotencyLeaseLost = errors.New("idempotency key lease lost")
+)
+
+// IdempotencyRecord - запрос пользователя с заголовком Idempotency-Key и ответ на него.
+// StatusCode == 0, пока первый запрос еще выполняется. Если к LockedUntil ответ
+// так и не сохранен (экземпляр упал), ключ может забрать повтор запроса.
+// LeaseToken меняется при каждом захвате ключа: сохранить ответ или освободить ключ
+// может только текущий владелец.
+type IdempotencyRecord struct {
+	UserID      int    `gorm:"primaryKey;autoIncrement:false"`
+	Key         string `gorm:"primaryKey"`
+	Fingerprint string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"index"`
+	LockedUntil time.Time
+	LeaseToken  string
+}
+
+func (record IdempotencyRecord) IsCompleted() bool {
+	return record.StatusCode != 0
+}
@@ -0,0 +1,135 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// LedgerEntryAdjustment - ручная или автоматическая корректировка начисления по заказу.
+	LedgerEntryAdjustment = "ADJUSTMENT"
+	// LedgerEntryReversal - возврат баллов по списанию, связан с ним через WithdrawnID.
+	LedgerEntryReversal = "REVERSAL"
+	// LedgerEntryExpiry - сгорание баллов, начисленных по заказу OrderNumber.
+	LedgerEntryExpiry = "EXPIRY"
+	// LedgerEntryTierBonus - надбавка к начислению по заказу по множителю уровня пользователя.
+	LedgerEntryTierBonus = "TIER_BONUS"
+	// LedgerEntryPromo - бонус по правилу PromoRuleID за заказ OrderNumber.
+	LedgerEntryPromo = "PROMO"
+	// LedgerEntryReferral - бонус за приглашение ReferralID, у приглашенного связан с его первым заказом.
+	LedgerEntryReferral = "REFERRAL"
+)
+
+const (
+	ReversalReasonOrderCancelled = "order_cancelled"
+	ReversalReasonOrderReturned  = "order_returned"
+	ReversalReasonPartialReturn  = "partial_return"
+	ReversalReasonDuplicate      = "duplicate_charge"
+	ReversalReasonSupport        = "support"
+)
+
+var ReversalReasons = []string{
+	ReversalReasonOrderCancelled,
+	ReversalReasonOrderReturned,
+	ReversalReasonPartialReturn,
+	ReversalReasonDuplicate,
+	ReversalReasonSupport,
+}
+
+var (
+	ErrReversalExceedsWithdrawn = errors.New("reversal exceeds withdrawn sum")
+	ErrReconciliationInProgress = errors.New("reconciliation is already running")
+)
+
+// LedgerEntry - движение баллов сверх начислений по заказам и списаний.
+// Amount со знаком: положительное увеличивает баланс, отрицательное уменьшает.
+type LedgerEntry struct {
+	ID          int       `json:"id" gorm:"primarykey"`
+	UserID      int       `json:"-" gorm:"index"`
+	Type        string    `json:"type"`
+	Amount      float64   `json:"amount"`
+	OrderNumber string    `json:"order,omitempty" gorm:"index"`
+	WithdrawnID *int      `json:"withdrawn_id,omitempty" gorm:"index"`
+	PromoRuleID *int      `json:"promo_rule_id,omitempty"`
+	ReferralID  *int      `json:"referral_id,omitempty"`
+	Reason      string    `json:"reason"`
+	CreatedAt   time.Time `json:"created_at"`
+	// DedupKey - уникальный ключ начисления, которое должно произойти один раз,
+	// повторная запись с тем же ключом считается уже примененной.
+	DedupKey *string `json:"-" gorm:"uniqueIndex"`
+}
+
+// NewDedupKey собирает DedupKey из типа записи и того, за что она начислена.
+func NewDedupKey(entryType string, parts ...any) *string {
+	key := entryType
+	for _, part := range parts {
+		key += ":" + fmt.Sprint(part)
+	}
+	key = strings.ToLower(key)
+	return &key
+}
+
+func NewReversalEntry(withdrawn Withdrawn, amount float64, reason string) *LedgerEntry {
+	return &LedgerEntry{
+		UserID:      withdrawn.UserID,
+		Type:        LedgerEntryReversal,
+		Amount:      amount,
+		OrderNumber: withdrawn.OrderNumber,
+		WithdrawnID: &withdrawn.ID,
+		Reason:      reason,
+		CreatedAt:   time.Now(),
+	}
+}
+
+// ReverseWithdrawnRequest - возврат баллов по списанию. Amount == 0 - вернуть весь остаток.
+type ReverseWithdrawnRequest struct {
+	OrderNumber string  `json:"order"`
+	Amount      float64 `json:"amount"`
+	Reason      string  `json:"reason"`
+}
+
+func (request ReverseWithdrawnRequest) Validate() error {
+	if request.OrderNumber == "" || request.Amount < 0 || !slices.Contains(ReversalReasons, request.Reason) {
+		return ErrInvalidInput
+	}
+	return nil
+}
+
+// ReconcileOptions задает, какие заказы перепроверять и нужно ли исправлять расхождения.
+type ReconcileOptions struct {
+	// Window - перепроверяются заказы, обработанные за этот период.
+	Window time.Duration
+	// SampleRate - доля заказов в выборке, от 0 до 1, 0 и 1 означают все заказы.
+	SampleRate float64
+	// Correct включает корректирующие записи в ledger, Reason сохраняется в каждой записи.
+	Correct bool
+	Reason  string
+}
+
+// ReconciliationMismatch - расхождение сохраненного начисления с тем, что сейчас отдает система начислений.
+// Stored учитывает уже проведенные корректировки. TierBonusDelta - на сколько при этом
+// меняется надбавка по уровню, начисленная пропорционально заказу.
+type ReconciliationMismatch struct {
+	OrderNumber    string  `json:"order"`
+	UserID         int     `json:"user_id"`
+	Status         string  `json:"status"`
+	Stored         float64 `json:"stored"`
+	Actual         float64 `json:"actual"`
+	Delta          float64 `json:"delta"`
+	TierBonusDelta float64 `json:"tier_bonus_delta,omitempty"`
+	Corrected      bool    `json:"corrected"`
+}
+
+type ReconciliationReport struct {
+	StartedAt  time.Time                `json:"started_at"`
+	FinishedAt time.Time                `json:"finished_at"`
+	Window     string                   `json:"window"`
+	Checked    int                      `json:"checked"`
+	Skipped    int                      `json:"skipped"`
+	Errors     int                      `json:"errors"`
+	Corrected  int                      `json:"corrected"`
+	Mismatches []ReconciliationMismatch `json:"mismatches"`
+}
@@ -0,0 +1,81 @@
+package entities
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	SortDesc = "desc"
+	SortAsc  = "asc"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// ListQuery описывает выборку списка: фильтры, сортировку по времени и keyset-пагинацию.
+// Нулевое значение означает "все записи, новые сначала".
+type ListQuery struct {
+	Limit    int
+	After    *ListCursor
+	Statuses []string
+	From     time.Time
+	To       time.Time
+	Sort     string
+}
+
+func (query ListQuery) IsDesc() bool {
+	return query.Sort != SortAsc
+}
+
+// Direction возвращает направление сортировки, пустое Sort означает SortDesc.
+func (query ListQuery) Direction() string {
+	if query.IsDesc() {
+		return SortDesc
+	}
+	return SortAsc
+}
+
+// ListCursor указывает на последнюю отданную запись: время сортировки и ключ записи.
+// Sort - направление выборки, с которой получен курсор: с другим направлением курсор
+// указывает не туда, и страницы пропускают или повторяют записи.
+type ListCursor struct {
+	Time time.Time
+	Key  string
+	Sort string
+}
+
+func (cursor ListCursor) Encode() string {
+	raw := cursor.Sort + "|" + cursor.Time.UTC().Format(time.RFC3339Nano) + "|" + cursor.Key
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeListCursor(value string) (*ListCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	sort, rest, _ := strings.Cut(string(raw), "|")
+	if sort != SortAsc && sort != SortDesc {
+		return nil, ErrInvalidCursor
+	}
+	timePart, key, found := strings.Cut(rest, "|")
+	if !found || key == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, timePart)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &ListCursor{
+		Time: t,
+		Key:  key,
+		Sort: sort,
+	}, nil
+}
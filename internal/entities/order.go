@@ -1,20 +1,140 @@
 package entities
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+// OrderEventsChannel - канал Postgres NOTIFY, через который все экземпляры узнают об изменениях заказов.
+const OrderEventsChannel = "order_events"
+
+// ErrOrderBusy - заказ сейчас проверяет другой экземпляр или он ждет повтора после ошибки.
+var ErrOrderBusy = errors.New("order is being checked")
 
 type Order struct {
-	Number    string    `json:"number" gorm:"primarykey;autoIncrement:false"`
-	UserID    int       `json:"-" gorm:"index"`
-	Status    string    `json:"status"`
-	Accrual   float64   `json:"accrual,omitempty"`
-	UpdatedAt time.Time `json:"uploaded_at"`
+	Number      string     `json:"number" gorm:"primarykey;autoIncrement:false"`
+	UserID      int        `json:"-" gorm:"index"`
+	Status      string     `json:"status"`
+	Accrual     float64    `json:"accrual,omitempty"`
+	UploadedAt  time.Time  `json:"uploaded_at" gorm:"index"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+	// CheckErrors - число подряд неудачных запросов в систему начислений,
+	// пока оно не нулевое, заказ опрашивается не раньше NextCheckAt.
+	CheckErrors    int        `json:"-"`
+	LastCheckError string     `json:"-"`
+	NextCheckAt    *time.Time `json:"-" gorm:"index"`
+	// ClaimedBy и ClaimedUntil - аренда заказа экземпляром поллера, истекшая аренда
+	// позволяет другому экземпляру забрать заказ.
+	ClaimedBy    string     `json:"-"`
+	ClaimedUntil *time.Time `json:"-" gorm:"index"`
 }
 
 func NewOrder(number string, userID int) *Order {
+	now := time.Now()
 	return &Order{
-		Number:    number,
-		UserID:    userID,
-		Status:    OrderStatusNew,
-		UpdatedAt: time.Now(),
+		Number:     number,
+		UserID:     userID,
+		Status:     OrderStatusNew,
+		UploadedAt: now,
+		UpdatedAt:  now,
+	}
+}
+
+// IsFinal сообщает, что статус заказа больше не изменится.
+func (order Order) IsFinal() bool {
+	return slices.Contains([]string{OrderStatusInvalid, OrderStatusProcessed}, order.Status)
+}
+
+func (order Order) Cursor() ListCursor {
+	return ListCursor{
+		Time: order.UploadedAt,
+		Key:  order.Number,
+	}
+}
+
+// OrderChange - новое состояние заказа и порожденные им записи. Сохраняется одной транзакцией,
+// Ledger, Tier и Referral применяются, только если статус заказа действительно изменился,
+// поэтому повторное сохранение того же перехода бонусы не задваивает.
+type OrderChange struct {
+	Order    Order
+	Ledger   []*LedgerEntry
+	Tier     *TierChange
+	Referral *ReferralReward
+}
+
+// OrderCheckFailure - заказ, который не удается проверить в системе начислений, для админки.
+type OrderCheckFailure struct {
+	Number         string     `json:"number"`
+	UserID         int        `json:"user_id"`
+	Status         string     `json:"status"`
+	CheckErrors    int        `json:"check_errors"`
+	LastCheckError string     `json:"last_check_error"`
+	NextCheckAt    *time.Time `json:"next_check_at,omitempty"`
+}
+
+func NewOrderCheckFailure(order Order) OrderCheckFailure {
+	return OrderCheckFailure{
+		Number:         order.Number,
+		UserID:         order.UserID,
+		Status:         order.Status,
+		CheckErrors:    order.CheckErrors,
+		LastCheckError: order.LastCheckError,
+		NextCheckAt:    order.NextCheckAt,
+	}
+}
+
+// OrderStatusChange - запись истории статусов заказа.
+type OrderStatusChange struct {
+	ID          int       `json:"-" gorm:"primarykey"`
+	OrderNumber string    `json:"-" gorm:"index"`
+	Status      string    `json:"status"`
+	Accrual     float64   `json:"accrual,omitempty"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+func NewOrderStatusChange(order Order) *OrderStatusChange {
+	return &OrderStatusChange{
+		OrderNumber: order.Number,
+		Status:      order.Status,
+		Accrual:     order.Accrual,
+		ChangedAt:   order.UpdatedAt,
+	}
+}
+
+type OrderDetails struct {
+	Order
+	History []*OrderStatusChange `json:"history"`
+}
+
+// OrderEvent - изменение заказа для потока пользователя. ID монотонно растет и пригоден как Last-Event-ID.
+type OrderEvent struct {
+	ID     int64 `json:"id"`
+	UserID int   `json:"-"`
+	Order  Order `json:"order"`
+}
+
+// orderNotification - OrderEvent в канале NOTIFY: владелец заказа в JSON заказа не попадает.
+type orderNotification struct {
+	ID     int64 `json:"id"`
+	UserID int   `json:"user_id"`
+	Order  Order `json:"order"`
+}
+
+// Notification кодирует событие для OrderEventsChannel.
+func (event OrderEvent) Notification() (string, error) {
+	payload, err := json.Marshal(orderNotification(event))
+	return string(payload), err
+}
+
+// ParseOrderNotification разбирает событие, полученное из OrderEventsChannel.
+func ParseOrderNotification(payload string) (OrderEvent, error) {
+	var notification orderNotification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		return OrderEvent{}, err
 	}
+	notification.Order.UserID = notification.UserID
+	return OrderEvent(notification), nil
 }
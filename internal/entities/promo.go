@@ -0,0 +1,64 @@
+package entities
+
+import (
+	"slices"
+	"time"
+)
+
+// PromoRule - собственная бонусная кампания Gophermart поверх начислений системы начислений.
+// Правило срабатывает, когда заказ переходит в PROCESSED и выполнены все заданные условия:
+// дата обработки в [StartsAt, EndsAt), уровень пользователя из Tiers, первый обработанный заказ.
+// Пустое условие не проверяется.
+type PromoRule struct {
+	ID             int        `json:"id" gorm:"primarykey"`
+	Name           string     `json:"name"`
+	RewardType     string     `json:"reward_type"`
+	Reward         float64    `json:"reward"`
+	StartsAt       *time.Time `json:"starts_at,omitempty"`
+	EndsAt         *time.Time `json:"ends_at,omitempty"`
+	Tiers          []string   `json:"tiers,omitempty" gorm:"serializer:json"`
+	FirstOrderOnly bool       `json:"first_order_only"`
+	Active         bool       `json:"active"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+func (rule PromoRule) Validate() error {
+	if rule.Name == "" || rule.Reward <= 0 || !slices.Contains([]string{RewardTypePercent, RewardTypePoint}, rule.RewardType) {
+		return ErrInvalidInput
+	}
+	if rule.StartsAt != nil && rule.EndsAt != nil && !rule.EndsAt.After(*rule.StartsAt) {
+		return ErrInvalidInput
+	}
+	return nil
+}
+
+// PromoContext - данные заказа и пользователя, по которым проверяются условия правил.
+type PromoContext struct {
+	ProcessedAt time.Time
+	Tier        string
+	FirstOrder  bool
+}
+
+func (rule PromoRule) Matches(promo PromoContext) bool {
+	switch {
+	case !rule.Active:
+		return false
+	case rule.StartsAt != nil && promo.ProcessedAt.Before(*rule.StartsAt):
+		return false
+	case rule.EndsAt != nil && !promo.ProcessedAt.Before(*rule.EndsAt):
+		return false
+	case len(rule.Tiers) > 0 && !slices.Contains(rule.Tiers, promo.Tier):
+		return false
+	case rule.FirstOrderOnly && !promo.FirstOrder:
+		return false
+	}
+	return true
+}
+
+// Bonus - бонус по правилу: процент от начисления системы начислений или фиксированные баллы.
+func (rule PromoRule) Bonus(accrual float64) float64 {
+	if rule.RewardType == RewardTypePercent {
+		return accrual * rule.Reward / 100
+	}
+	return rule.Reward
+}
@@ -0,0 +1,23 @@
+package entities
+
+import "time"
+
+// Причины, по которым ответ системы начислений не применяется к заказу.
+const (
+	QuarantineReasonMalformed        = "malformed_response"
+	QuarantineReasonUnknownStatus    = "unknown_status"
+	QuarantineReasonMissingAccrual   = "missing_accrual"
+	QuarantineReasonNegativeAccrual  = "negative_accrual"
+	QuarantineReasonWrongOrderNumber = "wrong_order_number"
+)
+
+// QuarantinedResponse - ответ системы начислений, отложенный на ручной разбор.
+type QuarantinedResponse struct {
+	ID          int        `json:"id" gorm:"primarykey"`
+	OrderNumber string     `json:"order" gorm:"index"`
+	UserID      int        `json:"user_id"`
+	Reason      string     `json:"reason"`
+	Payload     string     `json:"payload"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty" gorm:"index"`
+}
@@ -0,0 +1,155 @@
+package entities
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	ReferralStatusPending  = "PENDING"
+	ReferralStatusRewarded = "REWARDED"
+	ReferralStatusRejected = "REJECTED"
+)
+
+// Причины, по которым приглашение закрывается без бонусов.
+const (
+	ReferralRejectSelf         = "self_referral"
+	ReferralRejectSameIP       = "duplicate_signup_ip"
+	ReferralRejectRate         = "referrer_rate_limited"
+	ReferralRejectLimit        = "referrer_limit_reached"
+	ReferralRejectOrderAccrual = "order_accrual_below_minimum"
+)
+
+var (
+	ErrReferralCodeNotFound = fmt.Errorf("%w: unknown referral code", ErrInvalidInput)
+	ErrReferralClosed       = errors.New("referral is already closed")
+)
+
+// ReferralCode - код, по которому пользователь UserID приглашает новых пользователей.
+type ReferralCode struct {
+	UserID int    `gorm:"primarykey;autoIncrement:false"`
+	Code   string `gorm:"uniqueIndex"`
+	// Login - логин владельца кода, с ним сравниваются логины приглашенных.
+	Login string
+	// IP - адрес, с которого пользователь получил код.
+	IP        string
+	CreatedAt time.Time
+}
+
+// UserIP - адрес, с которого пользователь регистрировался, входил или получал реферальный код.
+type UserIP struct {
+	UserID     int    `gorm:"primarykey;autoIncrement:false"`
+	IP         string `gorm:"primarykey"`
+	LastSeenAt time.Time
+}
+
+// Referral - приглашение пользователя RefereeID пользователем ReferrerID. Пользователя можно
+// пригласить только один раз, при регистрации. Бонусы обоим начисляются за первый обработанный
+// заказ приглашенного, после чего приглашение закрывается.
+type Referral struct {
+	ID            int        `json:"-" gorm:"primarykey"`
+	ReferrerID    int        `json:"-" gorm:"index"`
+	RefereeID     int        `json:"-" gorm:"uniqueIndex"`
+	RefereeLogin  string     `json:"login"`
+	Status        string     `json:"status"`
+	RejectReason  string     `json:"reject_reason,omitempty"`
+	OrderNumber   string     `json:"-"`
+	ReferrerBonus float64    `json:"bonus"`
+	RefereeBonus  float64    `json:"-"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ClosedAt      *time.Time `json:"closed_at,omitempty"`
+	// SignupIP - адрес, с которого зарегистрировался приглашенный.
+	SignupIP string `json:"-"`
+}
+
+func NewReferral(referrerID int, referee User, signupIP string) *Referral {
+	return &Referral{
+		ReferrerID:   referrerID,
+		RefereeID:    referee.ID,
+		RefereeLogin: referee.Login,
+		Status:       ReferralStatusPending,
+		CreatedAt:    time.Now(),
+		SignupIP:     signupIP,
+	}
+}
+
+// ReferralLimits - ограничения против накруток, проверяются при сохранении приглашения
+// под блокировкой кода пригласившего.
+type ReferralLimits struct {
+	// MaxPerDay - сколько пользователей можно пригласить за сутки, 0 - без ограничения.
+	MaxPerDay int
+}
+
+// Check возвращает причину отказа для нового приглашения или пустую строку.
+// code - код пригласившего, referrerIPs - все известные его адреса, existing - его прежние приглашения.
+func (limits ReferralLimits) Check(referral Referral, code *ReferralCode, referrerIPs []string, existing []*Referral) string {
+	if code != nil && sameLogin(code.Login, referral.RefereeLogin) {
+		return ReferralRejectSelf
+	}
+	if referral.SignupIP != "" {
+		if (code != nil && code.IP == referral.SignupIP) || slices.Contains(referrerIPs, referral.SignupIP) {
+			return ReferralRejectSelf
+		}
+		for _, exist := range existing {
+			if exist.SignupIP == referral.SignupIP {
+				return ReferralRejectSameIP
+			}
+		}
+	}
+	if limits.MaxPerDay > 0 {
+		since := referral.CreatedAt.Add(-24 * time.Hour)
+		invited := 0
+		for _, exist := range existing {
+			if exist.CreatedAt.After(since) {
+				invited++
+			}
+		}
+		if invited >= limits.MaxPerDay {
+			return ReferralRejectRate
+		}
+	}
+	return ""
+}
+
+// sameLogin сравнивает логины без учета регистра, цифр и знаков: "Bob.Smith" и "bobsmith2"
+// считаются одним пользователем.
+func sameLogin(a, b string) bool {
+	letters := func(login string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, login)
+	}
+	a, b = letters(a), letters(b)
+	return a != "" && a == b
+}
+
+// Reject закрывает приглашение без бонусов.
+func (referral *Referral) Reject(reason string) {
+	referral.Status = ReferralStatusRejected
+	referral.RejectReason = reason
+	referral.ReferrerBonus = 0
+	referral.RefereeBonus = 0
+}
+
+// ReferralReward - закрытие приглашения первым обработанным заказом приглашенного.
+// Лимит MaxRewards проверяется при сохранении под блокировкой кода пригласившего:
+// если лимит исчерпан, приглашение отклоняется и Ledger не записывается.
+type ReferralReward struct {
+	Referral   Referral
+	Ledger     []*LedgerEntry
+	MaxRewards int
+}
+
+// ReferralSummary - код пользователя, приглашенные им пользователи и заработанные бонусы.
+type ReferralSummary struct {
+	Code      string      `json:"code"`
+	Earned    float64     `json:"earned"`
+	Referrals []*Referral `json:"referrals"`
+}
@@ -0,0 +1,99 @@
+package entities
+
+import "time"
+
+const (
+	tierBonusReason = "tier multiplier"
+)
+
+// Tier - уровень программы лояльности. Пользователь получает уровень с наибольшим Threshold,
+// не превышающим сумму его начислений за все время. Multiplier применяется к начислениям,
+// если множители включены.
+type Tier struct {
+	Name       string  `json:"name" gorm:"primarykey"`
+	Threshold  float64 `json:"threshold"`
+	Multiplier float64 `json:"multiplier"`
+}
+
+// DefaultTiers используются, пока таблица уровней пуста.
+var DefaultTiers = []Tier{
+	{Name: "bronze", Threshold: 0, Multiplier: 1},
+	{Name: "silver", Threshold: 1000, Multiplier: 1.05},
+	{Name: "gold", Threshold: 5000, Multiplier: 1.1},
+	{Name: "platinum", Threshold: 20000, Multiplier: 1.2},
+}
+
+// UserTier - уровень пользователя, пересчитывается при каждом обработанном заказе.
+type UserTier struct {
+	UserID          int `gorm:"primaryKey;autoIncrement:false"`
+	Tier            string
+	LifetimeAccrual float64
+	UpdatedAt       time.Time
+}
+
+// TierChange - вклад обработанного заказа в уровень пользователя. Применяется в транзакции
+// изменения заказа под блокировкой пользователя: Apply получает сумму начислений до заказа,
+// прочитанную в этой же транзакции, поэтому параллельные заказы не теряют начисления друг друга.
+type TierChange struct {
+	Order Order
+	Tiers []Tier
+	// Multiplier включает надбавку по уровню, который был у пользователя до заказа.
+	Multiplier bool
+}
+
+// Apply возвращает уровень пользователя после заказа и надбавку к заказу, если она положена.
+func (change TierChange) Apply(before float64) (UserTier, *LedgerEntry) {
+	order := change.Order
+	lifetime := before + order.Accrual
+
+	var bonus *LedgerEntry
+	if change.Multiplier && order.Accrual > 0 {
+		bonus = NewTierBonus(order, FindTier(change.Tiers, before))
+	}
+	return UserTier{
+		UserID:          order.UserID,
+		Tier:            FindTier(change.Tiers, lifetime).Name,
+		LifetimeAccrual: lifetime,
+		UpdatedAt:       time.Now(),
+	}, bonus
+}
+
+// NewTierBonus возвращает надбавку к начислению по заказу или nil, если у уровня нет множителя.
+func NewTierBonus(order Order, tier Tier) *LedgerEntry {
+	if tier.Multiplier <= 1 {
+		return nil
+	}
+	return &LedgerEntry{
+		UserID:      order.UserID,
+		Type:        LedgerEntryTierBonus,
+		Amount:      order.Accrual * (tier.Multiplier - 1),
+		OrderNumber: order.Number,
+		Reason:      tierBonusReason + " " + tier.Name,
+		CreatedAt:   time.Now(),
+		DedupKey:    NewDedupKey(LedgerEntryTierBonus, order.Number),
+	}
+}
+
+// FindTier возвращает уровень для суммы начислений, tiers отсортированы по возрастанию порога.
+func FindTier(tiers []Tier, lifetime float64) Tier {
+	tier := tiers[0]
+	for _, next := range tiers[1:] {
+		if lifetime < next.Threshold {
+			break
+		}
+		tier = next
+	}
+	return tier
+}
+
+// TierProgress - текущий уровень пользователя и сколько осталось до следующего.
+type TierProgress struct {
+	Tier            string  `json:"tier"`
+	Multiplier      float64 `json:"multiplier"`
+	LifetimeAccrual float64 `json:"lifetime_accrual"`
+	NextTier        string  `json:"next_tier,omitempty"`
+	NextThreshold   float64 `json:"next_threshold,omitempty"`
+	Remaining       float64 `json:"remaining,omitempty"`
+	// Progress - доля пути от порога текущего уровня до следующего, 1 на последнем уровне.
+	Progress float64 `json:"progress"`
+}
@@ -0,0 +1,68 @@
+package entities
+
+import "time"
+
+const (
+	WebhookEventOrderProcessed   = "order.processed"
+	WebhookEventOrderInvalid     = "order.invalid"
+	WebhookEventWithdrawnCreated = "withdrawal.created"
+	WebhookEventWithdrawnRefund  = "withdrawal.refunded"
+)
+
+const (
+	WebhookDeliveryStatusPending   = "pending"
+	WebhookDeliveryStatusDelivered = "delivered"
+	WebhookDeliveryStatusDead      = "dead"
+)
+
+var WebhookEvents = []string{
+	WebhookEventOrderProcessed,
+	WebhookEventOrderInvalid,
+	WebhookEventWithdrawnCreated,
+	WebhookEventWithdrawnRefund,
+}
+
+// Webhook - адрес, на который отправляются события. UserID == 0 у вебхуков,
+// созданных администратором: они получают события всех пользователей.
+type Webhook struct {
+	ID        int       `json:"id" gorm:"primarykey"`
+	UserID    int       `json:"-" gorm:"index"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events" gorm:"serializer:json"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery - запись исходящей очереди: одно событие для одного вебхука.
+type WebhookDelivery struct {
+	ID             int        `json:"id" gorm:"primarykey"`
+	WebhookID      int        `json:"webhook_id" gorm:"index;uniqueIndex:idx_webhook_delivery_event,priority:2"`
+	UserID         int        `json:"-" gorm:"index"`
+	EventID        string     `json:"event_id" gorm:"uniqueIndex:idx_webhook_delivery_event,priority:1"`
+	EventType      string     `json:"event_type"`
+	Payload        string     `json:"payload"`
+	Status         string     `json:"status" gorm:"index:idx_webhook_delivery_due,priority:1"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" gorm:"index:idx_webhook_delivery_due,priority:2"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// WebhookDeliveryFilter ограничивает выборку доставок. UserID == nil - доставки всех пользователей.
+type WebhookDeliveryFilter struct {
+	UserID  *int
+	Status  string
+	EventID string
+	Limit   int
+}
+
+// WebhookEvent - тело запроса, отправляемого на вебхук.
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
@@ -1,13 +1,36 @@
 package entities
 
-import "time"
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrWithdrawnConflict = errors.New("withdrawal order number already used")
+)
+
+const (
+	WithdrawnConflictWithdrawn    = "already_withdrawn"
+	WithdrawnConflictAccrualOrder = "accrual_order_of_another_user"
+)
 
 type Withdrawn struct {
 	ID          int       `json:"-" gorm:"primarykey"`
 	UserID      int       `json:"-" gorm:"index"`
-	OrderNumber string    `json:"order"`
+	OrderNumber string    `json:"order" gorm:"uniqueIndex"`
 	Sum         float64   `json:"sum"`
 	ProccesedAt time.Time `json:"processed_at"`
+	// Refunded и Reversals заполняются при выдаче истории из записей ledger.
+	Refunded  float64             `json:"refunded,omitempty" gorm:"-"`
+	Reversals []WithdrawnReversal `json:"reversals,omitempty" gorm:"-"`
+}
+
+// WithdrawnReversal - возврат баллов по списанию в истории пользователя.
+type WithdrawnReversal struct {
+	Amount    float64   `json:"amount"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 func NewWithdrawn(userID int, orderID string, sum float64) *Withdrawn {
@@ -17,3 +40,50 @@ func NewWithdrawn(userID int, orderID string, sum float64) *Withdrawn {
 		Sum:         sum,
 	}
 }
+
+// CanRefund проверяет, что с учетом уже возвращенного refunded можно вернуть еще amount.
+func (withdrawn Withdrawn) CanRefund(refunded float64, amount float64) bool {
+	// суммы хранятся во float, сравниваем с допуском на погрешность округления
+	return amount > 0 && refunded+amount <= withdrawn.Sum+1e-9
+}
+
+// AddReversal учитывает возврат в истории списания.
+func (withdrawn *Withdrawn) AddReversal(entry LedgerEntry) {
+	withdrawn.Refunded += entry.Amount
+	withdrawn.Reversals = append(withdrawn.Reversals, WithdrawnReversal{
+		Amount:    entry.Amount,
+		Reason:    entry.Reason,
+		CreatedAt: entry.CreatedAt,
+	})
+}
+
+func (withdrawn Withdrawn) Cursor() ListCursor {
+	return ListCursor{
+		Time: withdrawn.ProccesedAt,
+		Key:  strconv.Itoa(withdrawn.ID),
+	}
+}
+
+// WithdrawnConflictError - номер заказа уже использован. Сумма и время списания
+// раскрываются только владельцу списания.
+type WithdrawnConflictError struct {
+	OrderNumber string     `json:"order"`
+	Reason      string     `json:"reason"`
+	Sum         *float64   `json:"sum,omitempty"`
+	ProccesedAt *time.Time `json:"processed_at,omitempty"`
+}
+
+func NewWithdrawnConflictError(orderNumber string, reason string) *WithdrawnConflictError {
+	return &WithdrawnConflictError{
+		OrderNumber: orderNumber,
+		Reason:      reason,
+	}
+}
+
+func (err *WithdrawnConflictError) Error() string {
+	return ErrWithdrawnConflict.Error() + ": " + err.Reason
+}
+
+func (err *WithdrawnConflictError) Is(target error) bool {
+	return target == ErrWithdrawnConflict
+}
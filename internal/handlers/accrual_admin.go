@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+// GetOrderCheckFailures показывает администратору заказы, которые не удается проверить в системе начислений.
+func (handler Handler) GetOrderCheckFailures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, handler.LoyaltyService.GetOrderCheckFailures(r.Context()))
+}
+
+// GetQuarantinedResponses показывает неразобранные невалидные ответы системы начислений.
+func (handler Handler) GetQuarantinedResponses(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, handler.LoyaltyService.GetQuarantinedResponses(r.Context()))
+}
+
+func (handler Handler) ResolveQuarantinedResponse(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = handler.LoyaltyService.ResolveQuarantinedResponse(r.Context(), id)
+	if errors.Is(err, entities.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Get().Warn("resolve quarantined response error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type reconcileRequest struct {
+	Window     string  `json:"window"`
+	SampleRate float64 `json:"sample_rate"`
+	Correct    bool    `json:"correct"`
+	Reason     string  `json:"reason"`
+}
+
+// Reconcile запускает внеочередную сверку в фоне, отчет потом отдает GetReconciliationReport.
+func (handler Handler) Reconcile(w http.ResponseWriter, r *http.Request) {
+	var input reconcileRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	window, err := time.ParseDuration(input.Window)
+	if err != nil || window <= 0 || input.SampleRate < 0 || input.SampleRate > 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = handler.LoyaltyService.StartReconcile(r.Context(), entities.ReconcileOptions{
+		Window:     window,
+		SampleRate: input.SampleRate,
+		Correct:    input.Correct,
+		Reason:     input.Reason,
+	})
+	if errors.Is(err, entities.ErrInvalidInput) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, entities.ErrReconciliationInProgress) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.Get().Warn("reconcile error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (handler Handler) GetReconciliationReport(w http.ResponseWriter, r *http.Request) {
+	report := handler.LoyaltyService.GetReconciliationReport(r.Context())
+	if report == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"time"
@@ -45,15 +46,18 @@ func (handler Handler) ChangeBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	balance := handler.LoyaltyService.GetUserBalance(user.ID)
-	if balance.Current < withdrawn.Sum {
+	withdrawn.UserID = user.ID
+	withdrawn.ProccesedAt = time.Now()
+	err = handler.LoyaltyService.SaveWithdrawn(r.Context(), withdrawn)
+	var conflict *entities.WithdrawnConflictError
+	if errors.As(err, &conflict) {
+		writeJSON(w, http.StatusConflict, conflict)
+		return
+	}
+	if errors.Is(err, entities.ErrInsufficientBalance) {
 		w.WriteHeader(http.StatusPaymentRequired)
 		return
 	}
-
-	withdrawn.UserID = user.ID
-	withdrawn.ProccesedAt = time.Now()
-	err = handler.LoyaltyService.SaveWithdrawn(withdrawn)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -15,7 +15,7 @@ func (handler Handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	balance := handler.LoyaltyService.GetUserBalance(user.ID)
+	balance := handler.LoyaltyService.GetUserBalance(r.Context(), user.ID)
 	body, err := json.Marshal(balance)
 	if err != nil {
 		logger.Get().Warn("json marshal error", zap.String("error", err.Error()))
@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 
 	"github.com/besean163/gophermart/internal/logger"
 	"go.uber.org/zap"
@@ -15,7 +16,19 @@ func (handler Handler) GetBalanceHistory(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	withdrawns := handler.LoyaltyService.GetUserWithdrawals(user.ID)
+	query, err := parseListQuery(r, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if query.After != nil {
+		if _, err := strconv.Atoi(query.After.Key); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	withdrawns, nextCursor := handler.LoyaltyService.GetUserWithdrawals(r.Context(), user.ID, query)
 	if withdrawns == nil {
 		logger.Get().Warn("nil withdrawns", zap.String("error", "nil withdrawns"))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -33,6 +46,7 @@ func (handler Handler) GetBalanceHistory(w http.ResponseWriter, r *http.Request)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	setNextCursor(w, nextCursor)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(body)
 }
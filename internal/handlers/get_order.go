@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+func (handler Handler) GetOrder(w http.ResponseWriter, r *http.Request) {
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	number := chi.URLParam(r, "number")
+	details := handler.LoyaltyService.GetOrderDetails(r.Context(), number)
+	// чужой заказ не отличаем от несуществующего
+	if details == nil || details.UserID != user.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("refresh") == "true" && !details.IsFinal() {
+		allowed, wait := handler.refreshLimiter.Allow(user.ID)
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		err = handler.LoyaltyService.RefreshOrder(r.Context(), number)
+		if errors.Is(err, entities.ErrOrderBusy) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger.Get().Warn("refresh order error", zap.String("order", number), zap.String("error", err.Error()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		details = handler.LoyaltyService.GetOrderDetails(r.Context(), number)
+	}
+
+	body, err := json.Marshal(details)
+	if err != nil {
+		logger.Get().Warn("json marshal error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/besean163/gophermart/internal/entities"
 	"github.com/besean163/gophermart/internal/logger"
 	"go.uber.org/zap"
 )
@@ -15,7 +16,18 @@ func (handler Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orders := handler.LoyaltyService.GetUserOrders(user.ID)
+	query, err := parseListQuery(r, []string{
+		entities.OrderStatusNew,
+		entities.OrderStatusProcessing,
+		entities.OrderStatusInvalid,
+		entities.OrderStatusProcessed,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	orders, nextCursor := handler.LoyaltyService.GetUserOrders(r.Context(), user.ID, query)
 	if len(orders) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return
@@ -27,6 +39,7 @@ func (handler Handler) GetOrders(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	setNextCursor(w, nextCursor)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(body)
 }
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/besean163/gophermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+func (handler Handler) GetReferrals(w http.ResponseWriter, r *http.Request) {
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	summary, err := handler.LoyaltyService.GetUserReferrals(r.Context(), *user, clientIP(r))
+	if err != nil {
+		logger.Get().Warn("get referrals error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,15 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+func (handler Handler) GetTier(w http.ResponseWriter, r *http.Request) {
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, handler.LoyaltyService.GetUserTier(r.Context(), user.ID))
+}
@@ -1,80 +1,254 @@
 package handlers
 
 import (
+	"context"
 	"errors"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
 	"github.com/go-chi/chi/v5"
 )
 
+const (
+	defaultRefreshInterval = 5 * time.Second
+)
+
 var (
 	ErrCannotGetUser = errors.New("can't get user by context")
 )
 
 type AuthService interface {
-	GetUser(login string) *entities.User
-	SaveUser(entities.User) error
-	BuildUserToken(entities.User) (string, error)
-	GetUserByToken(token string) (*entities.User, error)
+	GetUser(ctx context.Context, login string) *entities.User
+	SaveUser(ctx context.Context, user entities.User, onCreate func(ctx context.Context, user entities.User) error) error
+	BuildUserToken(ctx context.Context, user entities.User) (string, error)
+	GetUserByToken(ctx context.Context, token string) (*entities.User, error)
 }
 
 type LoyaltyService interface {
-	GetOrder(orderID string) *entities.Order
-	GetUserOrders(userID int) []*entities.Order
-	GetUserWithdrawals(userID int) []*entities.Withdrawn
-	GetUserBalance(userID int) entities.Balance
-	SaveOrder(entities.Order) error
-	SaveWithdrawn(entities.Withdrawn) error
+	GetOrder(ctx context.Context, orderID string) *entities.Order
+	GetOrderDetails(ctx context.Context, orderNumber string) *entities.OrderDetails
+	RefreshOrder(ctx context.Context, orderNumber string) error
+	GetUserOrders(ctx context.Context, userID int, query entities.ListQuery) ([]*entities.Order, string)
+	GetUserWithdrawals(ctx context.Context, userID int, query entities.ListQuery) ([]*entities.Withdrawn, string)
+	GetUserBalance(ctx context.Context, userID int) entities.Balance
+	GetUserTier(ctx context.Context, userID int) entities.TierProgress
+	GetUserReferrals(ctx context.Context, user entities.User, clientIP string) (entities.ReferralSummary, error)
+	RecordUserIP(ctx context.Context, userID int, ip string) error
+	FindReferrer(ctx context.Context, code string) (int, error)
+	CreateReferral(ctx context.Context, referrerID int, referee entities.User, signupIP string) error
+	SaveOrder(ctx context.Context, order entities.Order) error
+	SaveWithdrawn(ctx context.Context, withdrawn entities.Withdrawn) error
+	CreateHold(ctx context.Context, userID int, orderNumber string, sum float64) (*entities.Hold, error)
+	GetUserHolds(ctx context.Context, userID int) []*entities.Hold
+	CaptureHold(ctx context.Context, userID int, id int, sum float64) (*entities.Withdrawn, error)
+	ReleaseHold(ctx context.Context, userID int, id int) error
+	ReverseWithdrawn(ctx context.Context, request entities.ReverseWithdrawnRequest) (*entities.LedgerEntry, error)
+	GetPromoRules(ctx context.Context) []*entities.PromoRule
+	CreatePromoRule(ctx context.Context, rule entities.PromoRule) (*entities.PromoRule, error)
+	UpdatePromoRule(ctx context.Context, rule entities.PromoRule) (*entities.PromoRule, error)
+	DeletePromoRule(ctx context.Context, id int) error
+	GetOrderCheckFailures(ctx context.Context) []entities.OrderCheckFailure
+	GetQuarantinedResponses(ctx context.Context) []*entities.QuarantinedResponse
+	ResolveQuarantinedResponse(ctx context.Context, id int) error
+	StartReconcile(ctx context.Context, options entities.ReconcileOptions) error
+	GetReconciliationReport(ctx context.Context) *entities.ReconciliationReport
+}
+
+type OrderStream interface {
+	Subscribe(userID int, lastEventID int64) ([]entities.OrderEvent, <-chan entities.OrderEvent, func())
+}
+
+type WebhookService interface {
+	CreateWebhook(ctx context.Context, userID int, url string, events []string) (*entities.Webhook, error)
+	GetWebhooks(ctx context.Context, userID int) []*entities.Webhook
+	DeleteWebhook(ctx context.Context, userID int, id int) error
+	GetDeliveries(ctx context.Context, filter entities.WebhookDeliveryFilter) []*entities.WebhookDelivery
+	Redeliver(ctx context.Context, userID *int, id int) (*entities.WebhookDelivery, error)
+}
+
+type IdempotencyService interface {
+	Begin(ctx context.Context, userID int, key string, fingerprint string) (*entities.IdempotencyRecord, error)
+	Complete(ctx context.Context, userID int, key string, leaseToken string, statusCode int, contentType string, body []byte) error
+	Abort(ctx context.Context, userID int, key string, leaseToken string) error
 }
 
 type JobService interface {
-	GetNotCalcOrders() []*entities.Order
-	SaveOrder(entities.Order) error
+	GetNotCalcOrders(ctx context.Context) []*entities.Order
+	SaveOrder(ctx context.Context, order entities.Order) error
 }
 
 type Handler struct {
-	Router         *chi.Mux
-	AuthService    AuthService
-	LoyaltyService LoyaltyService
-	HashSecret     string
+	Router             *chi.Mux
+	AuthService        AuthService
+	LoyaltyService     LoyaltyService
+	HashSecret         string
+	AdminToken         string
+	OrderStream        OrderStream
+	WebhookService     WebhookService
+	IdempotencyService IdempotencyService
+	Metrics            http.Handler
+	refreshLimiter     *userRateLimiter
+	healthChecks       []healthCheck
+}
+
+type Option func(*Handler)
+
+// WithAdminToken включает /api/admin, запросы к нему должны передавать токен в X-Admin-Token.
+func WithAdminToken(token string) Option {
+	return func(handler *Handler) {
+		handler.AdminToken = token
+	}
+}
+
+// WithRefreshInterval задает, как часто пользователь может запрашивать внеочередную проверку заказа.
+func WithRefreshInterval(interval time.Duration) Option {
+	return func(handler *Handler) {
+		handler.refreshLimiter = newUserRateLimiter(interval)
+	}
+}
+
+// WithOrderStream включает /api/user/orders/stream.
+func WithOrderStream(stream OrderStream) Option {
+	return func(handler *Handler) {
+		handler.OrderStream = stream
+	}
+}
+
+// WithWebhookService включает /api/user/webhooks и /api/admin/webhooks.
+func WithWebhookService(service WebhookService) Option {
+	return func(handler *Handler) {
+		handler.WebhookService = service
+	}
+}
+
+// WithIdempotencyService включает поддержку Idempotency-Key для загрузки заказов и списаний.
+func WithIdempotencyService(service IdempotencyService) Option {
+	return func(handler *Handler) {
+		handler.IdempotencyService = service
+	}
+}
+
+// WithHealthCheck добавляет зависимость в /api/health.
+func WithHealthCheck(name string, check HealthCheck) Option {
+	return func(handler *Handler) {
+		handler.healthChecks = append(handler.healthChecks, healthCheck{name: name, check: check})
+	}
+}
+
+// WithMetrics включает /metrics.
+func WithMetrics(metrics http.Handler) Option {
+	return func(handler *Handler) {
+		handler.Metrics = metrics
+	}
 }
 
 func NewHandlers(
 	authService AuthService,
 	loyaltyService LoyaltyService,
 	hashSecret string,
+	options ...Option,
 ) Handler {
 	h := Handler{
 		Router:         chi.NewRouter(),
 		AuthService:    authService,
 		LoyaltyService: loyaltyService,
 		HashSecret:     hashSecret,
+		refreshLimiter: newUserRateLimiter(defaultRefreshInterval),
+	}
+
+	for _, option := range options {
+		option(&h)
 	}
 
 	h.mount()
 	return h
 }
 
+// RunCleanup в фоне очищает устаревшие записи лимитера внеочередных проверок, пока не отменен ctx.
+func (handler Handler) RunCleanup(ctx context.Context) {
+	go handler.refreshLimiter.run(ctx)
+}
+
 func (handler Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler.Router.ServeHTTP(w, r)
 }
 
 func (handler Handler) mount() {
+	handler.Router.Use(tracing.Middleware)
+
+	handler.Router.Get("/api/health", handler.Health)
+	if handler.Metrics != nil {
+		handler.Router.Method(http.MethodGet, "/metrics", handler.Metrics)
+	}
+
 	handler.Router.Route("/api/user", func(r chi.Router) {
 		r.Post("/login", handler.Login)
 		r.Post("/register", handler.Register)
 		r.Group(func(r chi.Router) {
 			r.Use(handler.AuthMiddleware)
 			r.Get("/orders", handler.GetOrders)
+			r.Get("/orders/stream", handler.StreamOrders)
+			r.Get("/orders/{number}", handler.GetOrder)
 			r.Get("/withdrawals", handler.GetBalanceHistory)
-			r.Post("/orders", handler.SetOrders)
+			r.Get("/tier", handler.GetTier)
+			r.Get("/referrals", handler.GetReferrals)
+			r.With(handler.IdempotencyMiddleware).Post("/orders", handler.SetOrders)
 			r.Route("/balance", func(r chi.Router) {
 				r.Get("/", handler.GetBalance)
-				r.Post("/withdraw", handler.ChangeBalance)
+				r.With(handler.IdempotencyMiddleware).Post("/withdraw", handler.ChangeBalance)
+				r.Route("/holds", func(r chi.Router) {
+					r.Get("/", handler.GetHolds)
+					r.With(handler.IdempotencyMiddleware).Post("/", handler.CreateHold)
+					r.With(handler.IdempotencyMiddleware).Post("/{id}/capture", handler.CaptureHold)
+					r.Post("/{id}/release", handler.ReleaseHold)
+				})
 			})
+			if handler.WebhookService != nil {
+				r.Route("/webhooks", handler.mountWebhooks)
+			}
 		})
 	})
+
+	handler.Router.Route("/api/admin", func(r chi.Router) {
+		r.Use(handler.AdminMiddleware)
+		r.Method(http.MethodGet, "/log/level", logger.LevelHandler())
+		r.Method(http.MethodPut, "/log/level", logger.LevelHandler())
+		r.Get("/orders/check-failures", handler.GetOrderCheckFailures)
+		r.Get("/accrual/quarantine", handler.GetQuarantinedResponses)
+		r.Post("/accrual/quarantine/{id}/resolve", handler.ResolveQuarantinedResponse)
+		r.Get("/accrual/reconciliation", handler.GetReconciliationReport)
+		r.Post("/accrual/reconciliation", handler.Reconcile)
+		r.Post("/withdrawals/{number}/reversals", handler.ReverseWithdrawn)
+		r.Get("/promo-rules", handler.GetPromoRules)
+		r.Post("/promo-rules", handler.CreatePromoRule)
+		r.Put("/promo-rules/{id}", handler.UpdatePromoRule)
+		r.Delete("/promo-rules/{id}", handler.DeletePromoRule)
+		if handler.WebhookService != nil {
+			r.Route("/webhooks", handler.mountWebhooks)
+		}
+	})
+}
+
+func (handler Handler) mountWebhooks(r chi.Router) {
+	r.Get("/", handler.GetWebhooks)
+	r.Post("/", handler.CreateWebhook)
+	r.Delete("/{id}", handler.DeleteWebhook)
+	r.Get("/deliveries", handler.GetWebhookDeliveries)
+	r.Post("/deliveries/{id}/redeliver", handler.RedeliverWebhook)
+}
+
+// clientIP - адрес клиента без порта. Адрес берется из соединения, а не из заголовков,
+// которые клиент может подделать.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
 
 func getRequestUser(r *http.Request) (*entities.User, error) {
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
@@ -13,8 +15,11 @@ import (
 	"github.com/besean163/gophermart/internal/entities"
 	"github.com/besean163/gophermart/internal/handlers/mock"
 	"github.com/besean163/gophermart/internal/logger"
+	streamservice "github.com/besean163/gophermart/internal/services/stream_service"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/net/websocket"
 )
 
 func TestRegisterUser(t *testing.T) {
@@ -27,13 +32,18 @@ func TestRegisterUser(t *testing.T) {
 		Password: getMD5Pass("password_ok"),
 	}
 	authUserToken := "token"
-	authService.EXPECT().BuildUserToken(authUser).Return(authUserToken, nil)
-	authService.EXPECT().GetUser("login_fail").Return(&entities.User{
+	authService.EXPECT().BuildUserToken(gomock.Any(), authUser).Return(authUserToken, nil)
+	authService.EXPECT().GetUser(gomock.Any(), "login_fail").Return(&entities.User{
 		Login:    "login_fail",
 		Password: "password_fail",
 	})
-	authService.EXPECT().GetUser("login_ok").Return(nil)
-	authService.EXPECT().SaveUser(authUser).Return(nil)
+	authService.EXPECT().GetUser(gomock.Any(), "login_ok").Return(nil)
+	authService.EXPECT().SaveUser(gomock.Any(), authUser, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, user entities.User, onCreate func(context.Context, entities.User) error) error {
+			user.ID = 1
+			return onCreate(ctx, user)
+		})
+	loyaltyService.EXPECT().RecordUserIP(gomock.Any(), 1, gomock.Any()).Return(nil)
 
 	handler := NewHandlers(authService, loyaltyService, "")
 
@@ -95,9 +105,10 @@ func TestLoginUser(t *testing.T) {
 		Password: getMD5Pass("password_ok"),
 	}
 	authUserToken := "token"
-	authService.EXPECT().BuildUserToken(authUser).Return(authUserToken, nil)
-	authService.EXPECT().GetUser("login_ok").Return(&authUser)
-	authService.EXPECT().GetUser("login_fail").Return(&entities.User{
+	authService.EXPECT().BuildUserToken(gomock.Any(), authUser).Return(authUserToken, nil)
+	authService.EXPECT().GetUser(gomock.Any(), "login_ok").Return(&authUser)
+	loyaltyService.EXPECT().RecordUserIP(gomock.Any(), authUser.ID, gomock.Any()).Return(nil)
+	authService.EXPECT().GetUser(gomock.Any(), "login_fail").Return(&entities.User{
 		Login:    "login_fail",
 		Password: "password_fail",
 	})
@@ -155,7 +166,7 @@ func TestLoginUser(t *testing.T) {
 }
 
 func TestPostOrder(t *testing.T) {
-	logger.NewLogger()
+	logger.NewLogger(logger.DefaultConfig())
 
 	secret := "test_secret"
 	authUser := entities.User{
@@ -168,27 +179,27 @@ func TestPostOrder(t *testing.T) {
 	authService := mock.NewMockAuthService(ctrl)
 	// отдает авторизованого пользователя
 	authUserToken := "token"
-	authService.EXPECT().BuildUserToken(authUser).Return(authUserToken, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken(authUserToken).Return(&authUser, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken("").Return(nil, errors.New("token error")).AnyTimes()
-	authService.EXPECT().GetUser("login_auth").Return(&authUser).AnyTimes()
+	authService.EXPECT().BuildUserToken(gomock.Any(), authUser).Return(authUserToken, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	authService.EXPECT().GetUser(gomock.Any(), "login_auth").Return(&authUser).AnyTimes()
 
 	loyaltyService := mock.NewMockLoyaltyService(ctrl)
 	// показывает что нет созданного заказа, для проверки сохранения нового
-	loyaltyService.EXPECT().GetOrder("1111111").Return(nil)
+	loyaltyService.EXPECT().GetOrder(gomock.Any(), "1111111").Return(nil)
 	// показывает что есть уже заказ
-	loyaltyService.EXPECT().GetOrder("1111111").Return(&entities.Order{
+	loyaltyService.EXPECT().GetOrder(gomock.Any(), "1111111").Return(&entities.Order{
 		Number: "1111111",
 		UserID: authUser.ID,
 		Status: entities.OrderStatusNew,
 	})
 	// показывает что есть уже заказ, но на другом пользователе
-	loyaltyService.EXPECT().GetOrder("2222222").Return(&entities.Order{
+	loyaltyService.EXPECT().GetOrder(gomock.Any(), "2222222").Return(&entities.Order{
 		Number: "2222222",
 		UserID: 2,
 		Status: entities.OrderStatusNew,
 	})
-	loyaltyService.EXPECT().SaveOrder(gomock.Any()).Return(nil)
+	loyaltyService.EXPECT().SaveOrder(gomock.Any(), gomock.Any()).Return(nil)
 
 	handler := NewHandlers(authService, loyaltyService, secret)
 
@@ -261,7 +272,7 @@ func TestPostOrder(t *testing.T) {
 }
 
 func TestGetOrders(t *testing.T) {
-	logger.NewLogger()
+	logger.NewLogger(logger.DefaultConfig())
 
 	secret := "test_secret"
 	authUser := entities.User{
@@ -273,28 +284,37 @@ func TestGetOrders(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	authService := mock.NewMockAuthService(ctrl)
 	authUserToken := "token"
-	authService.EXPECT().BuildUserToken(authUser).Return(authUserToken, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken(authUserToken).Return(&authUser, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken("").Return(nil, errors.New("token error")).AnyTimes()
-	authService.EXPECT().GetUser("login_auth").Return(&authUser).AnyTimes()
+	authService.EXPECT().BuildUserToken(gomock.Any(), authUser).Return(authUserToken, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	authService.EXPECT().GetUser(gomock.Any(), "login_auth").Return(&authUser).AnyTimes()
 
 	loyaltyService := mock.NewMockLoyaltyService(ctrl)
-	loyaltyService.EXPECT().GetUserOrders(authUser.ID).Return([]*entities.Order{
+	orders := []*entities.Order{
 		{
 			Number: "1111111",
 			UserID: authUser.ID,
 			Status: entities.OrderStatusNew,
 		},
-	})
-	loyaltyService.EXPECT().GetUserOrders(authUser.ID).Return([]*entities.Order{})
+	}
+	defaultQuery := entities.ListQuery{Sort: entities.SortDesc}
+	loyaltyService.EXPECT().GetUserOrders(gomock.Any(), authUser.ID, defaultQuery).Return(orders, "")
+	loyaltyService.EXPECT().GetUserOrders(gomock.Any(), authUser.ID, defaultQuery).Return([]*entities.Order{}, "")
+	loyaltyService.EXPECT().GetUserOrders(gomock.Any(), authUser.ID, entities.ListQuery{
+		Limit:    1,
+		Statuses: []string{entities.OrderStatusNew},
+		Sort:     entities.SortAsc,
+	}).Return(orders, "next_cursor")
 
 	handler := NewHandlers(authService, loyaltyService, secret)
 
 	tests := []struct {
-		name      string
-		method    string
-		code      int
-		authToken string
+		name       string
+		method     string
+		query      string
+		code       int
+		authToken  string
+		nextCursor string
 	}{
 		{
 			name:      "full list",
@@ -313,11 +333,47 @@ func TestGetOrders(t *testing.T) {
 			method: http.MethodGet,
 			code:   401,
 		},
+		{
+			name:       "filtered page",
+			method:     http.MethodGet,
+			query:      "?limit=1&status=NEW&sort=asc",
+			code:       200,
+			authToken:  authUserToken,
+			nextCursor: "next_cursor",
+		},
+		{
+			name:      "invalid limit",
+			method:    http.MethodGet,
+			query:     "?limit=0",
+			code:      400,
+			authToken: authUserToken,
+		},
+		{
+			name:      "invalid status",
+			method:    http.MethodGet,
+			query:     "?status=DONE",
+			code:      400,
+			authToken: authUserToken,
+		},
+		{
+			name:      "invalid cursor",
+			method:    http.MethodGet,
+			query:     "?cursor=abc",
+			code:      400,
+			authToken: authUserToken,
+		},
+		{
+			name:      "cursor of another sort direction",
+			method:    http.MethodGet,
+			query:     "?sort=asc&cursor=" + entities.ListCursor{Time: time.Now(), Key: "1111111", Sort: entities.SortDesc}.Encode(),
+			code:      400,
+			authToken: authUserToken,
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			request, _ := http.NewRequest(test.method, "/api/user/orders", nil)
+			request, _ := http.NewRequest(test.method, "/api/user/orders"+test.query, nil)
 			if test.authToken != "" {
 				request.Header.Set("Authorization", authUserToken)
 			}
@@ -328,12 +384,252 @@ func TestGetOrders(t *testing.T) {
 			response := rr.Result()
 			defer response.Body.Close()
 			assert.Equal(t, test.code, response.StatusCode)
+			assert.Equal(t, test.nextCursor, response.Header.Get("X-Next-Cursor"))
+		})
+	}
+}
+
+func TestGetOrder(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+	testTime, _ := time.Parse(time.RFC3339, "2020-12-09T16:09:57+03:00")
+
+	secret := "test_secret"
+	authUser := entities.User{
+		ID:       1,
+		Login:    "login_auth",
+		Password: getMD5Pass("password_ok"),
+	}
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authUserToken := "token"
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	otherUser := entities.User{ID: 3, Login: "login_other"}
+	otherUserToken := "other_token"
+	authService.EXPECT().GetUserByToken(gomock.Any(), otherUserToken).Return(&otherUser, nil).AnyTimes()
+
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	loyaltyService.EXPECT().GetOrderDetails(gomock.Any(), "1111111").Return(&entities.OrderDetails{
+		Order: entities.Order{
+			Number:      "1111111",
+			UserID:      authUser.ID,
+			Status:      entities.OrderStatusProcessed,
+			Accrual:     500,
+			UploadedAt:  testTime,
+			UpdatedAt:   testTime,
+			ProcessedAt: &testTime,
+		},
+		History: []*entities.OrderStatusChange{
+			{Status: entities.OrderStatusNew, ChangedAt: testTime},
+			{Status: entities.OrderStatusProcessed, Accrual: 500, ChangedAt: testTime},
+		},
+	}).AnyTimes()
+	loyaltyService.EXPECT().GetOrderDetails(gomock.Any(), "2222222").Return(&entities.OrderDetails{
+		Order: entities.Order{
+			Number: "2222222",
+			UserID: 2,
+			Status: entities.OrderStatusNew,
+		},
+	}).AnyTimes()
+	loyaltyService.EXPECT().GetOrderDetails(gomock.Any(), "4444444").Return(&entities.OrderDetails{
+		Order: entities.Order{
+			Number: "4444444",
+			UserID: authUser.ID,
+			Status: entities.OrderStatusProcessing,
+		},
+	}).AnyTimes()
+	loyaltyService.EXPECT().RefreshOrder(gomock.Any(), "4444444").Return(nil).Times(1)
+	loyaltyService.EXPECT().GetOrderDetails(gomock.Any(), "5555555").Return(&entities.OrderDetails{
+		Order: entities.Order{
+			Number: "5555555",
+			UserID: otherUser.ID,
+			Status: entities.OrderStatusNew,
+		},
+	}).AnyTimes()
+	loyaltyService.EXPECT().RefreshOrder(gomock.Any(), "5555555").Return(entities.ErrOrderBusy).Times(1)
+	loyaltyService.EXPECT().GetOrderDetails(gomock.Any(), "3333333").Return(nil).AnyTimes()
+
+	handler := NewHandlers(authService, loyaltyService, secret, WithRefreshInterval(time.Hour))
+
+	tests := []struct {
+		name      string
+		number    string
+		code      int
+		authToken string
+		outBody   string
+	}{
+		{
+			name:      "own order",
+			number:    "1111111",
+			code:      200,
+			authToken: authUserToken,
+			outBody: `{"number":"1111111","status":"PROCESSED","accrual":500,` +
+				`"uploaded_at":"2020-12-09T16:09:57+03:00","updated_at":"2020-12-09T16:09:57+03:00",` +
+				`"processed_at":"2020-12-09T16:09:57+03:00","history":[` +
+				`{"status":"NEW","changed_at":"2020-12-09T16:09:57+03:00"},` +
+				`{"status":"PROCESSED","accrual":500,"changed_at":"2020-12-09T16:09:57+03:00"}]}`,
+		},
+		{
+			name:      "other user order",
+			number:    "2222222",
+			code:      404,
+			authToken: authUserToken,
+		},
+		{
+			name:      "not exist order",
+			number:    "3333333",
+			code:      404,
+			authToken: authUserToken,
+		},
+		{
+			name:   "unauthorized user",
+			number: "1111111",
+			code:   401,
+		},
+		{
+			name:      "refresh final order",
+			number:    "1111111?refresh=true",
+			code:      200,
+			authToken: authUserToken,
+		},
+		{
+			name:      "refresh order",
+			number:    "4444444?refresh=true",
+			code:      200,
+			authToken: authUserToken,
+		},
+		{
+			name:      "refresh rate limit",
+			number:    "4444444?refresh=true",
+			code:      429,
+			authToken: authUserToken,
+		},
+		{
+			name:      "refresh order checked by another instance",
+			number:    "5555555?refresh=true",
+			code:      409,
+			authToken: otherUserToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodGet, "/api/user/orders/"+test.number, nil)
+			if test.authToken != "" {
+				request.Header.Set("Authorization", test.authToken)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(rr, request)
+
+			response := rr.Result()
+			defer response.Body.Close()
+			assert.Equal(t, test.code, response.StatusCode)
+			if test.outBody != "" {
+				assert.JSONEq(t, test.outBody, rr.Body.String())
+			}
 		})
 	}
 }
 
+func TestStreamOrders(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	authUser := entities.User{
+		ID:    1,
+		Login: "login_auth",
+	}
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authUserToken := "token"
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := streamservice.New(ctx, 10)
+	stream.NotifyOrder(entities.Order{Number: "1111111", UserID: authUser.ID, Status: entities.OrderStatusProcessing})
+	stream.NotifyOrder(entities.Order{Number: "2222222", UserID: 2, Status: entities.OrderStatusProcessing})
+	stream.NotifyOrder(entities.Order{Number: "1111111", UserID: authUser.ID, Status: entities.OrderStatusProcessed, Accrual: 10})
+
+	server := httptest.NewServer(NewHandlers(authService, loyaltyService, "", WithOrderStream(stream)))
+	defer server.Close()
+	var sseData []string
+
+	t.Run("replay from last event id", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/api/user/orders/stream", nil)
+		request.Header.Set("Authorization", authUserToken)
+		request.Header.Set("Last-Event-ID", "1")
+
+		response, err := server.Client().Do(request)
+		assert.NoError(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, 200, response.StatusCode)
+		assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+		reader := bufio.NewReader(response.Body)
+		var data []string
+		for len(data) < 2 {
+			line, err := reader.ReadString('\n')
+			assert.NoError(t, err)
+			if strings.HasPrefix(line, "data: ") {
+				data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data: ")))
+			}
+		}
+		assert.Contains(t, data[0], `"status":"PROCESSING"`)
+		assert.Contains(t, data[1], `"status":"PROCESSED"`)
+		assert.Contains(t, data[1], `"number":"1111111"`)
+		sseData = data
+	})
+
+	t.Run("websocket with the same payload", func(t *testing.T) {
+		config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/api/user/orders/stream?last_event_id=1", server.URL)
+		if !assert.NoError(t, err) {
+			return
+		}
+		config.Header.Set("Authorization", authUserToken)
+		conn, err := websocket.DialConfig(config)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		assert.Len(t, sseData, 2)
+		for _, data := range sseData {
+			var message string
+			if !assert.NoError(t, websocket.Message.Receive(conn, &message)) {
+				return
+			}
+			assert.JSONEq(t, data, message)
+		}
+
+		// событие другого экземпляра приходит со своим ID
+		stream.NotifyOrderEvent(entities.OrderEvent{
+			ID:     42,
+			UserID: authUser.ID,
+			Order:  entities.Order{Number: "3333333", UserID: authUser.ID, Status: entities.OrderStatusNew},
+		})
+		var event entities.OrderEvent
+		if !assert.NoError(t, websocket.JSON.Receive(conn, &event)) {
+			return
+		}
+		assert.Equal(t, int64(42), event.ID)
+		assert.Equal(t, "3333333", event.Order.Number)
+	})
+
+	t.Run("unauthorized user", func(t *testing.T) {
+		response, err := server.Client().Get(server.URL + "/api/user/orders/stream")
+		assert.NoError(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, 401, response.StatusCode)
+	})
+}
+
 func TestGetWithdrawns(t *testing.T) {
-	logger.NewLogger()
+	logger.NewLogger(logger.DefaultConfig())
 	testTime, _ := time.Parse(time.RFC3339, "2020-12-09T16:09:57+03:00")
 
 	secret := "test_secret"
@@ -346,13 +642,13 @@ func TestGetWithdrawns(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	authService := mock.NewMockAuthService(ctrl)
 	authUserToken := "token"
-	authService.EXPECT().BuildUserToken(authUser).Return(authUserToken, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken(authUserToken).Return(&authUser, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken("").Return(nil, errors.New("token error")).AnyTimes()
-	authService.EXPECT().GetUser("login_auth").Return(&authUser).AnyTimes()
+	authService.EXPECT().BuildUserToken(gomock.Any(), authUser).Return(authUserToken, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	authService.EXPECT().GetUser(gomock.Any(), "login_auth").Return(&authUser).AnyTimes()
 
 	loyaltyService := mock.NewMockLoyaltyService(ctrl)
-	loyaltyService.EXPECT().GetUserWithdrawals(authUser.ID).Return([]*entities.Withdrawn{
+	loyaltyService.EXPECT().GetUserWithdrawals(gomock.Any(), authUser.ID, gomock.Any()).Return([]*entities.Withdrawn{
 		{
 			ID:          1,
 			UserID:      authUser.ID,
@@ -360,8 +656,8 @@ func TestGetWithdrawns(t *testing.T) {
 			Sum:         0,
 			ProccesedAt: testTime,
 		},
-	})
-	loyaltyService.EXPECT().GetUserWithdrawals(authUser.ID).Return([]*entities.Withdrawn{})
+	}, "")
+	loyaltyService.EXPECT().GetUserWithdrawals(gomock.Any(), authUser.ID, gomock.Any()).Return([]*entities.Withdrawn{}, "")
 
 	handler := NewHandlers(authService, loyaltyService, secret)
 
@@ -413,7 +709,7 @@ func TestGetWithdrawns(t *testing.T) {
 }
 
 func TestGetBalance(t *testing.T) {
-	logger.NewLogger()
+	logger.NewLogger(logger.DefaultConfig())
 
 	secret := "test_secret"
 	authUser := entities.User{
@@ -425,14 +721,15 @@ func TestGetBalance(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	authService := mock.NewMockAuthService(ctrl)
 	authUserToken := "token"
-	authService.EXPECT().BuildUserToken(authUser).Return(authUserToken, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken(authUserToken).Return(&authUser, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken("").Return(nil, errors.New("token error")).AnyTimes()
-	authService.EXPECT().GetUser("login_auth").Return(&authUser).AnyTimes()
+	authService.EXPECT().BuildUserToken(gomock.Any(), authUser).Return(authUserToken, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	authService.EXPECT().GetUser(gomock.Any(), "login_auth").Return(&authUser).AnyTimes()
 
 	loyaltyService := mock.NewMockLoyaltyService(ctrl)
-	loyaltyService.EXPECT().GetUserBalance(authUser.ID).Return(entities.Balance{
+	loyaltyService.EXPECT().GetUserBalance(gomock.Any(), authUser.ID).Return(entities.Balance{
 		Current:   100,
+		Held:      30,
 		Withdrawn: 50,
 	})
 
@@ -449,7 +746,7 @@ func TestGetBalance(t *testing.T) {
 			method:    http.MethodGet,
 			code:      200,
 			authToken: authUserToken,
-			outBody:   `{"current":100,"withdrawn":50}`,
+			outBody:   `{"current":100,"held":30,"withdrawn":50}`,
 		},
 		{
 			name:   "unauthorized user",
@@ -480,7 +777,7 @@ func TestGetBalance(t *testing.T) {
 }
 
 func TestSaveWithdrawn(t *testing.T) {
-	logger.NewLogger()
+	logger.NewLogger(logger.DefaultConfig())
 
 	secret := "test_secret"
 	authUser := entities.User{
@@ -492,17 +789,24 @@ func TestSaveWithdrawn(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	authService := mock.NewMockAuthService(ctrl)
 	authUserToken := "token"
-	authService.EXPECT().BuildUserToken(authUser).Return(authUserToken, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken(authUserToken).Return(&authUser, nil).AnyTimes()
-	authService.EXPECT().GetUserByToken("").Return(nil, errors.New("token error")).AnyTimes()
-	authService.EXPECT().GetUser("login_auth").Return(&authUser).AnyTimes()
+	authService.EXPECT().BuildUserToken(gomock.Any(), authUser).Return(authUserToken, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	authService.EXPECT().GetUser(gomock.Any(), "login_auth").Return(&authUser).AnyTimes()
 
 	loyaltyService := mock.NewMockLoyaltyService(ctrl)
-	loyaltyService.EXPECT().GetUserBalance(authUser.ID).Return(entities.Balance{
+	loyaltyService.EXPECT().GetUserBalance(gomock.Any(), authUser.ID).Return(entities.Balance{
 		Current:   15,
 		Withdrawn: 0,
 	}).AnyTimes()
-	loyaltyService.EXPECT().SaveWithdrawn(gomock.Any()).Return(nil).AnyTimes()
+	loyaltyService.EXPECT().SaveWithdrawn(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, withdrawn entities.Withdrawn) error {
+			if withdrawn.Sum > 15 {
+				return entities.ErrInsufficientBalance
+			}
+			return nil
+		},
+	).AnyTimes()
 
 	handler := NewHandlers(authService, loyaltyService, secret)
 
@@ -559,9 +863,812 @@ func TestSaveWithdrawn(t *testing.T) {
 	}
 }
 
+func TestLogLevel(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+	// уровень глобальный, возвращаем его для остальных тестов
+	t.Cleanup(func() { logger.NewLogger(logger.DefaultConfig()) })
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	adminToken := "admin_token"
+
+	handler := NewHandlers(authService, loyaltyService, "", WithAdminToken(adminToken))
+	disabledHandler := NewHandlers(authService, loyaltyService, "")
+	// логгер, созданный после монтирования роутера, тоже управляется через API
+	logger.NewLogger(logger.DefaultConfig())
+
+	tests := []struct {
+		name       string
+		handler    Handler
+		method     string
+		code       int
+		adminToken string
+		inBody     string
+		outBody    string
+	}{
+		{
+			name:       "current level",
+			handler:    handler,
+			method:     http.MethodGet,
+			code:       200,
+			adminToken: adminToken,
+			outBody:    `{"level":"info"}`,
+		},
+		{
+			name:       "change level",
+			handler:    handler,
+			method:     http.MethodPut,
+			code:       200,
+			adminToken: adminToken,
+			inBody:     `{"level":"debug"}`,
+			outBody:    `{"level":"debug"}`,
+		},
+		{
+			name:       "wrong token",
+			handler:    handler,
+			method:     http.MethodGet,
+			code:       401,
+			adminToken: "wrong",
+		},
+		{
+			name:       "admin api disabled",
+			handler:    disabledHandler,
+			method:     http.MethodGet,
+			code:       404,
+			adminToken: adminToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := strings.NewReader(test.inBody)
+			request, _ := http.NewRequest(test.method, "/api/admin/log/level", body)
+			request.Header.Set("X-Admin-Token", test.adminToken)
+			rr := httptest.NewRecorder()
+
+			test.handler.Router.ServeHTTP(rr, request)
+
+			response := rr.Result()
+			defer response.Body.Close()
+			assert.Equal(t, test.code, response.StatusCode)
+			if test.outBody != "" {
+				assert.JSONEq(t, test.outBody, rr.Body.String())
+			}
+		})
+	}
+	assert.Equal(t, zapcore.DebugLevel, logger.Get().Level())
+}
+
+func TestWebhooks(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	authUser := entities.User{
+		ID:    1,
+		Login: "login_auth",
+	}
+	adminToken := "admin_token"
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authUserToken := "token"
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error")).AnyTimes()
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+
+	webhookService := mock.NewMockWebhookService(ctrl)
+	webhookService.EXPECT().CreateWebhook(gomock.Any(), authUser.ID, "http://example.com/hook", []string{entities.WebhookEventOrderProcessed}).
+		Return(&entities.Webhook{ID: 1, UserID: authUser.ID, URL: "http://example.com/hook", Secret: "secret", Active: true}, nil)
+	webhookService.EXPECT().CreateWebhook(gomock.Any(), authUser.ID, "ftp://example.com", gomock.Any()).
+		Return(nil, entities.ErrInvalidInput)
+	webhookService.EXPECT().CreateWebhook(gomock.Any(), 0, "http://example.com/admin", gomock.Any()).
+		Return(&entities.Webhook{ID: 2, URL: "http://example.com/admin", Secret: "secret", Active: true}, nil)
+	webhookService.EXPECT().GetDeliveries(gomock.Any(), entities.WebhookDeliveryFilter{
+		UserID: &authUser.ID,
+		Status: entities.WebhookDeliveryStatusDead,
+		Limit:  100,
+	}).Return([]*entities.WebhookDelivery{{ID: 5, WebhookID: 1, Status: entities.WebhookDeliveryStatusDead}})
+	webhookService.EXPECT().Redeliver(gomock.Any(), &authUser.ID, 5).
+		Return(&entities.WebhookDelivery{ID: 5, WebhookID: 1, Status: entities.WebhookDeliveryStatusPending}, nil)
+	webhookService.EXPECT().Redeliver(gomock.Any(), &authUser.ID, 6).Return(nil, entities.ErrNotFound)
+	webhookService.EXPECT().DeleteWebhook(gomock.Any(), authUser.ID, 2).Return(entities.ErrNotFound)
+
+	handler := NewHandlers(authService, loyaltyService, "", WithAdminToken(adminToken), WithWebhookService(webhookService))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		code       int
+		authToken  string
+		adminToken string
+		inBody     string
+	}{
+		{
+			name:      "create webhook",
+			method:    http.MethodPost,
+			path:      "/api/user/webhooks",
+			code:      201,
+			authToken: authUserToken,
+			inBody:    `{"url":"http://example.com/hook","events":["order.processed"]}`,
+		},
+		{
+			name:      "invalid webhook",
+			method:    http.MethodPost,
+			path:      "/api/user/webhooks",
+			code:      400,
+			authToken: authUserToken,
+			inBody:    `{"url":"ftp://example.com","events":["order.processed"]}`,
+		},
+		{
+			name:   "unauthorized user",
+			method: http.MethodPost,
+			path:   "/api/user/webhooks",
+			code:   401,
+			inBody: `{"url":"http://example.com/hook","events":["order.processed"]}`,
+		},
+		{
+			name:       "admin webhook",
+			method:     http.MethodPost,
+			path:       "/api/admin/webhooks",
+			code:       201,
+			adminToken: adminToken,
+			inBody:     `{"url":"http://example.com/admin","events":["withdrawal.created"]}`,
+		},
+		{
+			name:      "dead letters",
+			method:    http.MethodGet,
+			path:      "/api/user/webhooks/deliveries?status=dead",
+			code:      200,
+			authToken: authUserToken,
+		},
+		{
+			name:      "unknown delivery status",
+			method:    http.MethodGet,
+			path:      "/api/user/webhooks/deliveries?status=lost",
+			code:      400,
+			authToken: authUserToken,
+		},
+		{
+			name:      "redeliver",
+			method:    http.MethodPost,
+			path:      "/api/user/webhooks/deliveries/5/redeliver",
+			code:      202,
+			authToken: authUserToken,
+		},
+		{
+			name:      "redeliver other user delivery",
+			method:    http.MethodPost,
+			path:      "/api/user/webhooks/deliveries/6/redeliver",
+			code:      404,
+			authToken: authUserToken,
+		},
+		{
+			name:      "delete other owner webhook",
+			method:    http.MethodDelete,
+			path:      "/api/user/webhooks/2",
+			code:      404,
+			authToken: authUserToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(test.method, test.path, strings.NewReader(test.inBody))
+			if test.authToken != "" {
+				request.Header.Set("Authorization", test.authToken)
+			}
+			if test.adminToken != "" {
+				request.Header.Set("X-Admin-Token", test.adminToken)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(rr, request)
+
+			response := rr.Result()
+			defer response.Body.Close()
+			assert.Equal(t, test.code, response.StatusCode)
+		})
+	}
+}
+
 func getMD5Pass(p string) string {
 	h := md5.New()
 	h.Write([]byte(p))
 
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+func TestHealth(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+
+	accrualHealthy := true
+	handler := NewHandlers(authService, loyaltyService, "",
+		WithHealthCheck("accrual", func(ctx context.Context) (bool, any) {
+			if accrualHealthy {
+				return true, map[string]string{"state": "closed"}
+			}
+			return false, map[string]string{"state": "open"}
+		}),
+		WithMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("gophermart_accrual_breaker_state 2\n"))
+		})),
+	)
+
+	tests := []struct {
+		name    string
+		healthy bool
+		outBody string
+	}{
+		{
+			name:    "ok",
+			healthy: true,
+			outBody: `{"status":"ok","components":{"accrual":{"status":"ok","details":{"state":"closed"}}}}`,
+		},
+		{
+			name:    "accrual breaker open",
+			healthy: false,
+			outBody: `{"status":"degraded","components":{"accrual":{"status":"degraded","details":{"state":"open"}}}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			accrualHealthy = test.healthy
+			request, _ := http.NewRequest(http.MethodGet, "/api/health", nil)
+			rr := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(rr, request)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.JSONEq(t, test.outBody, rr.Body.String())
+		})
+	}
+
+	t.Run("metrics", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		rr := httptest.NewRecorder()
+
+		handler.Router.ServeHTTP(rr, request)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Contains(t, rr.Body.String(), "gophermart_accrual_breaker_state")
+	})
+}
+
+func TestOrderCheckFailures(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	adminToken := "admin_token"
+	handler := NewHandlers(authService, loyaltyService, "", WithAdminToken(adminToken))
+
+	loyaltyService.EXPECT().GetOrderCheckFailures(gomock.Any()).Return([]entities.OrderCheckFailure{
+		{Number: "12345678903", UserID: 1, Status: entities.OrderStatusNew, CheckErrors: 3, LastCheckError: "accrual system internal error"},
+	})
+
+	request, _ := http.NewRequest(http.MethodGet, "/api/admin/orders/check-failures", nil)
+	request.Header.Set("X-Admin-Token", adminToken)
+	rr := httptest.NewRecorder()
+
+	handler.Router.ServeHTTP(rr, request)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `[{"number":"12345678903","user_id":1,"status":"NEW","check_errors":3,"last_check_error":"accrual system internal error"}]`, rr.Body.String())
+}
+
+func TestReconcile(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	adminToken := "admin_token"
+	handler := NewHandlers(authService, loyaltyService, "", WithAdminToken(adminToken))
+
+	loyaltyService.EXPECT().StartReconcile(gomock.Any(), entities.ReconcileOptions{
+		Window:  24 * time.Hour,
+		Correct: true,
+		Reason:  "rules changed",
+	}).Return(nil)
+	loyaltyService.EXPECT().StartReconcile(gomock.Any(), entities.ReconcileOptions{Window: time.Hour}).Return(entities.ErrReconciliationInProgress)
+	loyaltyService.EXPECT().StartReconcile(gomock.Any(), gomock.Any()).Return(entities.ErrInvalidInput)
+
+	tests := []struct {
+		name   string
+		inBody string
+		code   int
+	}{
+		{
+			name:   "correct mismatches",
+			inBody: `{"window":"24h","correct":true,"reason":"rules changed"}`,
+			code:   http.StatusAccepted,
+		},
+		{
+			name:   "wrong window",
+			inBody: `{"window":"day"}`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "running on another instance",
+			inBody: `{"window":"1h"}`,
+			code:   http.StatusConflict,
+		},
+		{
+			name:   "correction without reason",
+			inBody: `{"window":"24h","correct":true}`,
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, "/api/admin/accrual/reconciliation", strings.NewReader(test.inBody))
+			request.Header.Set("X-Admin-Token", adminToken)
+			rr := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(rr, request)
+
+			assert.Equal(t, test.code, rr.Code)
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	authUser := entities.User{ID: 1, Login: "login_auth"}
+	authUserToken := "token"
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	loyaltyService.EXPECT().GetUserBalance(gomock.Any(), authUser.ID).Return(entities.Balance{Current: 15}).AnyTimes()
+	idempotencyService := mock.NewMockIdempotencyService(ctrl)
+	handler := NewHandlers(authService, loyaltyService, "", WithIdempotencyService(idempotencyService))
+
+	inBody := `{"order":"2377225624","sum":10}`
+	gomock.InOrder(
+		idempotencyService.EXPECT().Begin(gomock.Any(), authUser.ID, "new", gomock.Any()).Return(&entities.IdempotencyRecord{LeaseToken: "lease"}, nil),
+		loyaltyService.EXPECT().SaveWithdrawn(gomock.Any(), gomock.Any()).Return(nil),
+		idempotencyService.EXPECT().Complete(gomock.Any(), authUser.ID, "new", "lease", http.StatusOK, "", gomock.Any()).Return(nil),
+	)
+	idempotencyService.EXPECT().Begin(gomock.Any(), authUser.ID, "done", gomock.Any()).Return(&entities.IdempotencyRecord{StatusCode: http.StatusOK}, nil)
+	idempotencyService.EXPECT().Begin(gomock.Any(), authUser.ID, "reused", gomock.Any()).Return(nil, entities.ErrIdempotencyKeyReused)
+	idempotencyService.EXPECT().Begin(gomock.Any(), authUser.ID, "running", gomock.Any()).Return(nil, entities.ErrIdempotencyKeyInProgress)
+	gomock.InOrder(
+		idempotencyService.EXPECT().Begin(gomock.Any(), authUser.ID, "failed", gomock.Any()).Return(&entities.IdempotencyRecord{LeaseToken: "lease"}, nil),
+		loyaltyService.EXPECT().SaveWithdrawn(gomock.Any(), gomock.Any()).Return(errors.New("db error")),
+		idempotencyService.EXPECT().Abort(gomock.Any(), authUser.ID, "failed", "lease").Return(nil),
+	)
+
+	tests := []struct {
+		name     string
+		key      string
+		code     int
+		replayed bool
+	}{
+		{
+			name: "first request",
+			key:  "new",
+			code: http.StatusOK,
+		},
+		{
+			name:     "retry replays response",
+			key:      "done",
+			code:     http.StatusOK,
+			replayed: true,
+		},
+		{
+			name: "reused key with other payload",
+			key:  "reused",
+			code: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "retry while first request in progress",
+			key:  "running",
+			code: http.StatusConflict,
+		},
+		{
+			name: "failed request releases key",
+			key:  "failed",
+			code: http.StatusInternalServerError,
+		},
+		{
+			name: "too long key",
+			key:  strings.Repeat("k", 256),
+			code: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(inBody))
+			request.Header.Set("Authorization", authUserToken)
+			request.Header.Set("Idempotency-Key", test.key)
+			rr := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(rr, request)
+
+			assert.Equal(t, test.code, rr.Code)
+			assert.Equal(t, test.replayed, rr.Header().Get("Idempotent-Replayed") == "true")
+		})
+	}
+
+	t.Run("panic releases key", func(t *testing.T) {
+		gomock.InOrder(
+			idempotencyService.EXPECT().Begin(gomock.Any(), authUser.ID, "panic", gomock.Any()).Return(&entities.IdempotencyRecord{LeaseToken: "lease"}, nil),
+			loyaltyService.EXPECT().SaveWithdrawn(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(context.Context, entities.Withdrawn) error { panic("boom") },
+			),
+			idempotencyService.EXPECT().Abort(gomock.Any(), authUser.ID, "panic", "lease").Return(nil),
+		)
+
+		request, _ := http.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(inBody))
+		request.Header.Set("Authorization", authUserToken)
+		request.Header.Set("Idempotency-Key", "panic")
+
+		assert.PanicsWithValue(t, "boom", func() {
+			handler.Router.ServeHTTP(httptest.NewRecorder(), request)
+		})
+	})
+}
+
+func TestWithdrawnConflict(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	authUser := entities.User{ID: 1, Login: "login_auth"}
+	authUserToken := "token"
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	loyaltyService.EXPECT().SaveWithdrawn(gomock.Any(), gomock.Any()).
+		Return(entities.NewWithdrawnConflictError("2377225624", entities.WithdrawnConflictWithdrawn))
+	handler := NewHandlers(authService, loyaltyService, "")
+
+	request, _ := http.NewRequest(http.MethodPost, "/api/user/balance/withdraw", strings.NewReader(`{"order":"2377225624","sum":10}`))
+	request.Header.Set("Authorization", authUserToken)
+	rr := httptest.NewRecorder()
+
+	handler.Router.ServeHTTP(rr, request)
+
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.JSONEq(t, `{"order":"2377225624","reason":"already_withdrawn"}`, rr.Body.String())
+}
+
+func TestReverseWithdrawn(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	adminToken := "admin_token"
+	handler := NewHandlers(authService, loyaltyService, "", WithAdminToken(adminToken))
+
+	loyaltyService.EXPECT().ReverseWithdrawn(gomock.Any(), entities.ReverseWithdrawnRequest{
+		OrderNumber: "2377225624",
+		Amount:      20,
+		Reason:      entities.ReversalReasonPartialReturn,
+	}).Return(&entities.LedgerEntry{ID: 1, Type: entities.LedgerEntryReversal, Amount: 20}, nil)
+	loyaltyService.EXPECT().ReverseWithdrawn(gomock.Any(), gomock.Any()).Return(nil, entities.ErrReversalExceedsWithdrawn)
+	loyaltyService.EXPECT().ReverseWithdrawn(gomock.Any(), gomock.Any()).Return(nil, entities.ErrNotFound)
+
+	tests := []struct {
+		name   string
+		inBody string
+		code   int
+	}{
+		{
+			name:   "partial refund",
+			inBody: `{"amount":20,"reason":"partial_return"}`,
+			code:   http.StatusCreated,
+		},
+		{
+			name:   "refund over withdrawn sum",
+			inBody: `{"amount":1000,"reason":"order_cancelled"}`,
+			code:   http.StatusConflict,
+		},
+		{
+			name:   "unknown withdrawal",
+			inBody: `{"reason":"order_cancelled"}`,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "wrong body",
+			inBody: `{"amount":`,
+			code:   http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, "/api/admin/withdrawals/2377225624/reversals", strings.NewReader(test.inBody))
+			request.Header.Set("X-Admin-Token", adminToken)
+			rr := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(rr, request)
+
+			assert.Equal(t, test.code, rr.Code)
+		})
+	}
+}
+
+func TestHolds(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	authUser := entities.User{ID: 1, Login: "login_auth"}
+	authUserToken := "token"
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil).AnyTimes()
+
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	loyaltyService.EXPECT().CreateHold(gomock.Any(), authUser.ID, "2377225624", 70.0).Return(&entities.Hold{ID: 1, Sum: 70}, nil)
+	loyaltyService.EXPECT().CreateHold(gomock.Any(), authUser.ID, "2377225624", 500.0).Return(nil, entities.ErrInsufficientBalance)
+	loyaltyService.EXPECT().CaptureHold(gomock.Any(), authUser.ID, 1, 0.0).Return(&entities.Withdrawn{Sum: 70}, nil)
+	loyaltyService.EXPECT().CaptureHold(gomock.Any(), authUser.ID, 1, 10.0).Return(nil, entities.ErrHoldNotActive)
+	loyaltyService.EXPECT().ReleaseHold(gomock.Any(), authUser.ID, 2).Return(entities.ErrNotFound)
+	handler := NewHandlers(authService, loyaltyService, "")
+
+	tests := []struct {
+		name   string
+		path   string
+		inBody string
+		code   int
+	}{
+		{
+			name:   "create hold",
+			path:   "/api/user/balance/holds",
+			inBody: `{"order":"2377225624","sum":70}`,
+			code:   http.StatusCreated,
+		},
+		{
+			name:   "not enough balance",
+			path:   "/api/user/balance/holds",
+			inBody: `{"order":"2377225624","sum":500}`,
+			code:   http.StatusPaymentRequired,
+		},
+		{
+			name:   "wrong order number",
+			path:   "/api/user/balance/holds",
+			inBody: `{"order":"2377225625","sum":70}`,
+			code:   http.StatusUnprocessableEntity,
+		},
+		{
+			name: "capture without body",
+			path: "/api/user/balance/holds/1/capture",
+			code: http.StatusOK,
+		},
+		{
+			name:   "capture closed hold",
+			path:   "/api/user/balance/holds/1/capture",
+			inBody: `{"sum":10}`,
+			code:   http.StatusConflict,
+		},
+		{
+			name: "release unknown hold",
+			path: "/api/user/balance/holds/2/release",
+			code: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodPost, test.path, strings.NewReader(test.inBody))
+			request.Header.Set("Authorization", authUserToken)
+			rr := httptest.NewRecorder()
+
+			handler.Router.ServeHTTP(rr, request)
+
+			assert.Equal(t, test.code, rr.Code)
+		})
+	}
+}
+
+func TestGetTier(t *testing.T) {
+	authUser := entities.User{ID: 1, Login: "login_auth"}
+	authUserToken := "token"
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil)
+	authService.EXPECT().GetUserByToken(gomock.Any(), "").Return(nil, errors.New("token error"))
+
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	loyaltyService.EXPECT().GetUserTier(gomock.Any(), authUser.ID).Return(entities.TierProgress{
+		Tier:            "silver",
+		Multiplier:      1.05,
+		LifetimeAccrual: 3000,
+		NextTier:        "gold",
+		NextThreshold:   5000,
+		Remaining:       2000,
+		Progress:        0.5,
+	})
+	handler := NewHandlers(authService, loyaltyService, "")
+
+	request, _ := http.NewRequest(http.MethodGet, "/api/user/tier", nil)
+	request.Header.Set("Authorization", authUserToken)
+	rr := httptest.NewRecorder()
+	handler.Router.ServeHTTP(rr, request)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"tier":"silver","multiplier":1.05,"lifetime_accrual":3000,"next_tier":"gold","next_threshold":5000,"remaining":2000,"progress":0.5}`, rr.Body.String())
+
+	request, _ = http.NewRequest(http.MethodGet, "/api/user/tier", nil)
+	rr = httptest.NewRecorder()
+	handler.Router.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestPromoRules(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	adminToken := "admin_token"
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	loyaltyService.EXPECT().CreatePromoRule(gomock.Any(), entities.PromoRule{
+		Name: "welcome", RewardType: entities.RewardTypePoint, Reward: 50, FirstOrderOnly: true, Active: true,
+	}).DoAndReturn(func(ctx context.Context, rule entities.PromoRule) (*entities.PromoRule, error) {
+		rule.ID = 1
+		rule.CreatedAt = createdAt
+		return &rule, nil
+	})
+	loyaltyService.EXPECT().CreatePromoRule(gomock.Any(), gomock.Any()).Return(nil, entities.ErrInvalidInput)
+	loyaltyService.EXPECT().UpdatePromoRule(gomock.Any(), gomock.Any()).Return(nil, entities.ErrNotFound)
+	loyaltyService.EXPECT().DeletePromoRule(gomock.Any(), 1).Return(nil)
+	loyaltyService.EXPECT().GetPromoRules(gomock.Any()).Return(nil)
+	handler := NewHandlers(authService, loyaltyService, "", WithAdminToken(adminToken))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+		result string
+	}{
+		{
+			name:   "create",
+			method: http.MethodPost,
+			path:   "/api/admin/promo-rules",
+			body:   `{"name":"welcome","reward_type":"pt","reward":50,"first_order_only":true}`,
+			code:   http.StatusCreated,
+			result: `{"id":1,"name":"welcome","reward_type":"pt","reward":50,"first_order_only":true,"active":true,"created_at":"2024-01-01T00:00:00Z"}`,
+		},
+		{
+			name:   "invalid rule",
+			method: http.MethodPost,
+			path:   "/api/admin/promo-rules",
+			body:   `{"name":"welcome","reward_type":"gift","reward":50}`,
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "update missing rule",
+			method: http.MethodPut,
+			path:   "/api/admin/promo-rules/5",
+			body:   `{"name":"welcome","reward_type":"pt","reward":50}`,
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   "bad id",
+			method: http.MethodDelete,
+			path:   "/api/admin/promo-rules/abc",
+			code:   http.StatusBadRequest,
+		},
+		{
+			name:   "delete",
+			method: http.MethodDelete,
+			path:   "/api/admin/promo-rules/1",
+			code:   http.StatusNoContent,
+		},
+		{
+			name:   "list",
+			method: http.MethodGet,
+			path:   "/api/admin/promo-rules",
+			code:   http.StatusOK,
+			result: `[]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			request.Header.Set("X-Admin-Token", adminToken)
+			rr := httptest.NewRecorder()
+			handler.Router.ServeHTTP(rr, request)
+
+			assert.Equal(t, test.code, rr.Code)
+			if test.result != "" {
+				assert.JSONEq(t, test.result, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestReferrals(t *testing.T) {
+	logger.NewLogger(logger.DefaultConfig())
+
+	authUser := entities.User{ID: 1, Login: "login_auth"}
+	authUserToken := "token"
+	referee := entities.User{Login: "login_new", Password: getMD5Pass("password")}
+	savedReferee := referee
+	savedReferee.ID = 2
+
+	ctrl := gomock.NewController(t)
+	authService := mock.NewMockAuthService(ctrl)
+	authService.EXPECT().GetUserByToken(gomock.Any(), authUserToken).Return(&authUser, nil)
+	authService.EXPECT().GetUser(gomock.Any(), referee.Login).Return(nil).Times(2)
+	authService.EXPECT().SaveUser(gomock.Any(), referee, gomock.Any()).DoAndReturn(
+		func(ctx context.Context, user entities.User, onCreate func(context.Context, entities.User) error) error {
+			return onCreate(ctx, savedReferee)
+		})
+	authService.EXPECT().BuildUserToken(gomock.Any(), referee).Return("referee_token", nil)
+
+	loyaltyService := mock.NewMockLoyaltyService(ctrl)
+	loyaltyService.EXPECT().FindReferrer(gomock.Any(), "WRONG").Return(0, entities.ErrReferralCodeNotFound)
+	loyaltyService.EXPECT().FindReferrer(gomock.Any(), "ABCD2345").Return(authUser.ID, nil)
+	loyaltyService.EXPECT().RecordUserIP(gomock.Any(), savedReferee.ID, "203.0.113.5").Return(nil)
+	loyaltyService.EXPECT().CreateReferral(gomock.Any(), authUser.ID, savedReferee, "203.0.113.5").Return(nil)
+	loyaltyService.EXPECT().GetUserReferrals(gomock.Any(), authUser, "198.51.100.7").Return(entities.ReferralSummary{
+		Code:   "ABCD2345",
+		Earned: 100,
+		Referrals: []*entities.Referral{
+			{RefereeLogin: "login_new", Status: entities.ReferralStatusRewarded, ReferrerBonus: 100, RefereeBonus: 50, CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}, nil)
+	handler := NewHandlers(authService, loyaltyService, "")
+
+	request, _ := http.NewRequest(http.MethodPost, "/api/user/register", strings.NewReader(`{"login":"login_new","password":"password","referral_code":"WRONG"}`))
+	rr := httptest.NewRecorder()
+	handler.Router.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	request, _ = http.NewRequest(http.MethodPost, "/api/user/register", strings.NewReader(`{"login":"login_new","password":"password","referral_code":"ABCD2345"}`))
+	request.RemoteAddr = "203.0.113.5:41000"
+	rr = httptest.NewRecorder()
+	handler.Router.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "referee_token", rr.Header().Get("Authorization"))
+
+	request, _ = http.NewRequest(http.MethodGet, "/api/user/referrals", nil)
+	request.Header.Set("Authorization", authUserToken)
+	request.RemoteAddr = "198.51.100.7:52000"
+	rr = httptest.NewRecorder()
+	handler.Router.ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"code":"ABCD2345","earned":100,"referrals":[{"login":"login_new","status":"REWARDED","bonus":100,"created_at":"2024-01-01T00:00:00Z"}]}`, rr.Body.String())
+}
+
+func TestUserRateLimiterCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	limiter := newUserRateLimiter(10 * time.Millisecond)
+	allowed, _ := limiter.Allow(1)
+	assert.True(t, allowed)
+	allowed, wait := limiter.Allow(1)
+	assert.False(t, allowed)
+	assert.Positive(t, wait)
+
+	go limiter.run(ctx)
+	assert.Eventually(t, func() bool {
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		return len(limiter.last) == 0
+	}, time.Second, 5*time.Millisecond)
+}
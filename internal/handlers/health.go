@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+)
+
+const (
+	healthStatusOK       = "ok"
+	healthStatusDegraded = "degraded"
+)
+
+// HealthCheck возвращает состояние зависимости и подробности для /api/health.
+type HealthCheck func(ctx context.Context) (healthy bool, details any)
+
+type healthCheck struct {
+	name  string
+	check HealthCheck
+}
+
+type componentHealth struct {
+	Status  string `json:"status"`
+	Details any    `json:"details,omitempty"`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentHealth `json:"components,omitempty"`
+}
+
+// Health отвечает 200, пока жив сам сервис. Отказ зависимостей переводит статус в degraded,
+// чтобы балансировщик не выводил экземпляр из работы из-за внешней системы.
+func (handler Handler) Health(w http.ResponseWriter, r *http.Request) {
+	checks := append([]healthCheck(nil), handler.healthChecks...)
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+
+	response := healthResponse{
+		Status:     healthStatusOK,
+		Components: make(map[string]componentHealth, len(checks)),
+	}
+	for _, check := range checks {
+		healthy, details := check.check(r.Context())
+		component := componentHealth{Status: healthStatusOK, Details: details}
+		if !healthy {
+			component.Status = healthStatusDegraded
+			response.Status = healthStatusDegraded
+		}
+		response.Components[check.name] = component
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
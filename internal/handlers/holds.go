@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/EClaesson/go-luhn"
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+type holdInput struct {
+	OrderNumber string  `json:"order"`
+	Sum         float64 `json:"sum"`
+}
+
+type captureHoldInput struct {
+	Sum float64 `json:"sum"`
+}
+
+// CreateHold резервирует баллы под заказ, коды ответа повторяют списание.
+func (handler Handler) CreateHold(w http.ResponseWriter, r *http.Request) {
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var input holdInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil || input.Sum <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	isValidLuna, err := luhn.IsValid(input.OrderNumber)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !isValidLuna {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	hold, err := handler.LoyaltyService.CreateHold(r.Context(), user.ID, input.OrderNumber, input.Sum)
+	if handleHoldError(w, err, "create hold error") {
+		return
+	}
+	writeJSON(w, http.StatusCreated, hold)
+}
+
+func (handler Handler) GetHolds(w http.ResponseWriter, r *http.Request) {
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	holds := handler.LoyaltyService.GetUserHolds(r.Context(), user.ID)
+	if len(holds) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, holds)
+}
+
+// CaptureHold списывает резерв, тело запроса необязательно: без sum списывается весь резерв.
+func (handler Handler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	user, id, ok := getHoldRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var input captureHoldInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	withdrawn, err := handler.LoyaltyService.CaptureHold(r.Context(), user.ID, id, input.Sum)
+	if handleHoldError(w, err, "capture hold error") {
+		return
+	}
+	writeJSON(w, http.StatusOK, withdrawn)
+}
+
+func (handler Handler) ReleaseHold(w http.ResponseWriter, r *http.Request) {
+	user, id, ok := getHoldRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := handler.LoyaltyService.ReleaseHold(r.Context(), user.ID, id)
+	if handleHoldError(w, err, "release hold error") {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getHoldRequest(w http.ResponseWriter, r *http.Request) (*entities.User, int, bool) {
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, 0, false
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, 0, false
+	}
+	return user, id, true
+}
+
+// handleHoldError пишет ответ для ошибки операции с резервом и сообщает, была ли ошибка.
+func handleHoldError(w http.ResponseWriter, err error, message string) bool {
+	var conflict *entities.WithdrawnConflictError
+	switch {
+	case err == nil:
+		return false
+	case errors.As(err, &conflict):
+		writeJSON(w, http.StatusConflict, conflict)
+	case errors.Is(err, entities.ErrInvalidInput):
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, entities.ErrInsufficientBalance):
+		w.WriteHeader(http.StatusPaymentRequired)
+	case errors.Is(err, entities.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, entities.ErrHoldNotActive):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		logger.Get().Warn(message, zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return true
+}
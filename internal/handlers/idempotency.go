@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	idempotencyKeyMaxLength   = 255
+)
+
+// IdempotencyMiddleware повторяет сохраненный ответ, если клиент прислал запрос
+// с тем же Idempotency-Key. Запросы без заголовка выполняются как обычно.
+// Ответы 5xx не сохраняются, чтобы клиент мог повторить запрос после сбоя.
+func (handler Handler) IdempotencyMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if handler.IdempotencyService == nil || key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > idempotencyKeyMaxLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		user, err := getRequestUser(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		record, err := handler.IdempotencyService.Begin(r.Context(), user.ID, key, requestFingerprint(r, body))
+		switch {
+		case errors.Is(err, entities.ErrIdempotencyKeyReused):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		case errors.Is(err, entities.ErrIdempotencyKeyInProgress):
+			w.WriteHeader(http.StatusConflict)
+			return
+		case err != nil:
+			logger.Get().Warn("idempotency begin error", zap.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		case record.IsCompleted():
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			if record.ContentType != "" {
+				w.Header().Set("Content-Type", record.ContentType)
+			}
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Body)
+			return
+		}
+
+		// ответ уже отправлен клиенту, сохраняем его независимо от отмены запроса
+		ctx := context.WithoutCancel(r.Context())
+		defer func() {
+			// после паники ответа нет, ключ освобождаем, чтобы запрос можно было повторить
+			if p := recover(); p != nil {
+				if err := handler.IdempotencyService.Abort(ctx, user.ID, key, record.LeaseToken); err != nil {
+					logger.Get().Warn("idempotency abort error", zap.String("error", err.Error()))
+				}
+				panic(p)
+			}
+		}()
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, r)
+
+		if recorder.StatusCode() >= http.StatusInternalServerError {
+			err = handler.IdempotencyService.Abort(ctx, user.ID, key, record.LeaseToken)
+		} else {
+			err = handler.IdempotencyService.Complete(ctx, user.ID, key, record.LeaseToken, recorder.StatusCode(), w.Header().Get("Content-Type"), recorder.body.Bytes())
+		}
+		if err != nil {
+			logger.Get().Warn("idempotency save error", zap.String("error", err.Error()))
+		}
+	})
+}
+
+// requestFingerprint отличает повтор запроса от другого запроса с тем же ключом.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// responseRecorder запоминает код и тело ответа, передавая их клиенту.
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (recorder *responseRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *responseRecorder) Write(body []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	recorder.body.Write(body)
+	return recorder.ResponseWriter.Write(body)
+}
+
+func (recorder *responseRecorder) StatusCode() int {
+	if recorder.statusCode == 0 {
+		return http.StatusOK
+	}
+	return recorder.statusCode
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+)
+
+const (
+	maxListLimit     = 1000
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+var (
+	ErrInvalidListQuery = errors.New("invalid list query")
+)
+
+// parseListQuery разбирает параметры limit, cursor, status, from, to и sort.
+// Если allowedStatuses пустой, фильтр по статусу запрещен.
+func parseListQuery(r *http.Request, allowedStatuses []string) (entities.ListQuery, error) {
+	values := r.URL.Query()
+	query := entities.ListQuery{
+		Sort: entities.SortDesc,
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 || value > maxListLimit {
+			return query, ErrInvalidListQuery
+		}
+		query.Limit = value
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := entities.DecodeListCursor(cursor)
+		if err != nil {
+			return query, err
+		}
+		query.After = after
+	}
+
+	for _, status := range values["status"] {
+		for _, s := range strings.Split(status, ",") {
+			if !slices.Contains(allowedStatuses, s) {
+				return query, ErrInvalidListQuery
+			}
+			query.Statuses = append(query.Statuses, s)
+		}
+	}
+
+	var err error
+	if query.From, err = parseListTime(values.Get("from")); err != nil {
+		return query, err
+	}
+	if query.To, err = parseListTime(values.Get("to")); err != nil {
+		return query, err
+	}
+
+	switch sort := values.Get("sort"); sort {
+	case "":
+	case entities.SortAsc, entities.SortDesc:
+		query.Sort = sort
+	default:
+		return query, ErrInvalidListQuery
+	}
+
+	if query.After != nil && query.After.Sort != query.Direction() {
+		return query, entities.ErrInvalidCursor
+	}
+
+	return query, nil
+}
+
+func parseListTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, ErrInvalidListQuery
+	}
+	return t, nil
+}
+
+func setNextCursor(w http.ResponseWriter, cursor string) {
+	if cursor != "" {
+		w.Header().Set(nextCursorHeader, cursor)
+	}
+}
@@ -31,13 +31,18 @@ func (handler Handler) Login(w http.ResponseWriter, r *http.Request) {
 	}
 
 	inputUser.HashingPassword()
-	existUser := handler.AuthService.GetUser(inputUser.Login)
+	existUser := handler.AuthService.GetUser(r.Context(), inputUser.Login)
 	if existUser == nil || existUser.Password != inputUser.Password {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	token, err := handler.AuthService.BuildUserToken(*existUser)
+	// адрес входа нужен только для проверки приглашений, его ошибка вход не прерывает
+	if err := handler.LoyaltyService.RecordUserIP(r.Context(), existUser.ID, clientIP(r)); err != nil {
+		logger.Get().Warn("record user ip error", zap.String("error", err.Error()))
+	}
+
+	token, err := handler.AuthService.BuildUserToken(r.Context(), *existUser)
 	if err != nil {
 		logger.Get().Warn("can't set token", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
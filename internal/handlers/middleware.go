@@ -2,15 +2,18 @@ package handlers
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
 )
 
 type userKeyContext string
 
+type adminKeyContext struct{}
+
 func (handler Handler) AuthMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("Authorization")
-		user, err := handler.AuthService.GetUserByToken(token)
+		user, err := handler.AuthService.GetUserByToken(r.Context(), token)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
@@ -21,3 +24,26 @@ func (handler Handler) AuthMiddleware(h http.Handler) http.Handler {
 		h.ServeHTTP(w, authR)
 	})
 }
+
+func (handler Handler) AdminMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler.AdminToken == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		token := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(handler.AdminToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), adminKeyContext{}, true)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func isAdminRequest(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminKeyContext{}).(bool)
+	return admin
+}
@@ -5,6 +5,7 @@
 package mock
 
 import (
+	context "context"
 	reflect "reflect"
 
 	entities "github.com/besean163/gophermart/internal/entities"
@@ -35,61 +36,61 @@ func (m *MockAuthService) EXPECT() *MockAuthServiceMockRecorder {
 }
 
 // BuildUserToken mocks base method.
-func (m *MockAuthService) BuildUserToken(arg0 entities.User) (string, error) {
+func (m *MockAuthService) BuildUserToken(ctx context.Context, user entities.User) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "BuildUserToken", arg0)
+	ret := m.ctrl.Call(m, "BuildUserToken", ctx, user)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // BuildUserToken indicates an expected call of BuildUserToken.
-func (mr *MockAuthServiceMockRecorder) BuildUserToken(arg0 interface{}) *gomock.Call {
+func (mr *MockAuthServiceMockRecorder) BuildUserToken(ctx, user interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BuildUserToken", reflect.TypeOf((*MockAuthService)(nil).BuildUserToken), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BuildUserToken", reflect.TypeOf((*MockAuthService)(nil).BuildUserToken), ctx, user)
 }
 
 // GetUser mocks base method.
-func (m *MockAuthService) GetUser(login string) *entities.User {
+func (m *MockAuthService) GetUser(ctx context.Context, login string) *entities.User {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUser", login)
+	ret := m.ctrl.Call(m, "GetUser", ctx, login)
 	ret0, _ := ret[0].(*entities.User)
 	return ret0
 }
 
 // GetUser indicates an expected call of GetUser.
-func (mr *MockAuthServiceMockRecorder) GetUser(login interface{}) *gomock.Call {
+func (mr *MockAuthServiceMockRecorder) GetUser(ctx, login interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUser", reflect.TypeOf((*MockAuthService)(nil).GetUser), login)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUser", reflect.TypeOf((*MockAuthService)(nil).GetUser), ctx, login)
 }
 
 // GetUserByToken mocks base method.
-func (m *MockAuthService) GetUserByToken(token string) (*entities.User, error) {
+func (m *MockAuthService) GetUserByToken(ctx context.Context, token string) (*entities.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserByToken", token)
+	ret := m.ctrl.Call(m, "GetUserByToken", ctx, token)
 	ret0, _ := ret[0].(*entities.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetUserByToken indicates an expected call of GetUserByToken.
-func (mr *MockAuthServiceMockRecorder) GetUserByToken(token interface{}) *gomock.Call {
+func (mr *MockAuthServiceMockRecorder) GetUserByToken(ctx, token interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByToken", reflect.TypeOf((*MockAuthService)(nil).GetUserByToken), token)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserByToken", reflect.TypeOf((*MockAuthService)(nil).GetUserByToken), ctx, token)
 }
 
 // SaveUser mocks base method.
-func (m *MockAuthService) SaveUser(arg0 entities.User) error {
+func (m *MockAuthService) SaveUser(ctx context.Context, user entities.User, onCreate func(context.Context, entities.User) error) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SaveUser", arg0)
+	ret := m.ctrl.Call(m, "SaveUser", ctx, user, onCreate)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // SaveUser indicates an expected call of SaveUser.
-func (mr *MockAuthServiceMockRecorder) SaveUser(arg0 interface{}) *gomock.Call {
+func (mr *MockAuthServiceMockRecorder) SaveUser(ctx, user, onCreate interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUser", reflect.TypeOf((*MockAuthService)(nil).SaveUser), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveUser", reflect.TypeOf((*MockAuthService)(nil).SaveUser), ctx, user, onCreate)
 }
 
 // MockLoyaltyService is a mock of LoyaltyService interface.
@@ -115,88 +116,591 @@ func (m *MockLoyaltyService) EXPECT() *MockLoyaltyServiceMockRecorder {
 	return m.recorder
 }
 
+// CaptureHold mocks base method.
+func (m *MockLoyaltyService) CaptureHold(ctx context.Context, userID, id int, sum float64) (*entities.Withdrawn, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CaptureHold", ctx, userID, id, sum)
+	ret0, _ := ret[0].(*entities.Withdrawn)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CaptureHold indicates an expected call of CaptureHold.
+func (mr *MockLoyaltyServiceMockRecorder) CaptureHold(ctx, userID, id, sum interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CaptureHold", reflect.TypeOf((*MockLoyaltyService)(nil).CaptureHold), ctx, userID, id, sum)
+}
+
+// CreateHold mocks base method.
+func (m *MockLoyaltyService) CreateHold(ctx context.Context, userID int, orderNumber string, sum float64) (*entities.Hold, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateHold", ctx, userID, orderNumber, sum)
+	ret0, _ := ret[0].(*entities.Hold)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateHold indicates an expected call of CreateHold.
+func (mr *MockLoyaltyServiceMockRecorder) CreateHold(ctx, userID, orderNumber, sum interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateHold", reflect.TypeOf((*MockLoyaltyService)(nil).CreateHold), ctx, userID, orderNumber, sum)
+}
+
+// CreatePromoRule mocks base method.
+func (m *MockLoyaltyService) CreatePromoRule(ctx context.Context, rule entities.PromoRule) (*entities.PromoRule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreatePromoRule", ctx, rule)
+	ret0, _ := ret[0].(*entities.PromoRule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreatePromoRule indicates an expected call of CreatePromoRule.
+func (mr *MockLoyaltyServiceMockRecorder) CreatePromoRule(ctx, rule interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreatePromoRule", reflect.TypeOf((*MockLoyaltyService)(nil).CreatePromoRule), ctx, rule)
+}
+
+// CreateReferral mocks base method.
+func (m *MockLoyaltyService) CreateReferral(ctx context.Context, referrerID int, referee entities.User, signupIP string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateReferral", ctx, referrerID, referee, signupIP)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// CreateReferral indicates an expected call of CreateReferral.
+func (mr *MockLoyaltyServiceMockRecorder) CreateReferral(ctx, referrerID, referee, signupIP interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateReferral", reflect.TypeOf((*MockLoyaltyService)(nil).CreateReferral), ctx, referrerID, referee, signupIP)
+}
+
+// DeletePromoRule mocks base method.
+func (m *MockLoyaltyService) DeletePromoRule(ctx context.Context, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeletePromoRule", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeletePromoRule indicates an expected call of DeletePromoRule.
+func (mr *MockLoyaltyServiceMockRecorder) DeletePromoRule(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeletePromoRule", reflect.TypeOf((*MockLoyaltyService)(nil).DeletePromoRule), ctx, id)
+}
+
+// FindReferrer mocks base method.
+func (m *MockLoyaltyService) FindReferrer(ctx context.Context, code string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindReferrer", ctx, code)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindReferrer indicates an expected call of FindReferrer.
+func (mr *MockLoyaltyServiceMockRecorder) FindReferrer(ctx, code interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindReferrer", reflect.TypeOf((*MockLoyaltyService)(nil).FindReferrer), ctx, code)
+}
+
 // GetOrder mocks base method.
-func (m *MockLoyaltyService) GetOrder(orderId string) *entities.Order {
+func (m *MockLoyaltyService) GetOrder(ctx context.Context, orderID string) *entities.Order {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetOrder", orderId)
+	ret := m.ctrl.Call(m, "GetOrder", ctx, orderID)
 	ret0, _ := ret[0].(*entities.Order)
 	return ret0
 }
 
 // GetOrder indicates an expected call of GetOrder.
-func (mr *MockLoyaltyServiceMockRecorder) GetOrder(orderId interface{}) *gomock.Call {
+func (mr *MockLoyaltyServiceMockRecorder) GetOrder(ctx, orderID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrder", reflect.TypeOf((*MockLoyaltyService)(nil).GetOrder), ctx, orderID)
+}
+
+// GetOrderCheckFailures mocks base method.
+func (m *MockLoyaltyService) GetOrderCheckFailures(ctx context.Context) []entities.OrderCheckFailure {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOrderCheckFailures", ctx)
+	ret0, _ := ret[0].([]entities.OrderCheckFailure)
+	return ret0
+}
+
+// GetOrderCheckFailures indicates an expected call of GetOrderCheckFailures.
+func (mr *MockLoyaltyServiceMockRecorder) GetOrderCheckFailures(ctx interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrder", reflect.TypeOf((*MockLoyaltyService)(nil).GetOrder), orderId)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrderCheckFailures", reflect.TypeOf((*MockLoyaltyService)(nil).GetOrderCheckFailures), ctx)
+}
+
+// GetOrderDetails mocks base method.
+func (m *MockLoyaltyService) GetOrderDetails(ctx context.Context, orderNumber string) *entities.OrderDetails {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOrderDetails", ctx, orderNumber)
+	ret0, _ := ret[0].(*entities.OrderDetails)
+	return ret0
+}
+
+// GetOrderDetails indicates an expected call of GetOrderDetails.
+func (mr *MockLoyaltyServiceMockRecorder) GetOrderDetails(ctx, orderNumber interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOrderDetails", reflect.TypeOf((*MockLoyaltyService)(nil).GetOrderDetails), ctx, orderNumber)
+}
+
+// GetPromoRules mocks base method.
+func (m *MockLoyaltyService) GetPromoRules(ctx context.Context) []*entities.PromoRule {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPromoRules", ctx)
+	ret0, _ := ret[0].([]*entities.PromoRule)
+	return ret0
+}
+
+// GetPromoRules indicates an expected call of GetPromoRules.
+func (mr *MockLoyaltyServiceMockRecorder) GetPromoRules(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPromoRules", reflect.TypeOf((*MockLoyaltyService)(nil).GetPromoRules), ctx)
+}
+
+// GetQuarantinedResponses mocks base method.
+func (m *MockLoyaltyService) GetQuarantinedResponses(ctx context.Context) []*entities.QuarantinedResponse {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetQuarantinedResponses", ctx)
+	ret0, _ := ret[0].([]*entities.QuarantinedResponse)
+	return ret0
+}
+
+// GetQuarantinedResponses indicates an expected call of GetQuarantinedResponses.
+func (mr *MockLoyaltyServiceMockRecorder) GetQuarantinedResponses(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQuarantinedResponses", reflect.TypeOf((*MockLoyaltyService)(nil).GetQuarantinedResponses), ctx)
+}
+
+// GetReconciliationReport mocks base method.
+func (m *MockLoyaltyService) GetReconciliationReport(ctx context.Context) *entities.ReconciliationReport {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetReconciliationReport", ctx)
+	ret0, _ := ret[0].(*entities.ReconciliationReport)
+	return ret0
+}
+
+// GetReconciliationReport indicates an expected call of GetReconciliationReport.
+func (mr *MockLoyaltyServiceMockRecorder) GetReconciliationReport(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetReconciliationReport", reflect.TypeOf((*MockLoyaltyService)(nil).GetReconciliationReport), ctx)
 }
 
 // GetUserBalance mocks base method.
-func (m *MockLoyaltyService) GetUserBalance(userId int) entities.Balance {
+func (m *MockLoyaltyService) GetUserBalance(ctx context.Context, userID int) entities.Balance {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserBalance", userId)
+	ret := m.ctrl.Call(m, "GetUserBalance", ctx, userID)
 	ret0, _ := ret[0].(entities.Balance)
 	return ret0
 }
 
 // GetUserBalance indicates an expected call of GetUserBalance.
-func (mr *MockLoyaltyServiceMockRecorder) GetUserBalance(userId interface{}) *gomock.Call {
+func (mr *MockLoyaltyServiceMockRecorder) GetUserBalance(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserBalance), ctx, userID)
+}
+
+// GetUserHolds mocks base method.
+func (m *MockLoyaltyService) GetUserHolds(ctx context.Context, userID int) []*entities.Hold {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserHolds", ctx, userID)
+	ret0, _ := ret[0].([]*entities.Hold)
+	return ret0
+}
+
+// GetUserHolds indicates an expected call of GetUserHolds.
+func (mr *MockLoyaltyServiceMockRecorder) GetUserHolds(ctx, userID interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserBalance", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserBalance), userId)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHolds", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserHolds), ctx, userID)
 }
 
 // GetUserOrders mocks base method.
-func (m *MockLoyaltyService) GetUserOrders(userId int) []*entities.Order {
+func (m *MockLoyaltyService) GetUserOrders(ctx context.Context, userID int, query entities.ListQuery) ([]*entities.Order, string) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserOrders", userId)
+	ret := m.ctrl.Call(m, "GetUserOrders", ctx, userID, query)
 	ret0, _ := ret[0].([]*entities.Order)
-	return ret0
+	ret1, _ := ret[1].(string)
+	return ret0, ret1
 }
 
 // GetUserOrders indicates an expected call of GetUserOrders.
-func (mr *MockLoyaltyServiceMockRecorder) GetUserOrders(userId interface{}) *gomock.Call {
+func (mr *MockLoyaltyServiceMockRecorder) GetUserOrders(ctx, userID, query interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOrders", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserOrders), userId)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserOrders", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserOrders), ctx, userID, query)
+}
+
+// GetUserReferrals mocks base method.
+func (m *MockLoyaltyService) GetUserReferrals(ctx context.Context, user entities.User, clientIP string) (entities.ReferralSummary, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserReferrals", ctx, user, clientIP)
+	ret0, _ := ret[0].(entities.ReferralSummary)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserReferrals indicates an expected call of GetUserReferrals.
+func (mr *MockLoyaltyServiceMockRecorder) GetUserReferrals(ctx, user, clientIP interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserReferrals", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserReferrals), ctx, user, clientIP)
+}
+
+// GetUserTier mocks base method.
+func (m *MockLoyaltyService) GetUserTier(ctx context.Context, userID int) entities.TierProgress {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserTier", ctx, userID)
+	ret0, _ := ret[0].(entities.TierProgress)
+	return ret0
+}
+
+// GetUserTier indicates an expected call of GetUserTier.
+func (mr *MockLoyaltyServiceMockRecorder) GetUserTier(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserTier", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserTier), ctx, userID)
 }
 
 // GetUserWithdrawals mocks base method.
-func (m *MockLoyaltyService) GetUserWithdrawals(userId int) []*entities.Withdrawn {
+func (m *MockLoyaltyService) GetUserWithdrawals(ctx context.Context, userID int, query entities.ListQuery) ([]*entities.Withdrawn, string) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetUserWithdrawals", userId)
+	ret := m.ctrl.Call(m, "GetUserWithdrawals", ctx, userID, query)
 	ret0, _ := ret[0].([]*entities.Withdrawn)
-	return ret0
+	ret1, _ := ret[1].(string)
+	return ret0, ret1
 }
 
 // GetUserWithdrawals indicates an expected call of GetUserWithdrawals.
-func (mr *MockLoyaltyServiceMockRecorder) GetUserWithdrawals(userId interface{}) *gomock.Call {
+func (mr *MockLoyaltyServiceMockRecorder) GetUserWithdrawals(ctx, userID, query interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserWithdrawals", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserWithdrawals), userId)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserWithdrawals", reflect.TypeOf((*MockLoyaltyService)(nil).GetUserWithdrawals), ctx, userID, query)
+}
+
+// RecordUserIP mocks base method.
+func (m *MockLoyaltyService) RecordUserIP(ctx context.Context, userID int, ip string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RecordUserIP", ctx, userID, ip)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RecordUserIP indicates an expected call of RecordUserIP.
+func (mr *MockLoyaltyServiceMockRecorder) RecordUserIP(ctx, userID, ip interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RecordUserIP", reflect.TypeOf((*MockLoyaltyService)(nil).RecordUserIP), ctx, userID, ip)
+}
+
+// RefreshOrder mocks base method.
+func (m *MockLoyaltyService) RefreshOrder(ctx context.Context, orderNumber string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RefreshOrder", ctx, orderNumber)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RefreshOrder indicates an expected call of RefreshOrder.
+func (mr *MockLoyaltyServiceMockRecorder) RefreshOrder(ctx, orderNumber interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RefreshOrder", reflect.TypeOf((*MockLoyaltyService)(nil).RefreshOrder), ctx, orderNumber)
+}
+
+// ReleaseHold mocks base method.
+func (m *MockLoyaltyService) ReleaseHold(ctx context.Context, userID, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReleaseHold", ctx, userID, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ReleaseHold indicates an expected call of ReleaseHold.
+func (mr *MockLoyaltyServiceMockRecorder) ReleaseHold(ctx, userID, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReleaseHold", reflect.TypeOf((*MockLoyaltyService)(nil).ReleaseHold), ctx, userID, id)
+}
+
+// ResolveQuarantinedResponse mocks base method.
+func (m *MockLoyaltyService) ResolveQuarantinedResponse(ctx context.Context, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveQuarantinedResponse", ctx, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ResolveQuarantinedResponse indicates an expected call of ResolveQuarantinedResponse.
+func (mr *MockLoyaltyServiceMockRecorder) ResolveQuarantinedResponse(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveQuarantinedResponse", reflect.TypeOf((*MockLoyaltyService)(nil).ResolveQuarantinedResponse), ctx, id)
+}
+
+// ReverseWithdrawn mocks base method.
+func (m *MockLoyaltyService) ReverseWithdrawn(ctx context.Context, request entities.ReverseWithdrawnRequest) (*entities.LedgerEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReverseWithdrawn", ctx, request)
+	ret0, _ := ret[0].(*entities.LedgerEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ReverseWithdrawn indicates an expected call of ReverseWithdrawn.
+func (mr *MockLoyaltyServiceMockRecorder) ReverseWithdrawn(ctx, request interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReverseWithdrawn", reflect.TypeOf((*MockLoyaltyService)(nil).ReverseWithdrawn), ctx, request)
 }
 
 // SaveOrder mocks base method.
-func (m *MockLoyaltyService) SaveOrder(arg0 entities.Order) error {
+func (m *MockLoyaltyService) SaveOrder(ctx context.Context, order entities.Order) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SaveOrder", arg0)
+	ret := m.ctrl.Call(m, "SaveOrder", ctx, order)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // SaveOrder indicates an expected call of SaveOrder.
-func (mr *MockLoyaltyServiceMockRecorder) SaveOrder(arg0 interface{}) *gomock.Call {
+func (mr *MockLoyaltyServiceMockRecorder) SaveOrder(ctx, order interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveOrder", reflect.TypeOf((*MockLoyaltyService)(nil).SaveOrder), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveOrder", reflect.TypeOf((*MockLoyaltyService)(nil).SaveOrder), ctx, order)
 }
 
 // SaveWithdrawn mocks base method.
-func (m *MockLoyaltyService) SaveWithdrawn(arg0 entities.Withdrawn) error {
+func (m *MockLoyaltyService) SaveWithdrawn(ctx context.Context, withdrawn entities.Withdrawn) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SaveWithdrawn", arg0)
+	ret := m.ctrl.Call(m, "SaveWithdrawn", ctx, withdrawn)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // SaveWithdrawn indicates an expected call of SaveWithdrawn.
-func (mr *MockLoyaltyServiceMockRecorder) SaveWithdrawn(arg0 interface{}) *gomock.Call {
+func (mr *MockLoyaltyServiceMockRecorder) SaveWithdrawn(ctx, withdrawn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveWithdrawn", reflect.TypeOf((*MockLoyaltyService)(nil).SaveWithdrawn), ctx, withdrawn)
+}
+
+// StartReconcile mocks base method.
+func (m *MockLoyaltyService) StartReconcile(ctx context.Context, options entities.ReconcileOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "StartReconcile", ctx, options)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// StartReconcile indicates an expected call of StartReconcile.
+func (mr *MockLoyaltyServiceMockRecorder) StartReconcile(ctx, options interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartReconcile", reflect.TypeOf((*MockLoyaltyService)(nil).StartReconcile), ctx, options)
+}
+
+// UpdatePromoRule mocks base method.
+func (m *MockLoyaltyService) UpdatePromoRule(ctx context.Context, rule entities.PromoRule) (*entities.PromoRule, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdatePromoRule", ctx, rule)
+	ret0, _ := ret[0].(*entities.PromoRule)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdatePromoRule indicates an expected call of UpdatePromoRule.
+func (mr *MockLoyaltyServiceMockRecorder) UpdatePromoRule(ctx, rule interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdatePromoRule", reflect.TypeOf((*MockLoyaltyService)(nil).UpdatePromoRule), ctx, rule)
+}
+
+// MockOrderStream is a mock of OrderStream interface.
+type MockOrderStream struct {
+	ctrl     *gomock.Controller
+	recorder *MockOrderStreamMockRecorder
+}
+
+// MockOrderStreamMockRecorder is the mock recorder for MockOrderStream.
+type MockOrderStreamMockRecorder struct {
+	mock *MockOrderStream
+}
+
+// NewMockOrderStream creates a new mock instance.
+func NewMockOrderStream(ctrl *gomock.Controller) *MockOrderStream {
+	mock := &MockOrderStream{ctrl: ctrl}
+	mock.recorder = &MockOrderStreamMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockOrderStream) EXPECT() *MockOrderStreamMockRecorder {
+	return m.recorder
+}
+
+// Subscribe mocks base method.
+func (m *MockOrderStream) Subscribe(userID int, lastEventID int64) ([]entities.OrderEvent, <-chan entities.OrderEvent, func()) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Subscribe", userID, lastEventID)
+	ret0, _ := ret[0].([]entities.OrderEvent)
+	ret1, _ := ret[1].(<-chan entities.OrderEvent)
+	ret2, _ := ret[2].(func())
+	return ret0, ret1, ret2
+}
+
+// Subscribe indicates an expected call of Subscribe.
+func (mr *MockOrderStreamMockRecorder) Subscribe(userID, lastEventID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Subscribe", reflect.TypeOf((*MockOrderStream)(nil).Subscribe), userID, lastEventID)
+}
+
+// MockWebhookService is a mock of WebhookService interface.
+type MockWebhookService struct {
+	ctrl     *gomock.Controller
+	recorder *MockWebhookServiceMockRecorder
+}
+
+// MockWebhookServiceMockRecorder is the mock recorder for MockWebhookService.
+type MockWebhookServiceMockRecorder struct {
+	mock *MockWebhookService
+}
+
+// NewMockWebhookService creates a new mock instance.
+func NewMockWebhookService(ctrl *gomock.Controller) *MockWebhookService {
+	mock := &MockWebhookService{ctrl: ctrl}
+	mock.recorder = &MockWebhookServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockWebhookService) EXPECT() *MockWebhookServiceMockRecorder {
+	return m.recorder
+}
+
+// CreateWebhook mocks base method.
+func (m *MockWebhookService) CreateWebhook(ctx context.Context, userID int, url string, events []string) (*entities.Webhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateWebhook", ctx, userID, url, events)
+	ret0, _ := ret[0].(*entities.Webhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateWebhook indicates an expected call of CreateWebhook.
+func (mr *MockWebhookServiceMockRecorder) CreateWebhook(ctx, userID, url, events interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateWebhook", reflect.TypeOf((*MockWebhookService)(nil).CreateWebhook), ctx, userID, url, events)
+}
+
+// DeleteWebhook mocks base method.
+func (m *MockWebhookService) DeleteWebhook(ctx context.Context, userID, id int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteWebhook", ctx, userID, id)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteWebhook indicates an expected call of DeleteWebhook.
+func (mr *MockWebhookServiceMockRecorder) DeleteWebhook(ctx, userID, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteWebhook", reflect.TypeOf((*MockWebhookService)(nil).DeleteWebhook), ctx, userID, id)
+}
+
+// GetDeliveries mocks base method.
+func (m *MockWebhookService) GetDeliveries(ctx context.Context, filter entities.WebhookDeliveryFilter) []*entities.WebhookDelivery {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDeliveries", ctx, filter)
+	ret0, _ := ret[0].([]*entities.WebhookDelivery)
+	return ret0
+}
+
+// GetDeliveries indicates an expected call of GetDeliveries.
+func (mr *MockWebhookServiceMockRecorder) GetDeliveries(ctx, filter interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeliveries", reflect.TypeOf((*MockWebhookService)(nil).GetDeliveries), ctx, filter)
+}
+
+// GetWebhooks mocks base method.
+func (m *MockWebhookService) GetWebhooks(ctx context.Context, userID int) []*entities.Webhook {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWebhooks", ctx, userID)
+	ret0, _ := ret[0].([]*entities.Webhook)
+	return ret0
+}
+
+// GetWebhooks indicates an expected call of GetWebhooks.
+func (mr *MockWebhookServiceMockRecorder) GetWebhooks(ctx, userID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWebhooks", reflect.TypeOf((*MockWebhookService)(nil).GetWebhooks), ctx, userID)
+}
+
+// Redeliver mocks base method.
+func (m *MockWebhookService) Redeliver(ctx context.Context, userID *int, id int) (*entities.WebhookDelivery, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Redeliver", ctx, userID, id)
+	ret0, _ := ret[0].(*entities.WebhookDelivery)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Redeliver indicates an expected call of Redeliver.
+func (mr *MockWebhookServiceMockRecorder) Redeliver(ctx, userID, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Redeliver", reflect.TypeOf((*MockWebhookService)(nil).Redeliver), ctx, userID, id)
+}
+
+// MockIdempotencyService is a mock of IdempotencyService interface.
+type MockIdempotencyService struct {
+	ctrl     *gomock.Controller
+	recorder *MockIdempotencyServiceMockRecorder
+}
+
+// MockIdempotencyServiceMockRecorder is the mock recorder for MockIdempotencyService.
+type MockIdempotencyServiceMockRecorder struct {
+	mock *MockIdempotencyService
+}
+
+// NewMockIdempotencyService creates a new mock instance.
+func NewMockIdempotencyService(ctrl *gomock.Controller) *MockIdempotencyService {
+	mock := &MockIdempotencyService{ctrl: ctrl}
+	mock.recorder = &MockIdempotencyServiceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockIdempotencyService) EXPECT() *MockIdempotencyServiceMockRecorder {
+	return m.recorder
+}
+
+// Abort mocks base method.
+func (m *MockIdempotencyService) Abort(ctx context.Context, userID int, key, leaseToken string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Abort", ctx, userID, key, leaseToken)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Abort indicates an expected call of Abort.
+func (mr *MockIdempotencyServiceMockRecorder) Abort(ctx, userID, key, leaseToken interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Abort", reflect.TypeOf((*MockIdempotencyService)(nil).Abort), ctx, userID, key, leaseToken)
+}
+
+// Begin mocks base method.
+func (m *MockIdempotencyService) Begin(ctx context.Context, userID int, key, fingerprint string) (*entities.IdempotencyRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Begin", ctx, userID, key, fingerprint)
+	ret0, _ := ret[0].(*entities.IdempotencyRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Begin indicates an expected call of Begin.
+func (mr *MockIdempotencyServiceMockRecorder) Begin(ctx, userID, key, fingerprint interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Begin", reflect.TypeOf((*MockIdempotencyService)(nil).Begin), ctx, userID, key, fingerprint)
+}
+
+// Complete mocks base method.
+func (m *MockIdempotencyService) Complete(ctx context.Context, userID int, key, leaseToken string, statusCode int, contentType string, body []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Complete", ctx, userID, key, leaseToken, statusCode, contentType, body)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Complete indicates an expected call of Complete.
+func (mr *MockIdempotencyServiceMockRecorder) Complete(ctx, userID, key, leaseToken, statusCode, contentType, body interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveWithdrawn", reflect.TypeOf((*MockLoyaltyService)(nil).SaveWithdrawn), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Complete", reflect.TypeOf((*MockIdempotencyService)(nil).Complete), ctx, userID, key, leaseToken, statusCode, contentType, body)
 }
 
 // MockJobService is a mock of JobService interface.
@@ -223,29 +727,29 @@ func (m *MockJobService) EXPECT() *MockJobServiceMockRecorder {
 }
 
 // GetNotCalcOrders mocks base method.
-func (m *MockJobService) GetNotCalcOrders() []*entities.Order {
+func (m *MockJobService) GetNotCalcOrders(ctx context.Context) []*entities.Order {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetNotCalcOrders")
+	ret := m.ctrl.Call(m, "GetNotCalcOrders", ctx)
 	ret0, _ := ret[0].([]*entities.Order)
 	return ret0
 }
 
 // GetNotCalcOrders indicates an expected call of GetNotCalcOrders.
-func (mr *MockJobServiceMockRecorder) GetNotCalcOrders() *gomock.Call {
+func (mr *MockJobServiceMockRecorder) GetNotCalcOrders(ctx interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNotCalcOrders", reflect.TypeOf((*MockJobService)(nil).GetNotCalcOrders))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNotCalcOrders", reflect.TypeOf((*MockJobService)(nil).GetNotCalcOrders), ctx)
 }
 
 // SaveOrder mocks base method.
-func (m *MockJobService) SaveOrder(arg0 entities.Order) error {
+func (m *MockJobService) SaveOrder(ctx context.Context, order entities.Order) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SaveOrder", arg0)
+	ret := m.ctrl.Call(m, "SaveOrder", ctx, order)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // SaveOrder indicates an expected call of SaveOrder.
-func (mr *MockJobServiceMockRecorder) SaveOrder(arg0 interface{}) *gomock.Call {
+func (mr *MockJobServiceMockRecorder) SaveOrder(ctx, order interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveOrder", reflect.TypeOf((*MockJobService)(nil).SaveOrder), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SaveOrder", reflect.TypeOf((*MockJobService)(nil).SaveOrder), ctx, order)
 }
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+func (handler Handler) GetPromoRules(w http.ResponseWriter, r *http.Request) {
+	rules := handler.LoyaltyService.GetPromoRules(r.Context())
+	if rules == nil {
+		rules = make([]*entities.PromoRule, 0)
+	}
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// CreatePromoRule создает правило, без поля active правило сразу включено.
+func (handler Handler) CreatePromoRule(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodePromoRule(w, r)
+	if !ok {
+		return
+	}
+
+	created, err := handler.LoyaltyService.CreatePromoRule(r.Context(), rule)
+	handlePromoRuleResult(w, http.StatusCreated, created, err)
+}
+
+func (handler Handler) UpdatePromoRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rule, ok := decodePromoRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = id
+
+	updated, err := handler.LoyaltyService.UpdatePromoRule(r.Context(), rule)
+	handlePromoRuleResult(w, http.StatusOK, updated, err)
+}
+
+func (handler Handler) DeletePromoRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = handler.LoyaltyService.DeletePromoRule(r.Context(), id)
+	if errors.Is(err, entities.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Get().Warn("delete promo rule error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodePromoRule(w http.ResponseWriter, r *http.Request) (entities.PromoRule, bool) {
+	rule := entities.PromoRule{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return rule, false
+	}
+	return rule, true
+}
+
+func handlePromoRuleResult(w http.ResponseWriter, code int, rule *entities.PromoRule, err error) {
+	switch {
+	case errors.Is(err, entities.ErrInvalidInput):
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, entities.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case err != nil:
+		logger.Get().Warn("save promo rule error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		writeJSON(w, code, rule)
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// userRateLimiter пропускает не больше одного запроса пользователя за interval.
+type userRateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[int]time.Time
+}
+
+func newUserRateLimiter(interval time.Duration) *userRateLimiter {
+	return &userRateLimiter{
+		interval: interval,
+		last:     make(map[int]time.Time),
+	}
+}
+
+// Allow возвращает false и время до следующей разрешенной попытки, если лимит исчерпан.
+func (limiter *userRateLimiter) Allow(userID int) (bool, time.Duration) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := limiter.last[userID]; ok {
+		if wait := limiter.interval - now.Sub(last); wait > 0 {
+			return false, wait
+		}
+	}
+
+	limiter.last[userID] = now
+	return true, 0
+}
+
+// run раз в interval удаляет пользователей, чей лимит уже восстановился, пока не отменен ctx.
+func (limiter *userRateLimiter) run(ctx context.Context) {
+	if limiter.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(limiter.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			limiter.sweep(time.Now())
+		}
+	}
+}
+
+func (limiter *userRateLimiter) sweep(now time.Time) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	for id, last := range limiter.last {
+		if now.Sub(last) >= limiter.interval {
+			delete(limiter.last, id)
+		}
+	}
+}
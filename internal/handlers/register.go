@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 
@@ -10,6 +12,12 @@ import (
 	"go.uber.org/zap"
 )
 
+type registerRequest struct {
+	entities.User
+	ReferralCode string `json:"referral_code"`
+}
+
+// Register регистрирует пользователя, необязательный referral_code связывает его с пригласившим.
 func (handler Handler) Register(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -17,12 +25,13 @@ func (handler Handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var inputUser entities.User
-	err = json.Unmarshal(body, &inputUser)
+	var input registerRequest
+	err = json.Unmarshal(body, &input)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	inputUser := input.User
 
 	err = inputUser.Validate()
 	if err != nil {
@@ -30,16 +39,45 @@ func (handler Handler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existUser := handler.AuthService.GetUser(inputUser.Login)
+	existUser := handler.AuthService.GetUser(r.Context(), inputUser.Login)
 	if existUser != nil {
 		w.WriteHeader(http.StatusConflict)
 		return
 	}
 
+	referrerID := 0
+	if input.ReferralCode != "" {
+		referrerID, err = handler.LoyaltyService.FindReferrer(r.Context(), input.ReferralCode)
+		if errors.Is(err, entities.ErrInvalidInput) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Get().Warn("find referrer error", zap.String("error", err.Error()))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// адрес регистрации и приглашение сохраняются в одной транзакции с пользователем
+	signupIP := clientIP(r)
 	inputUser.HashingPassword()
-	handler.AuthService.SaveUser(inputUser)
+	err = handler.AuthService.SaveUser(r.Context(), inputUser, func(ctx context.Context, user entities.User) error {
+		if err := handler.LoyaltyService.RecordUserIP(ctx, user.ID, signupIP); err != nil {
+			return err
+		}
+		if referrerID == 0 {
+			return nil
+		}
+		return handler.LoyaltyService.CreateReferral(ctx, referrerID, user, signupIP)
+	})
+	if err != nil {
+		logger.Get().Warn("register user error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	token, err := handler.AuthService.BuildUserToken(inputUser)
+	token, err := handler.AuthService.BuildUserToken(r.Context(), inputUser)
 	if err != nil {
 		logger.Get().Warn("can't set token", zap.String("error", err.Error()))
 		w.WriteHeader(http.StatusInternalServerError)
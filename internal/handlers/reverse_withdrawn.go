@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+type reverseWithdrawnRequest struct {
+	Amount float64 `json:"amount"`
+	Reason string  `json:"reason"`
+}
+
+// ReverseWithdrawn возвращает пользователю баллы по списанию, amount можно не передавать,
+// тогда возвращается весь остаток.
+func (handler Handler) ReverseWithdrawn(w http.ResponseWriter, r *http.Request) {
+	var input reverseWithdrawnRequest
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	entry, err := handler.LoyaltyService.ReverseWithdrawn(r.Context(), entities.ReverseWithdrawnRequest{
+		OrderNumber: chi.URLParam(r, "number"),
+		Amount:      input.Amount,
+		Reason:      input.Reason,
+	})
+	switch {
+	case errors.Is(err, entities.ErrInvalidInput):
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Is(err, entities.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, entities.ErrReversalExceedsWithdrawn):
+		w.WriteHeader(http.StatusConflict)
+	case err != nil:
+		logger.Get().Warn("reverse withdrawn error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusCreated, entry)
+	}
+}
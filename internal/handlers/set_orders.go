@@ -34,7 +34,7 @@ func (handler Handler) SetOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existOrder := handler.LoyaltyService.GetOrder(numOrder)
+	existOrder := handler.LoyaltyService.GetOrder(r.Context(), numOrder)
 	if existOrder != nil {
 		if existOrder.UserID == user.ID {
 			w.WriteHeader(http.StatusOK)
@@ -46,7 +46,7 @@ func (handler Handler) SetOrders(w http.ResponseWriter, r *http.Request) {
 	}
 
 	order := entities.NewOrder(numOrder, user.ID)
-	err = handler.LoyaltyService.SaveOrder(*order)
+	err = handler.LoyaltyService.SaveOrder(r.Context(), *order)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	streamHeartbeatInterval = 15 * time.Second
+	streamEventName         = "order"
+)
+
+// StreamOrders отдает изменения заказов пользователя через SSE, а при заголовке
+// Upgrade: websocket - через WebSocket. Пропущенные события можно дочитать,
+// передав Last-Event-ID в заголовке или параметре last_event_id.
+func (handler Handler) StreamOrders(w http.ResponseWriter, r *http.Request) {
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if handler.OrderStream == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	lastEventID, err := getLastEventID(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	replay, events, cancel := handler.OrderStream.Subscribe(user.ID, lastEventID)
+	defer cancel()
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		streamOrdersWebSocket(w, r, replay, events)
+		return
+	}
+	streamOrdersSSE(w, r, replay, events)
+}
+
+func getLastEventID(r *http.Request) (int64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func streamOrdersSSE(w http.ResponseWriter, r *http.Request, replay []entities.OrderEvent, events <-chan entities.OrderEvent) {
+	controller := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event entities.OrderEvent) error {
+		if err := writeSSEEvent(w, event); err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	for _, event := range replay {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		logger.Get().Warn("stream flush error", zap.String("error", err.Error()))
+		return
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := controller.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSEEvent пишет событие в том же виде, что и WebSocket: {"id":...,"order":{...}}.
+func writeSSEEvent(w io.Writer, event entities.OrderEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, streamEventName, data)
+	return err
+}
+
+func streamOrdersWebSocket(w http.ResponseWriter, r *http.Request, replay []entities.OrderEvent, events <-chan entities.OrderEvent) {
+	server := websocket.Server{
+		// клиент уже авторизован токеном, Origin не проверяем
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			defer conn.Close()
+
+			// клиент ничего не присылает, читаем только чтобы заметить закрытие соединения
+			closed := make(chan struct{})
+			go func() {
+				io.Copy(io.Discard, conn)
+				close(closed)
+			}()
+
+			for _, event := range replay {
+				if err := websocket.JSON.Send(conn, event); err != nil {
+					return
+				}
+			}
+
+			heartbeat := time.NewTicker(streamHeartbeatInterval)
+			defer heartbeat.Stop()
+
+			for {
+				select {
+				case event, ok := <-events:
+					if !ok {
+						return
+					}
+					if err := websocket.JSON.Send(conn, event); err != nil {
+						return
+					}
+				case <-heartbeat.C:
+					if err := websocket.Message.Send(conn, ""); err != nil {
+						return
+					}
+				case <-closed:
+					return
+				case <-r.Context().Done():
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookDeliveriesLimit = 100
+)
+
+type webhookInput struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// webhook-обработчики общие для пользователя и администратора: для администратора
+// владельцем считается userID == 0, а доставки видны по всем пользователям.
+
+func (handler Handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := getWebhookOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var input webhookInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	webhook, err := handler.WebhookService.CreateWebhook(r.Context(), userID, input.URL, input.Events)
+	if errors.Is(err, entities.ErrInvalidInput) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Get().Warn("create webhook error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, webhook)
+}
+
+func (handler Handler) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := getWebhookOwner(w, r)
+	if !ok {
+		return
+	}
+
+	webhooks := handler.WebhookService.GetWebhooks(r.Context(), userID)
+	if len(webhooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+func (handler Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, _, ok := getWebhookOwner(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = handler.WebhookService.DeleteWebhook(r.Context(), userID, id)
+	if errors.Is(err, entities.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Get().Warn("delete webhook error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handler Handler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	_, filterUserID, ok := getWebhookOwner(w, r)
+	if !ok {
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && !slices.Contains([]string{
+		entities.WebhookDeliveryStatusPending,
+		entities.WebhookDeliveryStatusDelivered,
+		entities.WebhookDeliveryStatusDead,
+	}, status) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	deliveries := handler.WebhookService.GetDeliveries(r.Context(), entities.WebhookDeliveryFilter{
+		UserID: filterUserID,
+		Status: status,
+		Limit:  webhookDeliveriesLimit,
+	})
+	if len(deliveries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+func (handler Handler) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	_, filterUserID, ok := getWebhookOwner(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	delivery, err := handler.WebhookService.Redeliver(r.Context(), filterUserID, id)
+	if errors.Is(err, entities.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Get().Warn("redeliver webhook error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+// getWebhookOwner возвращает владельца вебхуков и фильтр доставок:
+// для пользователя - его ID, для администратора - 0 и nil.
+func getWebhookOwner(w http.ResponseWriter, r *http.Request) (int, *int, bool) {
+	if isAdminRequest(r) {
+		return 0, nil, true
+	}
+
+	user, err := getRequestUser(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return 0, nil, false
+	}
+	return user.ID, &user.ID, true
+}
+
+func writeJSON(w http.ResponseWriter, code int, value any) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		logger.Get().Warn("json marshal error", zap.String("error", err.Error()))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
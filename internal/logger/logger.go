@@ -1,25 +1,105 @@
 package logger
 
-import "go.uber.org/zap"
+import (
+	"net/http"
+	"sync/atomic"
 
-// var state *zap.Logger
-var state *CustomLogger
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	EncodingJSON    = "json"
+	EncodingConsole = "console"
+)
+
+// state читается из обработчиков запросов параллельно с NewLogger.
+var state atomic.Pointer[CustomLogger]
 
 type CustomLogger struct {
 	*zap.Logger
+	level zap.AtomicLevel
+}
+
+type Config struct {
+	Level              string
+	Encoding           string
+	OutputPaths        []string
+	SamplingInitial    int
+	SamplingThereafter int
+}
+
+// DefaultConfig повторяет настройки zap.NewProduction.
+func DefaultConfig() Config {
+	return Config{
+		Level:              "info",
+		Encoding:           EncodingJSON,
+		OutputPaths:        []string{"stderr"},
+		SamplingInitial:    100,
+		SamplingThereafter: 100,
+	}
 }
 
-func NewLogger() error {
-	zLogger, err := zap.NewProduction()
+func NewLogger(config Config) error {
+	level, err := zap.ParseAtomicLevel(config.Level)
 	if err != nil {
 		return err
 	}
-	state = &CustomLogger{
-		Logger: zLogger,
+
+	zConfig := zap.NewProductionConfig()
+	zConfig.Level = level
+
+	switch config.Encoding {
+	case "", EncodingJSON:
+		zConfig.Encoding = EncodingJSON
+	case EncodingConsole:
+		zConfig.Encoding = EncodingConsole
+		zConfig.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+		zConfig.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	default:
+		zConfig.Encoding = config.Encoding
+	}
+
+	if len(config.OutputPaths) > 0 {
+		zConfig.OutputPaths = config.OutputPaths
 	}
+
+	// sampling отключается нулевым initial или thereafter: для zap нулевой thereafter
+	// означает отбрасывать все сообщения сверх initial
+	zConfig.Sampling = nil
+	if config.SamplingInitial > 0 && config.SamplingThereafter > 0 {
+		zConfig.Sampling = &zap.SamplingConfig{
+			Initial:    config.SamplingInitial,
+			Thereafter: config.SamplingThereafter,
+		}
+	}
+
+	zLogger, err := zConfig.Build()
+	if err != nil {
+		return err
+	}
+	state.Store(&CustomLogger{
+		Logger: zLogger,
+		level:  level,
+	})
 	return nil
 }
 
+// Get возвращает no-op логгер, если NewLogger еще не вызывался.
 func Get() *CustomLogger {
-	return state
+	if logger := state.Load(); logger != nil {
+		return logger
+	}
+	return &CustomLogger{
+		Logger: zap.NewNop(),
+		level:  zap.NewAtomicLevel(),
+	}
+}
+
+// LevelHandler позволяет читать (GET) и менять (PUT {"level":"debug"}) уровень логирования на лету.
+// Логгер берется на каждый запрос: NewLogger после монтирования роутера заменяет его целиком.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Get().level.ServeHTTP(w, r)
+	})
 }
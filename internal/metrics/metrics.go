@@ -0,0 +1,88 @@
+// Package metrics - минимальный реестр метрик в текстовом формате Prometheus.
+// Значения снимаются функциями в момент запроса, поэтому сервисам не нужно ничего обновлять.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	TypeGauge   = "gauge"
+	TypeCounter = "counter"
+)
+
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	labels map[string]string
+	value  func() float64
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+var defaultRegistry = &Registry{}
+
+// Default возвращает общий реестр приложения.
+func Default() *Registry {
+	return defaultRegistry
+}
+
+// Gauge регистрирует метрику, значение которой может как расти, так и уменьшаться.
+func (registry *Registry) Gauge(name string, help string, labels map[string]string, value func() float64) {
+	registry.add(metric{name: name, help: help, kind: TypeGauge, labels: labels, value: value})
+}
+
+// Counter регистрирует монотонно растущую метрику.
+func (registry *Registry) Counter(name string, help string, labels map[string]string, value func() float64) {
+	registry.add(metric{name: name, help: help, kind: TypeCounter, labels: labels, value: value})
+}
+
+func (registry *Registry) add(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.mu.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.mu.Unlock()
+
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	var previous string
+	for _, m := range metrics {
+		if m.name != previous {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+			previous = m.name
+		}
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels), strconv.FormatFloat(m.value(), 'g', -1, 64))
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+strconv.Quote(labels[key]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
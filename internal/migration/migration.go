@@ -24,14 +24,38 @@ func Run(dsn string) error {
 	if err != nil {
 		return err
 	}
+	defer database.Close(db)
+
+	return Migrate(db)
+}
+
+// Migrate приводит схему к сущностям через уже открытое подключение.
+func Migrate(db *gorm.DB) error {
+	if db == nil {
+		return ErrEmptyDBConnectRow
+	}
 
 	e := []interface{}{
 		entities.User{},
 		entities.Order{},
+		entities.OrderStatusChange{},
 		entities.Withdrawn{},
+		entities.Webhook{},
+		entities.WebhookDelivery{},
+		entities.OutboxEvent{},
+		entities.QuarantinedResponse{},
+		entities.LedgerEntry{},
+		entities.IdempotencyRecord{},
+		entities.Hold{},
+		entities.Tier{},
+		entities.UserTier{},
+		entities.PromoRule{},
+		entities.ReferralCode{},
+		entities.UserIP{},
+		entities.Referral{},
 	}
 
-	err = Migration(db, e...)
+	err := Migration(db, e...)
 
 	if err != nil {
 		logger.Get().Warn("migration error", zap.String("error", err.Error()))
@@ -40,27 +64,30 @@ func Run(dsn string) error {
 	return nil
 }
 
+// Migration приводит схему к сущностям, не удаляя данные: перед AutoMigrate
+// шаги готовят существующие строки к новым ограничениям, после - дозаполняют новые колонки.
 func Migration(db *gorm.DB, items ...interface{}) error {
-	for _, item := range items {
-		// дропаем таблицы для чистоты каждого запуска
-		if db.Migrator().HasTable(&item) {
-			err := db.Migrator().DropTable(&item)
-			if err != nil {
-				return err
-			}
+	for _, step := range beforeSteps {
+		if err := runStep(db, step); err != nil {
+			return err
 		}
+	}
 
-		if !db.Migrator().HasTable(&item) {
-			err := db.Migrator().CreateTable(&item)
-			if err != nil {
-				return err
-			}
+	for _, item := range items {
+		if err := db.AutoMigrate(item); err != nil {
+			return err
 		}
 
 		name := getEntityName(item)
 		logger.Get().Info("Entity migration done", zap.String("name", name))
 	}
 
+	for _, step := range afterSteps {
+		if err := runStep(db, step); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,106 @@
+package migration
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/besean163/gophermart/internal/logger"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// step - изменение данных, которое AutoMigrate сам не сделает. Шаг должен быть
+// идемпотентным: миграция запускается при каждом старте приложения.
+type step struct {
+	name string
+	run  func(tx *gorm.DB) (int64, error)
+}
+
+// beforeSteps выполняются до AutoMigrate.
+var beforeSteps = []step{
+	{name: "archive duplicate withdrawals", run: archiveDuplicateWithdrawals},
+	{name: "delete duplicate webhook deliveries", run: deleteDuplicateWebhookDeliveries},
+}
+
+// afterSteps выполняются после AutoMigrate.
+var afterSteps = []step{
+	{name: "backfill order upload time", run: backfillOrderUploadedAt},
+}
+
+func runStep(db *gorm.DB, step step) error {
+	var affected int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		affected, err = step.run(tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", step.name, err)
+	}
+	if affected > 0 {
+		logger.Get().Warn("migration step done", zap.String("step", step.name), zap.Int64("rows", affected))
+	}
+	return nil
+}
+
+// archivedWithdrawn - списание, убранное из withdrawns из-за повтора номера заказа.
+type archivedWithdrawn struct {
+	ID          int `gorm:"primarykey"`
+	UserID      int `gorm:"index"`
+	OrderNumber string
+	Sum         float64
+	ProccesedAt time.Time
+	ArchivedAt  time.Time
+}
+
+// archiveDuplicateWithdrawals оставляет самое раннее списание по каждому номеру заказа,
+// остальные переносит в archived_withdrawns, чтобы можно было построить уникальный индекс.
+func archiveDuplicateWithdrawals(tx *gorm.DB) (int64, error) {
+	if !tx.Migrator().HasTable("withdrawns") {
+		return 0, nil
+	}
+
+	const duplicates = `FROM withdrawns w WHERE EXISTS (
+		SELECT 1 FROM withdrawns e
+		WHERE e.order_number = w.order_number AND (e.proccesed_at, e.id) < (w.proccesed_at, w.id))`
+
+	var orders []string
+	if err := tx.Raw("SELECT DISTINCT w.order_number " + duplicates).Scan(&orders).Error; err != nil {
+		return 0, err
+	}
+	if len(orders) == 0 {
+		return 0, nil
+	}
+	logger.Get().Warn("duplicate withdrawals found", zap.Strings("orders", orders))
+
+	if err := tx.AutoMigrate(&archivedWithdrawn{}); err != nil {
+		return 0, err
+	}
+	err := tx.Exec(`INSERT INTO archived_withdrawns (id, user_id, order_number, sum, proccesed_at, archived_at)
+		SELECT w.id, w.user_id, w.order_number, w.sum, w.proccesed_at, ? `+duplicates, time.Now()).Error
+	if err != nil {
+		return 0, err
+	}
+	result := tx.Exec("DELETE " + duplicates)
+	return result.RowsAffected, result.Error
+}
+
+// deleteDuplicateWebhookDeliveries оставляет первую доставку события каждому вебхуку.
+func deleteDuplicateWebhookDeliveries(tx *gorm.DB) (int64, error) {
+	if !tx.Migrator().HasTable("webhook_deliveries") {
+		return 0, nil
+	}
+
+	result := tx.Exec(`DELETE FROM webhook_deliveries d WHERE EXISTS (
+		SELECT 1 FROM webhook_deliveries e
+		WHERE e.event_id = d.event_id AND e.webhook_id = d.webhook_id AND e.id < d.id)`)
+	return result.RowsAffected, result.Error
+}
+
+// backfillOrderUploadedAt заполняет uploaded_at у заказов, загруженных до ее появления:
+// раньше время загрузки хранилось в updated_at. История статусов для таких заказов
+// не восстанавливается, она есть только для изменений после обновления.
+func backfillOrderUploadedAt(tx *gorm.DB) (int64, error) {
+	result := tx.Exec("UPDATE orders SET uploaded_at = updated_at WHERE uploaded_at IS NULL")
+	return result.RowsAffected, result.Error
+}
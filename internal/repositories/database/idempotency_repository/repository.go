@@ -0,0 +1,96 @@
+package idempotencyrepository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrEmptyBDConnection = errors.New("empty db connect")
+)
+
+type Repository struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) (Repository, error) {
+	if db == nil {
+		return Repository{}, ErrEmptyBDConnection
+	}
+
+	return Repository{
+		DB: db,
+	}, nil
+}
+
+// CreateRecord опирается на первичный ключ (user_id, key): из параллельных
+// запросов с одним ключом запись создаст только один.
+func (repository Repository) CreateRecord(ctx context.Context, record *entities.IdempotencyRecord) (bool, error) {
+	result := repository.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(record)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (repository Repository) GetRecord(ctx context.Context, userID int, key string) *entities.IdempotencyRecord {
+	var records []*entities.IdempotencyRecord
+	repository.DB.WithContext(ctx).Limit(1).Find(&records, "user_id = ? AND key = ?", userID, key)
+	if len(records) == 0 {
+		return nil
+	}
+	return records[0]
+}
+
+// SaveRecord условием на lease_token не дает запросу, потерявшему аренду, перезаписать ответ.
+func (repository Repository) SaveRecord(ctx context.Context, record *entities.IdempotencyRecord) error {
+	result := repository.DB.WithContext(ctx).
+		Model(&entities.IdempotencyRecord{}).
+		Where("user_id = ? AND key = ? AND lease_token = ?", record.UserID, record.Key, record.LeaseToken).
+		Updates(map[string]any{
+			"status_code":  record.StatusCode,
+			"content_type": record.ContentType,
+			"body":         record.Body,
+			"expires_at":   record.ExpiresAt,
+			"locked_until": record.LockedUntil,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return entities.ErrIdempotencyLeaseLost
+	}
+	return nil
+}
+
+// TakeOverRecord условием на locked_until не дает двум повторам забрать ключ одновременно.
+func (repository Repository) TakeOverRecord(ctx context.Context, record *entities.IdempotencyRecord, now time.Time) (bool, error) {
+	result := repository.DB.WithContext(ctx).
+		Model(&entities.IdempotencyRecord{}).
+		Where("user_id = ? AND key = ? AND status_code = 0 AND locked_until <= ?", record.UserID, record.Key, now).
+		Updates(map[string]any{"locked_until": record.LockedUntil, "lease_token": record.LeaseToken})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (repository Repository) DeleteRecord(ctx context.Context, userID int, key string, leaseToken string) error {
+	return repository.DB.WithContext(ctx).
+		Where("user_id = ? AND key = ? AND lease_token = ?", userID, key, leaseToken).
+		Delete(&entities.IdempotencyRecord{}).Error
+}
+
+func (repository Repository) DeleteExpiredRecords(ctx context.Context, now time.Time) (int, error) {
+	result := repository.DB.WithContext(ctx).
+		Where("expires_at <= ?", now).
+		Delete(&entities.IdempotencyRecord{})
+	return int(result.RowsAffected), result.Error
+}
@@ -0,0 +1,94 @@
+package orderqueue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/jackc/pgx/v5"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	// Channel - канал NOTIFY, payload - номер заказа.
+	Channel        = "gophermart_orders"
+	reconnectDelay = time.Second
+)
+
+var (
+	ErrEmptyBDConnection = errors.New("empty db connect")
+)
+
+// Queue рассылает уведомления о новых заказах через LISTEN/NOTIFY всем процессам,
+// подключенным к базе, в том числе отдельным cmd/accrual-worker.
+type Queue struct {
+	db  *gorm.DB
+	dsn string
+}
+
+func New(db *gorm.DB, dsn string) (Queue, error) {
+	if db == nil {
+		return Queue{}, ErrEmptyBDConnection
+	}
+
+	return Queue{
+		db:  db,
+		dsn: dsn,
+	}, nil
+}
+
+func (queue Queue) Publish(ctx context.Context, orderNumber string) error {
+	return queue.db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", Channel, orderNumber).Error
+}
+
+// Subscribe держит отдельное соединение под LISTEN, пул gorm для этого не подходит.
+// При обрыве соединение восстанавливается, пропущенные за это время заказы подберет опрос.
+func (queue Queue) Subscribe(ctx context.Context) <-chan string {
+	orders := make(chan string)
+
+	go func() {
+		defer close(orders)
+		for {
+			err := queue.listen(ctx, orders)
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Get().Warn("order queue listen error", zap.String("error", err.Error()))
+
+			select {
+			case <-time.After(reconnectDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return orders
+}
+
+func (queue Queue) listen(ctx context.Context, orders chan<- string) error {
+	conn, err := pgx.Connect(ctx, queue.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{Channel}.Sanitize())
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case orders <- notification.Payload:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
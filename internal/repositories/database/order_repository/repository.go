@@ -1,10 +1,20 @@
 package orderrepository
 
 import (
+	"context"
 	"errors"
+	"strconv"
+	"time"
 
+	"github.com/besean163/gophermart/internal/database"
 	"github.com/besean163/gophermart/internal/entities"
+	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	uniqueViolationCode = "23505"
 )
 
 var (
@@ -25,39 +35,709 @@ func NewRepository(db *gorm.DB) (Repository, error) {
 	}, nil
 }
 
-func (repository Repository) GetOrder(id string) *entities.Order {
+// conn возвращает транзакцию LockUser или регистрации пользователя, если ctx получен из нее,
+// иначе общее подключение.
+func (repository Repository) conn(ctx context.Context) *gorm.DB {
+	return database.Conn(ctx, repository.DB)
+}
+
+// LockUser выполняет fn в транзакции, заблокировав строку пользователя. Запросы репозитория
+// с контекстом fn идут через эту же транзакцию: баланс читается на том же подключении,
+// а параллельные списания и резервы пользователя ждут ее завершения.
+func (repository Repository) LockUser(ctx context.Context, userID int, fn func(ctx context.Context) error) error {
+	return repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		var users []*entities.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&users, "id = ?", userID).Error; err != nil {
+			return err
+		}
+		return fn(database.WithTx(ctx, tx))
+	})
+}
+
+func (repository Repository) GetOrder(ctx context.Context, id string) *entities.Order {
 	var order entities.Order
-	repository.DB.Take(&order, "number = ?", id)
+	repository.conn(ctx).Take(&order, "number = ?", id)
 	if order.Number == "" {
 		return nil
 	}
 	return &order
 }
 
-func (repository Repository) SaveOrder(order entities.Order) error {
-	repository.DB.Save(&order)
-	return nil
+// SaveOrder сохраняет заказ и, если статус изменился, в той же транзакции дописывает
+// запись в историю статусов и доменное событие в outbox.
+func (repository Repository) SaveOrder(ctx context.Context, order entities.Order) error {
+	return repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		_, err := saveOrder(tx, order)
+		return err
+	})
+}
+
+// SaveOrderChange сохраняет заказ и порожденные им записи в одной транзакции. Строка заказа
+// заблокирована, поэтому из параллельных сохранений одного перехода записи применит только первое.
+func (repository Repository) SaveOrderChange(ctx context.Context, change entities.OrderChange) error {
+	return repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		statusChanged, err := saveOrder(tx, change.Order)
+		if err != nil || !statusChanged {
+			return err
+		}
+
+		if err := saveDedupLedger(tx, change.Ledger); err != nil {
+			return err
+		}
+		if change.Tier != nil {
+			bonus, err := saveTierChange(tx, *change.Tier)
+			if err != nil {
+				return err
+			}
+			if bonus != nil {
+				if err := saveDedupLedger(tx, []*entities.LedgerEntry{bonus}); err != nil {
+					return err
+				}
+			}
+		}
+		if change.Referral != nil {
+			return closeReferral(tx, *change.Referral)
+		}
+		return nil
+	})
+}
+
+// saveTierChange прибавляет начисление заказа к сумме пользователя и пересчитывает уровень.
+// Строка пользователя блокируется, чтобы параллельные заказы не потеряли начисления друг друга.
+func saveTierChange(tx *gorm.DB, change entities.TierChange) (*entities.LedgerEntry, error) {
+	order := change.Order
+	var users []*entities.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&users, "id = ?", order.UserID).Error; err != nil {
+		return nil, err
+	}
+
+	var userTiers []*entities.UserTier
+	if err := tx.Find(&userTiers, "user_id = ?", order.UserID).Error; err != nil {
+		return nil, err
+	}
+	if len(userTiers) == 0 {
+		// уровень еще не считался, например заказы обработаны до появления уровней
+		var before float64
+		err := tx.Model(&entities.Order{}).
+			Where("user_id = ? AND status = ? AND number <> ?", order.UserID, entities.OrderStatusProcessed, order.Number).
+			Select("COALESCE(SUM(accrual), 0)").
+			Scan(&before).Error
+		if err != nil {
+			return nil, err
+		}
+		userTier, bonus := change.Apply(before)
+		return bonus, tx.Create(&userTier).Error
+	}
+
+	userTier, bonus := change.Apply(userTiers[0].LifetimeAccrual)
+	err := tx.Model(&entities.UserTier{}).
+		Where("user_id = ?", order.UserID).
+		Updates(map[string]any{
+			"lifetime_accrual": gorm.Expr("lifetime_accrual + ?", order.Accrual),
+			"tier":             userTier.Tier,
+			"updated_at":       userTier.UpdatedAt,
+		}).Error
+	return bonus, err
+}
+
+// saveDedupLedger пропускает записи, чей dedup_key уже занят: такие записи уже применены.
+func saveDedupLedger(tx *gorm.DB, entries []*entities.LedgerEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "dedup_key"}}, DoNothing: true}).
+		Create(entries).Error
+}
+
+// closeReferral закрывает ожидающее приглашение. Строка кода пригласившего блокируется,
+// чтобы параллельные заказы его приглашенных не превысили лимит наград.
+func closeReferral(tx *gorm.DB, reward entities.ReferralReward) error {
+	referral := reward.Referral
+	if referral.Status == entities.ReferralStatusRewarded && reward.MaxRewards > 0 {
+		var codes []*entities.ReferralCode
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&codes, "user_id = ?", referral.ReferrerID).Error
+		if err != nil {
+			return err
+		}
+		var rewarded int64
+		err = tx.Model(&entities.Referral{}).
+			Where("referrer_id = ? AND status = ?", referral.ReferrerID, entities.ReferralStatusRewarded).
+			Count(&rewarded).Error
+		if err != nil {
+			return err
+		}
+		if int(rewarded) >= reward.MaxRewards {
+			referral.Reject(entities.ReferralRejectLimit)
+			reward.Ledger = nil
+		}
+	}
+
+	result := tx.Model(&entities.Referral{}).
+		Where("id = ? AND status = ?", referral.ID, entities.ReferralStatusPending).
+		Updates(map[string]any{
+			"status":         referral.Status,
+			"reject_reason":  referral.RejectReason,
+			"order_number":   referral.OrderNumber,
+			"referrer_bonus": referral.ReferrerBonus,
+			"referee_bonus":  referral.RefereeBonus,
+			"closed_at":      referral.ClosedAt,
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		// приглашение уже закрыто другим заказом
+		return result.Error
+	}
+	return saveDedupLedger(tx, reward.Ledger)
 }
 
-func (repository Repository) GetUserOrders(userID int) []*entities.Order {
+// saveOrder сохраняет заказ под блокировкой строки и сообщает, изменился ли статус.
+func saveOrder(tx *gorm.DB, order entities.Order) (bool, error) {
+	var exist entities.Order
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Limit(1).Find(&exist, "number = ?", order.Number)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	// аренду меняют только Claim/Release, иначе устаревшая копия заказа вернула бы ее
+	if err := tx.Omit("ClaimedBy", "ClaimedUntil").Save(&order).Error; err != nil {
+		return false, err
+	}
+
+	if result.RowsAffected > 0 && exist.Status == order.Status {
+		return false, nil
+	}
+
+	change := entities.NewOrderStatusChange(order)
+	if err := tx.Create(change).Error; err != nil {
+		return false, err
+	}
+	if err := notifyOrder(tx, change.ID, order); err != nil {
+		return false, err
+	}
+	if event := entities.NewOrderStatusEvent(order); event != nil {
+		if err := tx.Create(event).Error; err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// notifyOrder сообщает об изменении заказа всем экземплярам. NOTIFY доставляется только
+// после фиксации транзакции, ID записи истории одинаков для всех экземпляров.
+func notifyOrder(tx *gorm.DB, changeID int, order entities.Order) error {
+	payload, err := entities.OrderEvent{ID: int64(changeID), UserID: order.UserID, Order: order}.Notification()
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", entities.OrderEventsChannel, payload).Error
+}
+
+func (repository Repository) GetOrderHistory(ctx context.Context, orderNumber string) []*entities.OrderStatusChange {
+	var history []*entities.OrderStatusChange
+	repository.conn(ctx).Order("changed_at, id").Find(&history, "order_number = ?", orderNumber)
+	return history
+}
+
+func (repository Repository) GetUserOrders(ctx context.Context, userID int, query entities.ListQuery) []*entities.Order {
 	var orders []*entities.Order
-	repository.DB.Find(&orders, "user_id = ?", userID)
+	db := repository.conn(ctx).Where("user_id = ?", userID)
+	if len(query.Statuses) > 0 {
+		db = db.Where("status IN ?", query.Statuses)
+	}
+	db = applyListQuery(db, query, "uploaded_at", "number", orderCursorKey(query))
+	db.Find(&orders)
 	return orders
 }
 
-func (repository Repository) GetUserWithdrawals(userID int) []*entities.Withdrawn {
+func (repository Repository) GetUserWithdrawals(ctx context.Context, userID int, query entities.ListQuery) []*entities.Withdrawn {
 	var withdrawals []*entities.Withdrawn
-	repository.DB.Find(&withdrawals, "user_id = ?", userID)
+	var afterKey any
+	if query.After != nil {
+		afterKey, _ = strconv.Atoi(query.After.Key)
+	}
+	db := repository.conn(ctx).Where("user_id = ?", userID)
+	db = applyListQuery(db, query, "proccesed_at", "id", afterKey)
+	db.Find(&withdrawals)
 	return withdrawals
 }
 
-func (repository Repository) SaveWithdrawn(withdrawn entities.Withdrawn) error {
-	repository.DB.Save(&withdrawn)
+func (repository Repository) GetWithdrawnByOrder(ctx context.Context, orderNumber string) *entities.Withdrawn {
+	var withdrawals []*entities.Withdrawn
+	repository.conn(ctx).Limit(1).Find(&withdrawals, "order_number = ?", orderNumber)
+	if len(withdrawals) == 0 {
+		return nil
+	}
+	return withdrawals[0]
+}
+
+// SaveWithdrawn сохраняет списание вместе с событием PointsWithdrawn.
+// Повторное списание по номеру заказа отсекает уникальный индекс.
+func (repository Repository) SaveWithdrawn(ctx context.Context, withdrawn entities.Withdrawn) error {
+	err := repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&withdrawn).Error; err != nil {
+			return err
+		}
+		return tx.Create(entities.NewPointsWithdrawnEvent(withdrawn)).Error
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+		return entities.NewWithdrawnConflictError(withdrawn.OrderNumber, entities.WithdrawnConflictWithdrawn)
+	}
+	return err
+}
+
+func (repository Repository) SaveHold(ctx context.Context, hold *entities.Hold) error {
+	return repository.conn(ctx).Save(hold).Error
+}
+
+func (repository Repository) GetHold(ctx context.Context, id int) *entities.Hold {
+	var holds []*entities.Hold
+	repository.conn(ctx).Limit(1).Find(&holds, "id = ?", id)
+	if len(holds) == 0 {
+		return nil
+	}
+	return holds[0]
+}
+
+func (repository Repository) GetUserActiveHolds(ctx context.Context, userID int, now time.Time) []*entities.Hold {
+	var holds []*entities.Hold
+	repository.conn(ctx).
+		Where("user_id = ? AND status = ? AND expires_at > ?", userID, entities.HoldStatusActive, now).
+		Order("created_at").
+		Find(&holds)
+	return holds
+}
+
+// CaptureHold закрывает резерв и сохраняет списание в одной транзакции.
+// Резерв, который успели снять или который истек, не списывается.
+func (repository Repository) CaptureHold(ctx context.Context, hold *entities.Hold, withdrawn entities.Withdrawn) error {
+	err := repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := closeHold(tx, hold, withdrawn.ProccesedAt); err != nil {
+			return err
+		}
+		if err := tx.Create(&withdrawn).Error; err != nil {
+			return err
+		}
+		return tx.Create(entities.NewPointsWithdrawnEvent(withdrawn)).Error
+	})
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+		return entities.NewWithdrawnConflictError(withdrawn.OrderNumber, entities.WithdrawnConflictWithdrawn)
+	}
+	return err
+}
+
+// CloseHold переводит активный резерв в конечный статус hold.Status.
+func (repository Repository) CloseHold(ctx context.Context, hold *entities.Hold) error {
+	return closeHold(repository.conn(ctx), hold, *hold.ClosedAt)
+}
+
+func closeHold(tx *gorm.DB, hold *entities.Hold, now time.Time) error {
+	result := tx.Model(&entities.Hold{}).
+		Where("id = ? AND status = ? AND expires_at > ?", hold.ID, entities.HoldStatusActive, now).
+		Updates(map[string]any{"status": hold.Status, "captured": hold.Captured, "closed_at": hold.ClosedAt})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return entities.ErrHoldNotActive
+	}
 	return nil
 }
 
-func (repository Repository) GetWaitProcessOrders() []*entities.Order {
+// ExpireHolds переводит истекшие резервы в EXPIRED.
+func (repository Repository) ExpireHolds(ctx context.Context, now time.Time) (int, error) {
+	result := repository.conn(ctx).
+		Model(&entities.Hold{}).
+		Where("status = ? AND expires_at <= ?", entities.HoldStatusActive, now).
+		Updates(map[string]any{"status": entities.HoldStatusExpired, "closed_at": now})
+	return int(result.RowsAffected), result.Error
+}
+
+// GetWaitProcessOrders возвращает незавершенные заказы, у которых не идет пауза после ошибки проверки.
+func (repository Repository) GetWaitProcessOrders(ctx context.Context) []*entities.Order {
 	var orders []*entities.Order
-	repository.DB.Find(&orders, "status IN ?", []string{entities.OrderStatusNew, entities.OrderStatusProcessing})
+	repository.conn(ctx).
+		Where("status IN ?", []string{entities.OrderStatusNew, entities.OrderStatusProcessing}).
+		Where("next_check_at IS NULL OR next_check_at <= ?", time.Now()).
+		Find(&orders)
+	return orders
+}
+
+// ClaimWaitProcessOrders забирает в аренду до limit заказов, ожидающих проверки.
+// SKIP LOCKED не дает нескольким репликам забрать один заказ, а заказы
+// упавшей реплики вернутся в выборку после окончания аренды.
+func (repository Repository) ClaimWaitProcessOrders(ctx context.Context, owner string, lease time.Duration, limit int) []*entities.Order {
+	var orders []*entities.Order
+	now := time.Now()
+	claimedUntil := now.Add(lease)
+
+	err := repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ?", []string{entities.OrderStatusNew, entities.OrderStatusProcessing}).
+			Where("next_check_at IS NULL OR next_check_at <= ?", now).
+			Where("claimed_until IS NULL OR claimed_until <= ?", now).
+			Order("uploaded_at").
+			Limit(limit).
+			Find(&orders).Error
+		if err != nil || len(orders) == 0 {
+			return err
+		}
+
+		numbers := make([]string, 0, len(orders))
+		for _, order := range orders {
+			numbers = append(numbers, order.Number)
+			order.ClaimedBy = owner
+			order.ClaimedUntil = &claimedUntil
+		}
+		return tx.Model(&entities.Order{}).
+			Where("number IN ?", numbers).
+			Updates(map[string]any{"claimed_by": owner, "claimed_until": claimedUntil}).Error
+	})
+	if err != nil {
+		return nil
+	}
 	return orders
 }
+
+// ClaimOrder забирает в аренду один заказ, если он ожидает проверки и не занят другой репликой.
+// Возвращает nil, если заказ уже забран или проверять его пока рано.
+func (repository Repository) ClaimOrder(ctx context.Context, orderNumber string, owner string, lease time.Duration) *entities.Order {
+	var orders []*entities.Order
+	now := time.Now()
+
+	err := repository.conn(ctx).
+		Model(&orders).
+		Clauses(clause.Returning{}).
+		Where("number = ?", orderNumber).
+		Where("status IN ?", []string{entities.OrderStatusNew, entities.OrderStatusProcessing}).
+		Where("next_check_at IS NULL OR next_check_at <= ?", now).
+		Where("claimed_until IS NULL OR claimed_until <= ?", now).
+		Updates(map[string]any{"claimed_by": owner, "claimed_until": now.Add(lease)}).Error
+	if err != nil || len(orders) == 0 {
+		return nil
+	}
+	return orders[0]
+}
+
+// ReleaseOrderClaim снимает аренду, если она все еще принадлежит owner.
+func (repository Repository) ReleaseOrderClaim(ctx context.Context, orderNumber string, owner string) error {
+	return repository.conn(ctx).
+		Model(&entities.Order{}).
+		Where("number = ? AND claimed_by = ?", orderNumber, owner).
+		Updates(map[string]any{"claimed_by": "", "claimed_until": nil}).Error
+}
+
+// SaveOrderCheckError увеличивает счетчик ошибок проверки и откладывает следующую проверку.
+func (repository Repository) SaveOrderCheckError(ctx context.Context, orderNumber string, lastError string, nextCheckAt time.Time) error {
+	return repository.conn(ctx).
+		Model(&entities.Order{}).
+		Where("number = ?", orderNumber).
+		Updates(map[string]any{
+			"check_errors":     gorm.Expr("check_errors + 1"),
+			"last_check_error": lastError,
+			"next_check_at":    nextCheckAt,
+		}).Error
+}
+
+func (repository Repository) GetOrderCheckFailures(ctx context.Context, limit int) []*entities.Order {
+	var orders []*entities.Order
+	db := repository.conn(ctx).Where("check_errors > 0").Order("check_errors DESC, number")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+	db.Find(&orders)
+	return orders
+}
+
+func orderCursorKey(query entities.ListQuery) any {
+	if query.After == nil {
+		return nil
+	}
+	return query.After.Key
+}
+
+// applyListQuery добавляет к выборке диапазон дат, keyset-условие по (timeColumn, keyColumn),
+// сортировку и лимит.
+func applyListQuery(db *gorm.DB, query entities.ListQuery, timeColumn string, keyColumn string, afterKey any) *gorm.DB {
+	if !query.From.IsZero() {
+		db = db.Where(timeColumn+" >= ?", query.From)
+	}
+	if !query.To.IsZero() {
+		db = db.Where(timeColumn+" < ?", query.To)
+	}
+
+	direction := "ASC"
+	compare := ">"
+	if query.IsDesc() {
+		direction = "DESC"
+		compare = "<"
+	}
+
+	if query.After != nil {
+		db = db.Where("("+timeColumn+", "+keyColumn+") "+compare+" (?, ?)", query.After.Time, afterKey)
+	}
+
+	db = db.Order(timeColumn + " " + direction).Order(keyColumn + " " + direction)
+	if query.Limit > 0 {
+		db = db.Limit(query.Limit)
+	}
+	return db
+}
+
+func (repository Repository) SaveQuarantinedResponse(ctx context.Context, response *entities.QuarantinedResponse) error {
+	return repository.conn(ctx).Create(response).Error
+}
+
+// GetQuarantinedResponses возвращает неразобранные ответы, новые первыми.
+func (repository Repository) GetQuarantinedResponses(ctx context.Context, limit int) []*entities.QuarantinedResponse {
+	var responses []*entities.QuarantinedResponse
+	db := repository.conn(ctx).Where("resolved_at IS NULL").Order("id DESC")
+	if limit > 0 {
+		db = db.Limit(limit)
+	}
+	db.Find(&responses)
+	return responses
+}
+
+func (repository Repository) ResolveQuarantinedResponse(ctx context.Context, id int, resolvedAt time.Time) error {
+	result := repository.conn(ctx).
+		Model(&entities.QuarantinedResponse{}).
+		Where("id = ? AND resolved_at IS NULL", id).
+		Update("resolved_at", resolvedAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return entities.ErrNotFound
+	}
+	return nil
+}
+
+// GetProcessedOrders возвращает заказы, перешедшие в PROCESSED не раньше since.
+func (repository Repository) GetProcessedOrders(ctx context.Context, since time.Time) []*entities.Order {
+	var orders []*entities.Order
+	repository.conn(ctx).
+		Where("status = ? AND processed_at >= ?", entities.OrderStatusProcessed, since).
+		Order("processed_at").
+		Find(&orders)
+	return orders
+}
+
+// GetUsersWithAccrualsBefore возвращает пользователей, у которых есть начисления, обработанные раньше before.
+func (repository Repository) GetUsersWithAccrualsBefore(ctx context.Context, before time.Time) []int {
+	var userIDs []int
+	repository.conn(ctx).
+		Model(&entities.Order{}).
+		Distinct("user_id").
+		Where("status = ? AND accrual > 0 AND processed_at <= ?", entities.OrderStatusProcessed, before).
+		Pluck("user_id", &userIDs)
+	return userIDs
+}
+
+func (repository Repository) GetTiers(ctx context.Context) []*entities.Tier {
+	var tiers []*entities.Tier
+	repository.conn(ctx).Order("threshold").Find(&tiers)
+	return tiers
+}
+
+func (repository Repository) GetUserTier(ctx context.Context, userID int) *entities.UserTier {
+	var tiers []*entities.UserTier
+	repository.conn(ctx).Limit(1).Find(&tiers, "user_id = ?", userID)
+	if len(tiers) == 0 {
+		return nil
+	}
+	return tiers[0]
+}
+
+func (repository Repository) SaveUserTier(ctx context.Context, tier *entities.UserTier) error {
+	return repository.conn(ctx).Save(tier).Error
+}
+
+func (repository Repository) SavePromoRule(ctx context.Context, rule *entities.PromoRule) error {
+	return repository.conn(ctx).Save(rule).Error
+}
+
+func (repository Repository) GetPromoRule(ctx context.Context, id int) *entities.PromoRule {
+	var rules []*entities.PromoRule
+	repository.conn(ctx).Limit(1).Find(&rules, "id = ?", id)
+	if len(rules) == 0 {
+		return nil
+	}
+	return rules[0]
+}
+
+func (repository Repository) GetPromoRules(ctx context.Context, activeOnly bool) []*entities.PromoRule {
+	var rules []*entities.PromoRule
+	db := repository.conn(ctx).Order("id")
+	if activeOnly {
+		db = db.Where("active")
+	}
+	db.Find(&rules)
+	return rules
+}
+
+func (repository Repository) DeletePromoRule(ctx context.Context, id int) error {
+	result := repository.conn(ctx).Delete(&entities.PromoRule{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return entities.ErrNotFound
+	}
+	return nil
+}
+
+// CreateReferralCode не перезаписывает существующий код: false, если у пользователя уже есть код
+// или такой код занят другим пользователем.
+func (repository Repository) CreateReferralCode(ctx context.Context, code *entities.ReferralCode) (bool, error) {
+	result := repository.conn(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(code)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (repository Repository) GetReferralCode(ctx context.Context, userID int) *entities.ReferralCode {
+	return repository.findReferralCode(ctx, "user_id = ?", userID)
+}
+
+func (repository Repository) FindReferralCode(ctx context.Context, code string) *entities.ReferralCode {
+	return repository.findReferralCode(ctx, "code = ?", code)
+}
+
+func (repository Repository) findReferralCode(ctx context.Context, query string, arg any) *entities.ReferralCode {
+	var codes []*entities.ReferralCode
+	repository.conn(ctx).Limit(1).Find(&codes, query, arg)
+	if len(codes) == 0 {
+		return nil
+	}
+	return codes[0]
+}
+
+// SaveReferral сохраняет приглашение. Строка кода пригласившего блокируется, чтобы параллельные
+// регистрации не обошли limits; приглашение, не прошедшее проверку, сохраняется отклоненным.
+func (repository Repository) SaveReferral(ctx context.Context, referral *entities.Referral, limits entities.ReferralLimits) error {
+	err := repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		var codes []*entities.ReferralCode
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Find(&codes, "user_id = ?", referral.ReferrerID).Error
+		if err != nil {
+			return err
+		}
+		var code *entities.ReferralCode
+		if len(codes) > 0 {
+			code = codes[0]
+		}
+		var existing []*entities.Referral
+		if err := tx.Find(&existing, "referrer_id = ?", referral.ReferrerID).Error; err != nil {
+			return err
+		}
+		var referrerIPs []string
+		if err := tx.Model(&entities.UserIP{}).Where("user_id = ?", referral.ReferrerID).Pluck("ip", &referrerIPs).Error; err != nil {
+			return err
+		}
+		if reason := limits.Check(*referral, code, referrerIPs, existing); reason != "" {
+			referral.Reject(reason)
+			referral.ClosedAt = &referral.CreatedAt
+		}
+		return tx.Create(referral).Error
+	})
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+		return entities.ErrReferralClosed
+	}
+	return err
+}
+
+// SaveUserIP запоминает адрес пользователя, для известного адреса обновляет время.
+func (repository Repository) SaveUserIP(ctx context.Context, userIP *entities.UserIP) error {
+	return repository.conn(ctx).
+		Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "ip"}},
+			DoUpdates: clause.AssignmentColumns([]string{"last_seen_at"}),
+		}).
+		Create(userIP).Error
+}
+
+func (repository Repository) GetRefereeReferral(ctx context.Context, refereeID int) *entities.Referral {
+	var referrals []*entities.Referral
+	repository.conn(ctx).Limit(1).Find(&referrals, "referee_id = ?", refereeID)
+	if len(referrals) == 0 {
+		return nil
+	}
+	return referrals[0]
+}
+
+func (repository Repository) GetUserReferrals(ctx context.Context, referrerID int) []*entities.Referral {
+	var referrals []*entities.Referral
+	repository.conn(ctx).Order("id").Find(&referrals, "referrer_id = ?", referrerID)
+	return referrals
+}
+
+func (repository Repository) SaveLedgerEntry(ctx context.Context, entry *entities.LedgerEntry) error {
+	return repository.conn(ctx).Create(entry).Error
+}
+
+// SaveReversal проводит возврат по списанию вместе с событием PointsRefunded. Строка списания
+// блокируется, чтобы параллельные возвраты в сумме не превысили списанное.
+func (repository Repository) SaveReversal(ctx context.Context, entry *entities.LedgerEntry) error {
+	return repository.conn(ctx).Transaction(func(tx *gorm.DB) error {
+		var withdrawn entities.Withdrawn
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Take(&withdrawn, "id = ?", entry.WithdrawnID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return entities.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var refunded float64
+		err = tx.Model(&entities.LedgerEntry{}).
+			Where("withdrawn_id = ? AND type = ?", withdrawn.ID, entities.LedgerEntryReversal).
+			Select("COALESCE(SUM(amount), 0)").
+			Scan(&refunded).Error
+		if err != nil {
+			return err
+		}
+		if !withdrawn.CanRefund(refunded, entry.Amount) {
+			return entities.ErrReversalExceedsWithdrawn
+		}
+
+		if err := tx.Create(entry).Error; err != nil {
+			return err
+		}
+		return tx.Create(entities.NewPointsRefundedEvent(*entry)).Error
+	})
+}
+
+func (repository Repository) GetUserLedger(ctx context.Context, userID int) []*entities.LedgerEntry {
+	var entries []*entities.LedgerEntry
+	repository.conn(ctx).Order("id").Find(&entries, "user_id = ?", userID)
+	return entries
+}
+
+func (repository Repository) GetOrderLedger(ctx context.Context, orderNumber string) []*entities.LedgerEntry {
+	var entries []*entities.LedgerEntry
+	repository.conn(ctx).Order("id").Find(&entries, "order_number = ?", orderNumber)
+	return entries
+}
+
+// RunLocked выполняет fn под сессионной advisory-блокировкой name. Блокировка держится на одном
+// соединении пула, пока выполняется fn, и снимается даже при отмене ctx.
+func (repository Repository) RunLocked(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error) {
+	locked := false
+	err := repository.DB.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Raw("SELECT pg_try_advisory_lock(hashtext(?))", name).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+		defer conn.WithContext(context.Background()).Exec("SELECT pg_advisory_unlock(hashtext(?))", name)
+		return fn(ctx)
+	})
+	return locked, err
+}
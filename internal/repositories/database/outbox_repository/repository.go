@@ -0,0 +1,92 @@
+package outboxrepository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrEmptyBDConnection = errors.New("empty db connect")
+)
+
+// Repository читает outbox для relay. Пишут в outbox репозитории заказов и пользователей
+// в своих транзакциях.
+type Repository struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) (Repository, error) {
+	if db == nil {
+		return Repository{}, ErrEmptyBDConnection
+	}
+
+	return Repository{
+		DB: db,
+	}, nil
+}
+
+// ClaimEvents забирает до limit неопубликованных событий в порядке записи и скрывает их
+// от других экземпляров на lease. SKIP LOCKED не дает двум relay забрать одно событие.
+func (repository Repository) ClaimEvents(ctx context.Context, now time.Time, lease time.Duration, limit int) []*entities.OutboxEvent {
+	var events []*entities.OutboxEvent
+	err := repository.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL AND failed_at IS NULL").
+			Where("claimed_until IS NULL OR claimed_until <= ?", now).
+			Order("id").
+			Limit(limit).
+			Find(&events).Error
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		ids := make([]int, 0, len(events))
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+		return tx.Model(&entities.OutboxEvent{}).
+			Where("id IN ?", ids).
+			Update("claimed_until", now.Add(lease)).Error
+	})
+	if err != nil {
+		return nil
+	}
+	return events
+}
+
+func (repository Repository) MarkPublished(ctx context.Context, id int, publishedAt time.Time) error {
+	return repository.DB.WithContext(ctx).
+		Model(&entities.OutboxEvent{}).
+		Where("id = ?", id).
+		Updates(map[string]any{"published_at": publishedAt, "claimed_until": nil}).Error
+}
+
+// MarkFailed сохраняет ошибку публикации, событие будет выбрано снова не раньше retryAt.
+func (repository Repository) MarkFailed(ctx context.Context, id int, lastError string, retryAt time.Time) error {
+	return repository.DB.WithContext(ctx).
+		Model(&entities.OutboxEvent{}).
+		Where("id = ?", id).
+		Updates(map[string]any{
+			"attempts":      gorm.Expr("attempts + 1"),
+			"last_error":    lastError,
+			"claimed_until": retryAt,
+		}).Error
+}
+
+// MarkDead откладывает событие в dead-letter, relay его больше не выбирает.
+func (repository Repository) MarkDead(ctx context.Context, id int, lastError string, failedAt time.Time) error {
+	return repository.DB.WithContext(ctx).
+		Model(&entities.OutboxEvent{}).
+		Where("id = ?", id).
+		Updates(map[string]any{
+			"attempts":      gorm.Expr("attempts + 1"),
+			"last_error":    lastError,
+			"claimed_until": nil,
+			"failed_at":     failedAt,
+		}).Error
+}
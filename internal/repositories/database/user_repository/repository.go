@@ -1,8 +1,10 @@
 package userrepository
 
 import (
+	"context"
 	"errors"
 
+	"github.com/besean163/gophermart/internal/database"
 	"github.com/besean163/gophermart/internal/entities"
 	"gorm.io/gorm"
 )
@@ -25,14 +27,31 @@ func New(db *gorm.DB) (Repository, error) {
 	}, nil
 }
 
-func (repository Repository) SaveUser(user entities.User) error {
-	repository.DB.Save(&user)
-	return nil
+// SaveUser сохраняет пользователя, для нового пользователя в той же транзакции пишет событие
+// UserRegistered и вызывает onCreate. Запросы репозиториев с контекстом onCreate идут в этой
+// же транзакции, ошибка onCreate отменяет регистрацию.
+func (repository Repository) SaveUser(ctx context.Context, user entities.User, onCreate func(ctx context.Context, user entities.User) error) error {
+	return database.Conn(ctx, repository.DB).Transaction(func(tx *gorm.DB) error {
+		isNew := user.ID == 0
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		if !isNew {
+			return nil
+		}
+		if err := tx.Create(entities.NewUserRegisteredEvent(user)).Error; err != nil {
+			return err
+		}
+		if onCreate == nil {
+			return nil
+		}
+		return onCreate(database.WithTx(ctx, tx), user)
+	})
 }
 
-func (repository Repository) GetUser(login string) *entities.User {
+func (repository Repository) GetUser(ctx context.Context, login string) *entities.User {
 	var user entities.User
-	repository.DB.Take(&user, "login = ?", login)
+	repository.DB.WithContext(ctx).Take(&user, "login = ?", login)
 	if user.ID == 0 {
 		return nil
 	}
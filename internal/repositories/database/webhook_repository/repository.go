@@ -0,0 +1,131 @@
+package webhookrepository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrEmptyBDConnection = errors.New("empty db connect")
+)
+
+type Repository struct {
+	DB *gorm.DB
+}
+
+func New(db *gorm.DB) (Repository, error) {
+	if db == nil {
+		return Repository{}, ErrEmptyBDConnection
+	}
+
+	return Repository{
+		DB: db,
+	}, nil
+}
+
+func (repository Repository) SaveWebhook(ctx context.Context, webhook *entities.Webhook) error {
+	return repository.DB.WithContext(ctx).Save(webhook).Error
+}
+
+func (repository Repository) GetWebhook(ctx context.Context, id int) *entities.Webhook {
+	var webhook entities.Webhook
+	repository.DB.WithContext(ctx).Take(&webhook, "id = ?", id)
+	if webhook.ID == 0 {
+		return nil
+	}
+	return &webhook
+}
+
+func (repository Repository) GetWebhooks(ctx context.Context, userID int) []*entities.Webhook {
+	var webhooks []*entities.Webhook
+	repository.DB.WithContext(ctx).Order("id").Find(&webhooks, "user_id = ?", userID)
+	return webhooks
+}
+
+func (repository Repository) DeleteWebhook(ctx context.Context, id int) error {
+	return repository.DB.WithContext(ctx).Delete(&entities.Webhook{}, id).Error
+}
+
+// GetUserActiveWebhooks возвращает активные вебхуки пользователя и глобальные вебхуки администратора.
+func (repository Repository) GetUserActiveWebhooks(ctx context.Context, userID int) []*entities.Webhook {
+	var webhooks []*entities.Webhook
+	repository.DB.WithContext(ctx).Find(&webhooks, "active AND user_id IN ?", []int{0, userID})
+	return webhooks
+}
+
+// SaveDeliveries пропускает доставки, уже созданные для того же события и вебхука:
+// relay может опубликовать событие повторно.
+func (repository Repository) SaveDeliveries(ctx context.Context, deliveries []*entities.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return repository.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "event_id"}, {Name: "webhook_id"}}, DoNothing: true}).
+		Create(deliveries).Error
+}
+
+func (repository Repository) SaveDelivery(ctx context.Context, delivery entities.WebhookDelivery) error {
+	return repository.DB.WithContext(ctx).Save(&delivery).Error
+}
+
+func (repository Repository) GetDelivery(ctx context.Context, id int) *entities.WebhookDelivery {
+	var delivery entities.WebhookDelivery
+	repository.DB.WithContext(ctx).Take(&delivery, "id = ?", id)
+	if delivery.ID == 0 {
+		return nil
+	}
+	return &delivery
+}
+
+// ClaimDueDeliveries забирает до limit доставок, которым пора отправляться, и откладывает их на lease.
+// SKIP LOCKED не дает нескольким репликам забрать одну доставку, а доставки упавшей реплики
+// вернутся в выборку после окончания lease.
+func (repository Repository) ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) []*entities.WebhookDelivery {
+	var deliveries []*entities.WebhookDelivery
+	err := repository.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", entities.WebhookDeliveryStatusPending, now).
+			Order("next_attempt_at").
+			Limit(limit).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]int, 0, len(deliveries))
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.ID)
+		}
+		return tx.Model(&entities.WebhookDelivery{}).
+			Where("id IN ?", ids).
+			Update("next_attempt_at", now.Add(lease)).Error
+	})
+	if err != nil {
+		return nil
+	}
+	return deliveries
+}
+
+func (repository Repository) GetDeliveries(ctx context.Context, filter entities.WebhookDeliveryFilter) []*entities.WebhookDelivery {
+	var deliveries []*entities.WebhookDelivery
+	db := repository.DB.WithContext(ctx)
+	if filter.UserID != nil {
+		db = db.Where("user_id = ?", *filter.UserID)
+	}
+	if filter.Status != "" {
+		db = db.Where("status = ?", filter.Status)
+	}
+	if filter.EventID != "" {
+		db = db.Where("event_id = ?", filter.EventID)
+	}
+	if filter.Limit > 0 {
+		db = db.Limit(filter.Limit)
+	}
+	db.Order("id DESC").Find(&deliveries)
+	return deliveries
+}
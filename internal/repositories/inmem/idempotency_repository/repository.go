@@ -0,0 +1,101 @@
+package idempotencyrepository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+)
+
+type recordKey struct {
+	userID int
+	key    string
+}
+
+type Repository struct {
+	mu      sync.Mutex
+	records map[recordKey]*entities.IdempotencyRecord
+}
+
+func New() *Repository {
+	return &Repository{
+		records: make(map[recordKey]*entities.IdempotencyRecord),
+	}
+}
+
+func (repository *Repository) CreateRecord(ctx context.Context, record *entities.IdempotencyRecord) (bool, error) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	key := recordKey{userID: record.UserID, key: record.Key}
+	if _, ok := repository.records[key]; ok {
+		return false, nil
+	}
+	saved := *record
+	repository.records[key] = &saved
+	return true, nil
+}
+
+func (repository *Repository) GetRecord(ctx context.Context, userID int, key string) *entities.IdempotencyRecord {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	record, ok := repository.records[recordKey{userID: userID, key: key}]
+	if !ok {
+		return nil
+	}
+	result := *record
+	return &result
+}
+
+func (repository *Repository) SaveRecord(ctx context.Context, record *entities.IdempotencyRecord) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	key := recordKey{userID: record.UserID, key: record.Key}
+	if exist, ok := repository.records[key]; !ok || exist.LeaseToken != record.LeaseToken {
+		return entities.ErrIdempotencyLeaseLost
+	}
+	saved := *record
+	repository.records[key] = &saved
+	return nil
+}
+
+func (repository *Repository) TakeOverRecord(ctx context.Context, record *entities.IdempotencyRecord, now time.Time) (bool, error) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	exist, ok := repository.records[recordKey{userID: record.UserID, key: record.Key}]
+	if !ok || exist.IsCompleted() || exist.LockedUntil.After(now) {
+		return false, nil
+	}
+	exist.LockedUntil = record.LockedUntil
+	exist.LeaseToken = record.LeaseToken
+	return true, nil
+}
+
+func (repository *Repository) DeleteRecord(ctx context.Context, userID int, key string, leaseToken string) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	id := recordKey{userID: userID, key: key}
+	if exist, ok := repository.records[id]; ok && exist.LeaseToken == leaseToken {
+		delete(repository.records, id)
+	}
+	return nil
+}
+
+func (repository *Repository) DeleteExpiredRecords(ctx context.Context, now time.Time) (int, error) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	deleted := 0
+	for key, record := range repository.records {
+		if !record.ExpiresAt.After(now) {
+			delete(repository.records, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
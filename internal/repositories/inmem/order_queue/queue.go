@@ -0,0 +1,31 @@
+package orderqueue
+
+import (
+	"context"
+)
+
+// Queue - канал уведомлений о новых заказах внутри одного процесса.
+// Рассчитан на одного подписчика: в inmem-режиме поллер работает только в процессе API.
+type Queue struct {
+	orders chan string
+}
+
+func New(size int) *Queue {
+	return &Queue{
+		orders: make(chan string, size),
+	}
+}
+
+// Publish не блокирует загрузку заказа: при переполненном буфере уведомление
+// отбрасывается, и заказ проверится на очередном тике.
+func (queue *Queue) Publish(ctx context.Context, orderNumber string) error {
+	select {
+	case queue.orders <- orderNumber:
+	default:
+	}
+	return nil
+}
+
+func (queue *Queue) Subscribe(ctx context.Context) <-chan string {
+	return queue.orders
+}
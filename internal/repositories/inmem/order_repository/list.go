@@ -0,0 +1,56 @@
+package orderrepository
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+
+	"github.com/besean163/gophermart/internal/entities"
+)
+
+// applyListQuery повторяет для памяти то, что делает SQL-версия репозитория:
+// диапазон дат, keyset-условие, сортировку и лимит.
+func applyListQuery[T any](items []T, query entities.ListQuery, cursor func(T) entities.ListCursor, compareKeys func(a, b string) int) []T {
+	compare := func(a, b entities.ListCursor) int {
+		if c := a.Time.Compare(b.Time); c != 0 {
+			return c
+		}
+		return compareKeys(a.Key, b.Key)
+	}
+
+	result := make([]T, 0, len(items))
+	for _, item := range items {
+		itemCursor := cursor(item)
+		if !query.From.IsZero() && itemCursor.Time.Before(query.From) {
+			continue
+		}
+		if !query.To.IsZero() && !itemCursor.Time.Before(query.To) {
+			continue
+		}
+		if query.After != nil {
+			c := compare(itemCursor, *query.After)
+			if query.IsDesc() && c >= 0 || !query.IsDesc() && c <= 0 {
+				continue
+			}
+		}
+		result = append(result, item)
+	}
+
+	slices.SortFunc(result, func(a, b T) int {
+		if query.IsDesc() {
+			return compare(cursor(b), cursor(a))
+		}
+		return compare(cursor(a), cursor(b))
+	})
+
+	if query.Limit > 0 && len(result) > query.Limit {
+		result = result[:query.Limit]
+	}
+	return result
+}
+
+func compareNumericKeys(a, b string) int {
+	aID, _ := strconv.Atoi(a)
+	bID, _ := strconv.Atoi(b)
+	return cmp.Compare(aID, bID)
+}
@@ -1,104 +1,890 @@
 package orderrepository
 
 import (
+	"cmp"
+	"context"
 	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/besean163/gophermart/internal/entities"
 )
 
+// Outbox принимает доменные события, порожденные изменениями заказов и списаний.
+type Outbox interface {
+	SaveEvent(ctx context.Context, event *entities.OutboxEvent) error
+}
+
+// Repository хранит данные в памяти. Методы безопасны для параллельного вызова
+// и возвращают копии, изменить сохраненные данные можно только через репозиторий.
 type Repository struct {
+	mu          sync.RWMutex
 	orders      []*entities.Order
 	withdrawals []*entities.Withdrawn
+	history     []*entities.OrderStatusChange
+	quarantine  []*entities.QuarantinedResponse
+	ledger      []*entities.LedgerEntry
+	holds       []*entities.Hold
+	tiers       []*entities.Tier
+	userTiers   map[int]*entities.UserTier
+	promoRules  []*entities.PromoRule
+	lastPromoID int
+	codes       []*entities.ReferralCode
+	referrals   []*entities.Referral
+	userIPs     []*entities.UserIP
+	locks       map[string]bool
+	// userMu сериализует LockUser, как блокировка строки пользователя в базе
+	userMu sync.Mutex
+	outbox Outbox
 }
 
-func New() *Repository {
+// New создает репозиторий, outbox может быть nil, тогда события не пишутся.
+func New(outbox Outbox) *Repository {
 	return &Repository{
 		orders:      make([]*entities.Order, 0),
 		withdrawals: make([]*entities.Withdrawn, 0),
+		history:     make([]*entities.OrderStatusChange, 0),
+		userTiers:   make(map[int]*entities.UserTier),
+		locks:       make(map[string]bool),
+		outbox:      outbox,
 	}
 }
 
-func (repository *Repository) GetOrder(orderID string) *entities.Order {
+func (repository *Repository) GetOrder(ctx context.Context, orderID string) *entities.Order {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	order := repository.findOrder(orderID)
+	if order == nil {
+		return nil
+	}
+	result := *order
+	return &result
+}
+
+func (repository *Repository) findOrder(number string) *entities.Order {
 	for _, order := range repository.orders {
-		if order.Number == orderID {
+		if order.Number == number {
 			return order
 		}
 	}
 	return nil
 }
 
-func (repository *Repository) GetUserOrders(userID int) []*entities.Order {
+func (repository *Repository) GetUserOrders(ctx context.Context, userID int, query entities.ListQuery) []*entities.Order {
+	orders := repository.findOrders(func(order *entities.Order) bool {
+		if order.UserID != userID {
+			return false
+		}
+		return len(query.Statuses) == 0 || slices.Contains(query.Statuses, order.Status)
+	})
+	return applyListQuery(orders, query, (*entities.Order).Cursor, strings.Compare)
+}
+
+func (repository *Repository) findOrders(match func(*entities.Order) bool) []*entities.Order {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
 	var orders []*entities.Order
 	for _, order := range repository.orders {
-		if order.UserID == userID {
-			orders = append(orders, order)
+		if match(order) {
+			result := *order
+			orders = append(orders, &result)
 		}
 	}
 	return orders
 }
 
-func (repository *Repository) GetUserWithdrawals(userID int) []*entities.Withdrawn {
+func (repository *Repository) GetUserWithdrawals(ctx context.Context, userID int, query entities.ListQuery) []*entities.Withdrawn {
+	repository.mu.RLock()
 	var withdrawals []*entities.Withdrawn
 	for _, withdrawn := range repository.withdrawals {
 		if withdrawn.UserID == userID {
-			withdrawals = append(withdrawals, withdrawn)
+			result := *withdrawn
+			withdrawals = append(withdrawals, &result)
 		}
 	}
-	return withdrawals
+	repository.mu.RUnlock()
+	return applyListQuery(withdrawals, query, (*entities.Withdrawn).Cursor, compareNumericKeys)
 }
 
-func (repository *Repository) SaveOrder(inOrder entities.Order) error {
-	var exist *entities.Order
-	for _, order := range repository.orders {
-		if order.Number == inOrder.Number {
-			exist = order
-			break
+func (repository *Repository) SaveOrder(ctx context.Context, inOrder entities.Order) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	_, err := repository.saveOrder(ctx, inOrder)
+	return err
+}
+
+// SaveOrderChange применяет записи изменения, только если статус заказа изменился.
+func (repository *Repository) SaveOrderChange(ctx context.Context, change entities.OrderChange) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	statusChanged, err := repository.saveOrder(ctx, change.Order)
+	if err != nil || !statusChanged {
+		return err
+	}
+	for _, entry := range change.Ledger {
+		if err := repository.saveLedgerEntry(entry); err != nil {
+			return err
 		}
 	}
+	if change.Tier != nil {
+		if bonus := repository.saveTierChange(*change.Tier); bonus != nil {
+			if err := repository.saveLedgerEntry(bonus); err != nil {
+				return err
+			}
+		}
+	}
+	if change.Referral != nil {
+		return repository.closeReferral(*change.Referral)
+	}
+	return nil
+}
 
+// saveTierChange прибавляет начисление заказа к сумме пользователя, как saveTierChange в базе.
+func (repository *Repository) saveTierChange(change entities.TierChange) *entities.LedgerEntry {
+	order := change.Order
+	before := 0.0
+	if exist, ok := repository.userTiers[order.UserID]; ok {
+		before = exist.LifetimeAccrual
+	} else {
+		for _, exist := range repository.orders {
+			if exist.UserID == order.UserID && exist.Status == entities.OrderStatusProcessed && exist.Number != order.Number {
+				before += exist.Accrual
+			}
+		}
+	}
+
+	userTier, bonus := change.Apply(before)
+	repository.userTiers[order.UserID] = &userTier
+	return bonus
+}
+
+func (repository *Repository) saveOrder(ctx context.Context, inOrder entities.Order) (bool, error) {
+	exist := repository.findOrder(inOrder.Number)
+
+	inOrder.UpdatedAt = time.Now()
 	if exist == nil {
+		inOrder.ClaimedBy = ""
+		inOrder.ClaimedUntil = nil
 		repository.orders = append(repository.orders, &inOrder)
-	} else {
-		exist.Accrual = inOrder.Accrual
-		exist.Number = inOrder.Number
-		exist.Status = inOrder.Status
-		exist.UserID = inOrder.UserID
+		repository.history = append(repository.history, entities.NewOrderStatusChange(inOrder))
+		return true, repository.saveEvent(ctx, entities.NewOrderStatusEvent(inOrder))
 	}
 
-	return nil
+	statusChanged := exist.Status != inOrder.Status
+	exist.Accrual = inOrder.Accrual
+	exist.Number = inOrder.Number
+	exist.Status = inOrder.Status
+	exist.UserID = inOrder.UserID
+	exist.UploadedAt = inOrder.UploadedAt
+	exist.UpdatedAt = inOrder.UpdatedAt
+	exist.ProcessedAt = inOrder.ProcessedAt
+	exist.CheckErrors = inOrder.CheckErrors
+	exist.LastCheckError = inOrder.LastCheckError
+	exist.NextCheckAt = inOrder.NextCheckAt
+	if !statusChanged {
+		return false, nil
+	}
+	repository.history = append(repository.history, entities.NewOrderStatusChange(*exist))
+	return true, repository.saveEvent(ctx, entities.NewOrderStatusEvent(*exist))
 }
 
-func (repository *Repository) SaveWithdrawn(inWithdrawn entities.Withdrawn) error {
-	var exist *entities.Withdrawn
+func (repository *Repository) GetOrderHistory(ctx context.Context, orderNumber string) []*entities.OrderStatusChange {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var history []*entities.OrderStatusChange
+	for _, change := range repository.history {
+		if change.OrderNumber == orderNumber {
+			result := *change
+			history = append(history, &result)
+		}
+	}
+	return history
+}
+
+func (repository *Repository) GetWithdrawnByOrder(ctx context.Context, orderNumber string) *entities.Withdrawn {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	withdrawn := repository.findWithdrawn(orderNumber)
+	if withdrawn == nil {
+		return nil
+	}
+	result := *withdrawn
+	return &result
+}
+
+func (repository *Repository) findWithdrawn(orderNumber string) *entities.Withdrawn {
 	for _, withdrawn := range repository.withdrawals {
-		if withdrawn.OrderNumber == inWithdrawn.OrderNumber {
-			exist = withdrawn
-			break
+		if withdrawn.OrderNumber == orderNumber {
+			return withdrawn
 		}
 	}
+	return nil
+}
+
+// SaveWithdrawn повторяет уникальность номера заказа из базы: другое списание
+// с тем же номером не перезаписывается.
+func (repository *Repository) SaveWithdrawn(ctx context.Context, inWithdrawn entities.Withdrawn) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	return repository.saveWithdrawn(ctx, inWithdrawn)
+}
+
+func (repository *Repository) saveWithdrawn(ctx context.Context, inWithdrawn entities.Withdrawn) error {
+	exist := repository.findWithdrawn(inWithdrawn.OrderNumber)
 
 	if exist == nil {
+		if inWithdrawn.ID == 0 {
+			inWithdrawn.ID = len(repository.withdrawals) + 1
+		}
 		repository.withdrawals = append(repository.withdrawals, &inWithdrawn)
+	} else if exist.ID != inWithdrawn.ID {
+		return entities.NewWithdrawnConflictError(inWithdrawn.OrderNumber, entities.WithdrawnConflictWithdrawn)
 	} else {
-		exist.ID = inWithdrawn.ID
 		exist.UserID = inWithdrawn.UserID
-		exist.OrderNumber = inWithdrawn.OrderNumber
 		exist.Sum = inWithdrawn.Sum
 		exist.ProccesedAt = inWithdrawn.ProccesedAt
 	}
 
+	return repository.saveEvent(ctx, entities.NewPointsWithdrawnEvent(inWithdrawn))
+}
+
+func (repository *Repository) SaveHold(ctx context.Context, hold *entities.Hold) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	return repository.saveHold(hold)
+}
+
+// LockUser выполняет fn, не пересекаясь с другими вызовами LockUser. Блокировка одна на все
+// хранилище: в памяти это проще, чем блокировки по пользователям, и достаточно для тестов.
+func (repository *Repository) LockUser(ctx context.Context, userID int, fn func(ctx context.Context) error) error {
+	repository.userMu.Lock()
+	defer repository.userMu.Unlock()
+
+	return fn(ctx)
+}
+
+func (repository *Repository) saveHold(hold *entities.Hold) error {
+	if hold.ID == 0 {
+		hold.ID = len(repository.holds) + 1
+		saved := *hold
+		repository.holds = append(repository.holds, &saved)
+		return nil
+	}
+	for i, exist := range repository.holds {
+		if exist.ID == hold.ID {
+			saved := *hold
+			repository.holds[i] = &saved
+			return nil
+		}
+	}
+	return entities.ErrNotFound
+}
+
+func (repository *Repository) GetHold(ctx context.Context, id int) *entities.Hold {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	return repository.getHold(id)
+}
+
+func (repository *Repository) getHold(id int) *entities.Hold {
+	for _, hold := range repository.holds {
+		if hold.ID == id {
+			result := *hold
+			return &result
+		}
+	}
 	return nil
 }
 
-func (repository Repository) GetWaitProcessOrders() []*entities.Order {
+func (repository *Repository) GetUserActiveHolds(ctx context.Context, userID int, now time.Time) []*entities.Hold {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var holds []*entities.Hold
+	for _, hold := range repository.holds {
+		if hold.UserID == userID && hold.IsActive(now) {
+			result := *hold
+			holds = append(holds, &result)
+		}
+	}
+	return holds
+}
+
+func (repository *Repository) CaptureHold(ctx context.Context, hold *entities.Hold, withdrawn entities.Withdrawn) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	exist := repository.getHold(hold.ID)
+	if exist == nil || !exist.IsActive(withdrawn.ProccesedAt) {
+		return entities.ErrHoldNotActive
+	}
+	if repository.findWithdrawn(withdrawn.OrderNumber) != nil {
+		return entities.NewWithdrawnConflictError(withdrawn.OrderNumber, entities.WithdrawnConflictWithdrawn)
+	}
+	if err := repository.saveWithdrawn(ctx, withdrawn); err != nil {
+		return err
+	}
+	return repository.saveHold(hold)
+}
+
+func (repository *Repository) CloseHold(ctx context.Context, hold *entities.Hold) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	exist := repository.getHold(hold.ID)
+	if exist == nil || !exist.IsActive(*hold.ClosedAt) {
+		return entities.ErrHoldNotActive
+	}
+	return repository.saveHold(hold)
+}
+
+func (repository *Repository) ExpireHolds(ctx context.Context, now time.Time) (int, error) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	expired := 0
+	for _, hold := range repository.holds {
+		if hold.Status == entities.HoldStatusActive && !hold.ExpiresAt.After(now) {
+			hold.Status = entities.HoldStatusExpired
+			hold.ClosedAt = &now
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+func (repository *Repository) saveEvent(ctx context.Context, event *entities.OutboxEvent) error {
+	if repository.outbox == nil || event == nil {
+		return nil
+	}
+	return repository.outbox.SaveEvent(ctx, event)
+}
+
+func (repository *Repository) GetWaitProcessOrders(ctx context.Context) []*entities.Order {
+	now := time.Now()
+	return repository.findOrders(func(order *entities.Order) bool {
+		return isWaitProcess(order, now)
+	})
+}
+
+func isWaitProcess(order *entities.Order, now time.Time) bool {
+	if order.NextCheckAt != nil && order.NextCheckAt.After(now) {
+		return false
+	}
+	return slices.Contains([]string{
+		entities.OrderStatusNew,
+		entities.OrderStatusProcessing,
+	}, order.Status)
+}
+
+func (repository *Repository) ClaimWaitProcessOrders(ctx context.Context, owner string, lease time.Duration, limit int) []*entities.Order {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	now := time.Now()
+	claimedUntil := now.Add(lease)
+
 	var orders []*entities.Order
 	for _, order := range repository.orders {
-		if slices.Contains([]string{
-			entities.OrderStatusNew,
-			entities.OrderStatusProcessing,
-		}, order.Status) {
-			orders = append(orders, order)
+		if !isWaitProcess(order, now) {
+			continue
+		}
+		if order.ClaimedUntil != nil && order.ClaimedUntil.After(now) {
+			continue
+		}
+		order.ClaimedBy = owner
+		order.ClaimedUntil = &claimedUntil
+		result := *order
+		orders = append(orders, &result)
+		if limit > 0 && len(orders) == limit {
+			break
 		}
 	}
 	return orders
 }
+
+func (repository *Repository) ClaimOrder(ctx context.Context, orderNumber string, owner string, lease time.Duration) *entities.Order {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	now := time.Now()
+	order := repository.findOrder(orderNumber)
+	if order == nil || order.IsFinal() {
+		return nil
+	}
+	if order.NextCheckAt != nil && order.NextCheckAt.After(now) {
+		return nil
+	}
+	if order.ClaimedUntil != nil && order.ClaimedUntil.After(now) {
+		return nil
+	}
+
+	claimedUntil := now.Add(lease)
+	order.ClaimedBy = owner
+	order.ClaimedUntil = &claimedUntil
+	result := *order
+	return &result
+}
+
+func (repository *Repository) ReleaseOrderClaim(ctx context.Context, orderNumber string, owner string) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	order := repository.findOrder(orderNumber)
+	if order != nil && order.ClaimedBy == owner {
+		order.ClaimedBy = ""
+		order.ClaimedUntil = nil
+	}
+	return nil
+}
+
+func (repository *Repository) SaveOrderCheckError(ctx context.Context, orderNumber string, lastError string, nextCheckAt time.Time) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	order := repository.findOrder(orderNumber)
+	if order == nil {
+		return entities.ErrNotFound
+	}
+	order.CheckErrors++
+	order.LastCheckError = lastError
+	order.NextCheckAt = &nextCheckAt
+	return nil
+}
+
+func (repository *Repository) GetOrderCheckFailures(ctx context.Context, limit int) []*entities.Order {
+	orders := repository.findOrders(func(order *entities.Order) bool { return order.CheckErrors > 0 })
+	slices.SortFunc(orders, func(a, b *entities.Order) int {
+		if a.CheckErrors != b.CheckErrors {
+			return b.CheckErrors - a.CheckErrors
+		}
+		return strings.Compare(a.Number, b.Number)
+	})
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+	return orders
+}
+
+func (repository *Repository) SaveQuarantinedResponse(ctx context.Context, response *entities.QuarantinedResponse) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	response.ID = len(repository.quarantine) + 1
+	saved := *response
+	repository.quarantine = append(repository.quarantine, &saved)
+	return nil
+}
+
+func (repository *Repository) GetQuarantinedResponses(ctx context.Context, limit int) []*entities.QuarantinedResponse {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var responses []*entities.QuarantinedResponse
+	for i := len(repository.quarantine) - 1; i >= 0; i-- {
+		if repository.quarantine[i].ResolvedAt != nil {
+			continue
+		}
+		response := *repository.quarantine[i]
+		responses = append(responses, &response)
+		if limit > 0 && len(responses) == limit {
+			break
+		}
+	}
+	return responses
+}
+
+func (repository *Repository) ResolveQuarantinedResponse(ctx context.Context, id int, resolvedAt time.Time) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, response := range repository.quarantine {
+		if response.ID == id && response.ResolvedAt == nil {
+			response.ResolvedAt = &resolvedAt
+			return nil
+		}
+	}
+	return entities.ErrNotFound
+}
+
+func (repository *Repository) GetProcessedOrders(ctx context.Context, since time.Time) []*entities.Order {
+	return repository.findOrders(func(order *entities.Order) bool {
+		return order.Status == entities.OrderStatusProcessed && order.ProcessedAt != nil && !order.ProcessedAt.Before(since)
+	})
+}
+
+func (repository *Repository) GetUsersWithAccrualsBefore(ctx context.Context, before time.Time) []int {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var userIDs []int
+	for _, order := range repository.orders {
+		if order.Status != entities.OrderStatusProcessed || order.Accrual <= 0 || order.ProcessedAt == nil || order.ProcessedAt.After(before) {
+			continue
+		}
+		if !slices.Contains(userIDs, order.UserID) {
+			userIDs = append(userIDs, order.UserID)
+		}
+	}
+	return userIDs
+}
+
+// SetTiers заменяет таблицу уровней, в inmem-режиме ее больше неоткуда взять.
+func (repository *Repository) SetTiers(tiers []*entities.Tier) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	repository.tiers = tiers
+}
+
+func (repository *Repository) GetTiers(ctx context.Context) []*entities.Tier {
+	repository.mu.RLock()
+	tiers := make([]*entities.Tier, 0, len(repository.tiers))
+	for _, tier := range repository.tiers {
+		result := *tier
+		tiers = append(tiers, &result)
+	}
+	repository.mu.RUnlock()
+
+	slices.SortFunc(tiers, func(a, b *entities.Tier) int { return cmp.Compare(a.Threshold, b.Threshold) })
+	return tiers
+}
+
+func (repository *Repository) GetUserTier(ctx context.Context, userID int) *entities.UserTier {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	tier, ok := repository.userTiers[userID]
+	if !ok {
+		return nil
+	}
+	result := *tier
+	return &result
+}
+
+func (repository *Repository) SaveUserTier(ctx context.Context, tier *entities.UserTier) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	saved := *tier
+	repository.userTiers[tier.UserID] = &saved
+	return nil
+}
+
+func (repository *Repository) SavePromoRule(ctx context.Context, rule *entities.PromoRule) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	if rule.ID == 0 {
+		repository.lastPromoID++
+		rule.ID = repository.lastPromoID
+		saved := *rule
+		repository.promoRules = append(repository.promoRules, &saved)
+		return nil
+	}
+	for i, exist := range repository.promoRules {
+		if exist.ID == rule.ID {
+			saved := *rule
+			repository.promoRules[i] = &saved
+			return nil
+		}
+	}
+	return entities.ErrNotFound
+}
+
+func (repository *Repository) GetPromoRule(ctx context.Context, id int) *entities.PromoRule {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	for _, rule := range repository.promoRules {
+		if rule.ID == id {
+			result := *rule
+			return &result
+		}
+	}
+	return nil
+}
+
+func (repository *Repository) GetPromoRules(ctx context.Context, activeOnly bool) []*entities.PromoRule {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var rules []*entities.PromoRule
+	for _, rule := range repository.promoRules {
+		if !activeOnly || rule.Active {
+			result := *rule
+			rules = append(rules, &result)
+		}
+	}
+	return rules
+}
+
+func (repository *Repository) DeletePromoRule(ctx context.Context, id int) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for i, rule := range repository.promoRules {
+		if rule.ID == id {
+			repository.promoRules = slices.Delete(repository.promoRules, i, i+1)
+			return nil
+		}
+	}
+	return entities.ErrNotFound
+}
+
+func (repository *Repository) CreateReferralCode(ctx context.Context, code *entities.ReferralCode) (bool, error) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, exist := range repository.codes {
+		if exist.UserID == code.UserID || exist.Code == code.Code {
+			return false, nil
+		}
+	}
+	saved := *code
+	repository.codes = append(repository.codes, &saved)
+	return true, nil
+}
+
+func (repository *Repository) GetReferralCode(ctx context.Context, userID int) *entities.ReferralCode {
+	return repository.findReferralCode(func(code *entities.ReferralCode) bool { return code.UserID == userID })
+}
+
+func (repository *Repository) FindReferralCode(ctx context.Context, code string) *entities.ReferralCode {
+	return repository.findReferralCode(func(exist *entities.ReferralCode) bool { return exist.Code == code })
+}
+
+func (repository *Repository) findReferralCode(match func(*entities.ReferralCode) bool) *entities.ReferralCode {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	for _, code := range repository.codes {
+		if match(code) {
+			result := *code
+			return &result
+		}
+	}
+	return nil
+}
+
+func (repository *Repository) SaveReferral(ctx context.Context, referral *entities.Referral, limits entities.ReferralLimits) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	if repository.getRefereeReferral(referral.RefereeID) != nil {
+		return entities.ErrReferralClosed
+	}
+	var code *entities.ReferralCode
+	for _, exist := range repository.codes {
+		if exist.UserID == referral.ReferrerID {
+			code = exist
+		}
+	}
+	var existing []*entities.Referral
+	for _, exist := range repository.referrals {
+		if exist.ReferrerID == referral.ReferrerID {
+			existing = append(existing, exist)
+		}
+	}
+	if reason := limits.Check(*referral, code, repository.getUserIPs(referral.ReferrerID), existing); reason != "" {
+		referral.Reject(reason)
+		referral.ClosedAt = &referral.CreatedAt
+	}
+	referral.ID = len(repository.referrals) + 1
+	saved := *referral
+	repository.referrals = append(repository.referrals, &saved)
+	return nil
+}
+
+func (repository *Repository) SaveUserIP(ctx context.Context, userIP *entities.UserIP) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, exist := range repository.userIPs {
+		if exist.UserID == userIP.UserID && exist.IP == userIP.IP {
+			exist.LastSeenAt = userIP.LastSeenAt
+			return nil
+		}
+	}
+	saved := *userIP
+	repository.userIPs = append(repository.userIPs, &saved)
+	return nil
+}
+
+func (repository *Repository) getUserIPs(userID int) []string {
+	var ips []string
+	for _, userIP := range repository.userIPs {
+		if userIP.UserID == userID {
+			ips = append(ips, userIP.IP)
+		}
+	}
+	return ips
+}
+
+func (repository *Repository) GetRefereeReferral(ctx context.Context, refereeID int) *entities.Referral {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	return repository.getRefereeReferral(refereeID)
+}
+
+func (repository *Repository) getRefereeReferral(refereeID int) *entities.Referral {
+	for _, referral := range repository.referrals {
+		if referral.RefereeID == refereeID {
+			result := *referral
+			return &result
+		}
+	}
+	return nil
+}
+
+func (repository *Repository) GetUserReferrals(ctx context.Context, referrerID int) []*entities.Referral {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var referrals []*entities.Referral
+	for _, referral := range repository.referrals {
+		if referral.ReferrerID == referrerID {
+			result := *referral
+			referrals = append(referrals, &result)
+		}
+	}
+	return referrals
+}
+
+// closeReferral закрывает ожидающее приглашение, лимит наград проверяется под общей блокировкой.
+func (repository *Repository) closeReferral(reward entities.ReferralReward) error {
+	referral := reward.Referral
+	if referral.Status == entities.ReferralStatusRewarded && reward.MaxRewards > 0 {
+		rewarded := 0
+		for _, exist := range repository.referrals {
+			if exist.ReferrerID == referral.ReferrerID && exist.Status == entities.ReferralStatusRewarded {
+				rewarded++
+			}
+		}
+		if rewarded >= reward.MaxRewards {
+			referral.Reject(entities.ReferralRejectLimit)
+			reward.Ledger = nil
+		}
+	}
+
+	for i, exist := range repository.referrals {
+		if exist.ID != referral.ID {
+			continue
+		}
+		if exist.Status != entities.ReferralStatusPending {
+			return nil
+		}
+		repository.referrals[i] = &referral
+		for _, entry := range reward.Ledger {
+			if err := repository.saveLedgerEntry(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return entities.ErrNotFound
+}
+
+func (repository *Repository) SaveLedgerEntry(ctx context.Context, entry *entities.LedgerEntry) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	return repository.saveLedgerEntry(entry)
+}
+
+// saveLedgerEntry повторяет уникальность dedup_key из базы: запись с занятым ключом пропускается.
+func (repository *Repository) saveLedgerEntry(entry *entities.LedgerEntry) error {
+	if entry.DedupKey != nil {
+		for _, exist := range repository.ledger {
+			if exist.DedupKey != nil && *exist.DedupKey == *entry.DedupKey {
+				return nil
+			}
+		}
+	}
+	entry.ID = len(repository.ledger) + 1
+	saved := *entry
+	repository.ledger = append(repository.ledger, &saved)
+	return nil
+}
+
+func (repository *Repository) SaveReversal(ctx context.Context, entry *entities.LedgerEntry) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	var withdrawn *entities.Withdrawn
+	for _, exist := range repository.withdrawals {
+		if entry.WithdrawnID != nil && exist.ID == *entry.WithdrawnID {
+			withdrawn = exist
+			break
+		}
+	}
+	if withdrawn == nil {
+		return entities.ErrNotFound
+	}
+
+	refunded := 0.0
+	for _, exist := range repository.ledger {
+		if exist.Type == entities.LedgerEntryReversal && exist.WithdrawnID != nil && *exist.WithdrawnID == withdrawn.ID {
+			refunded += exist.Amount
+		}
+	}
+	if !withdrawn.CanRefund(refunded, entry.Amount) {
+		return entities.ErrReversalExceedsWithdrawn
+	}
+
+	if err := repository.saveLedgerEntry(entry); err != nil {
+		return err
+	}
+	return repository.saveEvent(ctx, entities.NewPointsRefundedEvent(*entry))
+}
+
+func (repository *Repository) GetUserLedger(ctx context.Context, userID int) []*entities.LedgerEntry {
+	return repository.findLedger(func(entry *entities.LedgerEntry) bool { return entry.UserID == userID })
+}
+
+func (repository *Repository) GetOrderLedger(ctx context.Context, orderNumber string) []*entities.LedgerEntry {
+	return repository.findLedger(func(entry *entities.LedgerEntry) bool { return entry.OrderNumber == orderNumber })
+}
+
+func (repository *Repository) findLedger(match func(*entities.LedgerEntry) bool) []*entities.LedgerEntry {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	var entries []*entities.LedgerEntry
+	for _, entry := range repository.ledger {
+		if match(entry) {
+			result := *entry
+			entries = append(entries, &result)
+		}
+	}
+	return entries
+}
+
+// RunLocked не держит общую блокировку репозитория во время fn: fn сама обращается к репозиторию.
+func (repository *Repository) RunLocked(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error) {
+	repository.mu.Lock()
+	if repository.locks[name] {
+		repository.mu.Unlock()
+		return false, nil
+	}
+	repository.locks[name] = true
+	repository.mu.Unlock()
+
+	defer func() {
+		repository.mu.Lock()
+		delete(repository.locks, name)
+		repository.mu.Unlock()
+	}()
+	return true, fn(ctx)
+}
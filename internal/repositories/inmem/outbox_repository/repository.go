@@ -0,0 +1,105 @@
+package outboxrepository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+)
+
+// Repository - outbox в памяти. Его разделяют inmem-репозитории заказов и пользователей,
+// атомарность записи события с изменением обеспечивают их собственные блокировки.
+type Repository struct {
+	mu     sync.Mutex
+	events []*entities.OutboxEvent
+}
+
+func New() *Repository {
+	return &Repository{
+		events: make([]*entities.OutboxEvent, 0),
+	}
+}
+
+func (repository *Repository) SaveEvent(ctx context.Context, event *entities.OutboxEvent) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	event.ID = len(repository.events) + 1
+	saved := *event
+	repository.events = append(repository.events, &saved)
+	return nil
+}
+
+// GetUnpublishedEvents возвращает события, которые еще не опубликованы и не отложены в dead-letter.
+func (repository *Repository) GetUnpublishedEvents(ctx context.Context, limit int) []*entities.OutboxEvent {
+	return repository.findEvents(limit, func(event *entities.OutboxEvent) bool { return true })
+}
+
+// ClaimEvents забирает до limit неопубликованных событий в порядке записи и скрывает их на lease.
+func (repository *Repository) ClaimEvents(ctx context.Context, now time.Time, lease time.Duration, limit int) []*entities.OutboxEvent {
+	claimedUntil := now.Add(lease)
+	return repository.findEvents(limit, func(event *entities.OutboxEvent) bool {
+		if event.ClaimedUntil != nil && event.ClaimedUntil.After(now) {
+			return false
+		}
+		event.ClaimedUntil = &claimedUntil
+		return true
+	})
+}
+
+// findEvents отбирает до limit неопубликованных событий, match может изменить событие.
+func (repository *Repository) findEvents(limit int, match func(*entities.OutboxEvent) bool) []*entities.OutboxEvent {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	var events []*entities.OutboxEvent
+	for _, event := range repository.events {
+		if event.PublishedAt != nil || event.FailedAt != nil || !match(event) {
+			continue
+		}
+		result := *event
+		events = append(events, &result)
+		if limit > 0 && len(events) == limit {
+			break
+		}
+	}
+	return events
+}
+
+func (repository *Repository) MarkPublished(ctx context.Context, id int, publishedAt time.Time) error {
+	return repository.update(id, func(event *entities.OutboxEvent) {
+		event.PublishedAt = &publishedAt
+		event.ClaimedUntil = nil
+	})
+}
+
+func (repository *Repository) MarkFailed(ctx context.Context, id int, lastError string, retryAt time.Time) error {
+	return repository.update(id, func(event *entities.OutboxEvent) {
+		event.Attempts++
+		event.LastError = lastError
+		event.ClaimedUntil = &retryAt
+	})
+}
+
+func (repository *Repository) MarkDead(ctx context.Context, id int, lastError string, failedAt time.Time) error {
+	return repository.update(id, func(event *entities.OutboxEvent) {
+		event.Attempts++
+		event.LastError = lastError
+		event.ClaimedUntil = nil
+		event.FailedAt = &failedAt
+	})
+}
+
+func (repository *Repository) update(id int, change func(*entities.OutboxEvent)) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, event := range repository.events {
+		if event.ID == id {
+			change(event)
+			return nil
+		}
+	}
+	return entities.ErrNotFound
+}
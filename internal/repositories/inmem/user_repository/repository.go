@@ -1,18 +1,30 @@
 package inmem
 
-import "github.com/besean163/gophermart/internal/entities"
+import (
+	"context"
+
+	"github.com/besean163/gophermart/internal/entities"
+)
+
+// Outbox принимает событие о регистрации пользователя.
+type Outbox interface {
+	SaveEvent(ctx context.Context, event *entities.OutboxEvent) error
+}
 
 type Storage struct {
-	Users []*entities.User
+	Users  []*entities.User
+	outbox Outbox
 }
 
-func New() *Storage {
+// New создает хранилище, outbox может быть nil, тогда события не пишутся.
+func New(outbox Outbox) *Storage {
 	return &Storage{
-		Users: make([]*entities.User, 0),
+		Users:  make([]*entities.User, 0),
+		outbox: outbox,
 	}
 }
 
-func (storage *Storage) GetUser(login string) *entities.User {
+func (storage *Storage) GetUser(ctx context.Context, login string) *entities.User {
 	for _, user := range storage.Users {
 		if user.Login == login {
 			return user
@@ -21,7 +33,20 @@ func (storage *Storage) GetUser(login string) *entities.User {
 	return nil
 }
 
-func (storage *Storage) SaveUser(user entities.User) error {
+// SaveUser вызывает onCreate для нового пользователя до сохранения: ошибка onCreate отменяет регистрацию.
+func (storage *Storage) SaveUser(ctx context.Context, user entities.User, onCreate func(ctx context.Context, user entities.User) error) error {
+	if user.ID == 0 {
+		user.ID = len(storage.Users) + 1
+		if onCreate != nil {
+			if err := onCreate(ctx, user); err != nil {
+				return err
+			}
+		}
+	}
 	storage.Users = append(storage.Users, &user)
-	return nil
+
+	if storage.outbox == nil {
+		return nil
+	}
+	return storage.outbox.SaveEvent(ctx, entities.NewUserRegisteredEvent(user))
 }
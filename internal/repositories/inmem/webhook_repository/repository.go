@@ -0,0 +1,203 @@
+package webhookrepository
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+)
+
+type Repository struct {
+	mu             sync.Mutex
+	webhooks       []*entities.Webhook
+	deliveries     []*entities.WebhookDelivery
+	lastWebhookID  int
+	lastDeliveryID int
+}
+
+func New() *Repository {
+	return &Repository{
+		webhooks:   make([]*entities.Webhook, 0),
+		deliveries: make([]*entities.WebhookDelivery, 0),
+	}
+}
+
+func (repository *Repository) SaveWebhook(ctx context.Context, webhook *entities.Webhook) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for i, exist := range repository.webhooks {
+		if exist.ID == webhook.ID {
+			saved := *webhook
+			repository.webhooks[i] = &saved
+			return nil
+		}
+	}
+
+	repository.lastWebhookID++
+	webhook.ID = repository.lastWebhookID
+	if webhook.CreatedAt.IsZero() {
+		webhook.CreatedAt = time.Now()
+	}
+	saved := *webhook
+	repository.webhooks = append(repository.webhooks, &saved)
+	return nil
+}
+
+func (repository *Repository) GetWebhook(ctx context.Context, id int) *entities.Webhook {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, webhook := range repository.webhooks {
+		if webhook.ID == id {
+			result := *webhook
+			return &result
+		}
+	}
+	return nil
+}
+
+func (repository *Repository) GetWebhooks(ctx context.Context, userID int) []*entities.Webhook {
+	return repository.findWebhooks(func(webhook *entities.Webhook) bool {
+		return webhook.UserID == userID
+	})
+}
+
+func (repository *Repository) DeleteWebhook(ctx context.Context, id int) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	repository.webhooks = slices.DeleteFunc(repository.webhooks, func(webhook *entities.Webhook) bool {
+		return webhook.ID == id
+	})
+	return nil
+}
+
+func (repository *Repository) GetUserActiveWebhooks(ctx context.Context, userID int) []*entities.Webhook {
+	return repository.findWebhooks(func(webhook *entities.Webhook) bool {
+		return webhook.Active && (webhook.UserID == 0 || webhook.UserID == userID)
+	})
+}
+
+// SaveDeliveries пропускает доставки, уже созданные для того же события и вебхука.
+func (repository *Repository) SaveDeliveries(ctx context.Context, deliveries []*entities.WebhookDelivery) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		exists := slices.ContainsFunc(repository.deliveries, func(exist *entities.WebhookDelivery) bool {
+			return exist.EventID == delivery.EventID && exist.WebhookID == delivery.WebhookID
+		})
+		if exists {
+			continue
+		}
+		repository.lastDeliveryID++
+		delivery.ID = repository.lastDeliveryID
+		if delivery.CreatedAt.IsZero() {
+			delivery.CreatedAt = time.Now()
+		}
+		saved := *delivery
+		repository.deliveries = append(repository.deliveries, &saved)
+	}
+	return nil
+}
+
+func (repository *Repository) SaveDelivery(ctx context.Context, delivery entities.WebhookDelivery) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for i, exist := range repository.deliveries {
+		if exist.ID == delivery.ID {
+			repository.deliveries[i] = &delivery
+			return nil
+		}
+	}
+	return entities.ErrNotFound
+}
+
+func (repository *Repository) GetDelivery(ctx context.Context, id int) *entities.WebhookDelivery {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, delivery := range repository.deliveries {
+		if delivery.ID == id {
+			result := *delivery
+			return &result
+		}
+	}
+	return nil
+}
+
+// ClaimDueDeliveries забирает до limit доставок, которым пора отправляться, и откладывает их на lease.
+func (repository *Repository) ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) []*entities.WebhookDelivery {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	var due []*entities.WebhookDelivery
+	for _, delivery := range repository.deliveries {
+		if delivery.Status == entities.WebhookDeliveryStatusPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	slices.SortFunc(due, func(a, b *entities.WebhookDelivery) int {
+		return a.NextAttemptAt.Compare(b.NextAttemptAt)
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	deliveries := make([]*entities.WebhookDelivery, 0, len(due))
+	for _, delivery := range due {
+		result := *delivery
+		deliveries = append(deliveries, &result)
+		delivery.NextAttemptAt = now.Add(lease)
+	}
+	return deliveries
+}
+
+func (repository *Repository) GetDeliveries(ctx context.Context, filter entities.WebhookDeliveryFilter) []*entities.WebhookDelivery {
+	deliveries := repository.findDeliveries(func(delivery *entities.WebhookDelivery) bool {
+		if filter.UserID != nil && delivery.UserID != *filter.UserID {
+			return false
+		}
+		if filter.EventID != "" && delivery.EventID != filter.EventID {
+			return false
+		}
+		return filter.Status == "" || delivery.Status == filter.Status
+	})
+	slices.Reverse(deliveries)
+	if filter.Limit > 0 && len(deliveries) > filter.Limit {
+		deliveries = deliveries[:filter.Limit]
+	}
+	return deliveries
+}
+
+func (repository *Repository) findWebhooks(match func(*entities.Webhook) bool) []*entities.Webhook {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	var webhooks []*entities.Webhook
+	for _, webhook := range repository.webhooks {
+		if match(webhook) {
+			result := *webhook
+			webhooks = append(webhooks, &result)
+		}
+	}
+	return webhooks
+}
+
+func (repository *Repository) findDeliveries(match func(*entities.WebhookDelivery) bool) []*entities.WebhookDelivery {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	var deliveries []*entities.WebhookDelivery
+	for _, delivery := range repository.deliveries {
+		if match(delivery) {
+			result := *delivery
+			deliveries = append(deliveries, &result)
+		}
+	}
+	return deliveries
+}
@@ -1,11 +1,13 @@
 package authservice
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/tracing"
 	"github.com/golang-jwt/jwt/v4"
 )
 
@@ -33,30 +35,41 @@ func New(repository UserRepository, secret string, tokenExpire time.Duration) Se
 }
 
 type UserRepository interface {
-	SaveUser(entities.User) error
-	GetUser(login string) *entities.User
+	SaveUser(ctx context.Context, user entities.User, onCreate func(ctx context.Context, user entities.User) error) error
+	GetUser(ctx context.Context, login string) *entities.User
 }
 
-func (service Service) SaveUser(user entities.User) error {
-	return service.repository.SaveUser(user)
+// SaveUser сохраняет пользователя. onCreate, если задан, вызывается для нового пользователя
+// в транзакции регистрации: так связанные с регистрацией записи не теряются по отдельности.
+func (service Service) SaveUser(ctx context.Context, user entities.User, onCreate func(ctx context.Context, user entities.User) error) (err error) {
+	ctx, span := tracing.Start(ctx, "AuthService.SaveUser")
+	defer func() { tracing.End(span, err) }()
+
+	return service.repository.SaveUser(ctx, user, onCreate)
 }
 
-func (service Service) GetUser(login string) *entities.User {
-	return service.repository.GetUser(login)
+func (service Service) GetUser(ctx context.Context, login string) *entities.User {
+	ctx, span := tracing.Start(ctx, "AuthService.GetUser")
+	defer span.End()
+
+	return service.repository.GetUser(ctx, login)
 }
 
-func (service Service) BuildUserToken(user entities.User) (string, error) {
+func (service Service) BuildUserToken(ctx context.Context, user entities.User) (token string, err error) {
+	_, span := tracing.Start(ctx, "AuthService.BuildUserToken")
+	defer func() { tracing.End(span, err) }()
+
 	if service.tokenSecret == "" {
 		return "", ErrEmptyHashSecret
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(service.tokenExpire)),
 		},
 		UserLogin: user.Login,
 	})
 
-	tokenString, err := token.SignedString([]byte(service.tokenSecret))
+	tokenString, err := jwtToken.SignedString([]byte(service.tokenSecret))
 	if err != nil {
 		return "", err
 	}
@@ -85,13 +98,16 @@ func getUserLoginByToken(token string, secret string) (string, error) {
 	return claims.UserLogin, nil
 }
 
-func (service Service) GetUserByToken(token string) (*entities.User, error) {
+func (service Service) GetUserByToken(ctx context.Context, token string) (user *entities.User, err error) {
+	ctx, span := tracing.Start(ctx, "AuthService.GetUserByToken")
+	defer func() { tracing.End(span, err) }()
+
 	userLogin, err := getUserLoginByToken(token, service.tokenSecret)
 	if err != nil {
 		return nil, err
 	}
 
-	user := service.repository.GetUser(userLogin)
+	user = service.repository.GetUser(ctx, userLogin)
 	if user == nil {
 		return nil, fmt.Errorf("user not exist")
 	}
@@ -0,0 +1,173 @@
+package idempotencyservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+type Repository interface {
+	// CreateRecord сохраняет запись, только если ключа у пользователя еще нет, и сообщает, создана ли она.
+	CreateRecord(ctx context.Context, record *entities.IdempotencyRecord) (bool, error)
+	GetRecord(ctx context.Context, userID int, key string) *entities.IdempotencyRecord
+	// SaveRecord сохраняет запись, только если ее LeaseToken не сменился, иначе ErrIdempotencyLeaseLost.
+	SaveRecord(ctx context.Context, record *entities.IdempotencyRecord) error
+	// TakeOverRecord передает незавершенную запись новой аренде record.LeaseToken до record.LockedUntil,
+	// только если прежняя аренда истекла к now, и сообщает, удалось ли это.
+	TakeOverRecord(ctx context.Context, record *entities.IdempotencyRecord, now time.Time) (bool, error)
+	// DeleteRecord удаляет запись, только если ее аренда - leaseToken.
+	DeleteRecord(ctx context.Context, userID int, key string, leaseToken string) error
+	DeleteExpiredRecords(ctx context.Context, now time.Time) (int, error)
+}
+
+type Config struct {
+	// TTL - сколько хранится ответ. Повтор после TTL выполняется как новый запрос.
+	TTL time.Duration
+	// LockTimeout - сколько ключ закреплен за выполняющимся запросом. Должен быть больше
+	// времени обработки запроса, иначе повтор выполнится параллельно с первым.
+	LockTimeout     time.Duration
+	CleanupInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		TTL:             24 * time.Hour,
+		LockTimeout:     time.Minute,
+		CleanupInterval: time.Hour,
+	}
+}
+
+type Service struct {
+	repository Repository
+	config     Config
+}
+
+func New(repository Repository, config Config) Service {
+	return Service{
+		repository: repository,
+		config:     config,
+	}
+}
+
+// Begin резервирует ключ за запросом и возвращает запись с токеном аренды. Если запрос
+// с этим ключом уже выполнен, возвращает сохраненный ответ (IsCompleted), и выполнять
+// запрос повторно не нужно. Ключ с другим отпечатком запроса - ErrIdempotencyKeyReused,
+// ключ запроса, который еще выполняется, - ErrIdempotencyKeyInProgress. Ключ, аренда
+// которого истекла без ответа, забирает новый запрос.
+func (service Service) Begin(ctx context.Context, userID int, key string, fingerprint string) (_ *entities.IdempotencyRecord, err error) {
+	ctx, span := tracing.Start(ctx, "IdempotencyService.Begin")
+	defer func() { tracing.End(span, err) }()
+
+	token, err := newLeaseToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	record := &entities.IdempotencyRecord{
+		UserID:      userID,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(service.config.TTL),
+		LockedUntil: now.Add(service.config.LockTimeout),
+		LeaseToken:  token,
+	}
+
+	// вторая попытка нужна, если найденная запись уже истекла, но еще не удалена
+	for attempt := 0; attempt < 2; attempt++ {
+		created, err := service.repository.CreateRecord(ctx, record)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			return record, nil
+		}
+
+		exist := service.repository.GetRecord(ctx, userID, key)
+		if exist == nil {
+			continue
+		}
+		if !exist.ExpiresAt.After(now) {
+			// запись, которую успел заменить другой запрос, удалена не будет: у нее другая аренда
+			if err := service.repository.DeleteRecord(ctx, userID, key, exist.LeaseToken); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if exist.Fingerprint != fingerprint {
+			return nil, entities.ErrIdempotencyKeyReused
+		}
+		if !exist.IsCompleted() {
+			if exist.LockedUntil.After(now) {
+				return nil, entities.ErrIdempotencyKeyInProgress
+			}
+			taken, err := service.repository.TakeOverRecord(ctx, record, now)
+			if err != nil {
+				return nil, err
+			}
+			if !taken {
+				return nil, entities.ErrIdempotencyKeyInProgress
+			}
+			return record, nil
+		}
+		return exist, nil
+	}
+	return nil, entities.ErrIdempotencyKeyInProgress
+}
+
+// Complete сохраняет ответ на запрос, зарезервированный Begin. Если ключ уже забрал
+// повтор запроса, возвращает ErrIdempotencyLeaseLost и ответ не сохраняет.
+func (service Service) Complete(ctx context.Context, userID int, key string, leaseToken string, statusCode int, contentType string, body []byte) error {
+	record := service.repository.GetRecord(ctx, userID, key)
+	if record == nil || record.LeaseToken != leaseToken {
+		return entities.ErrIdempotencyLeaseLost
+	}
+
+	record.StatusCode = statusCode
+	record.ContentType = contentType
+	record.Body = body
+	return service.repository.SaveRecord(ctx, record)
+}
+
+// Abort освобождает ключ, если запрос не удался и клиент должен иметь возможность его повторить.
+// Ключ, который уже забрал повтор запроса, не трогается.
+func (service Service) Abort(ctx context.Context, userID int, key string, leaseToken string) error {
+	return service.repository.DeleteRecord(ctx, userID, key, leaseToken)
+}
+
+func newLeaseToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Run периодически удаляет записи с истекшим TTL.
+func (service Service) Run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(service.config.CleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := service.repository.DeleteExpiredRecords(ctx, time.Now())
+				if err != nil {
+					logger.Get().Warn("delete expired idempotency records error", zap.String("error", err.Error()))
+					continue
+				}
+				if deleted > 0 {
+					logger.Get().Debug("expired idempotency records deleted", zap.Int("count", deleted))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,104 @@
+package idempotencyservice
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	idempotencyrepository "github.com/besean163/gophermart/internal/repositories/inmem/idempotency_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotency(t *testing.T) {
+	ctx := context.Background()
+	repository := idempotencyrepository.New()
+	service := New(repository, DefaultConfig())
+
+	record, err := service.Begin(ctx, 1, "key", "fingerprint")
+	require.NoError(t, err)
+	assert.False(t, record.IsCompleted(), "first request must be executed")
+	assert.NotEmpty(t, record.LeaseToken)
+
+	t.Run("retry while in progress", func(t *testing.T) {
+		_, err := service.Begin(ctx, 1, "key", "fingerprint")
+		assert.ErrorIs(t, err, entities.ErrIdempotencyKeyInProgress)
+	})
+
+	require.NoError(t, service.Complete(ctx, 1, "key", record.LeaseToken, http.StatusAccepted, "", nil))
+
+	t.Run("retry replays response", func(t *testing.T) {
+		record, err := service.Begin(ctx, 1, "key", "fingerprint")
+		require.NoError(t, err)
+		require.True(t, record.IsCompleted())
+		assert.Equal(t, http.StatusAccepted, record.StatusCode)
+	})
+
+	t.Run("reused key with other payload", func(t *testing.T) {
+		_, err := service.Begin(ctx, 1, "key", "other")
+		assert.ErrorIs(t, err, entities.ErrIdempotencyKeyReused)
+	})
+
+	t.Run("keys are per user", func(t *testing.T) {
+		record, err := service.Begin(ctx, 2, "key", "other")
+		require.NoError(t, err)
+		assert.False(t, record.IsCompleted())
+	})
+
+	t.Run("aborted key can be retried", func(t *testing.T) {
+		failed, err := service.Begin(ctx, 1, "failed", "fingerprint")
+		require.NoError(t, err)
+		require.NoError(t, service.Abort(ctx, 1, "failed", failed.LeaseToken))
+
+		record, err := service.Begin(ctx, 1, "failed", "fingerprint")
+		require.NoError(t, err)
+		assert.False(t, record.IsCompleted())
+	})
+
+	t.Run("stale lock is taken over", func(t *testing.T) {
+		first, err := service.Begin(ctx, 1, "stale", "fingerprint")
+		require.NoError(t, err)
+		stale := repository.GetRecord(ctx, 1, "stale")
+		stale.LockedUntil = time.Now().Add(-time.Second)
+		require.NoError(t, repository.SaveRecord(ctx, stale))
+
+		retry, err := service.Begin(ctx, 1, "stale", "fingerprint")
+		require.NoError(t, err)
+		assert.False(t, retry.IsCompleted(), "retry must execute request again")
+		assert.NotEqual(t, first.LeaseToken, retry.LeaseToken)
+
+		_, err = service.Begin(ctx, 1, "stale", "fingerprint")
+		assert.ErrorIs(t, err, entities.ErrIdempotencyKeyInProgress, "taken over key is locked again")
+
+		// первый запрос досрочно не освобождает и не перезаписывает чужую аренду
+		require.NoError(t, service.Abort(ctx, 1, "stale", first.LeaseToken))
+		assert.ErrorIs(t, service.Complete(ctx, 1, "stale", first.LeaseToken, http.StatusOK, "", nil), entities.ErrIdempotencyLeaseLost)
+		assert.Equal(t, retry.LeaseToken, repository.GetRecord(ctx, 1, "stale").LeaseToken)
+		assert.Zero(t, repository.GetRecord(ctx, 1, "stale").StatusCode)
+
+		require.NoError(t, service.Abort(ctx, 1, "stale", retry.LeaseToken))
+	})
+
+	t.Run("expired key starts new request", func(t *testing.T) {
+		expired := repository.GetRecord(ctx, 1, "key")
+		expired.ExpiresAt = time.Now().Add(-time.Second)
+		require.NoError(t, repository.SaveRecord(ctx, expired))
+
+		record, err := service.Begin(ctx, 1, "key", "other")
+		require.NoError(t, err)
+		assert.False(t, record.IsCompleted())
+
+		// удаление истекшей записи по старой аренде не трогает новую
+		require.NoError(t, repository.DeleteRecord(ctx, 1, "key", expired.LeaseToken))
+		assert.NotNil(t, repository.GetRecord(ctx, 1, "key"))
+	})
+
+	t.Run("expired records are deleted", func(t *testing.T) {
+		deleted, err := repository.DeleteExpiredRecords(ctx, time.Now().Add(48*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 3, deleted)
+		assert.Nil(t, repository.GetRecord(ctx, 1, "key"))
+	})
+}
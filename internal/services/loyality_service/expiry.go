@@ -0,0 +1,248 @@
+package loyalityservice
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	expiryReason = "points expired"
+	// expiryEpsilon отсекает остатки от погрешности float при сравнении сумм.
+	expiryEpsilon = 1e-9
+	// expiryLockName - блокировка, под которой экземпляры по очереди проводят сгорание.
+	expiryLockName = "points_expiry"
+)
+
+// ExpiryConfig - политика сгорания баллов. Months == 0 - баллы не сгорают.
+type ExpiryConfig struct {
+	Months int
+	// Interval - как часто проводить сгорание, NoticePeriod - за сколько до сгорания
+	// баллы попадают в expiring_soon баланса.
+	Interval     time.Duration
+	NoticePeriod time.Duration
+}
+
+// WithPointsExpiry включает сгорание баллов через config.Months месяцев после начисления.
+func WithPointsExpiry(config ExpiryConfig) Option {
+	return func(service *Service) {
+		service.expiryConfig = config
+	}
+}
+
+// pointsBucket - начисление по одному заказу вместе с его корректировками.
+type pointsBucket struct {
+	orderNumber string
+	accruedAt   time.Time
+	expiresAt   time.Time
+	remaining   float64
+	expired     float64
+	isExpired   bool
+}
+
+type pointsDebit struct {
+	at     time.Time
+	amount float64
+}
+
+// getPointsBuckets раскладывает начисления пользователя по заказам и на момент now
+// погашает их списаниями по FIFO: сначала расходуются самые старые баллы.
+// Остаток корзины на дату сгорания считается сгоревшим. Активные резервы погашают
+// корзины так же, как списания, поэтому зарезервированные баллы не сгорают.
+// Начисления без номера заказа не сгорают и в корзины не попадают.
+func (service Service) getPointsBuckets(ctx context.Context, userID int, now time.Time) []*pointsBucket {
+	var buckets []*pointsBucket
+	byOrder := make(map[string]*pointsBucket)
+	for _, order := range service.repository.GetUserOrders(ctx, userID, entities.ListQuery{}) {
+		if order.Status != entities.OrderStatusProcessed || order.Accrual <= 0 {
+			continue
+		}
+		accruedAt := order.UploadedAt
+		if order.ProcessedAt != nil {
+			accruedAt = *order.ProcessedAt
+		}
+		bucket := &pointsBucket{
+			orderNumber: order.Number,
+			accruedAt:   accruedAt,
+			expiresAt:   accruedAt.AddDate(0, service.expiryConfig.Months, 0),
+			remaining:   order.Accrual,
+		}
+		buckets = append(buckets, bucket)
+		byOrder[order.Number] = bucket
+	}
+
+	refunded := make(map[int]float64)
+	for _, entry := range service.repository.GetUserLedger(ctx, userID) {
+		switch entry.Type {
+		case entities.LedgerEntryReversal:
+			if entry.WithdrawnID != nil {
+				refunded[*entry.WithdrawnID] += entry.Amount
+			}
+		case entities.LedgerEntryExpiry:
+		default:
+			if bucket, ok := byOrder[entry.OrderNumber]; ok {
+				bucket.remaining += entry.Amount
+			}
+		}
+	}
+
+	// возврат уменьшает исходное списание, а не начисляет новые баллы с новым сроком
+	var debits []pointsDebit
+	for _, withdrawn := range service.repository.GetUserWithdrawals(ctx, userID, entities.ListQuery{}) {
+		if amount := withdrawn.Sum - refunded[withdrawn.ID]; amount > expiryEpsilon {
+			debits = append(debits, pointsDebit{at: withdrawn.ProccesedAt, amount: amount})
+		}
+	}
+	for _, hold := range service.repository.GetUserActiveHolds(ctx, userID, now) {
+		debits = append(debits, pointsDebit{at: hold.CreatedAt, amount: hold.Sum})
+	}
+
+	slices.SortStableFunc(buckets, func(a, b *pointsBucket) int { return a.accruedAt.Compare(b.accruedAt) })
+	slices.SortStableFunc(debits, func(a, b pointsDebit) int { return a.at.Compare(b.at) })
+
+	for _, debit := range debits {
+		expireBuckets(buckets, debit.at)
+		amount := debit.amount
+		for _, bucket := range buckets {
+			if amount <= expiryEpsilon || bucket.accruedAt.After(debit.at) {
+				break
+			}
+			if bucket.isExpired || bucket.remaining <= 0 {
+				continue
+			}
+			used := min(amount, bucket.remaining)
+			bucket.remaining -= used
+			amount -= used
+		}
+	}
+	expireBuckets(buckets, now)
+	return buckets
+}
+
+func expireBuckets(buckets []*pointsBucket, at time.Time) {
+	for _, bucket := range buckets {
+		if bucket.isExpired || bucket.expiresAt.After(at) {
+			continue
+		}
+		bucket.isExpired = true
+		bucket.expired = max(bucket.remaining, 0)
+		bucket.remaining = 0
+	}
+}
+
+// expiredByOrder возвращает суммы уже проведенного сгорания по заказам.
+func expiredByOrder(ledger []*entities.LedgerEntry) map[string]float64 {
+	expired := make(map[string]float64)
+	for _, entry := range ledger {
+		if entry.Type == entities.LedgerEntryExpiry {
+			expired[entry.OrderNumber] -= entry.Amount
+		}
+	}
+	return expired
+}
+
+// unpostedExpiry возвращает баллы, которые уже сгорели, но записи EXPIRY по ним еще нет.
+func unpostedExpiry(buckets []*pointsBucket, ledger []*entities.LedgerEntry) float64 {
+	posted := expiredByOrder(ledger)
+	total := 0.0
+	for _, bucket := range buckets {
+		if amount := bucket.expired - posted[bucket.orderNumber]; bucket.isExpired && amount > expiryEpsilon {
+			total += amount
+		}
+	}
+	return total
+}
+
+// getExpirations возвращает остатки, которые сгорят в течение NoticePeriod.
+func (service Service) getExpirations(buckets []*pointsBucket, now time.Time) ([]entities.PointsExpiration, float64) {
+	var expirations []entities.PointsExpiration
+	total := 0.0
+	for _, bucket := range buckets {
+		if bucket.isExpired || bucket.remaining <= expiryEpsilon || bucket.expiresAt.After(now.Add(service.expiryConfig.NoticePeriod)) {
+			continue
+		}
+		expirations = append(expirations, entities.PointsExpiration{
+			OrderNumber: bucket.orderNumber,
+			Amount:      bucket.remaining,
+			ExpiresAt:   bucket.expiresAt,
+		})
+		total += bucket.remaining
+	}
+	return expirations, total
+}
+
+// ExpirePoints проводит сгорание баллов, срок которых истек к now, и возвращает число записей.
+// Повторный запуск довыпускает только разницу с уже проведенным сгоранием по заказу.
+// Сгорание проводит один экземпляр за раз: пока блокировку держит другой, запуск пропускается.
+func (service Service) ExpirePoints(ctx context.Context, now time.Time) (posted int, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.ExpirePoints")
+	defer func() { tracing.End(span, err) }()
+
+	if service.expiryConfig.Months <= 0 {
+		return 0, nil
+	}
+
+	_, err = service.repository.RunLocked(ctx, expiryLockName, func(ctx context.Context) error {
+		posted, err = service.expirePoints(ctx, now)
+		return err
+	})
+	return posted, err
+}
+
+func (service Service) expirePoints(ctx context.Context, now time.Time) (posted int, err error) {
+	before := now.AddDate(0, -service.expiryConfig.Months, 0)
+	for _, userID := range service.repository.GetUsersWithAccrualsBefore(ctx, before) {
+		expired := expiredByOrder(service.repository.GetUserLedger(ctx, userID))
+		for _, bucket := range service.getPointsBuckets(ctx, userID, now) {
+			amount := bucket.expired - expired[bucket.orderNumber]
+			if !bucket.isExpired || amount <= expiryEpsilon {
+				continue
+			}
+			err := service.repository.SaveLedgerEntry(ctx, &entities.LedgerEntry{
+				UserID:      userID,
+				Type:        entities.LedgerEntryExpiry,
+				Amount:      -amount,
+				OrderNumber: bucket.orderNumber,
+				Reason:      expiryReason,
+				CreatedAt:   now,
+			})
+			if err != nil {
+				return posted, err
+			}
+			posted++
+		}
+	}
+	return posted, nil
+}
+
+// runPointsExpiry периодически проводит сгорание, реплики не мешают друг другу благодаря блокировке в ExpirePoints.
+func (service Service) runPointsExpiry(ctx context.Context) {
+	if service.expiryConfig.Months <= 0 || service.expiryConfig.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(service.expiryConfig.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				posted, err := service.ExpirePoints(ctx, time.Now())
+				if err != nil {
+					logger.Get().Warn("points expiry error", zap.String("error", err.Error()))
+					continue
+				}
+				if posted > 0 {
+					logger.Get().Info("points expired", zap.Int("entries", posted))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,125 @@
+package loyalityservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirePoints(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	monthsAgo := func(months int, days int) *time.Time {
+		at := now.AddDate(0, -months, -days)
+		return &at
+	}
+
+	repository := orderrepository.New(nil)
+	for _, order := range []entities.Order{
+		// сгорел два месяца назад
+		{Number: "12345678903", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 100, ProcessedAt: monthsAgo(14, 0)},
+		// сгорит примерно через две недели
+		{Number: "2377225624", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 50, ProcessedAt: monthsAgo(11, 15)},
+		{Number: "4561261212345", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 30, ProcessedAt: monthsAgo(1, 0)},
+	} {
+		require.NoError(t, repository.SaveOrder(ctx, order))
+	}
+	// первое списание погашает самое старое начисление, второе - следующее, так как первое уже сгорело
+	require.NoError(t, repository.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "79927398713", Sum: 70, ProccesedAt: *monthsAgo(13, 0)}))
+	require.NoError(t, repository.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "49927398716", Sum: 20, ProccesedAt: *monthsAgo(0, 7)}))
+
+	service := New(repository, "", WithPointsExpiry(ExpiryConfig{Months: 12, NoticePeriod: 30 * 24 * time.Hour}))
+
+	t.Run("expired points are not spendable before the job runs", func(t *testing.T) {
+		assert.InDelta(t, 60, service.GetUserBalance(ctx, 1).Current, 1e-9)
+		err := service.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "1234567812345670", Sum: 61, ProccesedAt: now})
+		assert.ErrorIs(t, err, entities.ErrInsufficientBalance)
+	})
+
+	posted, err := service.ExpirePoints(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, posted)
+
+	ledger := repository.GetOrderLedger(ctx, "12345678903")
+	require.Len(t, ledger, 1)
+	assert.Equal(t, entities.LedgerEntryExpiry, ledger[0].Type)
+	assert.InDelta(t, -30, ledger[0].Amount, 1e-9)
+
+	balance := service.GetUserBalance(ctx, 1)
+	assert.InDelta(t, 60, balance.Current, 1e-9)
+	assert.InDelta(t, 90, balance.Withdrawn, 1e-9)
+	assert.InDelta(t, 30, balance.ExpiringSoon, 1e-9)
+	require.Len(t, balance.Expirations, 1)
+	assert.Equal(t, "2377225624", balance.Expirations[0].OrderNumber)
+
+	t.Run("repeated run posts nothing", func(t *testing.T) {
+		posted, err := service.ExpirePoints(ctx, now)
+		require.NoError(t, err)
+		assert.Zero(t, posted)
+	})
+
+	t.Run("disabled policy", func(t *testing.T) {
+		posted, err := New(repository, "").ExpirePoints(ctx, now.AddDate(10, 0, 0))
+		require.NoError(t, err)
+		assert.Zero(t, posted)
+		assert.Empty(t, New(repository, "").GetUserBalance(ctx, 1).Expirations)
+	})
+}
+
+func TestExpirePointsHeld(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	processedAt := now.AddDate(0, -11, -15)
+
+	repository := orderrepository.New(nil)
+	order := entities.Order{Number: "12345678903", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 100, ProcessedAt: &processedAt}
+	require.NoError(t, repository.SaveOrder(ctx, order))
+
+	service := New(repository, "", WithPointsExpiry(ExpiryConfig{Months: 12}), WithHoldTTL(60*24*time.Hour))
+	_, err := service.CreateHold(ctx, 1, "2377225624", 40)
+	require.NoError(t, err)
+
+	posted, err := service.ExpirePoints(ctx, now.AddDate(0, 1, 0))
+	require.NoError(t, err)
+	assert.Equal(t, 1, posted)
+
+	ledger := repository.GetOrderLedger(ctx, "12345678903")
+	require.Len(t, ledger, 1)
+	assert.InDelta(t, -60, ledger[0].Amount, 1e-9, "held points must not expire")
+}
+
+func TestExpirePointsReplicas(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	processedAt := now.AddDate(-2, 0, 0)
+
+	repository := orderrepository.New(nil)
+	for i, number := range []string{"12345678903", "2377225624", "4561261212345", "79927398713"} {
+		order := entities.Order{Number: number, UserID: i + 1, Status: entities.OrderStatusProcessed, Accrual: 100, ProcessedAt: &processedAt}
+		require.NoError(t, repository.SaveOrder(ctx, order))
+	}
+
+	// экземпляры с общим репозиторием запускают сгорание одновременно
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			service := New(repository, "", WithPointsExpiry(ExpiryConfig{Months: 12}))
+			_, err := service.ExpirePoints(ctx, now)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	for userID := 1; userID <= 4; userID++ {
+		assert.Len(t, repository.GetUserLedger(ctx, userID), 1)
+		assert.InDelta(t, 0, New(repository, "").GetUserBalance(ctx, userID).Current, 1e-9)
+	}
+}
@@ -0,0 +1,149 @@
+package loyalityservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHoldTTL     = 15 * time.Minute
+	holdExpiryInterval = time.Minute
+)
+
+// WithHoldTTL задает, сколько живет резерв, если его не списали и не сняли.
+func WithHoldTTL(ttl time.Duration) Option {
+	return func(service *Service) {
+		service.holdTTL = ttl
+	}
+}
+
+// CreateHold резервирует баллы под заказ. Номер заказа должен быть свободен для списания,
+// иначе резерв нельзя будет списать.
+func (service Service) CreateHold(ctx context.Context, userID int, orderNumber string, sum float64) (_ *entities.Hold, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.CreateHold")
+	defer func() { tracing.End(span, err) }()
+
+	if sum <= 0 {
+		return nil, entities.ErrInvalidInput
+	}
+	if service.repository.GetWithdrawnByOrder(ctx, orderNumber) != nil {
+		return nil, entities.NewWithdrawnConflictError(orderNumber, entities.WithdrawnConflictWithdrawn)
+	}
+
+	hold := entities.NewHold(userID, orderNumber, sum, service.holdTTL)
+	err = service.spendPoints(ctx, userID, sum, func(ctx context.Context) error {
+		return service.repository.SaveHold(ctx, hold)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+func (service Service) GetUserHolds(ctx context.Context, userID int) []*entities.Hold {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetUserHolds")
+	defer span.End()
+
+	return service.repository.GetUserActiveHolds(ctx, userID, time.Now())
+}
+
+// CaptureHold списывает зарезервированные баллы. sum == 0 - списать весь резерв,
+// меньшая сумма списывается, а остаток резерва освобождается.
+func (service Service) CaptureHold(ctx context.Context, userID int, id int, sum float64) (_ *entities.Withdrawn, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.CaptureHold")
+	defer func() { tracing.End(span, err) }()
+
+	hold, err := service.getUserHold(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if sum == 0 {
+		sum = hold.Sum
+	}
+	if sum < 0 || sum > hold.Sum {
+		return nil, entities.ErrInvalidInput
+	}
+
+	now := time.Now()
+	hold.Status = entities.HoldStatusCaptured
+	hold.Captured = sum
+	hold.ClosedAt = &now
+	withdrawn := entities.Withdrawn{
+		UserID:      userID,
+		OrderNumber: hold.OrderNumber,
+		Sum:         sum,
+		ProccesedAt: now,
+	}
+	// резерв уже вычтен из доступного баланса, проверять нужно только то, что
+	// баланс не ушел в минус, пока баллы были зарезервированы
+	err = service.spendPoints(ctx, userID, sum-hold.Sum, func(ctx context.Context) error {
+		return service.repository.CaptureHold(ctx, hold, withdrawn)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, notifier := range service.withdrawnNotifiers {
+		notifier.NotifyWithdrawn(withdrawn)
+	}
+	return &withdrawn, nil
+}
+
+// ReleaseHold снимает резерв, баллы снова доступны.
+func (service Service) ReleaseHold(ctx context.Context, userID int, id int) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.ReleaseHold")
+	defer func() { tracing.End(span, err) }()
+
+	hold, err := service.getUserHold(ctx, userID, id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	hold.Status = entities.HoldStatusReleased
+	hold.ClosedAt = &now
+	return service.repository.CloseHold(ctx, hold)
+}
+
+// getUserHold не отличает чужой резерв от несуществующего.
+func (service Service) getUserHold(ctx context.Context, userID int, id int) (*entities.Hold, error) {
+	hold := service.repository.GetHold(ctx, id)
+	if hold == nil || hold.UserID != userID {
+		return nil, entities.ErrNotFound
+	}
+	if !hold.IsActive(time.Now()) {
+		return nil, entities.ErrHoldNotActive
+	}
+	return hold, nil
+}
+
+// RunHoldExpiry помечает истекшие резервы. Баланс их и так не учитывает,
+// задача нужна, чтобы статус резерва в API соответствовал действительности.
+// Запускается на экземплярах API независимо от опроса accrual: UPDATE идемпотентен,
+// и несколько экземпляров друг другу не мешают.
+func (service Service) RunHoldExpiry(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(holdExpiryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				expired, err := service.repository.ExpireHolds(ctx, time.Now())
+				if err != nil {
+					logger.Get().Warn("expire holds error", zap.String("error", err.Error()))
+					continue
+				}
+				if expired > 0 {
+					logger.Get().Info("holds expired", zap.Int("count", expired))
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,163 @@
+package loyalityservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// RunPoller запускает фоновый опрос системы начислений, сверку, истечение резервов
+// и сгорание баллов до отмены ctx.
+// Может работать в процессе API или отдельно, в cmd/accrual-worker.
+func (service Service) RunPoller(ctx context.Context) {
+	service.runAccrualJobService(ctx)
+	service.runReconciliation(ctx)
+	service.runPointsExpiry(ctx)
+}
+
+func (service Service) runAccrualJobService(ctx context.Context) {
+	orderIn := make(chan entities.Order, 1)
+	savingOrders := make(chan entities.Order, 1)
+	errorChan := make(chan error)
+
+	// заказы забираются в аренду только под свободных воркеров, иначе аренда
+	// истекла бы в очереди и заказ проверила бы еще одна реплика
+	idle := make(chan struct{}, accrualWorkerCount)
+	for workerID := 1; workerID <= accrualWorkerCount; workerID++ {
+		idle <- struct{}{}
+		go service.worker(ctx, workerID, orderIn, savingOrders, errorChan, idle)
+	}
+
+	go service.saver(ctx, savingOrders)
+	go log(ctx, errorChan)
+
+	// уведомления о новых заказах проверяются сразу, тикер остается страховочным обходом
+	var uploaded <-chan string
+	if service.orderQueue != nil {
+		uploaded = service.orderQueue.Subscribe(ctx)
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second * tickSec)
+		for {
+			select {
+			case number, ok := <-uploaded:
+				if !ok {
+					uploaded = nil
+					continue
+				}
+				if !service.accrualAvailable() || takeIdle(idle, 1) == 0 {
+					// заказ заберет страховочный обход
+					continue
+				}
+				if order := service.repository.ClaimOrder(ctx, number, service.instanceID, service.claimLease); order != nil {
+					orderIn <- *order
+				} else {
+					idle <- struct{}{}
+				}
+			case <-ticker.C:
+				if !service.accrualAvailable() {
+					continue
+				}
+				free := takeIdle(idle, accrualWorkerCount)
+				if free == 0 {
+					continue
+				}
+				orders := service.repository.ClaimWaitProcessOrders(ctx, service.instanceID, service.claimLease, free)
+				for _, order := range orders {
+					orderIn <- *order
+				}
+				for range free - len(orders) {
+					idle <- struct{}{}
+				}
+			case <-ctx.Done():
+				logger.Get().Info("close update")
+				return
+			}
+		}
+	}()
+}
+
+// takeIdle забирает до limit свободных воркеров, не дожидаясь занятых.
+func takeIdle(idle chan struct{}, limit int) int {
+	taken := 0
+	for taken < limit {
+		select {
+		case <-idle:
+			taken++
+		default:
+			return taken
+		}
+	}
+	return taken
+}
+
+// accrualAvailable - пока breaker разомкнут или идет пауза после 429, опрос приостанавливается.
+func (service Service) accrualAvailable() bool {
+	if service.pause.active(time.Now()) {
+		return false
+	}
+	client, ok := service.accrualClient.(accrualAvailability)
+	return !ok || client.Available()
+}
+
+// accrualPause - общая для всех воркеров пауза после ответа 429: пока она идет, поллер
+// не забирает заказы, и система начислений не получает заведомо отклоненных запросов.
+type accrualPause struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// extend продлевает паузу до until, более ранний срок паузу не сокращает.
+func (pause *accrualPause) extend(until time.Time) {
+	pause.mu.Lock()
+	defer pause.mu.Unlock()
+	if until.After(pause.until) {
+		pause.until = until
+	}
+}
+
+func (pause *accrualPause) active(now time.Time) bool {
+	pause.mu.Lock()
+	defer pause.mu.Unlock()
+	return now.Before(pause.until)
+}
+
+func (service Service) saver(ctx context.Context, savingOrders chan entities.Order) {
+	for {
+		select {
+		case order := <-savingOrders:
+			saveCtx, span := tracing.Start(ctx, "LoyaltyService.saver", trace.WithAttributes(
+				attribute.String("order.number", order.Number),
+				attribute.String("order.status", order.Status),
+			))
+			err := service.saveOrderChange(saveCtx, order)
+			if err != nil {
+				logger.Get().Warn("save order error", zap.String("error", err.Error()))
+			}
+			// после сохранения заказ сразу доступен следующей проверке, при ошибке - повторной
+			service.releaseOrder(saveCtx, order)
+			tracing.End(span, err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func log(ctx context.Context, errorChan chan error) {
+	for {
+		select {
+		case err := <-errorChan:
+			logger.Get().Warn("Service error.", zap.String("error", err.Error()))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package loyalityservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/tracing"
+)
+
+func (service Service) GetPromoRules(ctx context.Context) []*entities.PromoRule {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetPromoRules")
+	defer span.End()
+
+	return service.repository.GetPromoRules(ctx, false)
+}
+
+func (service Service) CreatePromoRule(ctx context.Context, rule entities.PromoRule) (_ *entities.PromoRule, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.CreatePromoRule")
+	defer func() { tracing.End(span, err) }()
+
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+
+	rule.ID = 0
+	rule.CreatedAt = time.Now()
+	if err := service.repository.SavePromoRule(ctx, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// UpdatePromoRule заменяет условия и награду правила. Уже начисленные бонусы не пересчитываются.
+func (service Service) UpdatePromoRule(ctx context.Context, rule entities.PromoRule) (_ *entities.PromoRule, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.UpdatePromoRule")
+	defer func() { tracing.End(span, err) }()
+
+	exist := service.repository.GetPromoRule(ctx, rule.ID)
+	if exist == nil {
+		return nil, entities.ErrNotFound
+	}
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+
+	rule.CreatedAt = exist.CreatedAt
+	if err := service.repository.SavePromoRule(ctx, &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+func (service Service) DeletePromoRule(ctx context.Context, id int) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.DeletePromoRule")
+	defer func() { tracing.End(span, err) }()
+
+	return service.repository.DeletePromoRule(ctx, id)
+}
+
+// addPromoChange добавляет к изменению бонусы по активным правилам, подходящим под обработанный заказ.
+// Каждый бонус - отдельная запись в ledger с DedupKey по правилу и заказу.
+func (service Service) addPromoChange(ctx context.Context, change *entities.OrderChange) {
+	rules := service.repository.GetPromoRules(ctx, true)
+	if len(rules) == 0 {
+		return
+	}
+
+	order := change.Order
+	promo := service.getPromoContext(ctx, order)
+	for _, rule := range rules {
+		if !rule.Matches(promo) {
+			continue
+		}
+		bonus := rule.Bonus(order.Accrual)
+		if bonus <= 0 {
+			continue
+		}
+
+		change.Ledger = append(change.Ledger, &entities.LedgerEntry{
+			UserID:      order.UserID,
+			Type:        entities.LedgerEntryPromo,
+			Amount:      bonus,
+			OrderNumber: order.Number,
+			PromoRuleID: &rule.ID,
+			Reason:      rule.Name,
+			CreatedAt:   time.Now(),
+			DedupKey:    entities.NewDedupKey(entities.LedgerEntryPromo, order.Number, rule.ID),
+		})
+	}
+}
+
+// getPromoContext - уровень берется на момент до заказа, как и для множителя уровня.
+func (service Service) getPromoContext(ctx context.Context, order entities.Order) entities.PromoContext {
+	promo := entities.PromoContext{
+		ProcessedAt: time.Now(),
+		FirstOrder:  true,
+	}
+	if order.ProcessedAt != nil {
+		promo.ProcessedAt = *order.ProcessedAt
+	}
+
+	lifetime := 0.0
+	for _, exist := range service.repository.GetUserOrders(ctx, order.UserID, entities.ListQuery{}) {
+		if exist.Number == order.Number || exist.Status != entities.OrderStatusProcessed {
+			continue
+		}
+		promo.FirstOrder = false
+		lifetime += exist.Accrual
+	}
+	promo.Tier = entities.FindTier(service.getTiers(ctx), lifetime).Name
+	return promo
+}
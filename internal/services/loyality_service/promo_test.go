@@ -0,0 +1,86 @@
+package loyalityservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromoRules(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	repository.SetTiers([]*entities.Tier{
+		{Name: "silver", Threshold: 100, Multiplier: 1},
+		{Name: "base", Threshold: 0, Multiplier: 1},
+	})
+	service := New(repository, "")
+
+	_, err := service.CreatePromoRule(ctx, entities.PromoRule{Name: "bad", RewardType: "gift", Reward: 1})
+	assert.ErrorIs(t, err, entities.ErrInvalidInput)
+
+	yesterday := time.Now().Add(-24 * time.Hour)
+	firstOrder, err := service.CreatePromoRule(ctx, entities.PromoRule{
+		Name: "welcome", RewardType: entities.RewardTypePoint, Reward: 50, FirstOrderOnly: true, Active: true,
+	})
+	require.NoError(t, err)
+	silver, err := service.CreatePromoRule(ctx, entities.PromoRule{
+		Name: "silver week", RewardType: entities.RewardTypePercent, Reward: 10, Tiers: []string{"silver"}, StartsAt: &yesterday, Active: true,
+	})
+	require.NoError(t, err)
+	_, err = service.CreatePromoRule(ctx, entities.PromoRule{
+		Name: "expired", RewardType: entities.RewardTypePoint, Reward: 5, EndsAt: &yesterday, Active: true,
+	})
+	require.NoError(t, err)
+	_, err = service.CreatePromoRule(ctx, entities.PromoRule{
+		Name: "disabled", RewardType: entities.RewardTypePoint, Reward: 5,
+	})
+	require.NoError(t, err)
+	assert.Len(t, service.GetPromoRules(ctx), 4)
+
+	process := func(number string, accrual float64) []*entities.LedgerEntry {
+		order := entities.NewOrder(number, 1)
+		require.NoError(t, repository.SaveOrder(ctx, *order))
+		order.Status = entities.OrderStatusProcessed
+		order.Accrual = accrual
+		require.NoError(t, service.saveOrderChange(ctx, *order))
+		return repository.GetOrderLedger(ctx, number)
+	}
+
+	ledger := process("12345678903", 120)
+	require.Len(t, ledger, 1)
+	assert.Equal(t, entities.LedgerEntryPromo, ledger[0].Type)
+	assert.Equal(t, firstOrder.ID, *ledger[0].PromoRuleID)
+	assert.InDelta(t, 50, ledger[0].Amount, 1e-9)
+
+	// уровень silver получен предыдущим заказом
+	ledger = process("2377225624", 40)
+	require.Len(t, ledger, 1)
+	assert.Equal(t, silver.ID, *ledger[0].PromoRuleID)
+	assert.InDelta(t, 4, ledger[0].Amount, 1e-9)
+	assert.InDelta(t, 214, service.GetUserBalance(ctx, 1).Current, 1e-9)
+
+	t.Run("repeated processing does not duplicate bonus", func(t *testing.T) {
+		order := service.GetOrder(ctx, "2377225624")
+		require.NoError(t, service.saveOrderChange(ctx, *order))
+		assert.Len(t, repository.GetOrderLedger(ctx, "2377225624"), 1)
+	})
+
+	t.Run("update and delete", func(t *testing.T) {
+		silver.Reward = 20
+		updated, err := service.UpdatePromoRule(ctx, *silver)
+		require.NoError(t, err)
+		assert.Equal(t, silver.CreatedAt, updated.CreatedAt)
+
+		_, err = service.UpdatePromoRule(ctx, entities.PromoRule{ID: 100, Name: "x", RewardType: entities.RewardTypePoint, Reward: 1})
+		assert.ErrorIs(t, err, entities.ErrNotFound)
+
+		require.NoError(t, service.DeletePromoRule(ctx, silver.ID))
+		assert.ErrorIs(t, service.DeletePromoRule(ctx, silver.ID), entities.ErrNotFound)
+		assert.Len(t, service.GetPromoRules(ctx), 3)
+	})
+}
@@ -0,0 +1,283 @@
+package loyalityservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.uber.org/zap"
+)
+
+const (
+	// reconciliationLockName - блокировка, под которой экземпляры по очереди проводят сверку.
+	reconciliationLockName = "reconciliation"
+)
+
+var (
+	ErrReconcileReasonRequired = fmt.Errorf("%w: reconciliation correction needs an audit reason", entities.ErrInvalidInput)
+)
+
+type ReconcileConfig struct {
+	Interval time.Duration
+	Options  entities.ReconcileOptions
+}
+
+type reconciliationState struct {
+	mu         sync.Mutex
+	lastReport *entities.ReconciliationReport
+	// running - идет сверка, запущенная StartReconcile на этом экземпляре.
+	running bool
+}
+
+// WithReconciliation включает периодическую сверку обработанных заказов с системой начислений.
+func WithReconciliation(config ReconcileConfig) Option {
+	return func(service *Service) {
+		service.reconcileConfig = config
+	}
+}
+
+// Reconcile перепрашивает обработанные заказы и сообщает о расхождениях начислений.
+// Корректировки идемпотентны: сохраненное начисление учитывает прошлые корректировки заказа.
+// Сверку проводит один экземпляр за раз, иначе корректировки задвоятся:
+// пока идет другая сверка, возвращается ErrReconciliationInProgress.
+func (service Service) Reconcile(ctx context.Context, options entities.ReconcileOptions) (report entities.ReconciliationReport, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.Reconcile")
+	defer func() { tracing.End(span, err) }()
+
+	if options.Correct && options.Reason == "" {
+		return report, ErrReconcileReasonRequired
+	}
+
+	locked, err := service.repository.RunLocked(ctx, reconciliationLockName, func(ctx context.Context) error {
+		report = service.reconcile(ctx, options)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if !locked {
+		return report, entities.ErrReconciliationInProgress
+	}
+	return report, nil
+}
+
+// StartReconcile запускает внеочередную сверку в фоне: на длинном окне она идет дольше
+// таймаута запроса. Отчет по завершении доступен через GetReconciliationReport.
+func (service Service) StartReconcile(ctx context.Context, options entities.ReconcileOptions) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.StartReconcile")
+	defer func() { tracing.End(span, err) }()
+
+	if options.Correct && options.Reason == "" {
+		return ErrReconcileReasonRequired
+	}
+
+	state := service.reconciliation
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if state.running {
+		return entities.ErrReconciliationInProgress
+	}
+	state.running = true
+
+	// сверка переживает запрос, который ее запустил
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		defer func() {
+			state.mu.Lock()
+			state.running = false
+			state.mu.Unlock()
+		}()
+
+		if _, err := service.Reconcile(ctx, options); err != nil {
+			logger.Get().Warn("reconciliation error", zap.String("error", err.Error()))
+		}
+	}()
+	return nil
+}
+
+func (service Service) reconcile(ctx context.Context, options entities.ReconcileOptions) entities.ReconciliationReport {
+	report := entities.ReconciliationReport{
+		StartedAt:  time.Now(),
+		Window:     options.Window.String(),
+		Mismatches: make([]entities.ReconciliationMismatch, 0),
+	}
+	for _, order := range service.repository.GetProcessedOrders(ctx, report.StartedAt.Add(-options.Window)) {
+		if ctx.Err() != nil {
+			break
+		}
+		if options.SampleRate > 0 && options.SampleRate < 1 && rand.Float64() >= options.SampleRate {
+			report.Skipped++
+			continue
+		}
+
+		mismatch, ok, err := service.reconcileOrder(ctx, *order)
+		if err != nil {
+			report.Errors++
+			logger.Get().Warn("reconcile order error", zap.String("order", order.Number), zap.String("error", err.Error()))
+			var rateLimit RateLimitError
+			if errors.As(err, &rateLimit) {
+				select {
+				case <-time.After(rateLimit.RetryAfter):
+				case <-ctx.Done():
+				}
+			}
+			continue
+		}
+		report.Checked++
+		if !ok {
+			continue
+		}
+
+		if options.Correct {
+			err := service.correctMismatch(ctx, mismatch, options.Reason)
+			if err != nil {
+				report.Errors++
+				logger.Get().Warn("save reconciliation adjustment error", zap.String("order", order.Number), zap.String("error", err.Error()))
+			} else {
+				mismatch.Corrected = true
+				report.Corrected++
+			}
+		}
+		report.Mismatches = append(report.Mismatches, mismatch)
+	}
+	report.FinishedAt = time.Now()
+
+	if service.reconciliation != nil {
+		service.reconciliation.mu.Lock()
+		service.reconciliation.lastReport = &report
+		service.reconciliation.mu.Unlock()
+	}
+	return report
+}
+
+// GetReconciliationReport возвращает отчет последней сверки или nil, если сверок еще не было.
+func (service Service) GetReconciliationReport(ctx context.Context) *entities.ReconciliationReport {
+	if service.reconciliation == nil {
+		return nil
+	}
+	service.reconciliation.mu.Lock()
+	defer service.reconciliation.mu.Unlock()
+	return service.reconciliation.lastReport
+}
+
+// correctMismatch проводит корректировку начисления и надбавки по уровню вместе,
+// чтобы прерванная сверка не оставила заказ исправленным наполовину.
+func (service Service) correctMismatch(ctx context.Context, mismatch entities.ReconciliationMismatch, reason string) error {
+	return service.repository.LockUser(ctx, mismatch.UserID, func(ctx context.Context) error {
+		entries := []struct {
+			entryType string
+			amount    float64
+		}{
+			{entities.LedgerEntryAdjustment, mismatch.Delta},
+			{entities.LedgerEntryTierBonus, mismatch.TierBonusDelta},
+		}
+		for _, entry := range entries {
+			if entry.amount == 0 {
+				continue
+			}
+			err := service.repository.SaveLedgerEntry(ctx, &entities.LedgerEntry{
+				UserID:      mismatch.UserID,
+				Type:        entry.entryType,
+				Amount:      entry.amount,
+				OrderNumber: mismatch.OrderNumber,
+				Reason:      reason,
+				CreatedAt:   time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// reconcileOrder сравнивает начисление заказа с текущим ответом системы начислений.
+// Заказ, ставший INVALID или неизвестным системе, должен иметь нулевое начисление.
+// Надбавка по уровню пересчитывается с той же ставкой, с которой была начислена при обработке заказа.
+func (service Service) reconcileOrder(ctx context.Context, order entities.Order) (entities.ReconciliationMismatch, bool, error) {
+	mismatch := entities.ReconciliationMismatch{
+		OrderNumber: order.Number,
+		UserID:      order.UserID,
+		Stored:      order.Accrual,
+	}
+	tierBonus, tierRate := 0.0, 0.0
+	for _, entry := range service.repository.GetOrderLedger(ctx, order.Number) {
+		switch entry.Type {
+		case entities.LedgerEntryAdjustment:
+			mismatch.Stored += entry.Amount
+		case entities.LedgerEntryTierBonus:
+			tierBonus += entry.Amount
+			// исходная надбавка - единственная с DedupKey, ее ставка - множитель уровня минус 1
+			if entry.DedupKey != nil && order.Accrual > 0 {
+				tierRate = entry.Amount / order.Accrual
+			}
+		}
+	}
+
+	result, err := service.accrualClient.GetOrder(ctx, order.Number)
+	if err != nil {
+		return mismatch, false, err
+	}
+	checked, _, err := applyAccrualResult(order, result)
+	if err != nil {
+		return mismatch, false, err
+	}
+
+	switch result.Kind {
+	case accrualclient.ResultProcessed:
+		mismatch.Actual = checked.Accrual
+	case accrualclient.ResultInvalid, accrualclient.ResultNotFound:
+		mismatch.Actual = 0
+	default:
+		// система начислений снова пересчитывает заказ, сверять пока не с чем
+		return mismatch, false, nil
+	}
+	mismatch.Status = checked.Status
+
+	mismatch.Delta = math.Round((mismatch.Actual-mismatch.Stored)*100) / 100
+	mismatch.TierBonusDelta = math.Round((mismatch.Actual*tierRate-tierBonus)*100) / 100
+	return mismatch, mismatch.Delta != 0 || mismatch.TierBonusDelta != 0, nil
+}
+
+func (service Service) runReconciliation(ctx context.Context) {
+	if service.reconcileConfig.Interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(service.reconcileConfig.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !service.accrualAvailable() {
+					continue
+				}
+				report, err := service.Reconcile(ctx, service.reconcileConfig.Options)
+				if errors.Is(err, entities.ErrReconciliationInProgress) {
+					continue
+				}
+				if err != nil {
+					logger.Get().Warn("reconciliation error", zap.String("error", err.Error()))
+					continue
+				}
+				logger.Get().Info("reconciliation finished",
+					zap.Int("checked", report.Checked),
+					zap.Int("mismatches", len(report.Mismatches)),
+					zap.Int("corrected", report.Corrected),
+					zap.Int("errors", report.Errors),
+				)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,144 @@
+package loyalityservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
+	"github.com/besean163/gophermart/internal/entities"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+
+	repository := orderrepository.New(nil)
+	processedAt := time.Now().Add(-time.Hour)
+	oldProcessedAt := time.Now().Add(-48 * time.Hour)
+	for _, order := range []entities.Order{
+		{Number: "12345678903", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 500, ProcessedAt: &processedAt},
+		{Number: "2377225624", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 100, ProcessedAt: &processedAt},
+		{Number: "4561261212345", UserID: 2, Status: entities.OrderStatusProcessed, Accrual: 50, ProcessedAt: &processedAt},
+		{Number: "79927398713", UserID: 2, Status: entities.OrderStatusProcessed, Accrual: 10, ProcessedAt: &oldProcessedAt},
+	} {
+		require.NoError(t, repository.SaveOrder(ctx, order))
+	}
+
+	processed := func(number string, accrual float64) []accrualclient.Result {
+		return []accrualclient.Result{{Kind: accrualclient.ResultProcessed, Order: number, Accrual: accrual, HasAccrual: true}}
+	}
+	client := &fakeAccrualClient{results: map[string][]accrualclient.Result{}}
+	service := Service{accrualClient: client, repository: repository, reconciliation: &reconciliationState{}}
+	options := entities.ReconcileOptions{Window: 24 * time.Hour}
+
+	t.Run("report only", func(t *testing.T) {
+		client.results["12345678903"] = processed("12345678903", 550)
+		client.results["2377225624"] = processed("2377225624", 100)
+		client.results["4561261212345"] = []accrualclient.Result{{Kind: accrualclient.ResultInvalid, Order: "4561261212345"}}
+
+		report, err := service.Reconcile(ctx, options)
+		require.NoError(t, err)
+		assert.Equal(t, 3, report.Checked)
+		require.Len(t, report.Mismatches, 2)
+		assert.Equal(t, entities.ReconciliationMismatch{
+			OrderNumber: "12345678903", UserID: 1, Status: entities.OrderStatusProcessed, Stored: 500, Actual: 550, Delta: 50,
+		}, report.Mismatches[0])
+		assert.Equal(t, -50.0, report.Mismatches[1].Delta)
+		assert.Empty(t, repository.GetUserLedger(ctx, 1))
+		assert.Equal(t, &report, service.GetReconciliationReport(ctx))
+	})
+
+	t.Run("correction needs reason", func(t *testing.T) {
+		_, err := service.Reconcile(ctx, entities.ReconcileOptions{Window: time.Hour, Correct: true})
+		assert.ErrorIs(t, err, entities.ErrInvalidInput)
+	})
+
+	t.Run("correct mismatches", func(t *testing.T) {
+		client.results["12345678903"] = processed("12345678903", 550)
+		client.results["4561261212345"] = []accrualclient.Result{{Kind: accrualclient.ResultInvalid, Order: "4561261212345"}}
+		options := options
+		options.Correct = true
+		options.Reason = "accrual rules changed"
+
+		report, err := service.Reconcile(ctx, options)
+		require.NoError(t, err)
+		assert.Equal(t, 2, report.Corrected)
+
+		ledger := repository.GetUserLedger(ctx, 1)
+		require.Len(t, ledger, 1)
+		assert.Equal(t, 50.0, ledger[0].Amount)
+		assert.Equal(t, "accrual rules changed", ledger[0].Reason)
+		assert.Equal(t, 650.0, service.GetUserBalance(ctx, 1).Current)
+		assert.Equal(t, 10.0, service.GetUserBalance(ctx, 2).Current)
+	})
+
+	t.Run("corrections are not repeated", func(t *testing.T) {
+		client.results["12345678903"] = processed("12345678903", 550)
+		client.results["4561261212345"] = []accrualclient.Result{{Kind: accrualclient.ResultInvalid, Order: "4561261212345"}}
+		options := options
+		options.Correct = true
+		options.Reason = "accrual rules changed"
+
+		report, err := service.Reconcile(ctx, options)
+		require.NoError(t, err)
+		assert.Empty(t, report.Mismatches)
+		assert.Len(t, repository.GetUserLedger(ctx, 1), 1)
+	})
+
+	t.Run("start in background", func(t *testing.T) {
+		require.ErrorIs(t, service.StartReconcile(ctx, entities.ReconcileOptions{Window: time.Hour, Correct: true}), entities.ErrInvalidInput)
+
+		started := time.Now()
+		client.results["12345678903"] = processed("12345678903", 550)
+		require.NoError(t, service.StartReconcile(ctx, options))
+		assert.Eventually(t, func() bool {
+			report := service.GetReconciliationReport(ctx)
+			return report != nil && report.StartedAt.After(started)
+		}, time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			service.reconciliation.mu.Lock()
+			defer service.reconciliation.mu.Unlock()
+			return !service.reconciliation.running
+		}, time.Second, 10*time.Millisecond, "после завершения сверку можно запустить снова")
+	})
+
+	t.Run("another instance is reconciling", func(t *testing.T) {
+		locked, err := repository.RunLocked(ctx, reconciliationLockName, func(ctx context.Context) error {
+			_, err := service.Reconcile(ctx, options)
+			assert.ErrorIs(t, err, entities.ErrReconciliationInProgress)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.True(t, locked)
+	})
+}
+
+func TestReconcileTierBonus(t *testing.T) {
+	ctx := context.Background()
+
+	repository := orderrepository.New(nil)
+	processedAt := time.Now().Add(-time.Hour)
+	order := entities.Order{Number: "12345678903", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 500, ProcessedAt: &processedAt}
+	require.NoError(t, repository.SaveOrder(ctx, order))
+	require.NoError(t, repository.SaveLedgerEntry(ctx, entities.NewTierBonus(order, entities.Tier{Name: "gold", Multiplier: 1.5})))
+
+	client := &fakeAccrualClient{results: map[string][]accrualclient.Result{}}
+	service := Service{accrualClient: client, repository: repository, reconciliation: &reconciliationState{}}
+	options := entities.ReconcileOptions{Window: 24 * time.Hour, Correct: true, Reason: "accrual rules changed"}
+
+	client.results[order.Number] = []accrualclient.Result{{Kind: accrualclient.ResultProcessed, Order: order.Number, Accrual: 400, HasAccrual: true}}
+	report, err := service.Reconcile(ctx, options)
+	require.NoError(t, err)
+	require.Len(t, report.Mismatches, 1)
+	assert.Equal(t, -100.0, report.Mismatches[0].Delta)
+	assert.Equal(t, -50.0, report.Mismatches[0].TierBonusDelta)
+	assert.Equal(t, 600.0, service.GetUserBalance(ctx, 1).Current, "400 начисления и 200 надбавки")
+
+	client.results[order.Number] = []accrualclient.Result{{Kind: accrualclient.ResultProcessed, Order: order.Number, Accrual: 400, HasAccrual: true}}
+	report, err = service.Reconcile(ctx, options)
+	require.NoError(t, err)
+	assert.Empty(t, report.Mismatches)
+}
@@ -0,0 +1,215 @@
+package loyalityservice
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/tracing"
+)
+
+const (
+	referralCodeLength   = 8
+	referralCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	referralCodeAttempts = 5
+	referralBonusReason  = "referral bonus"
+)
+
+var (
+	ErrReferralCodeGeneration = errors.New("can't generate unique referral code")
+)
+
+// ReferralConfig - бонусы за приглашение и ограничения против накруток.
+type ReferralConfig struct {
+	ReferrerBonus float64
+	RefereeBonus  float64
+	// MaxRewards - сколько приглашений одного пользователя могут принести бонусы, 0 - без ограничения.
+	MaxRewards int
+	// MinAccrual - минимальное начисление за первый заказ приглашенного, иначе бонусов нет.
+	MinAccrual float64
+	// MaxPerDay - сколько пользователей можно пригласить за сутки, 0 - без ограничения.
+	MaxPerDay int
+}
+
+// WithReferralProgram включает бонусы за приглашения. Без него приглашения остаются в PENDING.
+func WithReferralProgram(config ReferralConfig) Option {
+	return func(service *Service) {
+		service.referralConfig = config
+	}
+}
+
+// GetUserReferrals возвращает реферальный код пользователя, создавая его при первом обращении,
+// и приглашенных им пользователей. clientIP запоминается среди адресов пользователя: регистрации
+// с этого адреса не приносят бонусов.
+func (service Service) GetUserReferrals(ctx context.Context, user entities.User, clientIP string) (_ entities.ReferralSummary, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetUserReferrals")
+	defer func() { tracing.End(span, err) }()
+
+	summary := entities.ReferralSummary{
+		Referrals: make([]*entities.Referral, 0),
+	}
+	if err := service.RecordUserIP(ctx, user.ID, clientIP); err != nil {
+		return summary, err
+	}
+	summary.Code, err = service.getReferralCode(ctx, user, clientIP)
+	if err != nil {
+		return summary, err
+	}
+
+	for _, referral := range service.repository.GetUserReferrals(ctx, user.ID) {
+		if referral.Status == entities.ReferralStatusRewarded {
+			summary.Earned += referral.ReferrerBonus
+		}
+		summary.Referrals = append(summary.Referrals, referral)
+	}
+	return summary, nil
+}
+
+// FindReferrer возвращает владельца реферального кода.
+func (service Service) FindReferrer(ctx context.Context, code string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.FindReferrer")
+	defer func() { tracing.End(span, err) }()
+
+	referralCode := service.repository.FindReferralCode(ctx, strings.ToUpper(strings.TrimSpace(code)))
+	if referralCode == nil {
+		return 0, entities.ErrReferralCodeNotFound
+	}
+	return referralCode.UserID, nil
+}
+
+// RecordUserIP запоминает адрес, с которого пользователь регистрировался, входил или получал код.
+// Приглашения с любого из этих адресов не приносят бонусов.
+func (service Service) RecordUserIP(ctx context.Context, userID int, ip string) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.RecordUserIP")
+	defer func() { tracing.End(span, err) }()
+
+	if ip == "" {
+		return nil
+	}
+	return service.repository.SaveUserIP(ctx, &entities.UserIP{UserID: userID, IP: ip, LastSeenAt: time.Now()})
+}
+
+// CreateReferral связывает только что зарегистрированного пользователя с пригласившим.
+// Приглашение с адреса пригласившего, с логином, похожим на его логин, с адреса другого
+// его приглашенного или сверх суточного лимита сохраняется отклоненным.
+func (service Service) CreateReferral(ctx context.Context, referrerID int, referee entities.User, signupIP string) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.CreateReferral")
+	defer func() { tracing.End(span, err) }()
+
+	limits := entities.ReferralLimits{MaxPerDay: service.referralConfig.MaxPerDay}
+	return service.repository.SaveReferral(ctx, entities.NewReferral(referrerID, referee, signupIP), limits)
+}
+
+func (service Service) getReferralCode(ctx context.Context, user entities.User, clientIP string) (string, error) {
+	if exist := service.repository.GetReferralCode(ctx, user.ID); exist != nil {
+		return exist.Code, nil
+	}
+
+	for range referralCodeAttempts {
+		code, err := newReferralCode()
+		if err != nil {
+			return "", err
+		}
+		created, err := service.repository.CreateReferralCode(ctx, &entities.ReferralCode{
+			UserID:    user.ID,
+			Code:      code,
+			Login:     user.Login,
+			IP:        clientIP,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			return "", err
+		}
+		if created {
+			return code, nil
+		}
+		// код мог создать параллельный запрос этого же пользователя
+		if exist := service.repository.GetReferralCode(ctx, user.ID); exist != nil {
+			return exist.Code, nil
+		}
+	}
+	return "", ErrReferralCodeGeneration
+}
+
+func newReferralCode() (string, error) {
+	var code strings.Builder
+	size := big.NewInt(int64(len(referralCodeAlphabet)))
+	for range referralCodeLength {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(referralCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// addReferralChange вызывается при переходе заказа в PROCESSED. Первый обработанный заказ приглашенного
+// закрывает приглашение: оба пользователя получают бонусы, либо приглашение отклоняется
+// по одному из ограничений.
+func (service Service) addReferralChange(ctx context.Context, change *entities.OrderChange) {
+	config := service.referralConfig
+	if config.ReferrerBonus <= 0 && config.RefereeBonus <= 0 {
+		return
+	}
+	order := change.Order
+	referral := service.repository.GetRefereeReferral(ctx, order.UserID)
+	if referral == nil || referral.Status != entities.ReferralStatusPending {
+		return
+	}
+
+	now := time.Now()
+	referral.OrderNumber = order.Number
+	referral.ClosedAt = &now
+	reward := &entities.ReferralReward{MaxRewards: config.MaxRewards}
+	change.Referral = reward
+
+	if reason := service.checkReferral(*referral, order); reason != "" {
+		referral.Reject(reason)
+		reward.Referral = *referral
+		return
+	}
+
+	referral.Status = entities.ReferralStatusRewarded
+	referral.ReferrerBonus = config.ReferrerBonus
+	referral.RefereeBonus = config.RefereeBonus
+	reward.Referral = *referral
+
+	if config.RefereeBonus > 0 {
+		reward.Ledger = append(reward.Ledger, &entities.LedgerEntry{
+			UserID:      referral.RefereeID,
+			Type:        entities.LedgerEntryReferral,
+			Amount:      config.RefereeBonus,
+			OrderNumber: order.Number,
+			ReferralID:  &referral.ID,
+			Reason:      referralBonusReason,
+			CreatedAt:   now,
+			DedupKey:    entities.NewDedupKey(entities.LedgerEntryReferral, referral.ID, referral.RefereeID),
+		})
+	}
+	// заказ принадлежит приглашенному, поэтому запись пригласившего с заказом не связывается
+	if config.ReferrerBonus > 0 {
+		reward.Ledger = append(reward.Ledger, &entities.LedgerEntry{
+			UserID:     referral.ReferrerID,
+			Type:       entities.LedgerEntryReferral,
+			Amount:     config.ReferrerBonus,
+			ReferralID: &referral.ID,
+			Reason:     referralBonusReason,
+			CreatedAt:  now,
+			DedupKey:   entities.NewDedupKey(entities.LedgerEntryReferral, referral.ID, referral.ReferrerID),
+		})
+	}
+}
+
+// checkReferral возвращает причину отказа в бонусах или пустую строку.
+// Лимит наград пригласившего проверяет репозиторий при сохранении.
+func (service Service) checkReferral(referral entities.Referral, order entities.Order) string {
+	if order.Accrual < service.referralConfig.MinAccrual {
+		return entities.ReferralRejectOrderAccrual
+	}
+	return ""
+}
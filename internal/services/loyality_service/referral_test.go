@@ -0,0 +1,166 @@
+package loyalityservice
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/besean163/gophermart/internal/entities"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReferrals(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	service := New(repository, "", WithReferralProgram(ReferralConfig{
+		ReferrerBonus: 100,
+		RefereeBonus:  50,
+		MaxRewards:    1,
+		MinAccrual:    10,
+	}))
+
+	summary, err := service.GetUserReferrals(ctx, entities.User{ID: 1, Login: "alice"}, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Len(t, summary.Code, referralCodeLength)
+	assert.Empty(t, summary.Referrals)
+
+	again, err := service.GetUserReferrals(ctx, entities.User{ID: 1, Login: "alice"}, "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, summary.Code, again.Code)
+
+	_, err = service.FindReferrer(ctx, "UNKNOWN")
+	assert.ErrorIs(t, err, entities.ErrInvalidInput)
+	referrerID, err := service.FindReferrer(ctx, " "+summary.Code+" ")
+	require.NoError(t, err)
+	assert.Equal(t, 1, referrerID)
+
+	require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: 2, Login: "bob"}, "10.0.0.2"))
+	require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: 3, Login: "eve"}, "10.0.0.3"))
+	require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: 4, Login: "mallory"}, "10.0.0.4"))
+	assert.ErrorIs(t, service.CreateReferral(ctx, 1, entities.User{ID: 2, Login: "bob"}, "10.0.0.2"), entities.ErrReferralClosed)
+
+	process := func(number string, userID int, accrual float64) {
+		order := entities.NewOrder(number, userID)
+		require.NoError(t, repository.SaveOrder(ctx, *order))
+		order.Status = entities.OrderStatusProcessed
+		order.Accrual = accrual
+		require.NoError(t, service.saveOrderChange(ctx, *order))
+	}
+
+	// первый заказ ниже минимума закрывает приглашение без бонусов
+	process("12345678903", 4, 5)
+	process("2377225624", 2, 20)
+	// повторный обработанный заказ бонусы не задваивает
+	process("4561261212345", 2, 20)
+	// лимит приглашений пользователя уже исчерпан
+	process("79927398713", 3, 20)
+
+	assert.InDelta(t, 100, service.GetUserBalance(ctx, 1).Current, 1e-9)
+	assert.InDelta(t, 90, service.GetUserBalance(ctx, 2).Current, 1e-9)
+	assert.InDelta(t, 20, service.GetUserBalance(ctx, 3).Current, 1e-9)
+	assert.InDelta(t, 5, service.GetUserBalance(ctx, 4).Current, 1e-9)
+
+	summary, err = service.GetUserReferrals(ctx, entities.User{ID: 1, Login: "alice"}, "10.0.0.1")
+	require.NoError(t, err)
+	assert.InDelta(t, 100, summary.Earned, 1e-9)
+	require.Len(t, summary.Referrals, 3)
+
+	statuses := make(map[string]string)
+	for _, referral := range summary.Referrals {
+		statuses[referral.RefereeLogin] = referral.Status + " " + referral.RejectReason
+	}
+	assert.Equal(t, map[string]string{
+		"bob":     entities.ReferralStatusRewarded + " ",
+		"eve":     entities.ReferralStatusRejected + " " + entities.ReferralRejectLimit,
+		"mallory": entities.ReferralStatusRejected + " " + entities.ReferralRejectOrderAccrual,
+	}, statuses)
+}
+
+func TestReferralRewardLimitConcurrent(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	service := New(repository, "", WithReferralProgram(ReferralConfig{ReferrerBonus: 100, MaxRewards: 1}))
+
+	numbers := []string{"12345678903", "2377225624", "4561261212345", "79927398713"}
+	for i, number := range numbers {
+		refereeID := i + 2
+		require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: refereeID, Login: number}, ""))
+		require.NoError(t, repository.SaveOrder(ctx, *entities.NewOrder(number, refereeID)))
+	}
+
+	var wg sync.WaitGroup
+	for i, number := range numbers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			order := entities.NewOrder(number, i+2)
+			order.Status = entities.OrderStatusProcessed
+			order.Accrual = 10
+			assert.NoError(t, service.saveOrderChange(ctx, *order))
+		}()
+	}
+	wg.Wait()
+
+	rewarded := 0
+	for _, referral := range repository.GetUserReferrals(ctx, 1) {
+		if referral.Status == entities.ReferralStatusRewarded {
+			rewarded++
+		}
+	}
+	assert.Equal(t, 1, rewarded)
+	assert.InDelta(t, 100, service.GetUserBalance(ctx, 1).Current, 1e-9)
+}
+
+func TestReferralFraudLimits(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	service := New(repository, "", WithReferralProgram(ReferralConfig{ReferrerBonus: 100, RefereeBonus: 50, MaxPerDay: 3}))
+
+	_, err := service.GetUserReferrals(ctx, entities.User{ID: 1, Login: "alice"}, "10.0.0.1")
+	require.NoError(t, err)
+
+	// регистрация с адреса пригласившего
+	require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: 2, Login: "self"}, "10.0.0.1"))
+	require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: 3, Login: "bob"}, "10.0.0.2"))
+	// второй приглашенный с того же адреса
+	require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: 4, Login: "bob-alt"}, "10.0.0.2"))
+	// суточный лимит приглашений исчерпан
+	require.NoError(t, service.CreateReferral(ctx, 1, entities.User{ID: 5, Login: "eve"}, "10.0.0.3"))
+	// пригласивший с другим лимитом не затронут
+	require.NoError(t, service.CreateReferral(ctx, 6, entities.User{ID: 7, Login: "mallory"}, "10.0.0.2"))
+
+	_, err = service.GetUserReferrals(ctx, entities.User{ID: 8, Login: "carol"}, "10.0.1.1")
+	require.NoError(t, err)
+	require.NoError(t, service.RecordUserIP(ctx, 8, "10.0.1.9"))
+	// логин пригласившего с другого адреса
+	require.NoError(t, service.CreateReferral(ctx, 8, entities.User{ID: 9, Login: "Carol_2"}, "10.0.2.2"))
+	// адрес, с которого пригласивший входил
+	require.NoError(t, service.CreateReferral(ctx, 8, entities.User{ID: 10, Login: "dave"}, "10.0.1.9"))
+
+	statuses := make(map[string]string)
+	for _, referrerID := range []int{1, 6, 8} {
+		for _, referral := range repository.GetUserReferrals(ctx, referrerID) {
+			statuses[referral.RefereeLogin] = referral.Status + " " + referral.RejectReason
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"self":    entities.ReferralStatusRejected + " " + entities.ReferralRejectSelf,
+		"bob":     entities.ReferralStatusPending + " ",
+		"bob-alt": entities.ReferralStatusRejected + " " + entities.ReferralRejectSameIP,
+		"eve":     entities.ReferralStatusRejected + " " + entities.ReferralRejectRate,
+		"mallory": entities.ReferralStatusPending + " ",
+		"Carol_2": entities.ReferralStatusRejected + " " + entities.ReferralRejectSelf,
+		"dave":    entities.ReferralStatusRejected + " " + entities.ReferralRejectSelf,
+	}, statuses)
+
+	// отклоненное приглашение бонусов не приносит
+	order := entities.NewOrder("12345678903", 2)
+	require.NoError(t, repository.SaveOrder(ctx, *order))
+	order.Status = entities.OrderStatusProcessed
+	order.Accrual = 20
+	require.NoError(t, service.saveOrderChange(ctx, *order))
+	assert.InDelta(t, 0, service.GetUserBalance(ctx, 1).Current, 1e-9)
+	assert.InDelta(t, 20, service.GetUserBalance(ctx, 2).Current, 1e-9)
+}
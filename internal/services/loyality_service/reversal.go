@@ -0,0 +1,74 @@
+package loyalityservice
+
+import (
+	"context"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/tracing"
+)
+
+// ReverseWithdrawn возвращает баллы по списанию, например при отмене заказа в магазине.
+// Списание не меняется: возврат - отдельная запись в ledger, связанная с ним.
+// Возвратов может быть несколько, в сумме не больше списанного.
+func (service Service) ReverseWithdrawn(ctx context.Context, request entities.ReverseWithdrawnRequest) (_ *entities.LedgerEntry, err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.ReverseWithdrawn")
+	defer func() { tracing.End(span, err) }()
+
+	if err := request.Validate(); err != nil {
+		return nil, err
+	}
+
+	withdrawn := service.repository.GetWithdrawnByOrder(ctx, request.OrderNumber)
+	if withdrawn == nil {
+		return nil, entities.ErrNotFound
+	}
+
+	amount := request.Amount
+	if amount == 0 {
+		amount = withdrawn.Sum
+		for _, reversal := range service.getReversals(ctx, *withdrawn) {
+			amount -= reversal.Amount
+		}
+	}
+
+	// остаток перепроверяет репозиторий под блокировкой списания
+	entry := entities.NewReversalEntry(*withdrawn, amount, request.Reason)
+	if err := service.repository.SaveReversal(ctx, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (service Service) getReversals(ctx context.Context, withdrawn entities.Withdrawn) []*entities.LedgerEntry {
+	var reversals []*entities.LedgerEntry
+	for _, entry := range service.repository.GetOrderLedger(ctx, withdrawn.OrderNumber) {
+		if isReversalOf(*entry, withdrawn.ID) {
+			reversals = append(reversals, entry)
+		}
+	}
+	return reversals
+}
+
+// withReversals возвращает копии списаний с возвратами из ledger пользователя.
+func (service Service) withReversals(ctx context.Context, userID int, withdrawals []*entities.Withdrawn) []*entities.Withdrawn {
+	if len(withdrawals) == 0 {
+		return withdrawals
+	}
+
+	ledger := service.repository.GetUserLedger(ctx, userID)
+	result := make([]*entities.Withdrawn, 0, len(withdrawals))
+	for _, withdrawn := range withdrawals {
+		item := *withdrawn
+		for _, entry := range ledger {
+			if isReversalOf(*entry, item.ID) {
+				item.AddReversal(*entry)
+			}
+		}
+		result = append(result, &item)
+	}
+	return result
+}
+
+func isReversalOf(entry entities.LedgerEntry, withdrawnID int) bool {
+	return entry.Type == entities.LedgerEntryReversal && entry.WithdrawnID != nil && *entry.WithdrawnID == withdrawnID
+}
@@ -2,139 +2,428 @@ package loyalityservice
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
 	"github.com/besean163/gophermart/internal/entities"
 	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 const (
 	tickSec            = 1
 	accrualWorkerCount = 10
+	checkRetryBase     = 5 * time.Second
+	checkRetryMax      = 10 * time.Minute
+	checkFailuresLimit = 100
+	defaultClaimLease  = 30 * time.Second
 )
 
 type Service struct {
-	accrualServiceURL string
-	repository        OrderRepository
+	accrualClient      AccrualClient
+	repository         OrderRepository
+	orderNotifiers     []OrderNotifier
+	withdrawnNotifiers []WithdrawnNotifier
+	reconcileConfig    ReconcileConfig
+	reconciliation     *reconciliationState
+	pause              *accrualPause
+	instanceID         string
+	claimLease         time.Duration
+	orderQueue         OrderQueue
+	checkOrderOwner    bool
+	holdTTL            time.Duration
+	expiryConfig       ExpiryConfig
+	tierMultiplier     bool
+	referralConfig     ReferralConfig
+}
+
+// OrderNotifier получает каждое сохраненное изменение статуса или начисления заказа.
+type OrderNotifier interface {
+	NotifyOrder(order entities.Order)
+}
+
+// WithdrawnNotifier получает каждое сохраненное списание.
+type WithdrawnNotifier interface {
+	NotifyWithdrawn(withdrawn entities.Withdrawn)
+}
+
+// AccrualClient - источник статусов заказов во внешней системе начислений.
+type AccrualClient interface {
+	GetOrder(ctx context.Context, number string) (accrualclient.Result, error)
+}
+
+// OrderQueue будит поллеры при загрузке заказа, чтобы он проверялся сразу, а не на следующем тике.
+// Уведомление может потеряться, такие заказы подберет обычный опрос.
+type OrderQueue interface {
+	Publish(ctx context.Context, orderNumber string) error
+	Subscribe(ctx context.Context) <-chan string
+}
+
+// accrualAvailability реализуют клиенты с circuit breaker.
+type accrualAvailability interface {
+	Available() bool
+}
+
+type Option func(*Service)
+
+// WithClaimLease задает, на сколько экземпляр поллера забирает заказы. За это время
+// заказ должен быть проверен, иначе его заберет другой экземпляр.
+func WithClaimLease(lease time.Duration) Option {
+	return func(service *Service) {
+		service.claimLease = lease
+	}
+}
+
+// WithAccrualClient подменяет HTTP-клиент системы начислений, например на другого провайдера.
+func WithAccrualClient(client AccrualClient) Option {
+	return func(service *Service) {
+		service.accrualClient = client
+	}
+}
+
+func WithOrderQueue(queue OrderQueue) Option {
+	return func(service *Service) {
+		service.orderQueue = queue
+	}
+}
+
+// WithWithdrawnOrderOwnerCheck запрещает списание по номеру заказа, загруженного
+// на начисление другим пользователем.
+func WithWithdrawnOrderOwnerCheck(enabled bool) Option {
+	return func(service *Service) {
+		service.checkOrderOwner = enabled
+	}
+}
+
+func WithOrderNotifier(notifier OrderNotifier) Option {
+	return func(service *Service) {
+		service.orderNotifiers = append(service.orderNotifiers, notifier)
+	}
+}
+
+func WithWithdrawnNotifier(notifier WithdrawnNotifier) Option {
+	return func(service *Service) {
+		service.withdrawnNotifiers = append(service.withdrawnNotifiers, notifier)
+	}
 }
 
 type OrderRepository interface {
-	GetOrder(orderID string) *entities.Order
-	GetUserOrders(userID int) []*entities.Order
-	GetUserWithdrawals(userID int) []*entities.Withdrawn
-	SaveOrder(entities.Order) error
-	SaveWithdrawn(entities.Withdrawn) error
-	GetWaitProcessOrders() []*entities.Order
+	GetOrder(ctx context.Context, orderID string) *entities.Order
+	GetOrderHistory(ctx context.Context, orderNumber string) []*entities.OrderStatusChange
+	GetUserOrders(ctx context.Context, userID int, query entities.ListQuery) []*entities.Order
+	GetUserWithdrawals(ctx context.Context, userID int, query entities.ListQuery) []*entities.Withdrawn
+	SaveOrder(ctx context.Context, order entities.Order) error
+	SaveOrderChange(ctx context.Context, change entities.OrderChange) error
+	GetWithdrawnByOrder(ctx context.Context, orderNumber string) *entities.Withdrawn
+	SaveWithdrawn(ctx context.Context, withdrawn entities.Withdrawn) error
+	GetWaitProcessOrders(ctx context.Context) []*entities.Order
+	ClaimWaitProcessOrders(ctx context.Context, owner string, lease time.Duration, limit int) []*entities.Order
+	ClaimOrder(ctx context.Context, orderNumber string, owner string, lease time.Duration) *entities.Order
+	ReleaseOrderClaim(ctx context.Context, orderNumber string, owner string) error
+	SaveOrderCheckError(ctx context.Context, orderNumber string, lastError string, nextCheckAt time.Time) error
+	GetOrderCheckFailures(ctx context.Context, limit int) []*entities.Order
+	SaveQuarantinedResponse(ctx context.Context, response *entities.QuarantinedResponse) error
+	GetQuarantinedResponses(ctx context.Context, limit int) []*entities.QuarantinedResponse
+	ResolveQuarantinedResponse(ctx context.Context, id int, resolvedAt time.Time) error
+	GetProcessedOrders(ctx context.Context, since time.Time) []*entities.Order
+	GetUsersWithAccrualsBefore(ctx context.Context, before time.Time) []int
+	GetTiers(ctx context.Context) []*entities.Tier
+	GetUserTier(ctx context.Context, userID int) *entities.UserTier
+	SaveUserTier(ctx context.Context, tier *entities.UserTier) error
+	SavePromoRule(ctx context.Context, rule *entities.PromoRule) error
+	GetPromoRule(ctx context.Context, id int) *entities.PromoRule
+	GetPromoRules(ctx context.Context, activeOnly bool) []*entities.PromoRule
+	DeletePromoRule(ctx context.Context, id int) error
+	CreateReferralCode(ctx context.Context, code *entities.ReferralCode) (bool, error)
+	GetReferralCode(ctx context.Context, userID int) *entities.ReferralCode
+	FindReferralCode(ctx context.Context, code string) *entities.ReferralCode
+	SaveReferral(ctx context.Context, referral *entities.Referral, limits entities.ReferralLimits) error
+	SaveUserIP(ctx context.Context, userIP *entities.UserIP) error
+	GetRefereeReferral(ctx context.Context, refereeID int) *entities.Referral
+	GetUserReferrals(ctx context.Context, referrerID int) []*entities.Referral
+	SaveLedgerEntry(ctx context.Context, entry *entities.LedgerEntry) error
+	SaveReversal(ctx context.Context, entry *entities.LedgerEntry) error
+	SaveHold(ctx context.Context, hold *entities.Hold) error
+	GetHold(ctx context.Context, id int) *entities.Hold
+	GetUserActiveHolds(ctx context.Context, userID int, now time.Time) []*entities.Hold
+	CaptureHold(ctx context.Context, hold *entities.Hold, withdrawn entities.Withdrawn) error
+	CloseHold(ctx context.Context, hold *entities.Hold) error
+	ExpireHolds(ctx context.Context, now time.Time) (int, error)
+	GetUserLedger(ctx context.Context, userID int) []*entities.LedgerEntry
+	GetOrderLedger(ctx context.Context, orderNumber string) []*entities.LedgerEntry
+	// LockUser выполняет fn под блокировкой пользователя. Вызовы репозитория с контекстом fn
+	// видят состояние на момент блокировки, их изменения фиксируются вместе.
+	LockUser(ctx context.Context, userID int, fn func(ctx context.Context) error) error
+	// RunLocked выполняет fn под общей для всех экземпляров блокировкой name.
+	// false - блокировку держит другой экземпляр, fn не вызывалась.
+	RunLocked(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error)
 }
 
-func New(ctx context.Context, repository OrderRepository, accrualServiceURL string) Service {
+// New только собирает сервис, фоновый опрос системы начислений запускает RunPoller.
+func New(repository OrderRepository, accrualServiceURL string, options ...Option) Service {
 
 	service := Service{
-		accrualServiceURL: accrualServiceURL,
-		repository:        repository,
+		accrualClient:  accrualclient.New(accrualServiceURL, accrualclient.DefaultConfig()),
+		repository:     repository,
+		reconciliation: &reconciliationState{},
+		pause:          &accrualPause{},
+		instanceID:     uuid.NewString(),
+		claimLease:     defaultClaimLease,
+		holdTTL:        defaultHoldTTL,
+	}
+	for _, option := range options {
+		option(&service)
 	}
-	service.runAccrualJobService(ctx)
 
 	return service
 }
 
-func (service Service) GetOrder(orderNumber string) *entities.Order {
-	return service.repository.GetOrder(orderNumber)
+func (service Service) GetOrder(ctx context.Context, orderNumber string) *entities.Order {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetOrder")
+	defer span.End()
+
+	return service.repository.GetOrder(ctx, orderNumber)
 }
 
-func (service Service) SaveOrder(order entities.Order) error {
-	return service.repository.SaveOrder(order)
+// GetOrderDetails возвращает заказ вместе с историей статусов.
+func (service Service) GetOrderDetails(ctx context.Context, orderNumber string) *entities.OrderDetails {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetOrderDetails")
+	defer span.End()
+
+	order := service.repository.GetOrder(ctx, orderNumber)
+	if order == nil {
+		return nil
+	}
+
+	return &entities.OrderDetails{
+		Order:   *order,
+		History: service.repository.GetOrderHistory(ctx, orderNumber),
+	}
 }
 
-func (service Service) GetUserOrders(userID int) []*entities.Order {
-	return service.repository.GetUserOrders(userID)
+// RefreshOrder сразу проверяет заказ в системе начислений, не дожидаясь очередного тика.
+// Заказ берется в аренду, как поллером; если он уже арендован, возвращается ErrOrderBusy.
+func (service Service) RefreshOrder(ctx context.Context, orderNumber string) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.RefreshOrder")
+	defer func() { tracing.End(span, err) }()
+
+	order := service.repository.GetOrder(ctx, orderNumber)
+	if order == nil || order.IsFinal() {
+		return nil
+	}
+	order = service.repository.ClaimOrder(ctx, orderNumber, service.instanceID, service.claimLease)
+	if order == nil {
+		return entities.ErrOrderBusy
+	}
+	defer service.releaseOrder(ctx, *order)
+
+	updated, ok, err := checkOrder(ctx, service.accrualClient, *order)
+	if err != nil {
+		var rateLimit RateLimitError
+		if errors.As(err, &rateLimit) {
+			service.pause.extend(time.Now().Add(rateLimit.RetryAfter))
+		}
+		service.quarantineResponse(ctx, *order, err)
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	return service.saveOrderChange(ctx, updated)
 }
 
-func (service Service) GetUserWithdrawals(userID int) []*entities.Withdrawn {
-	return service.repository.GetUserWithdrawals(userID)
+// saveOrderChange сохраняет изменение, найденное в системе начислений, и оповещает подписчиков.
+// Бонусы за обработанный заказ сохраняются в одной транзакции с его статусом.
+func (service Service) saveOrderChange(ctx context.Context, order entities.Order) error {
+	change := entities.OrderChange{Order: order}
+	if order.Status == entities.OrderStatusProcessed {
+		service.addPromoChange(ctx, &change)
+		service.addReferralChange(ctx, &change)
+		service.addTierChange(ctx, &change)
+	}
+	err := service.repository.SaveOrderChange(ctx, change)
+	if err != nil {
+		return err
+	}
+
+	for _, notifier := range service.orderNotifiers {
+		notifier.NotifyOrder(order)
+	}
+	return nil
 }
 
-func (service Service) GetUserBalance(userID int) entities.Balance {
-	orders := service.GetUserOrders(userID)
-	withdrawals := service.GetUserWithdrawals(userID)
+func (service Service) SaveOrder(ctx context.Context, order entities.Order) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.SaveOrder")
+	defer func() { tracing.End(span, err) }()
+
+	err = service.repository.SaveOrder(ctx, order)
+	if err != nil || service.orderQueue == nil {
+		return err
+	}
+
+	// заказ уже сохранен, без уведомления его проверит обычный опрос
+	if err := service.orderQueue.Publish(ctx, order.Number); err != nil {
+		logger.Get().Warn("publish order error", zap.String("order", order.Number), zap.String("error", err.Error()))
+	}
+	return nil
+}
+
+// GetUserOrders возвращает страницу заказов и курсор следующей страницы,
+// курсор пустой, если страница последняя.
+func (service Service) GetUserOrders(ctx context.Context, userID int, query entities.ListQuery) ([]*entities.Order, string) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetUserOrders")
+	defer span.End()
+
+	return paginate(query, service.repository.GetUserOrders(ctx, userID, nextPageQuery(query)), (*entities.Order).Cursor)
+}
+
+func (service Service) GetUserWithdrawals(ctx context.Context, userID int, query entities.ListQuery) ([]*entities.Withdrawn, string) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetUserWithdrawals")
+	defer span.End()
+
+	withdrawals, nextCursor := paginate(query, service.repository.GetUserWithdrawals(ctx, userID, nextPageQuery(query)), (*entities.Withdrawn).Cursor)
+	return service.withReversals(ctx, userID, withdrawals), nextCursor
+}
+
+// nextPageQuery запрашивает на одну запись больше, чтобы понять, есть ли следующая страница.
+func nextPageQuery(query entities.ListQuery) entities.ListQuery {
+	if query.Limit > 0 {
+		query.Limit++
+	}
+	return query
+}
+
+func paginate[T any](query entities.ListQuery, items []T, cursor func(T) entities.ListCursor) ([]T, string) {
+	if query.Limit <= 0 || len(items) <= query.Limit {
+		return items, ""
+	}
+	items = items[:query.Limit]
+	next := cursor(items[len(items)-1])
+	next.Sort = query.Direction()
+	return items, next.Encode()
+}
+
+// GetOrderCheckFailures возвращает заказы с ошибками проверки, начиная с самых проблемных.
+func (service Service) GetOrderCheckFailures(ctx context.Context) []entities.OrderCheckFailure {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetOrderCheckFailures")
+	defer span.End()
+
+	orders := service.repository.GetOrderCheckFailures(ctx, checkFailuresLimit)
+	failures := make([]entities.OrderCheckFailure, 0, len(orders))
+	for _, order := range orders {
+		failures = append(failures, entities.NewOrderCheckFailure(*order))
+	}
+	return failures
+}
+
+// GetQuarantinedResponses возвращает отложенные на разбор ответы системы начислений.
+func (service Service) GetQuarantinedResponses(ctx context.Context) []*entities.QuarantinedResponse {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetQuarantinedResponses")
+	defer span.End()
+
+	return service.repository.GetQuarantinedResponses(ctx, checkFailuresLimit)
+}
+
+// ResolveQuarantinedResponse отмечает ответ разобранным. Заказ продолжает опрашиваться
+// по общему расписанию, исправленный ответ применится обычным путем.
+func (service Service) ResolveQuarantinedResponse(ctx context.Context, id int) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.ResolveQuarantinedResponse")
+	defer func() { tracing.End(span, err) }()
+
+	return service.repository.ResolveQuarantinedResponse(ctx, id, time.Now())
+}
+
+func (service Service) GetUserBalance(ctx context.Context, userID int) entities.Balance {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetUserBalance")
+	defer span.End()
+
+	orders := service.repository.GetUserOrders(ctx, userID, entities.ListQuery{})
+	withdrawals := service.repository.GetUserWithdrawals(ctx, userID, entities.ListQuery{})
 
 	totalSum := 0.0
 	for _, order := range orders {
 		totalSum += order.Accrual
 	}
-
 	totalWithdrawn := 0.0
 	for _, withdrawn := range withdrawals {
 		totalWithdrawn += withdrawn.Sum
 	}
 
-	return entities.Balance{
-		Current:   totalSum - totalWithdrawn,
-		Withdrawn: totalWithdrawn,
+	// возвраты уменьшают сумму списаний, остальные записи ledger меняют начисления
+	ledger := service.repository.GetUserLedger(ctx, userID)
+	for _, entry := range ledger {
+		if entry.Type == entities.LedgerEntryReversal {
+			totalWithdrawn -= entry.Amount
+			continue
+		}
+		totalSum += entry.Amount
 	}
-}
 
-func (service Service) SaveWithdrawn(withdrawn entities.Withdrawn) error {
-	return service.repository.SaveWithdrawn(withdrawn)
-}
+	now := time.Now()
+	totalHeld := 0.0
+	for _, hold := range service.repository.GetUserActiveHolds(ctx, userID, now) {
+		totalHeld += hold.Sum
+	}
 
-type AccrualOrder struct {
-	Order   string
-	Status  string
-	Accrual float64
+	balance := entities.Balance{
+		Current:   totalSum - totalWithdrawn - totalHeld,
+		Held:      totalHeld,
+		Withdrawn: totalWithdrawn,
+	}
+	if service.expiryConfig.Months > 0 {
+		buckets := service.getPointsBuckets(ctx, userID, now)
+		// сгоревшее, но еще не проведенное задачей сгорания, тратить уже нельзя
+		balance.Current -= unpostedExpiry(buckets, ledger)
+		balance.Expirations, balance.ExpiringSoon = service.getExpirations(buckets, now)
+	}
+	return balance
 }
 
-func (service Service) runAccrualJobService(ctx context.Context) {
-	orderIn := make(chan entities.Order, 1)
-	savingOrders := make(chan entities.Order, 1)
-	errorChan := make(chan error)
-
-	for workerID := 1; workerID <= accrualWorkerCount; workerID++ {
-		go worker(ctx, workerID, orderIn, savingOrders, service.accrualServiceURL, errorChan)
-	}
+// spendPoints выполняет save под блокировкой пользователя, если ему доступно не меньше sum,
+// иначе возвращает ErrInsufficientBalance. Списания и резервы одного пользователя проверяют
+// баланс по очереди и не уводят его в минус.
+func (service Service) spendPoints(ctx context.Context, userID int, sum float64, save func(ctx context.Context) error) error {
+	return service.repository.LockUser(ctx, userID, func(ctx context.Context) error {
+		if service.GetUserBalance(ctx, userID).Current < sum {
+			return entities.ErrInsufficientBalance
+		}
+		return save(ctx)
+	})
+}
 
-	go service.saver(ctx, savingOrders)
-	go log(ctx, errorChan)
+// SaveWithdrawn списывает баллы, если их хватает, иначе возвращает ErrInsufficientBalance.
+func (service Service) SaveWithdrawn(ctx context.Context, withdrawn entities.Withdrawn) (err error) {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.SaveWithdrawn")
+	defer func() { tracing.End(span, err) }()
 
-	go func() {
-		ticker := time.NewTicker(time.Second * tickSec)
-		for {
-			select {
-			case <-ticker.C:
-				orders := service.repository.GetWaitProcessOrders()
-				for _, order := range orders {
-					orderIn <- *order
-				}
-			case <-ctx.Done():
-				logger.Get().Info("close update")
-				return
-			}
+	if exist := service.repository.GetWithdrawnByOrder(ctx, withdrawn.OrderNumber); exist != nil {
+		conflict := entities.NewWithdrawnConflictError(withdrawn.OrderNumber, entities.WithdrawnConflictWithdrawn)
+		if exist.UserID == withdrawn.UserID {
+			conflict.Sum = &exist.Sum
+			conflict.ProccesedAt = &exist.ProccesedAt
 		}
-	}()
-}
-
-func (service Service) saver(ctx context.Context, savingOrders chan entities.Order) {
-	for {
-		select {
-		case order := <-savingOrders:
-			err := service.repository.SaveOrder(order)
-			if err != nil {
-				logger.Get().Warn("save order error", zap.String("error", err.Error()))
-			}
-		case <-ctx.Done():
-			return
+		return conflict
+	}
+	if service.checkOrderOwner {
+		if order := service.repository.GetOrder(ctx, withdrawn.OrderNumber); order != nil && order.UserID != withdrawn.UserID {
+			return entities.NewWithdrawnConflictError(withdrawn.OrderNumber, entities.WithdrawnConflictAccrualOrder)
 		}
 	}
-}
 
-func log(ctx context.Context, errorChan chan error) {
-	for {
-		select {
-		case err := <-errorChan:
-			logger.Get().Warn("Service error.", zap.String("error", err.Error()))
-		case <-ctx.Done():
-			return
-		}
+	// параллельное списание по тому же номеру отсечет уникальный индекс в репозитории
+	err = service.spendPoints(ctx, withdrawn.UserID, withdrawn.Sum, func(ctx context.Context) error {
+		return service.repository.SaveWithdrawn(ctx, withdrawn)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, notifier := range service.withdrawnNotifiers {
+		notifier.NotifyWithdrawn(withdrawn)
 	}
+	return nil
 }
@@ -0,0 +1,247 @@
+package loyalityservice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveWithdrawn(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	require.NoError(t, repository.SaveOrder(ctx, *entities.NewOrder("12345678903", 2)))
+	order := entities.NewOrder("79927398713", 1)
+	order.Status = entities.OrderStatusProcessed
+	order.Accrual = 100
+	require.NoError(t, repository.SaveOrder(ctx, *order))
+
+	withdrawn := entities.Withdrawn{UserID: 1, OrderNumber: "2377225624", Sum: 10, ProccesedAt: time.Now()}
+	service := New(repository, "")
+	require.NoError(t, service.SaveWithdrawn(ctx, withdrawn))
+
+	t.Run("over available balance", func(t *testing.T) {
+		err := service.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "4561261212345", Sum: 91, ProccesedAt: time.Now()})
+		assert.ErrorIs(t, err, entities.ErrInsufficientBalance)
+	})
+
+	t.Run("same user sees previous withdrawal", func(t *testing.T) {
+		var conflict *entities.WithdrawnConflictError
+		require.ErrorAs(t, service.SaveWithdrawn(ctx, withdrawn), &conflict)
+		assert.Equal(t, entities.WithdrawnConflictWithdrawn, conflict.Reason)
+		require.NotNil(t, conflict.Sum)
+		assert.Equal(t, 10.0, *conflict.Sum)
+	})
+
+	t.Run("other user gets no details", func(t *testing.T) {
+		other := withdrawn
+		other.UserID = 2
+
+		var conflict *entities.WithdrawnConflictError
+		require.ErrorAs(t, service.SaveWithdrawn(ctx, other), &conflict)
+		assert.Nil(t, conflict.Sum)
+		assert.Nil(t, conflict.ProccesedAt)
+	})
+
+	t.Run("repository keeps first withdrawal", func(t *testing.T) {
+		err := repository.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 2, OrderNumber: "2377225624", Sum: 1})
+		assert.ErrorIs(t, err, entities.ErrWithdrawnConflict)
+		assert.Equal(t, 1, repository.GetWithdrawnByOrder(ctx, "2377225624").UserID)
+	})
+
+	t.Run("accrual order of another user", func(t *testing.T) {
+		accrualOrder := entities.Withdrawn{UserID: 1, OrderNumber: "12345678903", Sum: 1}
+
+		checked := New(repository, "", WithWithdrawnOrderOwnerCheck(true))
+		var conflict *entities.WithdrawnConflictError
+		require.ErrorAs(t, checked.SaveWithdrawn(ctx, accrualOrder), &conflict)
+		assert.Equal(t, entities.WithdrawnConflictAccrualOrder, conflict.Reason)
+
+		assert.NoError(t, service.SaveWithdrawn(ctx, accrualOrder), "check is disabled by default")
+	})
+}
+
+func TestReverseWithdrawn(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	order := entities.NewOrder("12345678903", 1)
+	order.Status = entities.OrderStatusProcessed
+	order.Accrual = 100
+	require.NoError(t, repository.SaveOrder(ctx, *order))
+
+	service := New(repository, "")
+	require.NoError(t, service.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "2377225624", Sum: 60, ProccesedAt: time.Now()}))
+
+	partial, err := service.ReverseWithdrawn(ctx, entities.ReverseWithdrawnRequest{
+		OrderNumber: "2377225624",
+		Amount:      20,
+		Reason:      entities.ReversalReasonPartialReturn,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, partial.Amount)
+	assert.Equal(t, entities.Balance{Current: 60, Withdrawn: 40}, service.GetUserBalance(ctx, 1))
+
+	t.Run("refund over withdrawn sum", func(t *testing.T) {
+		_, err := service.ReverseWithdrawn(ctx, entities.ReverseWithdrawnRequest{
+			OrderNumber: "2377225624",
+			Amount:      50,
+			Reason:      entities.ReversalReasonOrderCancelled,
+		})
+		assert.ErrorIs(t, err, entities.ErrReversalExceedsWithdrawn)
+	})
+
+	t.Run("unknown reason", func(t *testing.T) {
+		_, err := service.ReverseWithdrawn(ctx, entities.ReverseWithdrawnRequest{OrderNumber: "2377225624", Reason: "changed mind"})
+		assert.ErrorIs(t, err, entities.ErrInvalidInput)
+	})
+
+	t.Run("unknown withdrawal", func(t *testing.T) {
+		_, err := service.ReverseWithdrawn(ctx, entities.ReverseWithdrawnRequest{OrderNumber: "4561261212345", Reason: entities.ReversalReasonSupport})
+		assert.ErrorIs(t, err, entities.ErrNotFound)
+	})
+
+	t.Run("rest is refunded without amount", func(t *testing.T) {
+		rest, err := service.ReverseWithdrawn(ctx, entities.ReverseWithdrawnRequest{
+			OrderNumber: "2377225624",
+			Reason:      entities.ReversalReasonOrderCancelled,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 40.0, rest.Amount)
+		assert.Equal(t, entities.Balance{Current: 100, Withdrawn: 0}, service.GetUserBalance(ctx, 1))
+
+		_, err = service.ReverseWithdrawn(ctx, entities.ReverseWithdrawnRequest{
+			OrderNumber: "2377225624",
+			Reason:      entities.ReversalReasonOrderCancelled,
+		})
+		assert.ErrorIs(t, err, entities.ErrReversalExceedsWithdrawn, "fully refunded withdrawal")
+	})
+
+	t.Run("reversals in history", func(t *testing.T) {
+		withdrawals, _ := service.GetUserWithdrawals(ctx, 1, entities.ListQuery{})
+		require.Len(t, withdrawals, 1)
+		assert.Equal(t, 60.0, withdrawals[0].Refunded)
+		require.Len(t, withdrawals[0].Reversals, 2)
+		assert.Equal(t, entities.ReversalReasonPartialReturn, withdrawals[0].Reversals[0].Reason)
+
+		again, _ := service.GetUserWithdrawals(ctx, 1, entities.ListQuery{})
+		assert.Len(t, again[0].Reversals, 2, "stored withdrawal must not change")
+	})
+}
+
+func TestHolds(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	order := entities.NewOrder("12345678903", 1)
+	order.Status = entities.OrderStatusProcessed
+	order.Accrual = 100
+	require.NoError(t, repository.SaveOrder(ctx, *order))
+
+	service := New(repository, "")
+
+	hold, err := service.CreateHold(ctx, 1, "2377225624", 70)
+	require.NoError(t, err)
+	assert.Equal(t, entities.Balance{Current: 30, Held: 70}, service.GetUserBalance(ctx, 1))
+
+	t.Run("hold over available balance", func(t *testing.T) {
+		_, err := service.CreateHold(ctx, 1, "4561261212345", 40)
+		assert.ErrorIs(t, err, entities.ErrInsufficientBalance)
+	})
+
+	t.Run("hold of another user", func(t *testing.T) {
+		_, err := service.CaptureHold(ctx, 2, hold.ID, 0)
+		assert.ErrorIs(t, err, entities.ErrNotFound)
+	})
+
+	t.Run("partial capture releases rest", func(t *testing.T) {
+		withdrawn, err := service.CaptureHold(ctx, 1, hold.ID, 50)
+		require.NoError(t, err)
+		assert.Equal(t, 50.0, withdrawn.Sum)
+		assert.Equal(t, entities.Balance{Current: 50, Withdrawn: 50}, service.GetUserBalance(ctx, 1))
+
+		_, err = service.CaptureHold(ctx, 1, hold.ID, 0)
+		assert.ErrorIs(t, err, entities.ErrHoldNotActive)
+	})
+
+	t.Run("release", func(t *testing.T) {
+		released, err := service.CreateHold(ctx, 1, "4561261212345", 20)
+		require.NoError(t, err)
+		require.NoError(t, service.ReleaseHold(ctx, 1, released.ID))
+		assert.Equal(t, entities.Balance{Current: 50, Withdrawn: 50}, service.GetUserBalance(ctx, 1))
+		assert.ErrorIs(t, service.ReleaseHold(ctx, 1, released.ID), entities.ErrHoldNotActive)
+	})
+
+	t.Run("concurrent withdrawals and holds do not overdraw", func(t *testing.T) {
+		repository := orderrepository.New(nil)
+		order := entities.NewOrder("12345678903", 1)
+		order.Status = entities.OrderStatusProcessed
+		order.Accrual = 100
+		require.NoError(t, repository.SaveOrder(ctx, *order))
+		service := New(repository, "")
+
+		numbers := []string{"2377225624", "4561261212345", "79927398713", "49927398716", "1234567812345670", "378282246310005"}
+		var wg sync.WaitGroup
+		for i, number := range numbers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if i%2 == 0 {
+					service.CreateHold(ctx, 1, number, 30)
+					return
+				}
+				service.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: number, Sum: 30, ProccesedAt: time.Now()})
+			}()
+		}
+		wg.Wait()
+
+		balance := service.GetUserBalance(ctx, 1)
+		assert.Equal(t, 10.0, balance.Current)
+		assert.Equal(t, 90.0, balance.Held+balance.Withdrawn)
+	})
+
+	t.Run("concurrent holds do not overdraw", func(t *testing.T) {
+		repository := orderrepository.New(nil)
+		order := entities.NewOrder("12345678903", 1)
+		order.Status = entities.OrderStatusProcessed
+		order.Accrual = 100
+		require.NoError(t, repository.SaveOrder(ctx, *order))
+		service := New(repository, "")
+
+		var wg sync.WaitGroup
+		var created atomic.Int32
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := service.CreateHold(ctx, 1, "2377225624", 30); err == nil {
+					created.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(3), created.Load())
+		assert.Equal(t, entities.Balance{Current: 10, Held: 90}, service.GetUserBalance(ctx, 1))
+	})
+
+	t.Run("expired hold frees points", func(t *testing.T) {
+		expiring := New(repository, "", WithHoldTTL(time.Millisecond))
+		expired, err := expiring.CreateHold(ctx, 1, "79927398713", 20)
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+
+		assert.Equal(t, entities.Balance{Current: 50, Withdrawn: 50}, service.GetUserBalance(ctx, 1))
+		_, err = service.CaptureHold(ctx, 1, expired.ID, 0)
+		assert.ErrorIs(t, err, entities.ErrHoldNotActive)
+
+		count, err := repository.ExpireHolds(ctx, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, entities.HoldStatusExpired, repository.GetHold(ctx, expired.ID).Status)
+	})
+}
@@ -0,0 +1,88 @@
+package loyalityservice
+
+import (
+	"context"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/tracing"
+)
+
+// WithTierMultiplier включает надбавку к начислениям по множителю уровня пользователя.
+func WithTierMultiplier(enabled bool) Option {
+	return func(service *Service) {
+		service.tierMultiplier = enabled
+	}
+}
+
+// GetUserTier возвращает уровень пользователя и прогресс до следующего.
+func (service Service) GetUserTier(ctx context.Context, userID int) entities.TierProgress {
+	ctx, span := tracing.Start(ctx, "LoyaltyService.GetUserTier")
+	defer span.End()
+
+	lifetime := 0.0
+	if userTier := service.repository.GetUserTier(ctx, userID); userTier != nil {
+		lifetime = userTier.LifetimeAccrual
+	} else {
+		// уровень еще не пересчитывался, например заказы обработаны до появления уровней
+		lifetime = service.getLifetimeAccrual(ctx, userID, "")
+	}
+	return newTierProgress(service.getTiers(ctx), lifetime)
+}
+
+// addTierChange вызывается при переходе заказа в PROCESSED. Уровень и надбавка по уровню
+// до заказа считаются при сохранении, по сумме начислений из той же транзакции.
+func (service Service) addTierChange(ctx context.Context, change *entities.OrderChange) {
+	change.Tier = &entities.TierChange{
+		Order:      change.Order,
+		Tiers:      service.getTiers(ctx),
+		Multiplier: service.tierMultiplier,
+	}
+}
+
+// getLifetimeAccrual - сумма начислений системы начислений по обработанным заказам, без надбавок.
+// Заказ except не учитывается, так считается уровень до его обработки.
+func (service Service) getLifetimeAccrual(ctx context.Context, userID int, except string) float64 {
+	lifetime := 0.0
+	for _, order := range service.repository.GetUserOrders(ctx, userID, entities.ListQuery{}) {
+		if order.Status == entities.OrderStatusProcessed && order.Number != except {
+			lifetime += order.Accrual
+		}
+	}
+	return lifetime
+}
+
+// getTiers возвращает уровни по возрастанию порога.
+func (service Service) getTiers(ctx context.Context) []entities.Tier {
+	stored := service.repository.GetTiers(ctx)
+	if len(stored) == 0 {
+		return entities.DefaultTiers
+	}
+
+	tiers := make([]entities.Tier, 0, len(stored))
+	for _, tier := range stored {
+		tiers = append(tiers, *tier)
+	}
+	return tiers
+}
+
+func newTierProgress(tiers []entities.Tier, lifetime float64) entities.TierProgress {
+	tier := entities.FindTier(tiers, lifetime)
+	progress := entities.TierProgress{
+		Tier:            tier.Name,
+		Multiplier:      tier.Multiplier,
+		LifetimeAccrual: lifetime,
+		Progress:        1,
+	}
+
+	for _, next := range tiers {
+		if next.Threshold <= tier.Threshold {
+			continue
+		}
+		progress.NextTier = next.Name
+		progress.NextThreshold = next.Threshold
+		progress.Remaining = next.Threshold - lifetime
+		progress.Progress = (lifetime - tier.Threshold) / (next.Threshold - tier.Threshold)
+		break
+	}
+	return progress
+}
@@ -0,0 +1,100 @@
+package loyalityservice
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/besean163/gophermart/internal/entities"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTiers(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	repository.SetTiers([]*entities.Tier{
+		{Name: "silver", Threshold: 100, Multiplier: 1.5},
+		{Name: "base", Threshold: 0, Multiplier: 1},
+	})
+	service := New(repository, "", WithTierMultiplier(true))
+
+	process := func(number string, accrual float64) {
+		order := entities.NewOrder(number, 1)
+		require.NoError(t, repository.SaveOrder(ctx, *order))
+		order.Status = entities.OrderStatusProcessed
+		order.Accrual = accrual
+		require.NoError(t, service.saveOrderChange(ctx, *order))
+	}
+
+	process("12345678903", 80)
+	assert.Equal(t, entities.TierProgress{
+		Tier:            "base",
+		Multiplier:      1,
+		LifetimeAccrual: 80,
+		NextTier:        "silver",
+		NextThreshold:   100,
+		Remaining:       20,
+		Progress:        0.8,
+	}, service.GetUserTier(ctx, 1))
+
+	// надбавка считается по уровню до заказа, поэтому заказ, переводящий на новый уровень, ее не получает
+	process("2377225624", 40)
+	assert.Equal(t, "silver", service.GetUserTier(ctx, 1).Tier)
+	assert.Empty(t, repository.GetOrderLedger(ctx, "2377225624"))
+
+	process("4561261212345", 20)
+	bonus := repository.GetOrderLedger(ctx, "4561261212345")
+	require.Len(t, bonus, 1)
+	assert.Equal(t, entities.LedgerEntryTierBonus, bonus[0].Type)
+	assert.InDelta(t, 10, bonus[0].Amount, 1e-9)
+	assert.InDelta(t, 150, service.GetUserBalance(ctx, 1).Current, 1e-9)
+
+	t.Run("repeated processed save does not duplicate bonus", func(t *testing.T) {
+		order := repository.GetOrder(ctx, "4561261212345")
+		require.NoError(t, service.saveOrderChange(ctx, *order))
+		assert.Len(t, repository.GetOrderLedger(ctx, "4561261212345"), 1)
+	})
+
+	progress := service.GetUserTier(ctx, 1)
+	assert.Empty(t, progress.NextTier)
+	assert.Equal(t, 1.0, progress.Progress)
+
+	t.Run("default tiers for new user", func(t *testing.T) {
+		progress := New(orderrepository.New(nil), "").GetUserTier(ctx, 2)
+		assert.Equal(t, entities.DefaultTiers[0].Name, progress.Tier)
+		assert.Equal(t, entities.DefaultTiers[1].Name, progress.NextTier)
+	})
+}
+
+func TestTiersParallelOrders(t *testing.T) {
+	ctx := context.Background()
+	repository := orderrepository.New(nil)
+	service := New(repository, "", WithTierMultiplier(true))
+
+	orders := make([]*entities.Order, 0, 10)
+	for i := range 10 {
+		order := entities.NewOrder(strconv.Itoa(1000+i), 1)
+		require.NoError(t, repository.SaveOrder(ctx, *order))
+		order.Status = entities.OrderStatusProcessed
+		order.Accrual = 150
+		orders = append(orders, order)
+	}
+
+	var wg sync.WaitGroup
+	for _, order := range orders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, service.saveOrderChange(ctx, *order))
+		}()
+	}
+	wg.Wait()
+
+	// каждый заказ прибавляется к сумме, накопленной предыдущими, ни одно начисление не теряется
+	progress := service.GetUserTier(ctx, 1)
+	assert.InDelta(t, 1500, progress.LifetimeAccrual, 1e-9)
+	assert.Equal(t, "silver", progress.Tier)
+}
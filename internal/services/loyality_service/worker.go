@@ -4,14 +4,54 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"net/http"
+	"math/rand"
 	"time"
 
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
 	"github.com/besean163/gophermart/internal/entities"
-	"github.com/go-resty/resty/v2"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
-func worker(ctx context.Context, id int, orderIn chan entities.Order, saveOrderOut chan entities.Order, accrualURL string, errorChan chan error) {
+var (
+	ErrAccrualRateLimited = errors.New("accrual system rate limit")
+	ErrAccrualServerError = errors.New("accrual system internal error")
+	ErrInvalidResponse    = errors.New("invalid accrual response")
+)
+
+// InvalidResponseError - ответ системы начислений нарушает правила валидации,
+// к заказу он не применяется и уходит в карантин на ручной разбор.
+type InvalidResponseError struct {
+	Reason string
+	Result accrualclient.Result
+}
+
+func (err InvalidResponseError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrInvalidResponse, err.Reason)
+}
+
+func (err InvalidResponseError) Is(target error) bool {
+	return target == ErrInvalidResponse
+}
+
+// RateLimitError - система начислений просит подождать RetryAfter.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (err RateLimitError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrAccrualRateLimited, err.RetryAfter)
+}
+
+func (err RateLimitError) Is(target error) bool {
+	return target == ErrAccrualRateLimited
+}
+
+// worker проверяет заказы из orderIn, после каждого заказа возвращая себя в idle.
+func (service Service) worker(ctx context.Context, id int, orderIn chan entities.Order, saveOrderOut chan entities.Order, errorChan chan error, idle chan<- struct{}) {
 	preffix := fmt.Sprintf("worker #%d", id)
 	for {
 		select {
@@ -19,46 +59,181 @@ func worker(ctx context.Context, id int, orderIn chan entities.Order, saveOrderO
 			errorChan <- makeWorkerError(preffix, errors.New("stopped by context"))
 			return
 		case order := <-orderIn:
-			var accrualOrder AccrualOrder
-			response, err := resty.New().R().SetResult(&accrualOrder).Get(accrualURL + "/api/orders/" + order.Number)
-			if err != nil {
-				errorChan <- makeWorkerError(preffix, err)
-				continue
+			service.checkClaimedOrder(ctx, preffix, order, saveOrderOut, errorChan)
+			select {
+			case idle <- struct{}{}:
+			default:
 			}
+		}
+	}
+}
 
-			switch response.StatusCode() {
-			case http.StatusNoContent:
-				order.Status = entities.OrderStatusInvalid
-			case http.StatusTooManyRequests:
-				return
-			case http.StatusInternalServerError:
-				return
-			}
+func (service Service) checkClaimedOrder(ctx context.Context, preffix string, order entities.Order, saveOrderOut chan entities.Order, errorChan chan error) {
+	checked, updated, err := checkOrder(ctx, service.accrualClient, order)
+	if err == nil && updated {
+		// аренду снимет saver после сохранения
+		saveOrderOut <- checked
+		return
+	}
 
-			if response.StatusCode() == http.StatusOK {
-
-				if order.Number != accrualOrder.Order {
-					errorChan <- makeWorkerError(preffix, errors.New("wrong order number"))
-					continue
-				}
-
-				switch accrualOrder.Status {
-				case entities.AccrealStatusRegistered:
-					continue
-				case entities.AccrealStatusProcessing:
-					order.Status = entities.OrderStatusProcessing
-				case entities.AccrealStatusInvalid:
-					order.Status = entities.OrderStatusInvalid
-				case entities.AccrealStatusProcessed:
-					order.Status = entities.OrderStatusProcessed
-					order.Accrual = accrualOrder.Accrual
-				}
-			}
+	var rateLimit RateLimitError
+	switch {
+	case errors.As(err, &rateLimit):
+		errorChan <- makeWorkerError(preffix, err)
+		// до истечения Retry-After запросы будут отклонены: останавливаем все воркеры, а не только этот
+		service.pause.extend(time.Now().Add(rateLimit.RetryAfter))
+	case errors.Is(err, accrualclient.ErrCircuitOpen):
+		// заказ вернется в очередь на следующем тике после восстановления системы
+	case err != nil:
+		errorChan <- makeWorkerError(preffix, err)
+		service.quarantineResponse(ctx, order, err)
+		service.rescheduleOrder(ctx, order, err)
+	}
+	service.releaseOrder(ctx, order)
+}
+
+// releaseOrder возвращает заказ в общую очередь, не дожидаясь окончания аренды.
+func (service Service) releaseOrder(ctx context.Context, order entities.Order) {
+	if order.ClaimedBy == "" {
+		return
+	}
+	err := service.repository.ReleaseOrderClaim(ctx, order.Number, order.ClaimedBy)
+	if err != nil {
+		logger.Get().Warn("release order claim error", zap.String("order", order.Number), zap.String("error", err.Error()))
+	}
+}
+
+// rescheduleOrder сохраняет ошибку проверки и откладывает заказ с экспоненциальной паузой.
+func (service Service) rescheduleOrder(ctx context.Context, order entities.Order, checkErr error) {
+	nextCheckAt := time.Now().Add(checkRetryDelay(order.CheckErrors + 1))
+	err := service.repository.SaveOrderCheckError(ctx, order.Number, checkErr.Error(), nextCheckAt)
+	if err != nil {
+		logger.Get().Warn("save order check error", zap.String("order", order.Number), zap.String("error", err.Error()))
+	}
+}
+
+// quarantineResponse сохраняет невалидный ответ для ручного разбора, остальные ошибки пропускает.
+func (service Service) quarantineResponse(ctx context.Context, order entities.Order, checkErr error) {
+	var invalid InvalidResponseError
+	if !errors.As(checkErr, &invalid) {
+		return
+	}
+
+	err := service.repository.SaveQuarantinedResponse(ctx, &entities.QuarantinedResponse{
+		OrderNumber: order.Number,
+		UserID:      order.UserID,
+		Reason:      invalid.Reason,
+		Payload:     invalid.Result.Body,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		logger.Get().Warn("save quarantined response error", zap.String("order", order.Number), zap.String("error", err.Error()))
+	}
+}
+
+// checkRetryDelay растет вдвое с каждой ошибкой до checkRetryMax, разброс ±20%
+// не дает заказам, упавшим вместе, вместе и вернуться.
+func checkRetryDelay(attempt int) time.Duration {
+	delay := checkRetryMax
+	if shift := attempt - 1; shift < 20 {
+		delay = min(checkRetryBase<<shift, checkRetryMax)
+	}
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(delay))
+	return delay + jitter
+}
+
+// checkOrder запрашивает заказ в системе начислений и возвращает его с новым статусом.
+// updated == false означает, что статус и начисление не изменились и сохранять нечего.
+func checkOrder(ctx context.Context, client AccrualClient, order entities.Order) (_ entities.Order, updated bool, err error) {
+	ctx, span := tracing.Start(ctx, "accrual.check", trace.WithAttributes(
+		attribute.String("order.number", order.Number),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	result, err := client.GetOrder(ctx, order.Number)
+	if err != nil {
+		return order, false, err
+	}
+	order, updated, err = applyAccrualResult(order, result)
+	if err != nil {
+		return order, false, err
+	}
+
+	// успешный ответ сбрасывает счетчик ошибок, даже если статус не изменился
+	if order.CheckErrors > 0 || order.NextCheckAt != nil {
+		order.CheckErrors = 0
+		order.LastCheckError = ""
+		order.NextCheckAt = nil
+		updated = true
+	}
+	return order, updated, nil
+}
 
-			order.UpdatedAt = time.Now()
-			saveOrderOut <- order
+// applyAccrualResult переводит ответ системы начислений в статус заказа.
+func applyAccrualResult(order entities.Order, result accrualclient.Result) (entities.Order, bool, error) {
+	previous := order
+
+	switch result.Kind {
+	case accrualclient.ResultRateLimited:
+		return order, false, RateLimitError{RetryAfter: result.RetryAfter}
+	case accrualclient.ResultServerError:
+		return order, false, ErrAccrualServerError
+	case accrualclient.ResultNotFound:
+		order.Status = entities.OrderStatusInvalid
+	default:
+		if err := validateAccrualResult(order, result); err != nil {
+			return order, false, err
 		}
 	}
+
+	switch result.Kind {
+	case accrualclient.ResultRegistered:
+		return order, false, nil
+	case accrualclient.ResultProcessing:
+		order.Status = entities.OrderStatusProcessing
+	case accrualclient.ResultInvalid:
+		order.Status = entities.OrderStatusInvalid
+	case accrualclient.ResultProcessed:
+		order.Status = entities.OrderStatusProcessed
+		order.Accrual = result.Accrual
+	}
+
+	if order.Status == previous.Status && order.Accrual == previous.Accrual {
+		return order, false, nil
+	}
+
+	order.UpdatedAt = time.Now()
+	if order.IsFinal() && order.ProcessedAt == nil {
+		processedAt := order.UpdatedAt
+		order.ProcessedAt = &processedAt
+	}
+	return order, true, nil
+}
+
+// validateAccrualResult проверяет ответ 200:
+//   - тело разбирается и статус известен;
+//   - номер заказа совпадает с запрошенным;
+//   - у PROCESSED есть поле accrual и оно не отрицательное, явный 0 допустим;
+//   - accrual у остальных статусов игнорируется.
+func validateAccrualResult(order entities.Order, result accrualclient.Result) error {
+	reason := ""
+	switch {
+	case result.Kind == accrualclient.ResultMalformed:
+		reason = entities.QuarantineReasonMalformed
+	case result.Kind == accrualclient.ResultUnknown:
+		reason = entities.QuarantineReasonUnknownStatus
+	case result.Order != order.Number:
+		reason = entities.QuarantineReasonWrongOrderNumber
+	case result.Kind == accrualclient.ResultProcessed && !result.HasAccrual:
+		reason = entities.QuarantineReasonMissingAccrual
+	case result.Kind == accrualclient.ResultProcessed && result.Accrual < 0:
+		reason = entities.QuarantineReasonNegativeAccrual
+	}
+
+	if reason == "" {
+		return nil
+	}
+	return InvalidResponseError{Reason: reason, Result: result}
 }
 
 func makeWorkerError(preffix string, err error) error {
@@ -0,0 +1,385 @@
+package loyalityservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	accrualclient "github.com/besean163/gophermart/internal/clients/accrual_client"
+	"github.com/besean163/gophermart/internal/entities"
+	orderqueue "github.com/besean163/gophermart/internal/repositories/inmem/order_queue"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAccrualClient отдает заранее заданные ответы по номеру заказа.
+type fakeAccrualClient struct {
+	mu      sync.Mutex
+	results map[string][]accrualclient.Result
+	err     error
+}
+
+func (client *fakeAccrualClient) GetOrder(ctx context.Context, number string) (accrualclient.Result, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.err != nil {
+		return accrualclient.Result{}, client.err
+	}
+	results := client.results[number]
+	if len(results) == 0 {
+		return accrualclient.Result{Kind: accrualclient.ResultRegistered, Order: number}, nil
+	}
+	client.results[number] = results[1:]
+	return results[0], nil
+}
+
+func TestCheckOrder(t *testing.T) {
+	ctx := context.Background()
+	order := entities.Order{Number: "12345678903", UserID: 1, Status: entities.OrderStatusNew}
+
+	tests := []struct {
+		name    string
+		result  accrualclient.Result
+		err     error
+		updated bool
+		status  string
+		accrual float64
+		wantErr error
+	}{
+		{
+			name:   "registered",
+			result: accrualclient.Result{Kind: accrualclient.ResultRegistered, Order: order.Number},
+			status: entities.OrderStatusNew,
+		},
+		{
+			name:    "processing",
+			result:  accrualclient.Result{Kind: accrualclient.ResultProcessing, Order: order.Number},
+			updated: true,
+			status:  entities.OrderStatusProcessing,
+		},
+		{
+			name:    "processed",
+			result:  accrualclient.Result{Kind: accrualclient.ResultProcessed, Order: order.Number, Accrual: 500, HasAccrual: true},
+			updated: true,
+			status:  entities.OrderStatusProcessed,
+			accrual: 500,
+		},
+		{
+			name:    "processed with explicit zero accrual",
+			result:  accrualclient.Result{Kind: accrualclient.ResultProcessed, Order: order.Number, HasAccrual: true},
+			updated: true,
+			status:  entities.OrderStatusProcessed,
+		},
+		{
+			name:    "accrual ignored for processing",
+			result:  accrualclient.Result{Kind: accrualclient.ResultProcessing, Order: order.Number, Accrual: 500, HasAccrual: true},
+			updated: true,
+			status:  entities.OrderStatusProcessing,
+		},
+		{
+			name:    "processed without accrual",
+			result:  accrualclient.Result{Kind: accrualclient.ResultProcessed, Order: order.Number},
+			status:  entities.OrderStatusNew,
+			wantErr: InvalidResponseError{Reason: entities.QuarantineReasonMissingAccrual},
+		},
+		{
+			name:    "negative accrual",
+			result:  accrualclient.Result{Kind: accrualclient.ResultProcessed, Order: order.Number, Accrual: -10, HasAccrual: true},
+			status:  entities.OrderStatusNew,
+			wantErr: InvalidResponseError{Reason: entities.QuarantineReasonNegativeAccrual},
+		},
+		{
+			name:    "unknown status",
+			result:  accrualclient.Result{Kind: accrualclient.ResultUnknown, Order: order.Number, Status: "DONE"},
+			status:  entities.OrderStatusNew,
+			wantErr: InvalidResponseError{Reason: entities.QuarantineReasonUnknownStatus},
+		},
+		{
+			name:    "malformed response",
+			result:  accrualclient.Result{Kind: accrualclient.ResultMalformed, Body: "{"},
+			status:  entities.OrderStatusNew,
+			wantErr: InvalidResponseError{Reason: entities.QuarantineReasonMalformed},
+		},
+		{
+			name:    "not found",
+			result:  accrualclient.Result{Kind: accrualclient.ResultNotFound, Order: order.Number},
+			updated: true,
+			status:  entities.OrderStatusInvalid,
+		},
+		{
+			name:    "rate limited",
+			result:  accrualclient.Result{Kind: accrualclient.ResultRateLimited, RetryAfter: time.Minute},
+			status:  entities.OrderStatusNew,
+			wantErr: ErrAccrualRateLimited,
+		},
+		{
+			name:    "server error",
+			result:  accrualclient.Result{Kind: accrualclient.ResultServerError},
+			status:  entities.OrderStatusNew,
+			wantErr: ErrAccrualServerError,
+		},
+		{
+			name:    "wrong order number",
+			result:  accrualclient.Result{Kind: accrualclient.ResultProcessing, Order: "2377225624"},
+			status:  entities.OrderStatusNew,
+			wantErr: InvalidResponseError{Reason: entities.QuarantineReasonWrongOrderNumber},
+		},
+		{
+			name:    "network error",
+			err:     errors.New("connection refused"),
+			status:  entities.OrderStatusNew,
+			wantErr: errors.New("connection refused"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeAccrualClient{
+				results: map[string][]accrualclient.Result{order.Number: {test.result}},
+				err:     test.err,
+			}
+
+			result, updated, err := checkOrder(ctx, client, order)
+			if test.wantErr != nil {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr.Error())
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, test.updated, updated)
+			assert.Equal(t, test.status, result.Status)
+			assert.Equal(t, test.accrual, result.Accrual)
+			if updated && result.IsFinal() {
+				assert.NotNil(t, result.ProcessedAt)
+			}
+		})
+	}
+}
+
+func TestWorker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := &fakeAccrualClient{results: map[string][]accrualclient.Result{
+		"12345678903":   {{Kind: accrualclient.ResultRateLimited, RetryAfter: time.Millisecond}},
+		"4561261212345": {{Kind: accrualclient.ResultServerError, StatusCode: 502}},
+		"2377225624":    {{Kind: accrualclient.ResultProcessed, Order: "2377225624", Accrual: 100, HasAccrual: true}},
+	}}
+	repository := orderrepository.New(nil)
+	failing := entities.NewOrder("4561261212345", 1)
+	require.NoError(t, repository.SaveOrder(ctx, *failing))
+	service := Service{accrualClient: client, repository: repository, pause: &accrualPause{}}
+
+	orderIn := make(chan entities.Order)
+	saveOut := make(chan entities.Order, 1)
+	errorChan := make(chan error, 10)
+	go service.worker(ctx, 1, orderIn, saveOut, errorChan, nil)
+
+	orderIn <- entities.Order{Number: "12345678903", Status: entities.OrderStatusNew}
+	orderIn <- *failing
+	orderIn <- entities.Order{Number: "2377225624", Status: entities.OrderStatusNew}
+
+	select {
+	case order := <-saveOut:
+		assert.Equal(t, "2377225624", order.Number)
+		assert.Equal(t, entities.OrderStatusProcessed, order.Status)
+		assert.Equal(t, 100.0, order.Accrual)
+	case <-time.After(time.Second):
+		t.Fatal("worker stopped after accrual error")
+	}
+	assert.ErrorContains(t, <-errorChan, ErrAccrualRateLimited.Error())
+	assert.ErrorContains(t, <-errorChan, ErrAccrualServerError.Error())
+
+	t.Run("rate limit pauses all workers", func(t *testing.T) {
+		pause := &accrualPause{}
+		limited := Service{accrualClient: client, repository: repository, pause: pause}
+		assert.True(t, limited.accrualAvailable())
+
+		pause.extend(time.Now().Add(time.Minute))
+		assert.False(t, limited.accrualAvailable())
+		pause.extend(time.Now())
+		assert.False(t, limited.accrualAvailable(), "более ранний срок не сокращает паузу")
+	})
+
+	t.Run("server error reschedules order", func(t *testing.T) {
+		failures := service.GetOrderCheckFailures(ctx)
+		require.Len(t, failures, 1)
+		assert.Equal(t, "4561261212345", failures[0].Number)
+		assert.Equal(t, 1, failures[0].CheckErrors)
+		require.NotNil(t, failures[0].NextCheckAt)
+		assert.True(t, failures[0].NextCheckAt.After(time.Now()))
+		assert.Empty(t, repository.GetWaitProcessOrders(ctx))
+	})
+
+	t.Run("successful check resets errors", func(t *testing.T) {
+		order := repository.GetOrder(ctx, "4561261212345")
+		checked, updated, err := checkOrder(ctx, client, *order)
+		require.NoError(t, err)
+		assert.True(t, updated)
+		assert.Zero(t, checked.CheckErrors)
+		assert.Nil(t, checked.NextCheckAt)
+	})
+}
+
+func TestCheckRetryDelay(t *testing.T) {
+	for attempt, expected := range map[int]time.Duration{
+		1:  checkRetryBase,
+		2:  2 * checkRetryBase,
+		3:  4 * checkRetryBase,
+		50: checkRetryMax,
+	} {
+		delay := checkRetryDelay(attempt)
+		assert.GreaterOrEqual(t, delay, expected*8/10)
+		assert.LessOrEqual(t, delay, expected*12/10)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+
+	client := &fakeAccrualClient{results: map[string][]accrualclient.Result{
+		"12345678903": {{Kind: accrualclient.ResultProcessed, Order: "12345678903", Body: `{"order":"12345678903","status":"PROCESSED"}`}},
+	}}
+	repository := orderrepository.New(nil)
+	order := entities.NewOrder("12345678903", 1)
+	require.NoError(t, repository.SaveOrder(ctx, *order))
+	service := Service{accrualClient: client, repository: repository, pause: &accrualPause{}}
+
+	err := service.RefreshOrder(ctx, order.Number)
+	require.ErrorIs(t, err, ErrInvalidResponse)
+	assert.Equal(t, entities.OrderStatusNew, repository.GetOrder(ctx, order.Number).Status)
+
+	quarantined := service.GetQuarantinedResponses(ctx)
+	require.Len(t, quarantined, 1)
+	assert.Equal(t, entities.QuarantineReasonMissingAccrual, quarantined[0].Reason)
+	assert.Equal(t, `{"order":"12345678903","status":"PROCESSED"}`, quarantined[0].Payload)
+	assert.Equal(t, 1, quarantined[0].UserID)
+
+	require.NoError(t, service.ResolveQuarantinedResponse(ctx, quarantined[0].ID))
+	assert.Empty(t, service.GetQuarantinedResponses(ctx))
+	assert.ErrorIs(t, service.ResolveQuarantinedResponse(ctx, quarantined[0].ID), entities.ErrNotFound)
+}
+
+func TestRefreshClaimedOrder(t *testing.T) {
+	ctx := context.Background()
+
+	client := &fakeAccrualClient{results: map[string][]accrualclient.Result{
+		"12345678903": {{Kind: accrualclient.ResultProcessing, Order: "12345678903", Status: entities.OrderStatusProcessing}},
+	}}
+	repository := orderrepository.New(nil)
+	order := entities.NewOrder("12345678903", 1)
+	require.NoError(t, repository.SaveOrder(ctx, *order))
+	service := New(repository, "", WithAccrualClient(client))
+
+	// заказ уже проверяет другой экземпляр
+	require.NotNil(t, repository.ClaimOrder(ctx, order.Number, "replica-1", time.Minute))
+	assert.ErrorIs(t, service.RefreshOrder(ctx, order.Number), entities.ErrOrderBusy)
+	assert.Equal(t, entities.OrderStatusNew, repository.GetOrder(ctx, order.Number).Status)
+
+	require.NoError(t, repository.ReleaseOrderClaim(ctx, order.Number, "replica-1"))
+	require.NoError(t, service.RefreshOrder(ctx, order.Number))
+	refreshed := repository.GetOrder(ctx, order.Number)
+	assert.Equal(t, entities.OrderStatusProcessing, refreshed.Status)
+	// аренда снимается сразу после проверки
+	assert.Empty(t, refreshed.ClaimedBy)
+	assert.NotNil(t, repository.ClaimOrder(ctx, order.Number, "replica-1", time.Minute))
+}
+
+func TestClaimOrders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	repository := orderrepository.New(nil)
+	for _, number := range []string{"12345678903", "2377225624", "4561261212345"} {
+		require.NoError(t, repository.SaveOrder(ctx, *entities.NewOrder(number, 1)))
+	}
+
+	first := repository.ClaimWaitProcessOrders(ctx, "replica-1", time.Minute, 2)
+	second := repository.ClaimWaitProcessOrders(ctx, "replica-2", time.Minute, 2)
+	require.Len(t, first, 2)
+	require.Len(t, second, 1, "replicas must not claim the same orders")
+	assert.Empty(t, repository.ClaimWaitProcessOrders(ctx, "replica-2", time.Minute, 2))
+
+	t.Run("expired lease is taken over", func(t *testing.T) {
+		// аренда с отрицательным сроком уже истекла
+		require.NoError(t, repository.ReleaseOrderClaim(ctx, first[0].Number, "replica-1"))
+		require.NotNil(t, repository.ClaimOrder(ctx, first[0].Number, "replica-1", -time.Second))
+
+		taken := repository.ClaimWaitProcessOrders(ctx, "replica-2", time.Minute, 2)
+		require.Len(t, taken, 1)
+		assert.Equal(t, first[0].Number, taken[0].Number)
+		assert.Equal(t, "replica-2", taken[0].ClaimedBy)
+	})
+
+	t.Run("worker releases checked order", func(t *testing.T) {
+		client := &fakeAccrualClient{results: map[string][]accrualclient.Result{}}
+		service := Service{accrualClient: client, repository: repository, pause: &accrualPause{}}
+		orderIn := make(chan entities.Order)
+		errorChan := make(chan error, 1)
+		go service.worker(ctx, 1, orderIn, make(chan entities.Order), errorChan, nil)
+
+		orderIn <- *second[0]
+		// второй заказ попадет к воркеру только после обработки первого
+		orderIn <- entities.Order{}
+
+		assert.Empty(t, repository.GetOrder(ctx, second[0].Number).ClaimedBy)
+		claimed := repository.ClaimWaitProcessOrders(ctx, "replica-1", time.Minute, 0)
+		require.Len(t, claimed, 1)
+		assert.Equal(t, second[0].Number, claimed[0].Number)
+	})
+
+	t.Run("saver releases saved order", func(t *testing.T) {
+		require.NoError(t, repository.SaveOrder(ctx, *entities.NewOrder("79927398713", 1)))
+		claimed := repository.ClaimOrder(ctx, "79927398713", "replica-1", time.Minute)
+		require.NotNil(t, claimed)
+
+		service := Service{repository: repository}
+		savingOrders := make(chan entities.Order)
+		go service.saver(ctx, savingOrders)
+
+		claimed.Status = entities.OrderStatusProcessing
+		savingOrders <- *claimed
+		assert.Eventually(t, func() bool {
+			order := repository.GetOrder(ctx, "79927398713")
+			return order.Status == entities.OrderStatusProcessing && order.ClaimedBy == ""
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("claims only for idle workers", func(t *testing.T) {
+		idle := make(chan struct{}, 3)
+		idle <- struct{}{}
+		idle <- struct{}{}
+		assert.Equal(t, 2, takeIdle(idle, 3))
+		assert.Zero(t, takeIdle(idle, 3))
+	})
+}
+
+func TestOrderQueue(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	accrual := 100.0
+	client := &fakeAccrualClient{results: map[string][]accrualclient.Result{
+		"12345678903": {{Kind: accrualclient.ResultProcessed, Order: "12345678903", Status: entities.AccrealStatusProcessed, Accrual: accrual, HasAccrual: true}},
+	}}
+	repository := orderrepository.New(nil)
+	service := New(repository, "", WithAccrualClient(client), WithOrderQueue(orderqueue.New(10)))
+	service.RunPoller(ctx)
+
+	require.NoError(t, service.SaveOrder(ctx, *entities.NewOrder("12345678903", 1)))
+
+	// тик поллера - секунда, заказ должен быть проверен раньше
+	assert.Eventually(t, func() bool {
+		return repository.GetOrder(ctx, "12345678903").Status == entities.OrderStatusProcessed
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	t.Run("postponed order is not claimed", func(t *testing.T) {
+		require.NoError(t, repository.SaveOrder(ctx, *entities.NewOrder("2377225624", 1)))
+		require.NoError(t, repository.SaveOrderCheckError(ctx, "2377225624", "server error", time.Now().Add(time.Minute)))
+
+		assert.Nil(t, repository.ClaimOrder(ctx, "2377225624", "replica-1", time.Minute))
+	})
+}
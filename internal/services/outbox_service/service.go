@@ -0,0 +1,137 @@
+package outboxservice
+
+import (
+	"context"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+type Repository interface {
+	ClaimEvents(ctx context.Context, now time.Time, lease time.Duration, limit int) []*entities.OutboxEvent
+	MarkPublished(ctx context.Context, id int, publishedAt time.Time) error
+	MarkFailed(ctx context.Context, id int, lastError string, retryAt time.Time) error
+	MarkDead(ctx context.Context, id int, lastError string, failedAt time.Time) error
+}
+
+// Sink - получатель доменных событий. Доставка хотя бы один раз,
+// поэтому Publish должен быть идемпотентным по EventID.
+type Sink interface {
+	Publish(ctx context.Context, event entities.OutboxEvent) error
+}
+
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	// ClaimLease - на сколько забранные события скрыты от relay других экземпляров.
+	ClaimLease time.Duration
+	// MaxAttempts - после стольких ошибок подряд событие откладывается в dead-letter.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PollInterval: time.Second,
+		BatchSize:    100,
+		ClaimLease:   time.Minute,
+		MaxAttempts:  10,
+		BaseDelay:    time.Second,
+		MaxDelay:     10 * time.Minute,
+	}
+}
+
+// Relay переносит события из outbox в sink в порядке записи. Событие, которое sink не принял,
+// повторяется позже и не задерживает следующие; после MaxAttempts оно откладывается в dead-letter.
+type Relay struct {
+	repository Repository
+	sink       Sink
+	config     Config
+}
+
+func New(repository Repository, sink Sink, config Config) Relay {
+	return Relay{
+		repository: repository,
+		sink:       sink,
+		config:     config,
+	}
+}
+
+func (relay Relay) Run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(relay.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				relay.relay(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// relay публикует очередную пачку событий.
+func (relay Relay) relay(ctx context.Context) {
+	now := time.Now()
+	for _, event := range relay.repository.ClaimEvents(ctx, now, relay.config.ClaimLease, relay.config.BatchSize) {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := relay.publish(ctx, *event); err != nil {
+			relay.fail(ctx, *event, err)
+			continue
+		}
+		if err := relay.repository.MarkPublished(ctx, event.ID, time.Now()); err != nil {
+			logger.Get().Warn("outbox mark published error", zap.String("error", err.Error()))
+		}
+	}
+}
+
+// fail откладывает повтор события с экспоненциальной паузой или отправляет его в dead-letter.
+func (relay Relay) fail(ctx context.Context, event entities.OutboxEvent, publishErr error) {
+	fields := []zap.Field{
+		zap.String("event", event.EventID),
+		zap.String("type", event.Type),
+		zap.Int("attempts", event.Attempts+1),
+		zap.String("error", publishErr.Error()),
+	}
+
+	var err error
+	if event.Attempts+1 >= relay.config.MaxAttempts {
+		logger.Get().Error("outbox event moved to dead-letter", fields...)
+		err = relay.repository.MarkDead(ctx, event.ID, publishErr.Error(), time.Now())
+	} else {
+		logger.Get().Warn("outbox publish error", fields...)
+		err = relay.repository.MarkFailed(ctx, event.ID, publishErr.Error(), time.Now().Add(relay.backoff(event.Attempts+1)))
+	}
+	if err != nil {
+		logger.Get().Warn("outbox mark failed error", zap.String("error", err.Error()))
+	}
+}
+
+// backoff растет вдвое с каждой попыткой от BaseDelay до MaxDelay.
+func (relay Relay) backoff(attempt int) time.Duration {
+	delay := relay.config.BaseDelay
+	for i := 1; i < attempt && delay < relay.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, relay.config.MaxDelay)
+}
+
+func (relay Relay) publish(ctx context.Context, event entities.OutboxEvent) (err error) {
+	ctx, span := tracing.Start(ctx, "OutboxRelay.publish", trace.WithAttributes(
+		attribute.String("event.id", event.EventID),
+		attribute.String("event.type", event.Type),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	return relay.sink.Publish(ctx, event)
+}
@@ -0,0 +1,121 @@
+package outboxservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	orderrepository "github.com/besean163/gophermart/internal/repositories/inmem/order_repository"
+	outboxrepository "github.com/besean163/gophermart/internal/repositories/inmem/outbox_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+
+	outbox := outboxrepository.New()
+	orders := orderrepository.New(outbox)
+	sink := NewInmemSink()
+	config := DefaultConfig()
+	config.BaseDelay = 0
+	relay := New(outbox, sink, config)
+
+	order := *entities.NewOrder("12345678903", 1)
+	require.NoError(t, orders.SaveOrder(ctx, order))
+	order.Status = entities.OrderStatusProcessing
+	require.NoError(t, orders.SaveOrder(ctx, order))
+	order.Status = entities.OrderStatusProcessed
+	order.Accrual = 500
+	require.NoError(t, orders.SaveOrder(ctx, order))
+	require.NoError(t, orders.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "2377225624", Sum: 100}))
+
+	t.Run("sink error keeps events", func(t *testing.T) {
+		sink.SetError(errors.New("broker unavailable"))
+		relay.relay(ctx)
+
+		assert.Empty(t, sink.Events())
+		assert.Len(t, outbox.GetUnpublishedEvents(ctx, 0), 2)
+	})
+
+	t.Run("publish in order", func(t *testing.T) {
+		sink.SetError(nil)
+		relay.relay(ctx)
+
+		events := sink.Events()
+		require.Len(t, events, 2)
+		assert.Equal(t, entities.EventOrderAccrued, events[0].Type)
+		assert.Equal(t, "12345678903", events[0].AggregateID)
+		assert.Contains(t, events[0].Payload, `"accrual":500`)
+		assert.Equal(t, entities.EventPointsWithdrawn, events[1].Type)
+		assert.Empty(t, outbox.GetUnpublishedEvents(ctx, 0))
+	})
+
+	t.Run("published events are not repeated", func(t *testing.T) {
+		relay.relay(ctx)
+		assert.Len(t, sink.Events(), 2)
+	})
+}
+
+// typeFailSink не принимает события одного типа, остальные передает дальше.
+type typeFailSink struct {
+	failType string
+	next     Sink
+}
+
+func (sink typeFailSink) Publish(ctx context.Context, event entities.OutboxEvent) error {
+	if event.Type == sink.failType {
+		return errors.New("rejected by sink")
+	}
+	return sink.next.Publish(ctx, event)
+}
+
+func TestRelayDeadLetter(t *testing.T) {
+	ctx := context.Background()
+
+	outbox := outboxrepository.New()
+	orders := orderrepository.New(outbox)
+	sink := NewInmemSink()
+	config := DefaultConfig()
+	config.BaseDelay = 0
+	config.MaxAttempts = 2
+	relay := New(outbox, typeFailSink{failType: entities.EventOrderAccrued, next: sink}, config)
+
+	order := *entities.NewOrder("12345678903", 1)
+	order.Status = entities.OrderStatusProcessed
+	order.Accrual = 500
+	require.NoError(t, orders.SaveOrder(ctx, order))
+	require.NoError(t, orders.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "2377225624", Sum: 100}))
+
+	// событие, которое sink не принимает, не задерживает следующее
+	relay.relay(ctx)
+	events := sink.Events()
+	require.Len(t, events, 1)
+	assert.Equal(t, entities.EventPointsWithdrawn, events[0].Type)
+	require.Len(t, outbox.GetUnpublishedEvents(ctx, 0), 1)
+
+	// после MaxAttempts событие откладывается и больше не выбирается
+	relay.relay(ctx)
+	assert.Empty(t, outbox.GetUnpublishedEvents(ctx, 0))
+	assert.Empty(t, outbox.ClaimEvents(ctx, time.Now().Add(time.Hour), time.Minute, 0))
+	assert.Len(t, sink.Events(), 1)
+}
+
+func TestRelayBackoff(t *testing.T) {
+	outbox := outboxrepository.New()
+	orders := orderrepository.New(outbox)
+	relay := New(outbox, NewInmemSink(), DefaultConfig())
+	ctx := context.Background()
+
+	require.NoError(t, orders.SaveWithdrawn(ctx, entities.Withdrawn{UserID: 1, OrderNumber: "2377225624", Sum: 100}))
+	relay.fail(ctx, *outbox.ClaimEvents(ctx, time.Now(), time.Minute, 0)[0], errors.New("broker unavailable"))
+	// до повтора событие не выбирается ни этим, ни другим экземпляром
+	assert.Empty(t, outbox.ClaimEvents(ctx, time.Now(), time.Minute, 0))
+	assert.Len(t, outbox.ClaimEvents(ctx, time.Now().Add(2*time.Second), time.Minute, 0), 1)
+
+	assert.Equal(t, time.Second, relay.backoff(1))
+	assert.Equal(t, 8*time.Second, relay.backoff(4))
+	assert.Equal(t, 10*time.Minute, relay.backoff(100))
+}
@@ -0,0 +1,72 @@
+package outboxservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"go.uber.org/zap"
+)
+
+// MultiSink публикует событие во все sink по очереди.
+// Ошибка любого из них приводит к повтору события целиком.
+type MultiSink []Sink
+
+func (sinks MultiSink) Publish(ctx context.Context, event entities.OutboxEvent) error {
+	var errs []error
+	for _, sink := range sinks {
+		if err := sink.Publish(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LogSink пишет события в лог, используется, когда внешний брокер не настроен.
+type LogSink struct{}
+
+func (LogSink) Publish(ctx context.Context, event entities.OutboxEvent) error {
+	logger.Get().Info("domain event",
+		zap.String("id", event.EventID),
+		zap.String("type", event.Type),
+		zap.String("aggregate", event.AggregateID),
+		zap.Int("user", event.UserID),
+	)
+	return nil
+}
+
+// InmemSink копит опубликованные события в памяти, предназначен для тестов.
+type InmemSink struct {
+	mu     sync.Mutex
+	events []entities.OutboxEvent
+	err    error
+}
+
+func NewInmemSink() *InmemSink {
+	return &InmemSink{}
+}
+
+// SetError заставляет последующие вызовы Publish возвращать err, nil возвращает успешную публикацию.
+func (sink *InmemSink) SetError(err error) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.err = err
+}
+
+func (sink *InmemSink) Publish(ctx context.Context, event entities.OutboxEvent) error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.err != nil {
+		return sink.err
+	}
+	sink.events = append(sink.events, event)
+	return nil
+}
+
+func (sink *InmemSink) Events() []entities.OutboxEvent {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return append([]entities.OutboxEvent(nil), sink.events...)
+}
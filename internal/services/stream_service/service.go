@@ -0,0 +1,144 @@
+package streamservice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+)
+
+const (
+	subscriberBufferSize = 16
+)
+
+// Service раздает изменения заказов подписчикам и хранит последние события,
+// чтобы переподключившийся клиент мог дочитать пропущенное.
+type Service struct {
+	mu          sync.Mutex
+	lastID      int64
+	history     []entities.OrderEvent
+	historySize int
+	subscribers map[int]map[chan entities.OrderEvent]struct{}
+	closed      bool
+}
+
+func New(ctx context.Context, historySize int) *Service {
+	service := &Service{
+		historySize: historySize,
+		subscribers: make(map[int]map[chan entities.OrderEvent]struct{}),
+	}
+
+	go func() {
+		<-ctx.Done()
+		service.close()
+	}()
+
+	return service
+}
+
+// NotifyOrder публикует событие для владельца заказа, ID события назначает сервис.
+// Используется, когда все изменения заказов проходят через этот экземпляр.
+func (service *Service) NotifyOrder(order entities.Order) {
+	service.NotifyOrderEvent(entities.OrderEvent{UserID: order.UserID, Order: order})
+}
+
+// NotifyOrderEvent публикует событие, полученное от другого экземпляра, например через
+// Postgres NOTIFY: ID, общий для всех экземпляров, сохраняется, без ID назначается свой.
+func (service *Service) NotifyOrderEvent(event entities.OrderEvent) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	if service.closed {
+		return
+	}
+
+	if event.ID == 0 {
+		event.ID = service.nextID()
+	} else {
+		service.lastID = max(service.lastID, event.ID)
+	}
+	order := event.Order
+
+	service.history = append(service.history, event)
+	if len(service.history) > service.historySize {
+		service.history = service.history[len(service.history)-service.historySize:]
+	}
+
+	for subscriber := range service.subscribers[order.UserID] {
+		select {
+		case subscriber <- event:
+		default:
+			// медленный клиент: отключаем, он переподключится с Last-Event-ID
+			service.unsubscribe(order.UserID, subscriber)
+		}
+	}
+}
+
+// Subscribe возвращает события пользователя с ID больше lastEventID, которые еще есть в буфере,
+// и канал новых событий. Канал закрывается после cancel или остановки сервиса.
+func (service *Service) Subscribe(userID int, lastEventID int64) ([]entities.OrderEvent, <-chan entities.OrderEvent, func()) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	var replay []entities.OrderEvent
+	if lastEventID > 0 {
+		for _, event := range service.history {
+			if event.UserID == userID && event.ID > lastEventID {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	subscriber := make(chan entities.OrderEvent, subscriberBufferSize)
+	if service.closed {
+		close(subscriber)
+		return replay, subscriber, func() {}
+	}
+
+	if service.subscribers[userID] == nil {
+		service.subscribers[userID] = make(map[chan entities.OrderEvent]struct{})
+	}
+	service.subscribers[userID][subscriber] = struct{}{}
+
+	cancel := func() {
+		service.mu.Lock()
+		defer service.mu.Unlock()
+		service.unsubscribe(userID, subscriber)
+	}
+
+	return replay, subscriber, cancel
+}
+
+// nextID опирается на время, чтобы ID не откатывались после перезапуска.
+func (service *Service) nextID() int64 {
+	id := time.Now().UnixMicro()
+	if id <= service.lastID {
+		id = service.lastID + 1
+	}
+	service.lastID = id
+	return id
+}
+
+func (service *Service) unsubscribe(userID int, subscriber chan entities.OrderEvent) {
+	if _, ok := service.subscribers[userID][subscriber]; !ok {
+		return
+	}
+	delete(service.subscribers[userID], subscriber)
+	if len(service.subscribers[userID]) == 0 {
+		delete(service.subscribers, userID)
+	}
+	close(subscriber)
+}
+
+func (service *Service) close() {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+
+	service.closed = true
+	for userID, subscribers := range service.subscribers {
+		for subscriber := range subscribers {
+			service.unsubscribe(userID, subscriber)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package webhookservice
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/logger"
+	"github.com/besean163/gophermart/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	HeaderEvent     = "X-Gophermart-Event"
+	HeaderDelivery  = "X-Gophermart-Delivery"
+	HeaderTimestamp = "X-Gophermart-Timestamp"
+	HeaderSignature = "X-Gophermart-Signature"
+)
+
+// Run отправляет накопившиеся доставки, пока не отменен ctx.
+func (service Service) Run(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(service.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				service.dispatch(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (service Service) dispatch(ctx context.Context) {
+	deliveries := service.repository.ClaimDueDeliveries(ctx, time.Now(), service.claimLease(), service.config.BatchSize)
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+
+		webhook := service.repository.GetWebhook(ctx, delivery.WebhookID)
+		if webhook == nil {
+			delivery.LastError = "webhook deleted"
+			delivery.Status = entities.WebhookDeliveryStatusDead
+		} else {
+			service.deliver(ctx, webhook, delivery)
+		}
+
+		if err := service.repository.SaveDelivery(ctx, *delivery); err != nil {
+			logger.Get().Warn("save webhook delivery error", zap.Int("delivery", delivery.ID), zap.String("error", err.Error()))
+		}
+	}
+}
+
+// claimLease - на сколько доставки пачки скрыты от других экземпляров: пачка отправляется
+// последовательно, и каждая попытка может занять до Timeout.
+func (service Service) claimLease() time.Duration {
+	return time.Duration(max(service.config.BatchSize, 1)+1) * service.config.Timeout
+}
+
+// deliver делает одну попытку отправки и по результату переводит доставку
+// в delivered, откладывает следующую попытку или отправляет в dead-letter.
+func (service Service) deliver(ctx context.Context, webhook *entities.Webhook, delivery *entities.WebhookDelivery) {
+	ctx, span := tracing.Start(ctx, "WebhookService.deliver", trace.WithAttributes(
+		attribute.Int("webhook.id", webhook.ID),
+		attribute.Int("webhook.delivery_id", delivery.ID),
+		attribute.String("webhook.event", delivery.EventType),
+	))
+
+	delivery.Attempts++
+	statusCode, err := service.send(ctx, webhook, delivery)
+	delivery.LastStatusCode = statusCode
+	tracing.End(span, err)
+
+	if err == nil {
+		now := time.Now()
+		delivery.Status = entities.WebhookDeliveryStatusDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= service.config.MaxAttempts {
+		delivery.Status = entities.WebhookDeliveryStatusDead
+		logger.Get().Warn("webhook delivery dead", zap.Int("delivery", delivery.ID), zap.String("error", err.Error()))
+		return
+	}
+	delivery.NextAttemptAt = time.Now().Add(service.backoff(delivery.Attempts))
+}
+
+func (service Service) send(ctx context.Context, webhook *entities.Webhook, delivery *entities.WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderEvent, delivery.EventType)
+	request.Header.Set(HeaderDelivery, delivery.EventID)
+	request.Header.Set(HeaderTimestamp, timestamp)
+	request.Header.Set(HeaderSignature, "sha256="+Sign(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+	response, err := service.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// Sign считает подпись тела события: hex(HMAC-SHA256(secret, timestamp + "." + body)).
+// Получатель должен проверить подпись и не принимать слишком старые timestamp.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff растет экспоненциально от BaseDelay до MaxDelay, со случайным разбросом ±20%.
+func (service Service) backoff(attempt int) time.Duration {
+	delay := service.config.BaseDelay
+	for i := 1; i < attempt && delay < service.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, service.config.MaxDelay)
+
+	jitter := time.Duration(float64(delay) * (rand.Float64()*0.4 - 0.2))
+	return delay + jitter
+}
@@ -0,0 +1,72 @@
+package webhookservice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+
+	"github.com/besean163/gophermart/internal/tracing"
+)
+
+var (
+	ErrForbiddenAddress = errors.New("webhook address is not public")
+
+	// reservedPrefixes - не частные по net/netip, но недоступные снаружи сети:
+	// "эта сеть" (RFC 1122) и адреса провайдерского NAT (RFC 6598).
+	reservedPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+	}
+)
+
+// newHTTPClient возвращает клиент, который подключается только к публичным адресам.
+// Адрес проверяется при подключении, уже после разрешения имени, поэтому ни перенаправление,
+// ни подмена DNS-записи после создания вебхука не приведут запрос во внутреннюю сеть.
+func newHTTPClient(config Config) *http.Client {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if !config.AllowPrivateNetworks {
+		dialer.Control = checkDialAddress
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// через прокси проверялся бы адрес прокси, а не получателя
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   config.Timeout,
+		Transport: tracing.NewTransport(transport),
+	}
+}
+
+func checkDialAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, ip)
+	}
+	return nil
+}
+
+// isPublicAddr отклоняет loopback, частные, link-local, multicast и неуказанные адреса.
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,227 @@
+package webhookservice
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	"github.com/besean163/gophermart/internal/tracing"
+)
+
+type Repository interface {
+	SaveWebhook(ctx context.Context, webhook *entities.Webhook) error
+	GetWebhook(ctx context.Context, id int) *entities.Webhook
+	GetWebhooks(ctx context.Context, userID int) []*entities.Webhook
+	DeleteWebhook(ctx context.Context, id int) error
+	GetUserActiveWebhooks(ctx context.Context, userID int) []*entities.Webhook
+	SaveDeliveries(ctx context.Context, deliveries []*entities.WebhookDelivery) error
+	SaveDelivery(ctx context.Context, delivery entities.WebhookDelivery) error
+	GetDelivery(ctx context.Context, id int) *entities.WebhookDelivery
+	ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) []*entities.WebhookDelivery
+	GetDeliveries(ctx context.Context, filter entities.WebhookDeliveryFilter) []*entities.WebhookDelivery
+}
+
+type Config struct {
+	PollInterval time.Duration
+	BatchSize    int
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Timeout      time.Duration
+	// AllowPrivateNetworks разрешает отправку на адреса локальной и частных сетей,
+	// например для локальной разработки. По умолчанию такие адреса отклоняются.
+	AllowPrivateNetworks bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PollInterval: time.Second,
+		BatchSize:    50,
+		MaxAttempts:  8,
+		BaseDelay:    5 * time.Second,
+		MaxDelay:     time.Hour,
+		Timeout:      10 * time.Second,
+	}
+}
+
+type Service struct {
+	repository Repository
+	config     Config
+	client     *http.Client
+}
+
+func New(repository Repository, config Config) Service {
+	return Service{
+		repository: repository,
+		config:     config,
+		client:     newHTTPClient(config),
+	}
+}
+
+// CreateWebhook регистрирует вебхук пользователя, userID == 0 - глобальный вебхук администратора.
+// Секрет для проверки подписи возвращается только здесь.
+func (service Service) CreateWebhook(ctx context.Context, userID int, webhookURL string, events []string) (*entities.Webhook, error) {
+	if !service.isValidWebhookURL(webhookURL) || len(events) == 0 {
+		return nil, entities.ErrInvalidInput
+	}
+	for _, event := range events {
+		if !slices.Contains(entities.WebhookEvents, event) {
+			return nil, entities.ErrInvalidInput
+		}
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	webhook := &entities.Webhook{
+		UserID:    userID,
+		URL:       webhookURL,
+		Secret:    secret,
+		Events:    events,
+		Active:    true,
+		CreatedAt: time.Now(),
+	}
+	if err := service.repository.SaveWebhook(ctx, webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (service Service) GetWebhooks(ctx context.Context, userID int) []*entities.Webhook {
+	webhooks := service.repository.GetWebhooks(ctx, userID)
+	for _, webhook := range webhooks {
+		webhook.Secret = ""
+	}
+	return webhooks
+}
+
+func (service Service) DeleteWebhook(ctx context.Context, userID int, id int) error {
+	webhook := service.repository.GetWebhook(ctx, id)
+	if webhook == nil || webhook.UserID != userID {
+		return entities.ErrNotFound
+	}
+	return service.repository.DeleteWebhook(ctx, id)
+}
+
+func (service Service) GetDeliveries(ctx context.Context, filter entities.WebhookDeliveryFilter) []*entities.WebhookDelivery {
+	return service.repository.GetDeliveries(ctx, filter)
+}
+
+// Redeliver ставит доставку в очередь заново со сброшенным счетчиком попыток.
+// userID == nil - доставка любого пользователя (для администратора).
+func (service Service) Redeliver(ctx context.Context, userID *int, id int) (*entities.WebhookDelivery, error) {
+	delivery := service.repository.GetDelivery(ctx, id)
+	if delivery == nil || userID != nil && delivery.UserID != *userID {
+		return nil, entities.ErrNotFound
+	}
+
+	delivery.Status = entities.WebhookDeliveryStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	delivery.DeliveredAt = nil
+	if err := service.repository.SaveDelivery(ctx, *delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// Publish принимает доменное событие из outbox и ставит его в очередь вебхуков.
+// EventID outbox переиспользуется, чтобы получатели могли дедуплицировать повторы relay,
+// а повторная публикация не создает вторую доставку тому же вебхуку.
+func (service Service) Publish(ctx context.Context, event entities.OutboxEvent) error {
+	var eventType string
+	switch event.Type {
+	case entities.EventOrderAccrued:
+		eventType = entities.WebhookEventOrderProcessed
+	case entities.EventOrderInvalidated:
+		eventType = entities.WebhookEventOrderInvalid
+	case entities.EventPointsWithdrawn:
+		eventType = entities.WebhookEventWithdrawnCreated
+	case entities.EventPointsRefunded:
+		eventType = entities.WebhookEventWithdrawnRefund
+	default:
+		return nil
+	}
+	return service.saveEvent(ctx, event.UserID, event.EventID, eventType, json.RawMessage(event.Payload))
+}
+
+// saveEvent записывает событие в исходящую очередь каждого подписанного вебхука.
+func (service Service) saveEvent(ctx context.Context, userID int, eventID string, eventType string, data any) (err error) {
+	ctx, span := tracing.Start(ctx, "WebhookService.saveEvent")
+	defer func() { tracing.End(span, err) }()
+
+	var webhooks []*entities.Webhook
+	for _, webhook := range service.repository.GetUserActiveWebhooks(ctx, userID) {
+		if slices.Contains(webhook.Events, eventType) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	event := entities.WebhookEvent{
+		ID:        eventID,
+		Type:      eventType,
+		CreatedAt: now,
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	deliveries := make([]*entities.WebhookDelivery, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		deliveries = append(deliveries, &entities.WebhookDelivery{
+			WebhookID:     webhook.ID,
+			UserID:        webhook.UserID,
+			EventID:       event.ID,
+			EventType:     eventType,
+			Payload:       string(payload),
+			Status:        entities.WebhookDeliveryStatusPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+
+	return service.repository.SaveDeliveries(ctx, deliveries)
+}
+
+// isValidWebhookURL сразу отклоняет явно внутренние адреса. Имена, которые разрешаются
+// во внутренние адреса, отклоняет проверка при подключении.
+func (service Service) isValidWebhookURL(value string) bool {
+	u, err := url.ParseRequestURI(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if service.config.AllowPrivateNetworks {
+		return true
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return isPublicAddr(ip)
+	}
+	return true
+}
+
+func newSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
@@ -0,0 +1,147 @@
+package webhookservice
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/besean163/gophermart/internal/entities"
+	webhookrepository "github.com/besean163/gophermart/internal/repositories/inmem/webhook_repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+
+	var received []*http.Request
+	var bodies [][]byte
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	config := DefaultConfig()
+	config.MaxAttempts = 2
+	config.BaseDelay = 0
+	config.AllowPrivateNetworks = true
+	service := New(webhookrepository.New(), config)
+
+	webhook, err := service.CreateWebhook(ctx, 1, receiver.URL, []string{entities.WebhookEventOrderProcessed})
+	require.NoError(t, err)
+
+	require.NoError(t, service.Publish(ctx, *entities.NewOrderStatusEvent(entities.Order{Number: "1111111", UserID: 2, Status: entities.OrderStatusProcessed})))
+	event := entities.NewOrderStatusEvent(entities.Order{Number: "1111111", UserID: 1, Status: entities.OrderStatusProcessed, Accrual: 10})
+	require.NoError(t, service.Publish(ctx, *event))
+	// relay может опубликовать событие повторно, вторая доставка не создается
+	require.NoError(t, service.Publish(ctx, *event))
+	require.Len(t, service.GetDeliveries(ctx, entities.WebhookDeliveryFilter{}), 1)
+
+	t.Run("signed delivery", func(t *testing.T) {
+		service.dispatch(ctx)
+		require.Len(t, received, 1)
+
+		request := received[0]
+		assert.Equal(t, entities.WebhookEventOrderProcessed, request.Header.Get(HeaderEvent))
+		assert.Equal(t, "sha256="+Sign(webhook.Secret, request.Header.Get(HeaderTimestamp), bodies[0]), request.Header.Get(HeaderSignature))
+		assert.Contains(t, string(bodies[0]), `"number":"1111111"`)
+	})
+
+	t.Run("dead letter after max attempts", func(t *testing.T) {
+		service.dispatch(ctx)
+		require.Len(t, received, 2)
+
+		dead := service.GetDeliveries(ctx, entities.WebhookDeliveryFilter{Status: entities.WebhookDeliveryStatusDead})
+		require.Len(t, dead, 1)
+		assert.Equal(t, 2, dead[0].Attempts)
+		assert.Equal(t, http.StatusInternalServerError, dead[0].LastStatusCode)
+	})
+
+	t.Run("redeliver", func(t *testing.T) {
+		fail = false
+		userID := 1
+		_, err := service.Redeliver(ctx, &userID, 1)
+		require.NoError(t, err)
+
+		service.dispatch(ctx)
+		require.Len(t, received, 3)
+
+		delivered := service.GetDeliveries(ctx, entities.WebhookDeliveryFilter{Status: entities.WebhookDeliveryStatusDelivered})
+		require.Len(t, delivered, 1)
+		assert.NotNil(t, delivered[0].DeliveredAt)
+	})
+
+	t.Run("backoff grows", func(t *testing.T) {
+		service := New(webhookrepository.New(), DefaultConfig())
+		assert.InDelta(t, float64(5*time.Second), float64(service.backoff(1)), float64(time.Second))
+		assert.InDelta(t, float64(40*time.Second), float64(service.backoff(4)), float64(8*time.Second))
+		assert.LessOrEqual(t, service.backoff(100), time.Hour+12*time.Minute)
+	})
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	ctx := context.Background()
+
+	received := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+	}))
+	defer receiver.Close()
+
+	repository := webhookrepository.New()
+	service := New(repository, DefaultConfig())
+
+	for _, webhookURL := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.1.2.3/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://[::ffff:192.168.0.1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		_, err := service.CreateWebhook(ctx, 1, webhookURL, []string{entities.WebhookEventOrderProcessed})
+		assert.ErrorIs(t, err, entities.ErrInvalidInput, webhookURL)
+	}
+	_, err := service.CreateWebhook(ctx, 1, "https://example.com/hook", []string{entities.WebhookEventOrderProcessed})
+	assert.NoError(t, err)
+
+	// имя может разрешиться во внутренний адрес уже после создания вебхука
+	webhook := &entities.Webhook{UserID: 2, URL: receiver.URL, Events: []string{entities.WebhookEventOrderProcessed}, Active: true}
+	require.NoError(t, repository.SaveWebhook(ctx, webhook))
+	require.NoError(t, repository.SaveDeliveries(ctx, []*entities.WebhookDelivery{{
+		WebhookID: webhook.ID, UserID: 2, EventID: "event", EventType: entities.WebhookEventOrderProcessed,
+		Payload: "{}", Status: entities.WebhookDeliveryStatusPending, NextAttemptAt: time.Now(),
+	}}))
+
+	service.dispatch(ctx)
+	assert.Zero(t, received)
+	deliveries := service.GetDeliveries(ctx, entities.WebhookDeliveryFilter{EventID: "event"})
+	require.Len(t, deliveries, 1)
+	assert.Contains(t, deliveries[0].LastError, ErrForbiddenAddress.Error())
+}
+
+func TestClaimDueDeliveries(t *testing.T) {
+	ctx := context.Background()
+	repository := webhookrepository.New()
+	now := time.Now()
+	require.NoError(t, repository.SaveDeliveries(ctx, []*entities.WebhookDelivery{
+		{WebhookID: 1, EventID: "first", Status: entities.WebhookDeliveryStatusPending, NextAttemptAt: now},
+		{WebhookID: 1, EventID: "second", Status: entities.WebhookDeliveryStatusPending, NextAttemptAt: now},
+	}))
+
+	claimed := repository.ClaimDueDeliveries(ctx, now, time.Minute, 10)
+	assert.Len(t, claimed, 2)
+	// другой экземпляр не получит доставки, пока не истечет аренда
+	assert.Empty(t, repository.ClaimDueDeliveries(ctx, now, time.Minute, 10))
+	assert.Len(t, repository.ClaimDueDeliveries(ctx, now.Add(2*time.Minute), time.Minute, 10), 2)
+}
@@ -0,0 +1,68 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// GormPlugin открывает спан на каждый запрос gorm. Чтобы спан стал дочерним,
+// запрос должен выполняться через db.WithContext(ctx).
+type GormPlugin struct{}
+
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	callback := db.Callback()
+	return errors.Join(
+		callback.Create().Before("gorm:create").Register("tracing:before_create", beforeGorm("create")),
+		callback.Create().After("gorm:create").Register("tracing:after_create", afterGorm),
+		callback.Query().Before("gorm:query").Register("tracing:before_query", beforeGorm("query")),
+		callback.Query().After("gorm:query").Register("tracing:after_query", afterGorm),
+		callback.Update().Before("gorm:update").Register("tracing:before_update", beforeGorm("update")),
+		callback.Update().After("gorm:update").Register("tracing:after_update", afterGorm),
+		callback.Delete().Before("gorm:delete").Register("tracing:before_delete", beforeGorm("delete")),
+		callback.Delete().After("gorm:delete").Register("tracing:after_delete", afterGorm),
+		callback.Row().Before("gorm:row").Register("tracing:before_row", beforeGorm("row")),
+		callback.Row().After("gorm:row").Register("tracing:after_row", afterGorm),
+		callback.Raw().Before("gorm:raw").Register("tracing:before_raw", beforeGorm("raw")),
+		callback.Raw().After("gorm:raw").Register("tracing:after_raw", afterGorm),
+	)
+}
+
+func beforeGorm(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx, _ := Start(db.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemPostgreSQL,
+				semconv.DBOperationName(operation),
+			),
+		)
+		db.Statement.Context = ctx
+	}
+}
+
+func afterGorm(db *gorm.DB) {
+	span := trace.SpanFromContext(db.Statement.Context)
+	if !span.IsRecording() {
+		return
+	}
+
+	span.SetAttributes(
+		semconv.DBCollectionName(db.Statement.Table),
+		semconv.DBQueryText(db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+
+	err := db.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = nil
+	}
+	End(span, err)
+}